@@ -1,42 +1,106 @@
-import { useState, useEffect } from 'react'
+import { useState, useEffect, useCallback } from 'react'
 import './App.css'
 import { Login } from './components/Login'
 import { ChatRoom } from './components/ChatRoom'
-import { getOptimalServer, getChatHistory } from './services/api'
-import { ChatWebSocket } from './services/websocket'
+import { getOptimalServer, getChatHistory, getMessageContext, getRoom, getMembers, redeemInvite, searchGifs, translateMessage, uploadAttachment, getAttachmentLink, getDraft, saveDraft, deleteDraft, type MessageAttachment, type MessageCard, type MessageContact, type MessageEntity, type MessageGIF, type MessageLocation, type MessageForward, type MessageMembership, type MessageQuote, type Member, type RoomInfo } from './services/api'
+import { ChatWebSocket, type Session } from './services/websocket'
 
 interface Message {
-  id?: number
+  id?: string
   username: string
   content: string
   server?: string
   timestamp?: string
+  entities?: MessageEntity[]
+  card?: MessageCard
+  location?: MessageLocation
+  contact?: MessageContact
+  gif?: MessageGIF
+  member?: MessageMembership
+  attachment?: MessageAttachment
+  quote?: MessageQuote
+  forwarded?: MessageForward
 }
 
+// The client only joins the default room.
+const DRAFT_ROOM = 'general'
+
+// Embedded widgets are opened as /?token=JWT, minted for the visitor by the
+// embedding site, and connect right away.
+const widgetToken = new URLSearchParams(window.location.search).get('token') ?? undefined
+
 function App() {
   const [isConnected, setIsConnected] = useState(false)
   const [username, setUsername] = useState('')
   const [messages, setMessages] = useState<Message[]>([])
+  const [room, setRoom] = useState<RoomInfo | null>(null)
   const [websocket, setWebsocket] = useState<ChatWebSocket | null>(null)
+  const [server, setServer] = useState('')
+  // Drafts are only served to the holder of an access token, so only
+  // widget visitors keep them.
+  const [draftUser, setDraftUser] = useState('')
+  // Named users connected by name, neither as guests nor with a token.
+  const [namedUser, setNamedUser] = useState(false)
+  const [draft, setDraft] = useState('')
+  const [sessions, setSessions] = useState<Session[] | null>(null)
+  // null while the member list is closed.
+  const [members, setMembers] = useState<Member[] | null>(null)
   const [connectionStatus, setConnectionStatus] = useState<string>('')
 
   const handleConnect = async (inputUsername: string) => {
     try {
       setConnectionStatus('Getting optimal server...')
-      const serverAddress = await getOptimalServer()
+      const { address: serverAddress, assignment } = await getOptimalServer()
 
+      // Invite links look like /?invite=TOKEN; guests can't redeem them.
+      const invite = new URLSearchParams(window.location.search).get('invite')
+      if (invite && inputUsername) {
+        setConnectionStatus('Redeeming invite...')
+        await redeemInvite(serverAddress, invite, inputUsername)
+      }
+
+      // Deep links look like /?message=ID and open history around that
+      // message instead of at the newest one.
       setConnectionStatus('Loading chat history...')
-      const history = await getChatHistory(serverAddress)
+      const linked = new URLSearchParams(window.location.search).get('message')
+      const history = linked
+        ? await getMessageContext(serverAddress, linked).then((c) => [...c.before, c.message, ...c.after])
+        : await getChatHistory(serverAddress)
       setMessages(history || [])
+      getRoom(serverAddress).then(setRoom).catch((error) => {
+        console.error('Error getting room information:', error)
+      })
 
       setConnectionStatus('Connecting to chat...')
       const ws = new ChatWebSocket(
         serverAddress,
         inputUsername,
         (message) => {
+          if (message.type === 'room' && message.room) {
+            setRoom(message.room)
+          }
+          if (message.type === 'sessions') {
+            setSessions(message.sessions ?? [])
+            return
+          }
+          // Member messages keep an open member list current.
+          if (message.type === 'member' && message.member) {
+            const { action } = message.member
+            setMembers((prev) => {
+              if (!prev) return prev
+              const rest = prev.filter((m) => m.username !== message.username)
+              if (action !== 'joined') return rest
+              return [...rest, {
+                user_id: message.user_id ?? '',
+                username: message.username,
+                joined_at: message.timestamp ?? new Date().toISOString(),
+                online: true
+              }]
+            })
+          }
           const messageWithId = {
             ...message,
-            id: message.id || Date.now() + Math.random(),
+            id: message.id || `${Date.now()}-${Math.random()}`,
             timestamp: message.timestamp || new Date().toISOString()
           }
           setMessages(prev => [...prev, messageWithId])
@@ -53,27 +117,99 @@ function App() {
         (error) => {
           console.error('WebSocket error:', error)
           setConnectionStatus(`Error: ${error}`)
-        }
+        },
+        (hello) => {
+          setUsername(hello.username)
+          if (widgetToken) {
+            setDraftUser(hello.username)
+            getDraft(serverAddress, hello.username, DRAFT_ROOM, widgetToken).then((d) => setDraft(d?.content ?? '')).catch((error) => {
+              console.error('Error getting draft:', error)
+            })
+          }
+        },
+        assignment,
+        widgetToken
       )
 
+      history?.forEach((message) => ws.markSeen(message.id))
       ws.connect()
       setWebsocket(ws)
+      setServer(serverAddress)
+      setNamedUser(!!inputUsername && !widgetToken)
     } catch (error) {
       console.error('Connection error:', error)
       setConnectionStatus('Failed to connect. Please try again.')
     }
   }
 
-  const handleSendMessage = (content: string) => {
-    websocket?.sendMessage(content)
+  const handleSendMessage = (content: string, quoteId?: string) => {
+    websocket?.sendMessage(content, quoteId)
+  }
+
+  const handleInteraction = (messageId: string, callbackId: string) => {
+    websocket?.sendInteraction(messageId, callbackId)
+  }
+
+  // There is only one room, so forwarding reposts a message there.
+  const handleForward = (messageId: string) => {
+    websocket?.forward(messageId, DRAFT_ROOM)
+  }
+
+  const handleDraftChange = (content: string) => {
+    if (!draftUser || !widgetToken) return
+    const request = content.trim()
+      ? saveDraft(server, draftUser, DRAFT_ROOM, content, widgetToken)
+      : deleteDraft(server, draftUser, DRAFT_ROOM, widgetToken)
+    request.catch((error) => console.error('Error saving draft:', error))
+  }
+
+  const handleShowSessions = () => {
+    websocket?.requestSessions()
+  }
+
+  // Stable across renders, so attachments only fetch their links once.
+  const attachmentLink = useCallback((id: string) => getAttachmentLink(server, id, username), [server, username])
+
+  const handleShowMembers = () => {
+    getMembers(server, DRAFT_ROOM).then((page) => setMembers(page.members)).catch((error) => {
+      console.error('Error getting members:', error)
+    })
+  }
+
+  const handleRevokeSession = (id: string) => {
+    websocket?.revokeSession(id)
+    setSessions((prev) => prev?.filter((s) => s.id !== id) ?? null)
+  }
+
+  const handleLeave = () => {
+    websocket?.leave()
+  }
+
+  const handleSearchGifs = (query: string) => searchGifs(server, query)
+
+  const handleSendFile = (file: File) =>
+    uploadAttachment(server, file, username).then((attachment) => websocket?.sendAttachment(attachment.id))
+
+  const handleTranslate = (messageId: string) =>
+    translateMessage(server, messageId, navigator.language).then((t) => t.text)
+
+  const handleSendGif = (gif: MessageGIF) => {
+    websocket?.sendGif(gif)
   }
 
   const handleDisconnect = () => {
     websocket?.disconnect()
     setWebsocket(null)
+    setServer('')
+    setDraftUser('')
+    setNamedUser(false)
+    setDraft('')
+    setSessions(null)
+    setMembers(null)
     setIsConnected(false)
     setUsername('')
     setMessages([])
+    setRoom(null)
     setConnectionStatus('')
   }
 
@@ -83,10 +219,17 @@ function App() {
     }
   }, [websocket])
 
+  useEffect(() => {
+    if (widgetToken) {
+      handleConnect('')
+    }
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [])
+
   if (!isConnected) {
     return (
       <div>
-        <Login onConnect={handleConnect} />
+        <Login onConnect={handleConnect} onGuest={() => handleConnect('')} />
         {connectionStatus && (
           <div className="fixed bottom-4 right-4 bg-background border rounded-lg p-3 shadow-lg">
             <p className="text-sm">{connectionStatus}</p>
@@ -99,8 +242,26 @@ function App() {
   return (
     <ChatRoom
       username={username}
+      room={room}
       messages={messages}
       onSendMessage={handleSendMessage}
+      onInteraction={handleInteraction}
+      onForward={handleForward}
+      onTranslate={handleTranslate}
+      onSendFile={handleSendFile}
+      attachmentLink={attachmentLink}
+      onSearchGifs={handleSearchGifs}
+      onSendGif={handleSendGif}
+      draft={draft}
+      onDraftChange={handleDraftChange}
+      sessions={widgetToken ? sessions : undefined}
+      onShowSessions={handleShowSessions}
+      onCloseSessions={() => setSessions(null)}
+      onRevokeSession={handleRevokeSession}
+      members={members}
+      onShowMembers={handleShowMembers}
+      onCloseMembers={() => setMembers(null)}
+      onLeave={namedUser ? handleLeave : undefined}
       onDisconnect={handleDisconnect}
     />
   )
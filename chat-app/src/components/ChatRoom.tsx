@@ -2,25 +2,212 @@ import { useState, useRef, useEffect } from "react"
 import { Button } from "@/components/ui/button"
 import { Input } from "@/components/ui/input"
 import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card"
+import type { AttachmentLink, MessageAttachment, MessageCard, MessageContact, MessageEntity, MessageGIF, MessageLocation, Member, MessageForward, MessageMembership, MessageQuote, RoomInfo } from "@/services/api"
+import type { Session } from "@/services/websocket"
 
 interface Message {
-  id?: number
+  id?: string
   username: string
   content: string
   server?: string
   timestamp?: string
+  entities?: MessageEntity[]
+  card?: MessageCard
+  location?: MessageLocation
+  contact?: MessageContact
+  gif?: MessageGIF
+  member?: MessageMembership
+  attachment?: MessageAttachment
+  quote?: MessageQuote
+  forwarded?: MessageForward
+}
+
+// Formatting is parsed by the server; offsets are UTF-16 code units, which
+// matches how JavaScript indexes strings.
+function renderContent(content: string, entities?: MessageEntity[]) {
+  if (!entities || entities.length === 0) return content
+
+  const parts: React.ReactNode[] = []
+  let cursor = 0
+  ;[...entities]
+    .sort((a, b) => a.offset - b.offset)
+    .forEach((entity, i) => {
+      if (entity.offset < cursor) return
+      if (entity.offset > cursor) parts.push(content.slice(cursor, entity.offset))
+
+      const text = content.slice(entity.offset, entity.offset + entity.length)
+      switch (entity.type) {
+        case "bold":
+          parts.push(<strong key={i}>{text}</strong>)
+          break
+        case "italic":
+          parts.push(<em key={i}>{text}</em>)
+          break
+        case "code":
+          parts.push(<code key={i} className="rounded bg-muted px-1 font-mono text-sm">{text}</code>)
+          break
+        case "link":
+          parts.push(<a key={i} href={entity.url} target="_blank" rel="noopener noreferrer" className="underline">{text}</a>)
+          break
+        default:
+          parts.push(text)
+      }
+      cursor = entity.offset + entity.length
+    })
+  if (cursor < content.length) parts.push(content.slice(cursor))
+
+  return parts
+}
+
+function renderCard(card: MessageCard, onClick: (callbackId: string) => void) {
+  return (
+    <div className="space-y-2 border-l-4 border-primary pl-3">
+      <p className="font-semibold">{card.title}</p>
+      {card.text && <p className="text-sm whitespace-pre-wrap">{card.text}</p>}
+      {card.fields && card.fields.length > 0 && (
+        <div className="flex flex-wrap gap-x-4 gap-y-1">
+          {card.fields.map((field, i) => (
+            <div key={i} className={field.inline ? "" : "basis-full"}>
+              <p className="text-xs font-medium opacity-70">{field.name}</p>
+              <p className="text-sm">{field.value}</p>
+            </div>
+          ))}
+        </div>
+      )}
+      {card.buttons && card.buttons.length > 0 && (
+        <div className="flex flex-wrap gap-2">
+          {card.buttons.map((button) => (
+            <Button
+              key={button.callback_id}
+              size="sm"
+              variant={button.style === "danger" ? "destructive" : button.style === "primary" ? "default" : "outline"}
+              onClick={() => onClick(button.callback_id)}
+            >
+              {button.label}
+            </Button>
+          ))}
+        </div>
+      )}
+    </div>
+  )
+}
+
+function renderLocation(location: MessageLocation) {
+  const { latitude, longitude } = location
+  const url = `https://www.openstreetmap.org/?mlat=${latitude}&mlon=${longitude}#map=16/${latitude}/${longitude}`
+  return (
+    <div className="border-l-4 border-primary pl-3">
+      {location.name && <p className="font-semibold">{location.name}</p>}
+      <a href={url} target="_blank" rel="noopener noreferrer" className="text-sm underline">
+        {latitude.toFixed(5)}, {longitude.toFixed(5)}
+      </a>
+      {location.accuracy_meters !== undefined && (
+        <p className="text-xs opacity-70">within {Math.round(location.accuracy_meters)} m</p>
+      )}
+    </div>
+  )
+}
+
+function renderContact(contact: MessageContact) {
+  return (
+    <div className="border-l-4 border-primary pl-3">
+      <p className="font-semibold">{contact.name}</p>
+      {contact.phone && <a href={`tel:${contact.phone}`} className="block text-sm underline">{contact.phone}</a>}
+      {contact.email && <a href={`mailto:${contact.email}`} className="block text-sm underline">{contact.email}</a>}
+      {contact.username && <p className="text-sm">@{contact.username}</p>}
+    </div>
+  )
+}
+
+function formatSize(bytes: number) {
+  if (bytes < 1024) return `${bytes} B`
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`
+  return `${(bytes / (1024 * 1024)).toFixed(1)} MB`
+}
+
+// Images are shown inline, like the server serves them, through their
+// largest thumbnail when they have one and linking to the full image. Their
+// dimensions reserve their space while they load. Other files are links to
+// download them. Download URLs come from the server, which may sign them
+// so they expire; they are fetched again when the attachment is shown again.
+function AttachmentView({ attachment, caption, getLink }: { attachment: MessageAttachment, caption: string, getLink: (id: string) => Promise<AttachmentLink> }) {
+  const [link, setLink] = useState<AttachmentLink | null>(null)
+  useEffect(() => {
+    let cancelled = false
+    getLink(attachment.id)
+      .then((l) => { if (!cancelled) setLink(l) })
+      .catch((err) => console.error('Failed to get attachment link:', err))
+    return () => { cancelled = true }
+  }, [attachment.id, getLink])
+
+  const image = attachment.content_type.startsWith("image/") && !attachment.content_type.startsWith("image/svg")
+  const thumbnail = attachment.thumbnails?.length ? Math.max(...attachment.thumbnails) : undefined
+  const url = link?.url
+  const src = thumbnail && link?.thumbnails?.[thumbnail] ? link.thumbnails[thumbnail] : url
+  return (
+    <div className="space-y-1">
+      {image ? (
+        <a href={url} target="_blank" rel="noreferrer">
+          <img
+            src={src}
+            alt={attachment.name}
+            width={attachment.width}
+            height={attachment.height}
+            className="max-h-64 w-auto rounded"
+            loading="lazy"
+          />
+        </a>
+      ) : (
+        <a href={url} className="block underline">
+          {attachment.name} ({formatSize(attachment.size)})
+        </a>
+      )}
+      {caption !== attachment.name && <p className="whitespace-pre-wrap">{caption}</p>}
+    </div>
+  )
 }
 
 interface ChatRoomProps {
   username: string
+  room: RoomInfo | null
   messages: Message[]
-  onSendMessage: (message: string) => void
+  onSendMessage: (message: string, quoteId?: string) => void
+  onInteraction: (messageId: string, callbackId: string) => void
+  onForward: (messageId: string) => void
+  onTranslate: (messageId: string) => Promise<string>
+  onSendFile: (file: File) => Promise<void>
+  attachmentLink: (id: string) => Promise<AttachmentLink>
+  onSearchGifs: (query: string) => Promise<MessageGIF[]>
+  onSendGif: (gif: MessageGIF) => void
+  draft: string
+  onDraftChange: (content: string) => void
+  // sessions is undefined for connections without a token, which can't
+  // manage sessions, and null while the list is closed.
+  sessions?: Session[] | null
+  onShowSessions: () => void
+  onCloseSessions: () => void
+  onRevokeSession: (id: string) => void
+  // members is null while the list is closed.
+  members: Member[] | null
+  onShowMembers: () => void
+  onCloseMembers: () => void
+  // onLeave is undefined for guests and widget visitors.
+  onLeave?: () => void
   onDisconnect: () => void
 }
 
-export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: ChatRoomProps) {
+export function ChatRoom({ username, room, messages, onSendMessage, onInteraction, onForward, onTranslate, onSendFile, attachmentLink, onSearchGifs, onSendGif, draft, onDraftChange, sessions, onShowSessions, onCloseSessions, onRevokeSession, members, onShowMembers, onCloseMembers, onLeave, onDisconnect }: ChatRoomProps) {
   const [newMessage, setNewMessage] = useState("")
+  const draftTimer = useRef<ReturnType<typeof setTimeout> | null>(null)
+  const [gifQuery, setGifQuery] = useState<string | null>(null)
+  const [gifResults, setGifResults] = useState<MessageGIF[]>([])
+  const [gifError, setGifError] = useState("")
+  const [replyTo, setReplyTo] = useState<Message | null>(null)
+  // Translations shown under their messages, by message id.
+  const [translations, setTranslations] = useState<Record<string, string>>({})
   const messagesEndRef = useRef<HTMLDivElement>(null)
+  const fileInputRef = useRef<HTMLInputElement>(null)
+  const [uploadError, setUploadError] = useState("")
 
   const scrollToBottom = () => {
     messagesEndRef.current?.scrollIntoView({ behavior: "smooth" })
@@ -30,12 +217,44 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
     scrollToBottom()
   }, [messages])
 
+  // A draft saved on another device arrives after connecting.
+  useEffect(() => {
+    if (draft) setNewMessage(draft)
+  }, [draft])
+
+  // Drafts are saved once typing pauses for a second.
+  const updateMessage = (content: string) => {
+    setNewMessage(content)
+    if (draftTimer.current) clearTimeout(draftTimer.current)
+    draftTimer.current = setTimeout(() => onDraftChange(content), 1000)
+  }
+
   const handleSubmit = (e: React.FormEvent) => {
     e.preventDefault()
     if (!newMessage.trim()) return
 
-    onSendMessage(newMessage.trim())
+    onSendMessage(newMessage.trim(), replyTo?.id)
     setNewMessage("")
+    setReplyTo(null)
+    if (draftTimer.current) clearTimeout(draftTimer.current)
+    onDraftChange("")
+  }
+
+  const handleGifSearch = async (e: React.FormEvent) => {
+    e.preventDefault()
+    if (!gifQuery?.trim()) return
+    try {
+      setGifError("")
+      setGifResults(await onSearchGifs(gifQuery.trim()))
+    } catch (error) {
+      setGifError(error instanceof Error ? error.message : "Failed to search GIFs")
+    }
+  }
+
+  const closeGifPicker = () => {
+    setGifQuery(null)
+    setGifResults([])
+    setGifError("")
   }
 
   const handleKeyPress = (e: React.KeyboardEvent) => {
@@ -45,6 +264,20 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
     }
   }
 
+  const handleTranslate = (messageId: string) => {
+    onTranslate(messageId)
+      .then((text) => setTranslations((prev) => ({ ...prev, [messageId]: text })))
+      .catch((error) => setTranslations((prev) => ({ ...prev, [messageId]: `Translation failed: ${error.message}` })))
+  }
+
+  const handleFileChange = (e: React.ChangeEvent<HTMLInputElement>) => {
+    const file = e.target.files?.[0]
+    e.target.value = ""
+    if (!file) return
+    setUploadError("")
+    onSendFile(file).catch((error) => setUploadError(error.message))
+  }
+
   const formatTimestamp = (timestamp?: string) => {
     if (!timestamp) return ""
     const date = new Date(timestamp)
@@ -57,12 +290,67 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
         <CardHeader className="flex flex-row items-center justify-between">
           <div>
             <CardTitle>Chat Room</CardTitle>
+            {room?.topic && (
+              <p className="text-sm font-medium">{room.topic}</p>
+            )}
+            {room?.description && (
+              <p className="text-xs text-muted-foreground">{room.description}</p>
+            )}
             <p className="text-sm text-muted-foreground">Welcome, {username}!</p>
           </div>
-          <Button variant="outline" onClick={onDisconnect}>
-            Disconnect
-          </Button>
+          <div className="flex space-x-2">
+            <Button variant="outline" onClick={members ? onCloseMembers : onShowMembers}>
+              Members
+            </Button>
+            {sessions !== undefined && (
+              <Button variant="outline" onClick={sessions ? onCloseSessions : onShowSessions}>
+                Sessions
+              </Button>
+            )}
+            {onLeave && (
+              <Button variant="outline" onClick={onLeave}>
+                Leave
+              </Button>
+            )}
+            <Button variant="outline" onClick={onDisconnect}>
+              Disconnect
+            </Button>
+          </div>
         </CardHeader>
+        {members && (
+          <div className="mx-6 mb-2 space-y-1 rounded-lg border p-3">
+            <p className="text-sm font-medium">Members ({members.length})</p>
+            {members.map((member) => (
+              <div key={member.username} className="flex items-center gap-2 text-sm">
+                <span className={`h-2 w-2 rounded-full ${member.online ? "bg-green-500" : "bg-muted-foreground/40"}`} />
+                <span>{member.username}</span>
+                <span className="text-xs text-muted-foreground">
+                  since {new Date(member.joined_at).toLocaleDateString()}
+                </span>
+              </div>
+            ))}
+          </div>
+        )}
+        {sessions && (
+          <div className="mx-6 mb-2 space-y-2 rounded-lg border p-3">
+            <p className="text-sm font-medium">Where you're signed in</p>
+            {sessions.map((session) => (
+              <div key={session.id} className="flex items-center justify-between text-sm">
+                <div>
+                  <p>{session.user_agent || "Unknown device"}{session.current && " (this device)"}</p>
+                  <p className="text-xs text-muted-foreground">
+                    {session.server} · since {new Date(session.connected_at).toLocaleString()}
+                  </p>
+                </div>
+                {!session.current && (
+                  <Button size="sm" variant="destructive" onClick={() => onRevokeSession(session.id)}>
+                    Sign out
+                  </Button>
+                )}
+              </div>
+            ))}
+          </div>
+        )}
         <CardContent className="flex flex-col h-[calc(100vh-8rem)]">
           <div className="flex-1 overflow-y-auto space-y-3 p-4 bg-muted/50 rounded-lg mb-4">
             {messages && messages.length > 0 ? (
@@ -72,6 +360,14 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
                 `${message.username}-${message.timestamp}-${index}` ||
                 `msg-${Date.now()}-${index}`
 
+              if (message.member) {
+                return (
+                  <p key={messageKey} className="text-center text-xs text-muted-foreground">
+                    {message.content}
+                  </p>
+                )
+              }
+
               return (
                 <div
                   key={messageKey}
@@ -85,13 +381,53 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
                       }`}
                   >
                     <p className="text-sm font-medium">{message.username}</p>
-                    <p>{typeof message.content === 'string' ? message.content : JSON.stringify(message.content)}</p>
+                    {message.forwarded && (
+                      <p className="text-xs italic opacity-70">Forwarded from {message.forwarded.username}</p>
+                    )}
+                    {message.quote && (
+                      <div className="my-1 border-l-2 border-current pl-2 text-xs opacity-80">
+                        <p className="font-medium">{message.quote.username}</p>
+                        <p className="whitespace-pre-wrap">{message.quote.excerpt}</p>
+                      </div>
+                    )}
+                    {message.card && message.id ? (
+                      renderCard(message.card, (callbackId) => onInteraction(message.id!, callbackId))
+                    ) : message.location ? (
+                      renderLocation(message.location)
+                    ) : message.contact ? (
+                      renderContact(message.contact)
+                    ) : message.gif ? (
+                      <img src={message.gif.url} alt={message.gif.title || "GIF"} className="max-h-64 rounded" loading="lazy" />
+                    ) : message.attachment ? (
+                      <AttachmentView attachment={message.attachment} caption={message.content} getLink={attachmentLink} />
+                    ) : (
+                      <p>{typeof message.content === 'string' ? renderContent(message.content, message.entities) : JSON.stringify(message.content)}</p>
+                    )}
+                    {message.id && translations[message.id] && (
+                      <p className="mt-1 border-t pt-1 text-sm italic opacity-80">{translations[message.id]}</p>
+                    )}
                     {message.timestamp && (
                       <p className="text-xs opacity-70 mt-1">
                         {formatTimestamp(message.timestamp)}
                       </p>
                     )}
                   </div>
+                  {/* Only messages with a server id can be quoted, forwarded or translated; cards can't be forwarded. */}
+                  {message.id && /^\d+$/.test(message.id) && (
+                    <div className="flex space-x-2">
+                      <button type="button" className="text-xs text-muted-foreground hover:underline" onClick={() => setReplyTo(message)}>
+                        Reply
+                      </button>
+                      {!message.card && (
+                        <button type="button" className="text-xs text-muted-foreground hover:underline" onClick={() => onForward(message.id!)}>
+                          Forward
+                        </button>
+                      )}
+                      <button type="button" className="text-xs text-muted-foreground hover:underline" onClick={() => handleTranslate(message.id!)}>
+                        Translate
+                      </button>
+                    </div>
+                  )}
                 </div>
               )
             })
@@ -103,15 +439,65 @@ export function ChatRoom({ username, messages, onSendMessage, onDisconnect }: Ch
             <div ref={messagesEndRef} />
           </div>
 
+          {gifQuery !== null && (
+            <div className="mb-2 space-y-2 rounded-lg border p-2">
+              <form onSubmit={handleGifSearch} className="flex space-x-2">
+                <Input
+                  type="text"
+                  placeholder="Search GIFs..."
+                  value={gifQuery}
+                  onChange={(e) => setGifQuery(e.target.value)}
+                  className="flex-1"
+                  autoFocus
+                />
+                <Button type="submit" disabled={!gifQuery.trim()}>Search</Button>
+                <Button type="button" variant="outline" onClick={closeGifPicker}>Close</Button>
+              </form>
+              {gifError && <p className="text-sm text-destructive">{gifError}</p>}
+              {gifResults.length > 0 && (
+                <div className="flex max-h-48 flex-wrap gap-2 overflow-y-auto">
+                  {gifResults.map((gif) => (
+                    <button
+                      key={gif.id}
+                      type="button"
+                      onClick={() => {
+                        onSendGif(gif)
+                        closeGifPicker()
+                      }}
+                    >
+                      <img src={gif.preview_url || gif.url} alt={gif.title || "GIF"} className="h-24 rounded" loading="lazy" />
+                    </button>
+                  ))}
+                </div>
+              )}
+            </div>
+          )}
+
+          {uploadError && <p className="mb-2 text-sm text-destructive">{uploadError}</p>}
+          {replyTo && (
+            <div className="mb-2 flex items-center justify-between rounded-lg border-l-4 border-primary bg-muted/50 px-3 py-1 text-sm">
+              <p className="truncate">Replying to <span className="font-medium">{replyTo.username}</span>: {replyTo.content}</p>
+              <Button type="button" size="sm" variant="ghost" onClick={() => setReplyTo(null)}>
+                Cancel
+              </Button>
+            </div>
+          )}
           <form onSubmit={handleSubmit} className="flex space-x-2">
             <Input
               type="text"
               placeholder="Type your message..."
               value={newMessage}
-              onChange={(e) => setNewMessage(e.target.value)}
+              onChange={(e) => updateMessage(e.target.value)}
               onKeyDown={handleKeyPress}
               className="flex-1"
             />
+            <input ref={fileInputRef} type="file" className="hidden" onChange={handleFileChange} />
+            <Button type="button" variant="outline" onClick={() => fileInputRef.current?.click()}>
+              File
+            </Button>
+            <Button type="button" variant="outline" onClick={() => setGifQuery(gifQuery === null ? "" : null)}>
+              GIF
+            </Button>
             <Button type="submit" disabled={!newMessage.trim()}>
               Send
             </Button>
@@ -5,9 +5,10 @@ import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/com
 
 interface LoginProps {
   onConnect: (username: string) => void
+  onGuest?: () => void
 }
 
-export function Login({ onConnect }: LoginProps) {
+export function Login({ onConnect, onGuest }: LoginProps) {
   const [username, setUsername] = useState("")
   const [isConnecting, setIsConnecting] = useState(false)
 
@@ -56,6 +57,17 @@ export function Login({ onConnect }: LoginProps) {
             >
               {isConnecting ? "Connecting..." : "Connect"}
             </Button>
+            {onGuest && (
+              <Button
+                type="button"
+                variant="outline"
+                className="w-full"
+                disabled={isConnecting}
+                onClick={onGuest}
+              >
+                Join as guest
+              </Button>
+            )}
           </form>
         </CardContent>
       </Card>
@@ -1,25 +1,139 @@
-interface ServerInfo {
-  Address: string
-  Load: number
+export interface ServerInfo {
+  address: string
+  load: number
+  // assignment is passed to the server on connect, so the load balancer
+  // can tell the client arrived.
+  assignment?: string
+}
+
+export interface RoomInfo {
+  name: string
+  topic: string
+  description: string
+  updated_by?: string
+  updated_at?: string
+}
+
+export interface MessageEntity {
+  type: 'bold' | 'italic' | 'code' | 'link'
+  offset: number
+  length: number
+  url?: string
+}
+
+// A card is a structured message posted by a bot; clicking a button sends
+// an interaction frame, which the server hands to the bot.
+export interface MessageCard {
+  title: string
+  text?: string
+  fields?: { name: string; value: string; inline?: boolean }[]
+  buttons?: { label: string; callback_id: string; style?: 'primary' | 'danger' }[]
+}
+
+// Shared locations and contact cards, sent by location and contact
+// messages.
+export interface MessageLocation {
+  latitude: number
+  longitude: number
+  accuracy_meters?: number
+  name?: string
+}
+
+export interface MessageContact {
+  name: string
+  phone?: string
+  email?: string
+  username?: string
+}
+
+// A GIF found through the server's /gif/search proxy.
+export interface MessageGIF {
+  provider: 'giphy' | 'tenor'
+  id: string
+  title?: string
+  url: string
+  preview_url?: string
+  width?: number
+  height?: number
+}
+
+// A membership change, on member messages.
+export interface MessageMembership {
+  action: 'joined' | 'left' | 'kicked'
+  by?: string
+}
+
+// A file shared in a message. Attachments with the same content share one
+// stored copy, identified by sha256.
+export interface MessageAttachment {
+  id: string
+  name: string
+  content_type: string
+  size: number
+  sha256: string
+  uploaded_at: string
+  // Images' dimensions and the sizes of their thumbnails, by longer side.
+  width?: number
+  height?: number
+  thumbnails?: number[]
+}
+
+// Snapshot of the message a reply quotes, taken by the server.
+export interface MessageQuote {
+  id: string
+  username: string
+  excerpt: string
+  timestamp?: string
+}
+
+// The original of a forwarded message.
+export interface MessageForward {
+  id: string
+  room: string
+  username: string
+  timestamp?: string
+}
+
+// A current member of a room; online is whether they were connected in the
+// last few minutes.
+export interface Member {
+  user_id: string
+  username: string
+  joined_at: string
+  online: boolean
+}
+
+export interface MemberPage {
+  members: Member[]
+  next?: string
 }
 
 interface HistoryMessage {
-  id: number
+  id: string
+  type?: string
   username: string
   content: string
   server: string
   timestamp: string
+  entities?: MessageEntity[]
+  card?: MessageCard
+  location?: MessageLocation
+  contact?: MessageContact
+  gif?: MessageGIF
+  member?: MessageMembership
+  attachment?: MessageAttachment
+  quote?: MessageQuote
+  forwarded?: MessageForward
 }
 
-export async function getOptimalServer(): Promise<string> {
+export async function getOptimalServer(): Promise<ServerInfo> {
   try {
     const response = await fetch('http://localhost:9000/get')
     if (!response.ok) {
       throw new Error('Failed to get server information')
     }
     
-    const data: ServerInfo = await response.json()
-    return data.Address
+    return await response.json()
   } catch (error) {
     console.error('Error getting optimal server:', error)
     throw error
@@ -47,4 +161,208 @@ export async function getChatHistory(serverUrl: string): Promise<HistoryMessage[
     console.error('Error getting chat history:', error)
     throw error
   }
-}
\ No newline at end of file
+}
+
+export interface MessageContext {
+  message: HistoryMessage
+  before: HistoryMessage[]
+  after: HistoryMessage[]
+}
+
+// getMessageContext returns a message with the messages around it, for
+// deep links into history.
+export async function getMessageContext(serverUrl: string, id: string): Promise<MessageContext> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/messages/${encodeURIComponent(id)}/context`)
+  if (!response.ok) {
+    throw new Error('Failed to get message context')
+  }
+  return response.json()
+}
+
+export async function getRoom(serverUrl: string): Promise<RoomInfo> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/room`)
+  if (!response.ok) {
+    throw new Error('Failed to get room information')
+  }
+
+  return response.json()
+}
+
+// redeemInvite makes username a member of the room an invite link was
+// issued for, so it can join the room even when that room is invite-only.
+export async function redeemInvite(serverUrl: string, token: string, username: string): Promise<void> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/invites/redeem`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ token, username })
+  })
+  if (!response.ok) {
+    const body = await response.json().catch(() => null)
+    throw new Error(body?.message || 'Failed to redeem invite')
+  }
+}
+
+// searchGifs searches GIFs through the chat server, which holds the
+// provider's API key.
+export async function searchGifs(serverUrl: string, query: string): Promise<MessageGIF[]> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/gif/search?q=${encodeURIComponent(query)}`)
+  if (!response.ok) {
+    const body = await response.json().catch(() => null)
+    throw new Error(body?.message || 'Failed to search GIFs')
+  }
+  return response.json()
+}
+
+// uploadAttachment stores a file on the chat server, to be shared in a
+// message by its id. It counts against the user's quota.
+export async function uploadAttachment(serverUrl: string, file: File, username: string): Promise<MessageAttachment> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/attachments?name=${encodeURIComponent(file.name)}&username=${encodeURIComponent(username)}`, {
+    method: 'POST',
+    headers: { 'Content-Type': file.type || 'application/octet-stream' },
+    body: file
+  })
+  if (!response.ok) {
+    const body = await response.json().catch(() => null)
+    throw new Error(body?.message || 'Failed to upload file')
+  }
+  return response.json()
+}
+
+// Where an attachment and its thumbnails, by size, are downloaded from.
+// The URLs expire at expires_at when the server signs them.
+export interface AttachmentLink {
+  url: string
+  thumbnails?: Record<string, string>
+  expires_at?: string
+}
+
+// getAttachmentLink asks the server for an attachment's download URLs,
+// which it only gives users who can read the room when it checks rooms.
+export async function getAttachmentLink(serverUrl: string, id: string, username: string): Promise<AttachmentLink> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const base = `http://localhost:${portMatch[1]}`
+  const response = await fetch(`${base}/attachments/${encodeURIComponent(id)}/link?username=${encodeURIComponent(username)}`)
+  if (!response.ok) {
+    throw new Error('Failed to get attachment link')
+  }
+  const link: AttachmentLink = await response.json()
+  return {
+    ...link,
+    url: base + link.url,
+    thumbnails: link.thumbnails && Object.fromEntries(Object.entries(link.thumbnails).map(([size, url]) => [size, base + url]))
+  }
+}
+
+export interface Translation {
+  id: string
+  lang: string
+  source_lang?: string
+  text: string
+}
+
+// translateMessage translates a stored message into lang through the chat
+// server, which holds the provider's API key and caches translations.
+export async function translateMessage(serverUrl: string, id: string, lang: string): Promise<Translation> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const response = await fetch(`http://localhost:${portMatch[1]}/messages/${encodeURIComponent(id)}/translate?lang=${encodeURIComponent(lang)}`)
+  if (!response.ok) {
+    const body = await response.json().catch(() => null)
+    throw new Error(body?.message || 'Failed to translate message')
+  }
+  return response.json()
+}
+
+// getMembers returns a page of the room's members, longest-standing first.
+// Pass the previous page's next to get the following one.
+export async function getMembers(serverUrl: string, room: string, after?: string): Promise<MemberPage> {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+
+  const params = new URLSearchParams({ limit: '200' })
+  if (after) params.set('after', after)
+  const response = await fetch(`http://localhost:${portMatch[1]}/rooms/${encodeURIComponent(room)}/members?${params}`)
+  if (!response.ok) {
+    throw new Error('Failed to get room members')
+  }
+
+  return response.json()
+}
+
+export interface Draft {
+  room: string
+  content: string
+  updated_at: string
+}
+
+// Drafts are kept per user and room on the server, so composing continues
+// on another device. They need the user's access token. getDraft returns
+// null when there is none.
+export async function getDraft(serverUrl: string, username: string, room: string, token: string): Promise<Draft | null> {
+  const response = await fetch(draftUrl(serverUrl, username, room), { headers: { Authorization: `Bearer ${token}` } })
+  if (response.status === 404) return null
+  if (!response.ok) {
+    throw new Error('Failed to get draft')
+  }
+  return response.json()
+}
+
+export async function saveDraft(serverUrl: string, username: string, room: string, content: string, token: string): Promise<void> {
+  const response = await fetch(draftUrl(serverUrl, username, room), {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${token}` },
+    body: JSON.stringify({ content })
+  })
+  if (!response.ok) {
+    throw new Error('Failed to save draft')
+  }
+}
+
+export async function deleteDraft(serverUrl: string, username: string, room: string, token: string): Promise<void> {
+  const response = await fetch(draftUrl(serverUrl, username, room), { method: 'DELETE', headers: { Authorization: `Bearer ${token}` } })
+  if (!response.ok && response.status !== 404) {
+    throw new Error('Failed to delete draft')
+  }
+}
+
+function draftUrl(serverUrl: string, username: string, room: string): string {
+  const portMatch = serverUrl.match(/:(\d{4})\/?/)
+  if (!portMatch) {
+    throw new Error('Invalid server URL format')
+  }
+  return `http://localhost:${portMatch[1]}/users/${encodeURIComponent(username)}/drafts/${encodeURIComponent(room)}`
+}
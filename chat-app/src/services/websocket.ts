@@ -1,27 +1,108 @@
+import { getOptimalServer } from './api'
+import type { MessageAttachment, MessageCard, MessageContact, MessageEntity, MessageGIF, MessageLocation, MessageForward, MessageMembership, MessageQuote, RoomInfo } from './api'
+
+export interface ServerHello {
+  protocol_version: number
+  subprotocol?: string
+  server: string
+  encodings: string[]
+  compression: boolean
+  max_frame_size: number
+  max_content_size: number
+  max_username_size: number
+  messages_per_second: number
+  message_burst: number
+  event_types: string[]
+  features?: Record<string, boolean>
+  acks: boolean
+  username: string
+  guest?: boolean
+}
+
+// A connection of the user, listed in answer to requestSessions.
+export interface Session {
+  id: string
+  server: string
+  user_agent?: string
+  connected_at: string
+  last_seen: string
+  current?: boolean
+}
+
+export interface ReconnectHint {
+  reason: string
+  retry_after_ms: number
+  server?: string
+}
+
+const SUBPROTOCOL = 'chat.v1'
+// Close code of revoked sessions (policy violation).
+const SESSION_REVOKED = 1008
+// Close code the server uses once the user left the room.
+const LEFT_ROOM = 1000
+// Ids of recently delivered messages, to drop redeliveries of ones that
+// arrived but whose ack was lost.
+const SEEN_LIMIT = 1000
+// Message types kept in history, acked like chat messages; plain chat
+// messages have no type.
+const CHAT_TYPES = ['', 'card', 'location', 'contact', 'gif', 'member']
+
 interface WebSocketMessage {
-  id?: number
+  id?: string
+  user_id?: string
+  type?: string
+  room?: RoomInfo
+  entities?: MessageEntity[]
+  card?: MessageCard
+  location?: MessageLocation
+  contact?: MessageContact
+  gif?: MessageGIF
+  member?: MessageMembership
+  attachment?: MessageAttachment
+  quote?: MessageQuote
+  forwarded?: MessageForward
   username: string
   content: string
   server?: string
   timestamp?: string
+  hello?: ServerHello
+  reconnect?: ReconnectHint
+  sessions?: Session[]
 }
 
 export class ChatWebSocket {
   private ws: WebSocket | null = null
+  private hello: ServerHello | null = null
+  private reconnectHint: ReconnectHint | null = null
+  private seen = new Set<string>()
+  // Id of the newest chat message received, sent on reconnect so the
+  // server replays what was missed meanwhile.
+  private lastId = ''
   private serverUrl: string
   private username: string
   private onMessage: (message: WebSocketMessage) => void
   private onConnect: () => void
   private onDisconnect: () => void
   private onError: (error: string) => void
+  private onHello?: (hello: ServerHello) => void
+  // The load balancer's assignment id, sent with the next connect only.
+  private assignment?: string
+  // An access token minted by the embedding site, used instead of the
+  // username.
+  private token?: string
 
+  // An empty username joins as a guest, unless a token is given; the
+  // server picks or takes the name and reports it in the hello frame.
   constructor(
     serverUrl: string,
     username: string,
     onMessage: (message: WebSocketMessage) => void,
     onConnect: () => void,
     onDisconnect: () => void,
-    onError: (error: string) => void
+    onError: (error: string) => void,
+    onHello?: (hello: ServerHello) => void,
+    assignment?: string,
+    token?: string
   ) {
     this.serverUrl = serverUrl
     this.username = username
@@ -29,12 +110,21 @@ export class ChatWebSocket {
     this.onConnect = onConnect
     this.onDisconnect = onDisconnect
     this.onError = onError
+    this.onHello = onHello
+    this.assignment = assignment
+    this.token = token
   }
 
   connect() {
     try {
-      const wsUrl = `${this.serverUrl}/ws?username=${encodeURIComponent(this.username)}`
-      this.ws = new WebSocket(wsUrl)
+      const identity = this.token
+        ? `token=${encodeURIComponent(this.token)}`
+        : this.username ? `username=${encodeURIComponent(this.username)}` : 'guest=1'
+      const assignment = this.assignment ? `&assignment=${encodeURIComponent(this.assignment)}` : ''
+      this.assignment = undefined
+      const since = this.lastId ? `&since=${this.lastId}` : ''
+      const wsUrl = `${this.serverUrl}/ws?${identity}&ack=1${assignment}${since}`
+      this.ws = new WebSocket(wsUrl, SUBPROTOCOL)
 
       this.ws.onopen = () => {
         console.log('WebSocket connected')
@@ -44,6 +134,30 @@ export class ChatWebSocket {
       this.ws.onmessage = (event) => {
         try {
           const message: WebSocketMessage = JSON.parse(event.data)
+
+          if (message.type === 'hello' && message.hello) {
+            this.hello = message.hello
+            // A guest's name is freed when it disconnects, so guests
+            // keep asking for a fresh one on reconnect.
+            if (!message.hello.guest) {
+              this.username = message.hello.username
+            }
+            this.onHello?.(message.hello)
+            return
+          }
+
+          if (message.type === 'reconnect' && message.reconnect) {
+            this.reconnectHint = message.reconnect
+            return
+          }
+
+          if (message.id && CHAT_TYPES.includes(message.type ?? '')) {
+            this.ack(message.id)
+            if (this.seen.has(message.id)) {
+              return
+            }
+            this.remember(message.id)
+          }
           
           if (typeof message.content === 'string' && message.content.startsWith('{')) {
             try {
@@ -63,7 +177,38 @@ export class ChatWebSocket {
         }
       }
 
-      this.ws.onclose = () => {
+      this.ws.onclose = (event) => {
+        const hint = this.reconnectHint
+        this.reconnectHint = null
+        // The session was revoked from another device or by an
+        // administrator; reconnecting would undo that.
+        if (event.code === SESSION_REVOKED) {
+          console.log('Session revoked')
+          this.hello = null
+          this.onError('This session was signed out')
+          this.onDisconnect()
+          return
+        }
+        if (event.code === LEFT_ROOM) {
+          console.log('Left the room')
+          this.hello = null
+          this.onDisconnect()
+          return
+        }
+        if (hint && this.ws) {
+          console.log(`Server asked us to reconnect (${hint.reason}), retrying in ${hint.retry_after_ms}ms`)
+          setTimeout(() => this.reconnect(hint), hint.retry_after_ms)
+          return
+        }
+        // A connection that was up and dropped without a hint lost its
+        // server; ask the load balancer for another one.
+        if (this.ws && this.hello) {
+          const lost: ReconnectHint = { reason: 'lost', retry_after_ms: 1000 + Math.random() * 2000 }
+          console.log(`Connection lost, retrying in ${Math.round(lost.retry_after_ms)}ms`)
+          this.hello = null
+          setTimeout(() => this.reconnect(lost), lost.retry_after_ms)
+          return
+        }
         console.log('WebSocket disconnected')
         this.onDisconnect()
       }
@@ -78,12 +223,64 @@ export class ChatWebSocket {
     }
   }
 
-  sendMessage(content: string) {
-    
+  private async reconnect(hint: ReconnectHint) {
+    if (!this.ws) {
+      return
+    }
+    try {
+      if (hint.server) {
+        this.serverUrl = hint.server
+      } else {
+        const server = await getOptimalServer()
+        this.serverUrl = server.address
+        this.assignment = server.assignment
+      }
+      this.connect()
+    } catch (error) {
+      console.error('Reconnect failed:', error)
+      this.onDisconnect()
+    }
+  }
+
+  private ack(id: string) {
+    if (this.hello?.acks && this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'ack', id }))
+    }
+  }
+
+  // markSeen records a message loaded from /history, so a reconnect
+  // replays from there even before any live message arrived.
+  markSeen(id: string) {
+    this.remember(id)
+  }
+
+  private remember(id: string) {
+    // Ids are decimal strings too large for a number; a longer one is newer.
+    if (id.length > this.lastId.length || (id.length === this.lastId.length && id > this.lastId)) {
+      this.lastId = id
+    }
+    this.seen.add(id)
+    if (this.seen.size > SEEN_LIMIT) {
+      const oldest = this.seen.values().next().value
+      if (oldest !== undefined) {
+        this.seen.delete(oldest)
+      }
+    }
+  }
+
+  // sendMessage sends a chat message, replying to the message with quoteId
+  // when given.
+  sendMessage(content: string, quoteId?: string) {
+    if (this.hello && new TextEncoder().encode(content).length > this.hello.max_content_size) {
+      this.onError(`Messages are limited to ${this.hello.max_content_size} bytes`)
+      return
+    }
+
     if (this.ws && this.ws.readyState === WebSocket.OPEN) {
       const message = {
         username: this.username,
-        content: content
+        content: content,
+        ...(quoteId && { quote_id: quoteId })
       }
       this.ws.send(JSON.stringify(message))
     } else {
@@ -91,6 +288,68 @@ export class ChatWebSocket {
     }
   }
 
+  // sendInteraction clicks a button of the card message with id.
+  sendInteraction(id: string, callbackId: string) {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'interaction', id, interaction: { callback_id: callbackId } }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
+  // sendAttachment shares an uploaded file, with an optional caption.
+  sendAttachment(attachmentId: string, caption = '') {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ content: caption, attachment_id: attachmentId }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
+  // forward copies the message with id to room as a new message.
+  forward(id: string, room: string) {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'forward', id, to_room: room }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
+  // requestSessions asks for the user's connections; they arrive as a
+  // sessions message.
+  requestSessions() {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'sessions' }))
+    }
+  }
+
+  revokeSession(id: string) {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'revoke_session', session: id }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
+  // leave takes the user out of the room; the server then closes this and
+  // the user's other connections.
+  leave() {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'leave' }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
+  // sendGif sends a GIF returned by searchGifs.
+  sendGif(gif: MessageGIF) {
+    if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ type: 'gif', gif }))
+    } else {
+      this.onError('Connection is not open')
+    }
+  }
+
   disconnect() {
     if (this.ws) {
       this.ws.close()
@@ -98,6 +357,10 @@ export class ChatWebSocket {
     }
   }
 
+  capabilities(): ServerHello | null {
+    return this.hello
+  }
+
   isConnected(): boolean {
     return this.ws?.readyState === WebSocket.OPEN
   }
@@ -0,0 +1,216 @@
+// Package analytics emits anonymized usage events so product metrics can be
+// computed outside the chat servers, without querying their databases.
+// Events are queued, batched and written to the configured sink in the
+// background, so emitting never blocks the caller; batches the sink
+// refuses are dropped and counted.
+//
+// Users appear only as a keyed hash of their id, stable across servers and
+// sessions while the salt stays the same. Message contents and names are
+// never included.
+package analytics
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+)
+
+const (
+	EventSessionStarted = "session.started"
+	EventSessionEnded   = "session.ended"
+	// EventRoomActivity summarizes a room's messages on one server over a
+	// window.
+	EventRoomActivity = "room.activity"
+)
+
+const (
+	queueSize     = 4096
+	batchSize     = 500
+	flushInterval = 5 * time.Second
+	// activityWindow is how long room.activity events summarize.
+	activityWindow = time.Minute
+	writeTimeout   = 10 * time.Second
+)
+
+// Event is one analytics record. Fields that don't apply to the type are
+// left out.
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	// User is the hashed user id.
+	User            string  `json:"user,omitempty"`
+	Guest           bool    `json:"guest,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Room            string  `json:"room,omitempty"`
+	Messages        int     `json:"messages,omitempty"`
+	// Senders counts the distinct users who sent the window's messages.
+	Senders       int     `json:"senders,omitempty"`
+	WindowSeconds float64 `json:"window_seconds,omitempty"`
+}
+
+// Emitter queues events for a sink. A nil *Emitter drops events, for
+// servers without analytics.
+type Emitter struct {
+	source string
+	salt   []byte
+	sink   Sink
+	queue  chan Event
+
+	mu       sync.Mutex
+	activity map[string]*roomActivity
+	// windowStart is when the current activity window began.
+	windowStart time.Time
+}
+
+type roomActivity struct {
+	messages int
+	senders  map[int64]bool
+}
+
+// New returns an emitter for cfg's sink, or nil when analytics are off.
+// source identifies the emitting server in each event.
+func New(cfg config.Analytics, source string) *Emitter {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &Emitter{
+		source:      source,
+		salt:        []byte(cfg.Salt),
+		sink:        newSink(cfg),
+		queue:       make(chan Event, queueSize),
+		activity:    make(map[string]*roomActivity),
+		windowStart: time.Now(),
+	}
+}
+
+// Run writes queued events until ctx is done, then writes what is left.
+func (e *Emitter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	window := time.NewTicker(activityWindow)
+	defer window.Stop()
+
+	var batch []Event
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		wctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		defer cancel()
+		if err := e.sink.Write(wctx, batch); err != nil {
+			metrics.AnalyticsEvents.Add("failed", int64(len(batch)))
+			log.Printf("[Analytics] dropped %d events: %v", len(batch), err)
+		} else {
+			metrics.AnalyticsEvents.Add("sent", int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			batch = append(batch, e.drainActivity(time.Now())...)
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			write()
+			return
+		case ev := <-e.queue:
+			batch = append(batch, ev)
+			if len(batch) >= batchSize {
+				write()
+			}
+		case now := <-window.C:
+			batch = append(batch, e.drainActivity(now)...)
+		case <-flush.C:
+			write()
+		}
+	}
+}
+
+// SessionStarted records a connection opening.
+func (e *Emitter) SessionStarted(userID int64, guest bool) {
+	if e == nil {
+		return
+	}
+	e.emit(Event{Type: EventSessionStarted, User: e.hash(userID), Guest: guest})
+}
+
+// SessionEnded records a connection closing after lasting d.
+func (e *Emitter) SessionEnded(userID int64, guest bool, d time.Duration) {
+	if e == nil {
+		return
+	}
+	e.emit(Event{Type: EventSessionEnded, User: e.hash(userID), Guest: guest, DurationSeconds: d.Seconds()})
+}
+
+// Message counts a message a user sent to room through this server. Counts
+// are emitted once per window as room.activity events.
+func (e *Emitter) Message(room string, userID int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a, ok := e.activity[room]
+	if !ok {
+		a = &roomActivity{senders: make(map[int64]bool)}
+		e.activity[room] = a
+	}
+	a.messages++
+	a.senders[userID] = true
+}
+
+func (e *Emitter) emit(ev Event) {
+	ev.Time = time.Now().UTC()
+	ev.Server = e.source
+	select {
+	case e.queue <- ev:
+	default:
+		metrics.AnalyticsEvents.Add("dropped", 1)
+	}
+}
+
+// drainActivity turns the window's message counts into events and starts
+// the next window. The last window before shutdown is shorter.
+func (e *Emitter) drainActivity(now time.Time) []Event {
+	e.mu.Lock()
+	activity, start := e.activity, e.windowStart
+	e.activity = make(map[string]*roomActivity)
+	e.windowStart = now
+	e.mu.Unlock()
+
+	events := make([]Event, 0, len(activity))
+	for room, a := range activity {
+		events = append(events, Event{
+			Type:          EventRoomActivity,
+			Time:          now.UTC(),
+			Server:        e.source,
+			Room:          room,
+			Messages:      a.messages,
+			Senders:       len(a.senders),
+			WindowSeconds: now.Sub(start).Round(time.Second).Seconds(),
+		})
+	}
+	return events
+}
+
+// hash replaces a user id with the first 64 bits of its HMAC-SHA256 under
+// the salt.
+func (e *Emitter) hash(userID int64) string {
+	h := hmac.New(sha256.New, e.salt)
+	h.Write([]byte(strconv.FormatInt(userID, 10)))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
@@ -0,0 +1,171 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/objectstore"
+)
+
+// Sink stores batches of events.
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+}
+
+func newSink(cfg config.Analytics) Sink {
+	client := &http.Client{Timeout: writeTimeout}
+	switch cfg.Sink {
+	case config.AnalyticsClickHouse:
+		return &clickHouse{client: client, url: cfg.URL, table: cfg.Table, username: cfg.Username, password: cfg.Password}
+	case config.AnalyticsKafka:
+		return &kafkaREST{client: client, url: strings.TrimRight(cfg.URL, "/") + "/topics/" + url.PathEscape(cfg.Topic)}
+	case config.AnalyticsObjects:
+		return &objects{store: objectstore.New(cfg.Storage), prefix: cfg.Storage.Prefix}
+	default:
+		return &file{dir: cfg.Dir}
+	}
+}
+
+// file appends events as NDJSON to one file per UTC day in dir, e.g.
+// "events-2025-10-09.ndjson".
+type file struct {
+	dir string
+}
+
+func (f *file) Write(_ context.Context, events []Event) error {
+	if err := os.MkdirAll(f.dir, 0o755); err != nil {
+		return err
+	}
+	name := filepath.Join(f.dir, "events-"+time.Now().UTC().Format("2006-01-02")+".ndjson")
+	out, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	body, err := ndjson(events)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Write(body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// objects writes each batch as an NDJSON object, grouped by UTC day, e.g.
+// "events/2025-10-09/20251009T101500.123Z-1f3a9c2e.ndjson". Object stores
+// can't append, so unlike the file sink a day is many objects; the random
+// suffix keeps servers flushing at once apart.
+type objects struct {
+	store  objectstore.Store
+	prefix string
+}
+
+func (o *objects) Write(ctx context.Context, events []Event) error {
+	body, err := ndjson(events)
+	if err != nil {
+		return err
+	}
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%sevents/%s/%s-%s.ndjson", o.prefix, now.Format("2006-01-02"), now.Format("20060102T150405.000Z"), hex.EncodeToString(suffix[:]))
+	return o.store.Put(ctx, key, body, "application/x-ndjson")
+}
+
+// clickHouse inserts events through ClickHouse's HTTP interface. The
+// table's columns are named after the event's JSON fields.
+type clickHouse struct {
+	client             *http.Client
+	url, table         string
+	username, password string
+}
+
+func (c *clickHouse) Write(ctx context.Context, events []Event) error {
+	body, err := ndjson(events)
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("query", "INSERT INTO "+c.table+" FORMAT JSONEachRow")
+	// Event times are RFC 3339, which DateTime columns only accept with
+	// best-effort parsing.
+	q.Set("date_time_input_format", "best_effort")
+	q.Set("input_format_skip_unknown_fields", "1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.url, "/")+"/?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return send(c.client, req)
+}
+
+// kafkaREST produces events to a topic through a Kafka REST proxy (the
+// Confluent v2 API), one record per event.
+type kafkaREST struct {
+	client *http.Client
+	url    string
+}
+
+func (k *kafkaREST) Write(ctx context.Context, events []Event) error {
+	type record struct {
+		Value Event `json:"value"`
+	}
+	records := make([]record, len(events))
+	for i, ev := range events {
+		records[i] = record{Value: ev}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	return send(k.client, req)
+}
+
+func send(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func ndjson(events []Event) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,187 @@
+// Package antientropy reconciles message history between servers. Each
+// server keeps its own SQLite database, so a server that was down or missed
+// a Redis broadcast would otherwise serve a different /history forever.
+//
+// Every interval a server asks each peer for hourly digests of recent
+// messages, compares them with its own, and pulls whole hours whose digests
+// differ. Inserts are idempotent, so pulling is always safe and every server
+// converges on the union of all histories, less what retention and the
+// archive have deleted.
+package antientropy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lukagolubovic/balancer"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/idgen"
+	"lukagolubovic/loadbalancer"
+	"lukagolubovic/models"
+)
+
+type Syncer struct {
+	address  string
+	db       *sql.DB
+	writer   *database.Writer
+	lbClient *loadbalancer.Client
+	cfg      *config.Store
+	token    string
+	window   time.Duration
+	client   *http.Client
+	synced   bool
+}
+
+// New returns a Syncer that reconciles the last window of history on
+// every run. token is the -sync-token shared by the cluster's servers. It
+// is sent to every peer the load balancer lists, so it must not be the
+// admin token. transport carries the client certificate under mutual TLS
+// and may be nil.
+func New(address string, db *sql.DB, writer *database.Writer, lbClient *loadbalancer.Client, cfg *config.Store, token string, window time.Duration, transport http.RoundTripper) *Syncer {
+	return &Syncer{
+		address:  address,
+		db:       db,
+		writer:   writer,
+		lbClient: lbClient,
+		cfg:      cfg,
+		token:    token,
+		window:   window,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// RunOnce reconciles the full history on the first run and the recent
+// window after that; it is meant to be scheduled every -sync-interval.
+// Failures with single peers are logged and retried on the next run.
+func (s *Syncer) RunOnce(ctx context.Context) error {
+	now := time.Now()
+	sinceID := s.watermark(now)
+	if s.synced {
+		sinceID = max(sinceID, idgen.MinID(now.Add(-s.window)))
+	}
+	peers, err := s.lbClient.Peers()
+	if err != nil {
+		return fmt.Errorf("anti-entropy: listing peers: %w", err)
+	}
+	s.synced = true
+	for _, peer := range peers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := s.syncPeer(ctx, peer, sinceID)
+		if err != nil {
+			log.Printf("[Server %s] Anti-entropy with %s failed: %v", s.address, peer.Address, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("[Server %s] Anti-entropy pulled %d messages from %s\n", s.address, n, peer.Address)
+		}
+	}
+	return nil
+}
+
+// watermark is the smallest id worth pulling. Messages older than the
+// retention or the archive age are deleted here, and pulling them back from
+// a peer that hasn't deleted them yet would undo that.
+func (s *Syncer) watermark(now time.Time) int64 {
+	rt := s.cfg.Room(models.DefaultRoom)
+	days := rt.RetentionDays
+	if rt.Archive.Enabled() && (days <= 0 || rt.Archive.AfterDays < days) {
+		days = rt.Archive.AfterDays
+	}
+	if days <= 0 {
+		return database.FirstSyncedID
+	}
+	return max(database.FirstSyncedID, idgen.MinID(now.AddDate(0, 0, -days)))
+}
+
+func (s *Syncer) syncPeer(ctx context.Context, peer balancer.ChatServerInfo, sinceID int64) (int, error) {
+	base, err := peer.AdminURL()
+	if err != nil {
+		return 0, err
+	}
+
+	var remote []database.SyncBucket
+	if err := s.get(base+"/admin/sync/digest?since="+strconv.FormatInt(sinceID, 10), &remote); err != nil {
+		return 0, err
+	}
+	local, err := database.SyncDigest(ctx, s.db, sinceID)
+	if err != nil {
+		return 0, err
+	}
+	have := make(map[int64]database.SyncBucket, len(local))
+	for _, b := range local {
+		have[b.Bucket] = b
+	}
+
+	pulled := 0
+	for _, b := range remote {
+		if mine, ok := have[b.Bucket]; ok && mine == b {
+			continue
+		}
+		var rows []database.MessageRow
+		if err := s.get(base+"/admin/sync/messages?bucket="+strconv.FormatInt(b.Bucket, 10), &rows); err != nil {
+			return pulled, err
+		}
+		inserted := 0
+		var conflicts []int64
+		err := s.writer.Tx(func(tx *sql.Tx) error {
+			inserted, conflicts = 0, nil
+			for _, row := range rows {
+				// Peers older than FirstSyncedID still send legacy ids.
+				if row.ID < sinceID {
+					continue
+				}
+				ok, err := database.InsertReplicated(tx, row)
+				if err != nil {
+					return err
+				}
+				if ok {
+					inserted++
+					continue
+				}
+				conflict, err := database.ReplicaConflicts(tx, row)
+				if err != nil {
+					return err
+				}
+				if conflict {
+					conflicts = append(conflicts, row.ID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return pulled, err
+		}
+		if len(conflicts) > 0 {
+			log.Printf("[Server %s] Anti-entropy kept %d local messages whose ids %s uses for different messages: %v", s.address, len(conflicts), peer.Address, conflicts)
+		}
+		pulled += inserted
+	}
+	return pulled, nil
+}
+
+func (s *Syncer) get(rawURL string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,59 @@
+// Package apierror writes the JSON error envelope shared by every HTTP
+// endpoint of the chat server, load balancer and orchestrator.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Machine-readable error codes. Clients should switch on these rather than on
+// the human-readable message.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeGone             = "gone"
+	CodeRateLimited      = "rate_limited"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal"
+)
+
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Write sends {code, message} with the given status.
+func Write(w http.ResponseWriter, status int, code, message string) {
+	WriteDetails(w, status, code, message, nil)
+}
+
+// WriteDetails sends {code, message, details}; details is any JSON-encodable
+// value, such as the offending field or the underlying parse error.
+func WriteDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Error{Code: code, Message: message, Details: details})
+}
+
+// SetRateLimit adds X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (seconds until the quota is fully restored) to h.
+func SetRateLimit(h http.Header, limit, remaining int, reset time.Duration) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int((reset+time.Second-1)/time.Second)))
+}
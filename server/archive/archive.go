@@ -0,0 +1,175 @@
+// Package archive moves messages older than the configured age out of the
+// servers' SQLite files into gzipped NDJSON objects in object storage, and
+// reads them back for deep history pages.
+//
+// Every server holds a copy of the room's history, so one server at a time
+// (whichever holds a Redis lock) uploads the next segments from its own
+// database and records them in a Redis index. Every server then deletes
+// its local copies of messages the index covers.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/idgen"
+	"lukagolubovic/models"
+	"lukagolubovic/objectstore"
+)
+
+const (
+	// segmentKeyPrefix is followed by the room name; the index of a room is
+	// a sorted set of its segments.
+	segmentKeyPrefix = "chat:{archive}:segments:"
+	lockKey          = "chat:{archive}:lock"
+
+	contentType = "application/x-ndjson"
+	// segmentSize is the most messages in one object.
+	segmentSize = 10000
+)
+
+// Segment describes one archived object: the messages of a room with ids
+// FirstID to LastID, sent between Start and End.
+type Segment struct {
+	Key     string `json:"key"`
+	FirstID int64  `json:"first_id"`
+	LastID  int64  `json:"last_id"`
+	Count   int    `json:"count"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+// NewStore returns the object store cfg describes.
+func NewStore(cfg config.Archive) objectstore.Store {
+	return objectstore.New(cfg.ObjectStorage)
+}
+
+// Ids exceed what a float64 score holds exactly, so index members start
+// with the zero-padded first id: segments whose scores round to the same
+// value still sort by id.
+func member(seg Segment) (string, error) {
+	raw, err := json.Marshal(seg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%019d %s", seg.FirstID, raw), nil
+}
+
+func parseMember(m string) (Segment, error) {
+	var seg Segment
+	_, raw, ok := strings.Cut(m, " ")
+	if !ok {
+		return seg, fmt.Errorf("malformed archive index entry %q", m)
+	}
+	err := json.Unmarshal([]byte(raw), &seg)
+	return seg, err
+}
+
+// lastSegment returns the newest segment of room's index, if any.
+func lastSegment(ctx context.Context, rdb redis.UniversalClient, room string) (Segment, bool, error) {
+	members, err := rdb.ZRevRange(ctx, segmentKeyPrefix+room, 0, 0).Result()
+	if err != nil || len(members) == 0 {
+		return Segment{}, false, err
+	}
+	seg, err := parseMember(members[0])
+	return seg, err == nil, err
+}
+
+// segmentsBefore returns up to count segments of room starting before id,
+// newest first, skipping the first offset of them.
+func segmentsBefore(ctx context.Context, rdb redis.UniversalClient, room string, id int64, offset, count int) ([]Segment, error) {
+	members, err := rdb.ZRevRangeByScore(ctx, segmentKeyPrefix+room, &redis.ZRangeBy{
+		Max:    strconv.FormatFloat(float64(id), 'f', -1, 64),
+		Min:    "-inf",
+		Offset: int64(offset),
+		Count:  int64(count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]Segment, 0, len(members))
+	for _, m := range members {
+		seg, err := parseMember(m)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// segmentsFrom returns up to count segments of room starting at or after
+// the score min, oldest first, skipping the first offset of them.
+func segmentsFrom(ctx context.Context, rdb redis.UniversalClient, room, min string, offset, count int) ([]Segment, error) {
+	members, err := rdb.ZRangeByScore(ctx, segmentKeyPrefix+room, &redis.ZRangeBy{
+		Min:    min,
+		Max:    "+inf",
+		Offset: int64(offset),
+		Count:  int64(count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]Segment, 0, len(members))
+	for _, m := range members {
+		seg, err := parseMember(m)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func encodeSegment(messages []models.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSegment(body []byte) ([]models.Message, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var messages []models.Message
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var msg models.Message
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// objectKey names a segment's object, e.g.
+// "prefix/general/2025/06/01/<first>-<last>.ndjson.gz".
+func objectKey(prefix, room string, first, last int64) string {
+	key := fmt.Sprintf("%s/%s/%d-%d.ndjson.gz", room, idgen.Time(first).UTC().Format("2006/01/02"), first, last)
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
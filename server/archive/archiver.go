@@ -0,0 +1,130 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/objectstore"
+)
+
+// lockTTL bounds how long a crashed uploader keeps others from uploading.
+const lockTTL = 10 * time.Minute
+
+// Archiver archives a database's cold messages and deletes the archived
+// ones. A nil *Archiver does nothing.
+type Archiver struct {
+	rdb    redis.UniversalClient
+	db     *sql.DB
+	writer *database.Writer
+	store  objectstore.Store
+	cfg    config.Archive
+	// name identifies this process in the lock and in logs.
+	name string
+}
+
+// New returns nil when archiving is disabled.
+func New(name string, rdb redis.UniversalClient, db *sql.DB, writer *database.Writer, cfg config.Archive) *Archiver {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &Archiver{rdb: rdb, db: db, writer: writer, store: NewStore(cfg), cfg: cfg, name: name}
+}
+
+// RunOnce uploads the messages older than the configured age that the
+// index doesn't cover yet, if no other server is doing so, then deletes
+// the local copies of everything archived.
+func (a *Archiver) RunOnce(ctx context.Context, now time.Time) error {
+	cutoff := now.AddDate(0, 0, -a.cfg.AfterDays)
+	locked, err := a.rdb.SetNX(ctx, lockKey, a.name, lockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if locked {
+		err := a.upload(ctx, models.DefaultRoom, models.DefaultRoomID, cutoff)
+		// Only release the lock if it is still ours.
+		if owner, _ := a.rdb.Get(ctx, lockKey).Result(); owner == a.name {
+			a.rdb.Del(ctx, lockKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return a.prune(ctx, models.DefaultRoom, models.DefaultRoomID, cutoff)
+}
+
+func (a *Archiver) upload(ctx context.Context, room string, roomID int64, cutoff time.Time) error {
+	last, _, err := lastSegment(ctx, a.rdb, room)
+	if err != nil {
+		return err
+	}
+	after := last.LastID
+	for ctx.Err() == nil {
+		messages, err := database.ArchivedMessages(ctx, a.db, roomID, database.ArchiveQuery{After: after, End: cutoff, Limit: segmentSize})
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		first, final := messages[0], messages[len(messages)-1]
+		seg := Segment{
+			Key:     objectKey(a.cfg.Prefix, room, first.ID, final.ID),
+			FirstID: first.ID,
+			LastID:  final.ID,
+			Count:   len(messages),
+			Start:   first.Timestamp,
+			End:     final.Timestamp,
+		}
+		body, err := encodeSegment(messages)
+		if err != nil {
+			return err
+		}
+		if err := a.store.Put(ctx, seg.Key, body, contentType); err != nil {
+			return err
+		}
+		m, err := member(seg)
+		if err != nil {
+			return err
+		}
+		if err := a.rdb.ZAdd(ctx, segmentKeyPrefix+room, &redis.Z{Score: float64(seg.FirstID), Member: m}).Err(); err != nil {
+			return err
+		}
+		log.Printf("[Archive %s] Archived %d messages of %s to %s", a.name, seg.Count, room, seg.Key)
+		after = seg.LastID
+		if len(messages) < segmentSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// prune deletes local messages the index covers. Messages this database
+// missed when they were sent, and that the uploader didn't have either,
+// are deleted unarchived; anti-entropy repairs such gaps long before
+// messages are old enough to archive.
+func (a *Archiver) prune(ctx context.Context, room string, roomID int64, cutoff time.Time) error {
+	last, ok, err := lastSegment(ctx, a.rdb, room)
+	if err != nil || !ok {
+		return err
+	}
+	var n int64
+	err = a.writer.TxContext(ctx, func(tx *sql.Tx) error {
+		var err error
+		n, err = database.DeleteArchived(tx, roomID, last.LastID, cutoff)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("[Archive %s] Deleted %d archived messages of %s", a.name, n, room)
+	}
+	return nil
+}
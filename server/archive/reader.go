@@ -0,0 +1,161 @@
+package archive
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+	"lukagolubovic/objectstore"
+)
+
+const (
+	// cachedSegments is how many decoded segments a Reader keeps, so
+	// paging through one segment fetches it once.
+	cachedSegments = 8
+	// segmentBatch is how many index entries are read at a time.
+	segmentBatch = 8
+)
+
+// Reader reads archived messages back. A nil *Reader has no archive.
+type Reader struct {
+	rdb   redis.UniversalClient
+	store objectstore.Store
+
+	mu    sync.Mutex
+	cache map[string][]models.Message
+	order []string
+}
+
+// NewReader returns nil when archiving is disabled.
+func NewReader(rdb redis.UniversalClient, cfg config.Archive) *Reader {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &Reader{rdb: rdb, store: NewStore(cfg), cache: make(map[string][]models.Message)}
+}
+
+// Before returns up to limit archived messages of room with ids below
+// before, oldest first.
+func (r *Reader) Before(ctx context.Context, room string, before int64, limit int) ([]models.Message, error) {
+	if r == nil || limit <= 0 {
+		return nil, nil
+	}
+	var pages [][]models.Message
+	found := 0
+	for offset := 0; found < limit; offset += segmentBatch {
+		segments, err := segmentsBefore(ctx, r.rdb, room, before, offset, segmentBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range segments {
+			if seg.FirstID >= before || found >= limit {
+				continue
+			}
+			messages, err := r.segment(ctx, seg.Key)
+			if err != nil {
+				return nil, err
+			}
+			end := len(messages)
+			for end > 0 && messages[end-1].ID >= before {
+				end--
+			}
+			start := max(end-(limit-found), 0)
+			pages = append(pages, messages[start:end])
+			found += end - start
+		}
+		if len(segments) < segmentBatch {
+			break
+		}
+	}
+
+	out := make([]models.Message, 0, found)
+	for i := len(pages) - 1; i >= 0; i-- {
+		out = append(out, pages[i]...)
+	}
+	return out, nil
+}
+
+// Each calls fn with the archived messages of room with ids above after,
+// oldest first, and stops at the first error. Segments are read one at a
+// time and not cached, so a long export neither holds the archive in
+// memory nor evicts the segments pages share.
+func (r *Reader) Each(ctx context.Context, room string, after int64, fn func(models.Message) error) error {
+	if r == nil {
+		return nil
+	}
+	// Start from the segment holding after, if it is archived.
+	min := "-inf"
+	if after > 0 {
+		first, err := segmentsBefore(ctx, r.rdb, room, after, 0, 1)
+		if err != nil {
+			return err
+		}
+		if len(first) > 0 {
+			min = strconv.FormatFloat(float64(first[0].FirstID), 'f', -1, 64)
+		}
+	}
+	for offset := 0; ; offset += segmentBatch {
+		segments, err := segmentsFrom(ctx, r.rdb, room, min, offset, segmentBatch)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segments {
+			if seg.LastID <= after {
+				continue
+			}
+			messages, err := r.load(ctx, seg.Key)
+			if err != nil {
+				return err
+			}
+			for _, msg := range messages {
+				if msg.ID <= after {
+					continue
+				}
+				if err := fn(msg); err != nil {
+					return err
+				}
+			}
+		}
+		if len(segments) < segmentBatch {
+			return nil
+		}
+	}
+}
+
+func (r *Reader) segment(ctx context.Context, key string) ([]models.Message, error) {
+	r.mu.Lock()
+	messages, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return messages, nil
+	}
+
+	messages, err := r.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[key]; !ok {
+		if len(r.order) == cachedSegments {
+			delete(r.cache, r.order[0])
+			r.order = r.order[1:]
+		}
+		r.cache[key] = messages
+		r.order = append(r.order, key)
+	}
+	return messages, nil
+}
+
+func (r *Reader) load(ctx context.Context, key string) ([]models.Message, error) {
+	body, err := r.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSegment(body)
+}
@@ -0,0 +1,538 @@
+// Package attachment stores the files shared in messages. Files are
+// content-addressed: every upload gets its own attachment, with its own
+// name and type, but the content is stored once under its SHA-256 digest
+// and counted by the attachments referencing it. The stored copy is
+// deleted with its last attachment.
+//
+// Attachments and reference counts are kept in Redis, shared by every
+// server; contents go to the object store.
+//
+// Images are stripped of their metadata and measured on upload, and new
+// images are scaled down to thumbnails stored beside their content.
+//
+// When a scanner is configured, new content is scanned before it is
+// stored, so nothing is downloadable before it was found clean. Flagged
+// files are kept aside in quarantine for moderators to review instead.
+package attachment
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+	"lukagolubovic/objectstore"
+	"lukagolubovic/scan"
+)
+
+// The keys share a hash tag, so the scripts can update an attachment and
+// its content's count together on a cluster.
+const (
+	attachmentPrefix = "chat:{attachments}:attachment:"
+	blobPrefix       = "chat:{attachments}:blob:"
+	lockPrefix       = "chat:{attachments}:lock:"
+	quarantineKey    = "chat:{attachments}:quarantine"
+	// usageKey maps user ids to the bytes of their attachments, and
+	// quotaKey to the quotas admins set them.
+	usageKey = "chat:{attachments}:usage"
+	quotaKey = "chat:{attachments}:quotas"
+
+	// lockTTL bounds how long a crashed server keeps others from storing
+	// or purging a content.
+	lockTTL  = time.Minute
+	lockPoll = 50 * time.Millisecond
+)
+
+var (
+	ErrNotFound = errors.New("attachment not found")
+	// ErrScanFailed is returned when the scanner couldn't check a file and
+	// failing open isn't allowed.
+	ErrScanFailed = errors.New("the file could not be scanned")
+)
+
+// Quarantined is a file the scanner flagged.
+type Quarantined struct {
+	models.Attachment
+	Threat string `json:"threat,omitempty"`
+}
+
+// QuarantineError is returned for an upload the scanner flagged.
+type QuarantineError struct {
+	File Quarantined
+}
+
+func (e *QuarantineError) Error() string {
+	if e.File.Threat == "" {
+		return "the file was flagged as malware"
+	}
+	return "the file was flagged as malware: " + e.File.Threat
+}
+
+// attachScript records an attachment, counts it against its content and
+// adds its size to the usage of its uploader, ARGV[4], if any. Unless
+// ARGV[1] is "1", telling it the content was just stored with the
+// thumbnails in ARGV[3], it only does so when the content is already
+// stored, and returns nil otherwise. An upload that would take the
+// uploader past their quota, ARGV[5] bytes unless zero, fails with a
+// QUOTA error and their usage. Otherwise it returns the content's
+// thumbnails, which the attachment shares.
+var attachScript = redis.NewScript(`
+if ARGV[1] ~= "1" and redis.call("EXISTS", KEYS[2]) == 0 then
+	return false
+end
+if ARGV[4] ~= "" then
+	local used = tonumber(redis.call("HGET", KEYS[3], ARGV[4]) or "0")
+	local quota = tonumber(ARGV[5])
+	if quota > 0 and used + tonumber(ARGV[2]) > quota then
+		return redis.error_reply("QUOTA " .. used)
+	end
+	redis.call("HINCRBY", KEYS[3], ARGV[4], ARGV[2])
+end
+if ARGV[1] == "1" then
+	redis.call("HSET", KEYS[2], "thumbnails", ARGV[3])
+end
+redis.call("HSET", KEYS[2], "size", ARGV[2])
+redis.call("HINCRBY", KEYS[2], "refs", 1)
+local thumbnails = redis.call("HGET", KEYS[2], "thumbnails") or ""
+redis.call("HSET", KEYS[1], "thumbnails", thumbnails, "owner", ARGV[4], unpack(ARGV, 6))
+return thumbnails
+`)
+
+// releaseScript deletes an attachment, gives its size back to its
+// uploader, and returns how many attachments still reference its content,
+// or -1 when it was already deleted.
+var releaseScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local owner = redis.call("HGET", KEYS[1], "owner")
+if owner and owner ~= "" then
+	redis.call("HINCRBY", KEYS[3], owner, -tonumber(redis.call("HGET", KEYS[1], "size") or "0"))
+end
+redis.call("DEL", KEYS[1])
+return redis.call("HINCRBY", KEYS[2], "refs", -1)
+`)
+
+// purgeScript forgets a content nothing references anymore and returns
+// its thumbnails, or nil when an upload referenced it again in the
+// meantime.
+var purgeScript = redis.NewScript(`
+if tonumber(redis.call("HGET", KEYS[1], "refs") or "0") > 0 then
+	return false
+end
+local thumbnails = redis.call("HGET", KEYS[1], "thumbnails") or ""
+redis.call("DEL", KEYS[1])
+return thumbnails
+`)
+
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type Store struct {
+	rdb         redis.UniversalClient
+	objects     objectstore.Store
+	prefix      string
+	scanner     scan.Scanner
+	scanTimeout time.Duration
+	failOpen    bool
+	thumbnails  []int
+}
+
+// New returns nil when attachments are disabled.
+func New(rdb redis.UniversalClient, cfg config.Attachments) *Store {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &Store{
+		rdb:         rdb,
+		objects:     objectstore.New(cfg.ObjectStorage),
+		prefix:      cfg.Prefix,
+		scanner:     scan.New(cfg.Scan),
+		scanTimeout: time.Duration(cfg.Scan.TimeoutSeconds) * time.Second,
+		failOpen:    cfg.Scan.FailOpen,
+		thumbnails:  cfg.ThumbnailSizes,
+	}
+}
+
+// Upload stores body as attachment id. Content that is already stored is
+// only counted again; otherwise it is scanned and written to the object
+// store under the content's lock, so a concurrent purge of the same
+// content can't delete it afterwards. A flagged file is quarantined and
+// returned in a QuarantineError. Images are stripped of their metadata
+// first, so their digest is the stripped content's. Every attachment
+// counts against its uploader's quota, shared content or not; one that
+// doesn't fit is refused with a QuotaError.
+func (s *Store) Upload(ctx context.Context, id int64, up Uploader, name, contentType string, body []byte) (models.Attachment, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	body, info, err := processImage(mediaType, body)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	sum := sha256.Sum256(body)
+	a := models.Attachment{
+		ID:          id,
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(body)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		UploadedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if info != nil {
+		a.Width, a.Height = info.Width, info.Height
+	}
+	// Checked again atomically when attaching; this spares storing and
+	// scanning a file that can't fit.
+	if err := s.checkQuota(ctx, up, a.Size); err != nil {
+		return models.Attachment{}, err
+	}
+	if ok, err := s.attach(ctx, &a, up, false); err != nil || ok {
+		if ok {
+			metrics.Attachments.Add("deduplicated", 1)
+		}
+		return a, err
+	}
+
+	unlock, err := s.lock(ctx, a.SHA256)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	defer unlock()
+	// Another upload may have stored the content while this one waited.
+	if ok, err := s.attach(ctx, &a, up, false); err != nil || ok {
+		if ok {
+			metrics.Attachments.Add("deduplicated", 1)
+		}
+		return a, err
+	}
+	if err := s.scan(ctx, a, body); err != nil {
+		return models.Attachment{}, err
+	}
+	if err := s.objects.Put(ctx, s.objectKey(a.SHA256), body, contentType); err != nil {
+		return models.Attachment{}, fmt.Errorf("store content: %w", err)
+	}
+	if info != nil {
+		a.Thumbnails = s.storeThumbnails(ctx, a.SHA256, mediaType, body, info)
+	}
+	if _, err := s.attach(ctx, &a, up, true); err != nil {
+		// The quota was reached meanwhile. Nothing references the content
+		// yet, and the lock keeps others from attaching it.
+		var quota *QuotaError
+		if errors.As(err, &quota) {
+			s.deleteContent(ctx, a.SHA256, a.Thumbnails)
+		}
+		return models.Attachment{}, err
+	}
+	metrics.Attachments.Add("stored", 1)
+	return a, nil
+}
+
+// scan checks new content, quarantining it when it is flagged.
+func (s *Store) scan(ctx context.Context, a models.Attachment, body []byte) error {
+	if s.scanner == nil {
+		return nil
+	}
+	scanCtx, cancel := context.WithTimeout(ctx, s.scanTimeout)
+	defer cancel()
+	verdict, err := s.scanner.Scan(scanCtx, a.Name, a.ContentType, body)
+	if err != nil {
+		metrics.Attachments.Add("scan_failed", 1)
+		if s.failOpen {
+			log.Printf("[Attachments] Failed to scan %s, storing it unscanned: %v", a.SHA256, err)
+			return nil
+		}
+		log.Printf("[Attachments] Failed to scan %s: %v", a.SHA256, err)
+		return ErrScanFailed
+	}
+	if !verdict.Infected {
+		return nil
+	}
+
+	q := Quarantined{Attachment: a, Threat: verdict.Threat}
+	if err := s.objects.Put(ctx, s.quarantineObjectKey(a.SHA256), body, a.ContentType); err != nil {
+		return fmt.Errorf("quarantine content: %w", err)
+	}
+	raw, _ := json.Marshal(q)
+	if err := s.rdb.HSet(ctx, quarantineKey, strconv.FormatInt(a.ID, 10), raw).Err(); err != nil {
+		return fmt.Errorf("quarantine content: %w", err)
+	}
+	metrics.Attachments.Add("quarantined", 1)
+	return &QuarantineError{File: q}
+}
+
+// Quarantined lists the quarantined files, oldest first.
+func (s *Store) Quarantined(ctx context.Context) ([]Quarantined, error) {
+	entries, err := s.rdb.HVals(ctx, quarantineKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]Quarantined, 0, len(entries))
+	for _, raw := range entries {
+		var q Quarantined
+		if err := json.Unmarshal([]byte(raw), &q); err != nil {
+			log.Printf("[Attachments] Skipping invalid quarantine entry: %v", err)
+			continue
+		}
+		files = append(files, q)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files, nil
+}
+
+// storeThumbnails scales a new image down to the configured sizes it is
+// larger than and returns the sizes stored. Thumbnails are a convenience:
+// one that can't be made or stored is only left out.
+func (s *Store) storeThumbnails(ctx context.Context, digest, mediaType string, body []byte, info *imageInfo) []int {
+	var sizes []int
+	for _, size := range s.thumbnails {
+		if size < max(info.Width, info.Height) {
+			sizes = append(sizes, size)
+		}
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+	img, err := decodeImage(mediaType, body, info)
+	if err != nil || img == nil {
+		if err != nil {
+			log.Printf("[Attachments] Failed to decode %s for thumbnails: %v", digest, err)
+		}
+		return nil
+	}
+	var stored []int
+	for _, size := range sizes {
+		thumb, err := thumbnail(img, size, mediaType)
+		if err == nil {
+			err = s.objects.Put(ctx, s.thumbnailKey(digest, size), thumb, thumbnailType(mediaType))
+		}
+		if err != nil {
+			log.Printf("[Attachments] Failed to store the %d thumbnail of %s: %v", size, digest, err)
+			continue
+		}
+		stored = append(stored, size)
+	}
+	metrics.Attachments.Add("thumbnails", int64(len(stored)))
+	return stored
+}
+
+// attach records a and sets its thumbnails to its content's.
+func (s *Store) attach(ctx context.Context, a *models.Attachment, up Uploader, stored bool) (bool, error) {
+	flag := "0"
+	if stored {
+		flag = "1"
+	}
+	owner := ""
+	if up.ID != 0 {
+		owner = strconv.FormatInt(up.ID, 10)
+	}
+	thumbnails, err := attachScript.Run(ctx, s.rdb, []string{attachmentKey(a.ID), blobKey(a.SHA256), usageKey},
+		flag, a.Size, formatSizes(a.Thumbnails), owner, up.Quota,
+		"name", a.Name,
+		"content_type", a.ContentType,
+		"size", a.Size,
+		"sha256", a.SHA256,
+		"uploaded_at", a.UploadedAt,
+		"width", a.Width,
+		"height", a.Height,
+	).Text()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		if used, ok := strings.CutPrefix(err.Error(), "QUOTA "); ok {
+			n, _ := strconv.ParseInt(used, 10, 64)
+			return false, &QuotaError{Used: n, Quota: up.Quota}
+		}
+		return false, err
+	}
+	a.Thumbnails = parseSizes(thumbnails)
+	return true, nil
+}
+
+// Get returns an attachment's description.
+func (s *Store) Get(ctx context.Context, id int64) (models.Attachment, error) {
+	fields, err := s.rdb.HGetAll(ctx, attachmentKey(id)).Result()
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	if len(fields) == 0 {
+		return models.Attachment{}, ErrNotFound
+	}
+	size, _ := strconv.ParseInt(fields["size"], 10, 64)
+	width, _ := strconv.Atoi(fields["width"])
+	height, _ := strconv.Atoi(fields["height"])
+	return models.Attachment{
+		ID:          id,
+		Name:        fields["name"],
+		ContentType: fields["content_type"],
+		Size:        size,
+		SHA256:      fields["sha256"],
+		UploadedAt:  fields["uploaded_at"],
+		Width:       width,
+		Height:      height,
+		Thumbnails:  parseSizes(fields["thumbnails"]),
+	}, nil
+}
+
+// Open reads an attachment's content.
+func (s *Store) Open(ctx context.Context, a models.Attachment) ([]byte, error) {
+	body, err := s.objects.Get(ctx, s.objectKey(a.SHA256))
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return body, err
+}
+
+// OpenThumbnail reads an attachment's thumbnail of size, and returns its
+// content type.
+func (s *Store) OpenThumbnail(ctx context.Context, a models.Attachment, size int) ([]byte, string, error) {
+	if !a.HasThumbnail(size) {
+		return nil, "", ErrNotFound
+	}
+	mediaType, _, _ := mime.ParseMediaType(a.ContentType)
+	body, err := s.objects.Get(ctx, s.thumbnailKey(a.SHA256, size))
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil, "", ErrNotFound
+	}
+	return body, thumbnailType(mediaType), err
+}
+
+// Delete deletes an attachment, and its content once no other attachment
+// references it.
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	a, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	refs, err := releaseScript.Run(ctx, s.rdb, []string{attachmentKey(id), blobKey(a.SHA256), usageKey}).Int64()
+	if err != nil {
+		return err
+	}
+	if refs < 0 {
+		return ErrNotFound
+	}
+	if refs > 0 {
+		return nil
+	}
+
+	unlock, err := s.lock(ctx, a.SHA256)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	thumbnails, err := purgeScript.Run(ctx, s.rdb, []string{blobKey(a.SHA256)}).Text()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.deleteContent(ctx, a.SHA256, parseSizes(thumbnails)) {
+		metrics.Attachments.Add("purged", 1)
+	}
+	return nil
+}
+
+// deleteContent deletes a content and its thumbnails, reporting whether
+// the content went. What can't be deleted is only leaked storage, so it is
+// logged.
+func (s *Store) deleteContent(ctx context.Context, digest string, thumbnails []int) bool {
+	for _, size := range thumbnails {
+		if err := s.objects.Delete(ctx, s.thumbnailKey(digest, size)); err != nil {
+			log.Printf("[Attachments] Failed to delete the %d thumbnail of %s: %v", size, digest, err)
+		}
+	}
+	if err := s.objects.Delete(ctx, s.objectKey(digest)); err != nil {
+		log.Printf("[Attachments] Failed to delete content %s: %v", digest, err)
+		return false
+	}
+	return true
+}
+
+// lock takes the lock of a content, waiting for whoever holds it, and
+// returns its release.
+func (s *Store) lock(ctx context.Context, digest string) (func(), error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b[:])
+	key := lockPrefix + digest
+	for {
+		ok, err := s.rdb.SetNX(ctx, key, token, lockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+	return func() {
+		// The caller's context may be done; the lock must still go.
+		if err := unlockScript.Run(context.Background(), s.rdb, []string{key}, token).Err(); err != nil {
+			log.Printf("[Attachments] Failed to release the lock of %s: %v", digest, err)
+		}
+	}, nil
+}
+
+func (s *Store) objectKey(digest string) string {
+	return s.prefix + "attachments/" + digest[:2] + "/" + digest
+}
+
+func (s *Store) thumbnailKey(digest string, size int) string {
+	return s.prefix + "thumbnails/" + digest[:2] + "/" + digest + "/" + strconv.Itoa(size)
+}
+
+// quarantineObjectKey keeps flagged content away from the attachments, so
+// no attachment can reach it.
+func (s *Store) quarantineObjectKey(digest string) string {
+	return s.prefix + "quarantine/" + digest
+}
+
+func attachmentKey(id int64) string {
+	return attachmentPrefix + strconv.FormatInt(id, 10)
+}
+
+func blobKey(digest string) string {
+	return blobPrefix + digest
+}
+
+func formatSizes(sizes []int) string {
+	parts := make([]string, len(sizes))
+	for i, size := range sizes {
+		parts[i] = strconv.Itoa(size)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseSizes(s string) []int {
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		if size, err := strconv.Atoi(part); err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
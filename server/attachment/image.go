@@ -0,0 +1,285 @@
+package attachment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// maxPixels bounds the images decoded for thumbnails and rotation, so
+	// a small file can't claim a huge canvas.
+	maxPixels = 40_000_000
+
+	jpegQuality = 90
+)
+
+var ErrInvalidImage = errors.New("the image can't be read")
+
+// imageInfo is what processing learned about an image.
+type imageInfo struct {
+	Width, Height int
+}
+
+// processImage strips the metadata of JPEG and PNG images, which carry
+// the camera, the time and often the place a photo was taken, and
+// measures images. Metadata is stripped losslessly, except that a JPEG
+// with an EXIF orientation other than upright is re-encoded upright,
+// since the orientation goes with the EXIF data. Other types are returned
+// as they are, with a nil info.
+func processImage(contentType string, body []byte) ([]byte, *imageInfo, error) {
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		body, err = stripJPEG(body)
+	case "image/png":
+		body, err = stripPNG(body)
+	case "image/gif":
+	default:
+		return body, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, ErrInvalidImage
+	}
+	return body, &imageInfo{Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+// stripJPEG drops the APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments, keeping the JFIF, ICC profile and Adobe segments decoders
+// need for colors.
+func stripJPEG(body []byte) ([]byte, error) {
+	if len(body) < 4 || body[0] != 0xFF || body[1] != 0xD8 {
+		return nil, ErrInvalidImage
+	}
+	out := append(make([]byte, 0, len(body)), 0xFF, 0xD8)
+	orientation := 1
+	rest := body[2:]
+	for {
+		if len(rest) < 4 || rest[0] != 0xFF {
+			return nil, ErrInvalidImage
+		}
+		marker := rest[1]
+		// The scan's entropy-coded data follows start of scan; nothing
+		// after it is metadata.
+		if marker == 0xDA {
+			out = append(out, rest...)
+			break
+		}
+		n := int(binary.BigEndian.Uint16(rest[2:4])) + 2
+		if n < 4 || n > len(rest) {
+			return nil, ErrInvalidImage
+		}
+		switch marker {
+		case 0xE1:
+			if o := exifOrientation(rest[4:n]); o != 0 {
+				orientation = o
+			}
+		case 0xED, 0xFE:
+		default:
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	if orientation == 1 {
+		return out, nil
+	}
+	return orientJPEG(out, orientation)
+}
+
+// exifOrientation reads the orientation tag of an APP1 segment, or
+// returns 0 when it has none.
+func exifOrientation(segment []byte) int {
+	if !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := segment[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			o := int(order.Uint16(tiff[e+8:]))
+			if o < 1 || o > 8 {
+				return 0
+			}
+			return o
+		}
+	}
+	return 0
+}
+
+// orientJPEG re-encodes an image turned as EXIF orientation o says. An
+// image too large to decode is left as it is, turned.
+func orientJPEG(body []byte, o int) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return body, nil
+	}
+	src, err := jpeg.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(src, o), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orient applies EXIF orientation o: 2-4 mirror or turn the image half
+// way, and 5-8 swap its width and height.
+func orient(src image.Image, o int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// stripPNG drops the text, time and EXIF chunks.
+func stripPNG(body []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(body, []byte(signature)) {
+		return nil, ErrInvalidImage
+	}
+	out := append(make([]byte, 0, len(body)), signature...)
+	rest := body[len(signature):]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, ErrInvalidImage
+		}
+		n := int(binary.BigEndian.Uint32(rest)) + 12
+		if n < 12 || n > len(rest) {
+			return nil, ErrInvalidImage
+		}
+		switch string(rest[4:8]) {
+		case "tEXt", "zTXt", "iTXt", "tIME", "eXIf":
+		default:
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	return out, nil
+}
+
+// thumbnail scales an image down so its longer side is size, averaging
+// the pixels each thumbnail pixel covers. JPEG images get JPEG thumbnails,
+// and others PNG ones, which keep transparency.
+func thumbnail(src image.Image, size int, contentType string) ([]byte, error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := b.Min.Y+ty*h/th, b.Min.Y+max((ty+1)*h/th, ty*h/th+1)
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := b.Min.X+tx*w/tw, b.Min.X+max((tx+1)*w/tw, tx*w/tw+1)
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := src.At(x, y).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(tx, ty)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// thumbnailType is the content type of an image's thumbnails.
+func thumbnailType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// decodeImage decodes an image for thumbnails, or returns nil when it is
+// too large.
+func decodeImage(contentType string, body []byte, info *imageInfo) (image.Image, error) {
+	if info.Width*info.Height > maxPixels {
+		return nil, nil
+	}
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Decode(bytes.NewReader(body))
+	case "image/png":
+		return png.Decode(bytes.NewReader(body))
+	}
+	return gif.Decode(bytes.NewReader(body))
+}
@@ -0,0 +1,68 @@
+package attachment
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Uploader is who an upload counts against. A zero ID counts against no
+// one, and a zero Quota is unlimited.
+type Uploader struct {
+	ID    int64
+	Quota int64
+}
+
+// QuotaError is returned for an upload that would take its uploader past
+// their quota.
+type QuotaError struct {
+	Used, Quota int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("attachment quota exceeded: %d of %d bytes used", e.Used, e.Quota)
+}
+
+// Usage returns the bytes of a user's attachments.
+func (s *Store) Usage(ctx context.Context, userID int64) (int64, error) {
+	used, err := s.rdb.HGet(ctx, usageKey, strconv.FormatInt(userID, 10)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return used, err
+}
+
+// QuotaOverride returns the quota an admin set a user, if any.
+func (s *Store) QuotaOverride(ctx context.Context, userID int64) (int64, bool, error) {
+	quota, err := s.rdb.HGet(ctx, quotaKey, strconv.FormatInt(userID, 10)).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	return quota, err == nil, err
+}
+
+// SetQuotaOverride gives a user their own quota; zero is unlimited.
+func (s *Store) SetQuotaOverride(ctx context.Context, userID, quota int64) error {
+	return s.rdb.HSet(ctx, quotaKey, strconv.FormatInt(userID, 10), quota).Err()
+}
+
+// ClearQuotaOverride puts a user back on the default quota.
+func (s *Store) ClearQuotaOverride(ctx context.Context, userID int64) error {
+	return s.rdb.HDel(ctx, quotaKey, strconv.FormatInt(userID, 10)).Err()
+}
+
+func (s *Store) checkQuota(ctx context.Context, up Uploader, size int64) error {
+	if up.ID == 0 || up.Quota <= 0 {
+		return nil
+	}
+	used, err := s.Usage(ctx, up.ID)
+	if err != nil {
+		return err
+	}
+	if used+size > up.Quota {
+		return &QuotaError{Used: used, Quota: up.Quota}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package attachment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrURLExpired       = errors.New("the URL has expired")
+)
+
+// SignPath returns a download path with its expiry and an HMAC over both
+// as query parameters, so any server holding the key can check it without
+// a lookup.
+func SignPath(key []byte, path string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return path + "?expires=" + exp + "&signature=" + base64.RawURLEncoding.EncodeToString(signature(key, path, exp))
+}
+
+// VerifyPath checks the signature and expiry of a download request. The
+// URL is still accepted skew after it expired, for clocks that differ
+// between servers.
+func VerifyPath(key []byte, path string, query url.Values, now time.Time, skew time.Duration) error {
+	exp := query.Get("expires")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	got, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(got, signature(key, path, exp)) {
+		return ErrInvalidSignature
+	}
+	if now.After(time.Unix(expires, 0).Add(skew)) {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+func signature(key []byte, path, expires string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(path + "\n" + expires))
+	return h.Sum(nil)
+}
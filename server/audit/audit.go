@@ -0,0 +1,91 @@
+// Package audit keeps the audit log: a record of moderation commands and
+// lockouts, kept in Redis so the entries of every server and gateway end up
+// in one place. The log holds the latest maxEntries entries.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	logKey     = "chat:audit"
+	maxEntries = 10000
+)
+
+// Entry types.
+const (
+	TypeModeration = "moderation"
+	TypeLockout    = "lockout"
+)
+
+// Entry is one audited event. Action is the control command type of a
+// moderation entry and "locked_out" for a lockout. Subject is the username
+// a moderation command targeted, or the locked out subject, such as
+// "ip:203.0.113.7" or "mqtt:alice".
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Action  string    `json:"action"`
+	Subject string    `json:"subject"`
+	UserID  int64     `json:"user_id,string,omitempty"`
+	// Origin is the address of the server that recorded the entry.
+	Origin string `json:"origin,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Log appends to and reads the audit log. A nil *Log drops entries, for
+// processes without Redis.
+type Log struct {
+	rdb    redis.UniversalClient
+	origin string
+}
+
+func New(rdb redis.UniversalClient, origin string) *Log {
+	return &Log{rdb: rdb, origin: origin}
+}
+
+// Record appends e to the log, stamped with the time and this process's
+// origin. Failing to record is logged rather than failing the action
+// audited, which has already happened.
+func (l *Log) Record(ctx context.Context, e Entry) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Origin = l.origin
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[Audit] failed to encode a %s entry: %v", e.Type, err)
+		return
+	}
+	_, err = l.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, logKey, b)
+		pipe.LTrim(ctx, logKey, 0, maxEntries-1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Audit] failed to record %s '%s' of '%s': %v", e.Type, e.Action, e.Subject, err)
+	}
+}
+
+// Recent returns up to limit entries, newest first.
+func (l *Log) Recent(ctx context.Context, limit int) ([]Entry, error) {
+	raw, err := l.rdb.LRange(ctx, logKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(raw))
+	for _, r := range raw {
+		var e Entry
+		if err := json.Unmarshal([]byte(r), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
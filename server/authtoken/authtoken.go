@@ -0,0 +1,118 @@
+// Package authtoken signs and verifies the JWTs that admit users to /ws.
+// Another service holding the shared secret mints them, so it decides who
+// may connect and how: a token names its user and can narrow the rooms it
+// may join, what it may do there and its message rate. Only HS256 is
+// accepted.
+package authtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeRead receives the room's messages; ScopeSend posts to it.
+	ScopeRead = "read"
+	ScopeSend = "send"
+)
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token has expired")
+)
+
+// header is the only JOSE header signed and accepted.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims is the payload of a token. Rooms and Scope only ever narrow what
+// the user could do without a token.
+type Claims struct {
+	// Subject is the username.
+	Subject string `json:"sub"`
+	// Rooms the token may join; empty allows every room.
+	Rooms []string `json:"rooms,omitempty"`
+	// Scope is a space-separated list of ScopeRead and ScopeSend; empty
+	// allows both.
+	Scope string `json:"scope,omitempty"`
+	// Tier picks one of the config's rate tiers instead of the regular
+	// message rate limit.
+	Tier string `json:"tier,omitempty"`
+	// Expires, NotBefore and IssuedAt are Unix timestamps. Expires is
+	// required, so every token is short-lived.
+	Expires   int64 `json:"exp"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+}
+
+func (c Claims) Allows(scope string) bool {
+	return c.Scope == "" || slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+func (c Claims) AllowsRoom(room string) bool {
+	return len(c.Rooms) == 0 || slices.Contains(c.Rooms, room)
+}
+
+// Sign encodes c as a compact HS256 JWT.
+func Sign(secret []byte, c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac(secret, signed)), nil
+}
+
+// Verify checks the signature and validity period of token and returns its
+// claims.
+func Verify(secret []byte, token string, now time.Time) (Claims, error) {
+	var c Claims
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return c, ErrInvalid
+	}
+	signed, sig := token[:i], token[i+1:]
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(secret, signed)) {
+		return c, ErrInvalid
+	}
+	h, encoded, ok := strings.Cut(signed, ".")
+	if !ok || !validHeader(h) {
+		return c, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return c, ErrInvalid
+	}
+	if err := json.Unmarshal(payload, &c); err != nil || c.Subject == "" || c.Expires == 0 {
+		return c, ErrInvalid
+	}
+	if now.Unix() >= c.Expires || now.Unix() < c.NotBefore {
+		return c, ErrExpired
+	}
+	return c, nil
+}
+
+// validHeader accepts any HS256 header, since other JWT libraries order or
+// extend it differently.
+func validHeader(encoded string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(b, &h) == nil && h.Alg == "HS256"
+}
+
+func mac(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"lukagolubovic/objectstore"
+)
+
+const filePrefix = "chat-"
+
+// Snapshot writes a consistent copy of db to dest using VACUUM INTO, which
+// runs as a read transaction and never blocks the writer.
+func Snapshot(db *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("backup destination %s already exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	_, err := db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// SnapshotToDir writes a timestamped snapshot into dir and returns its path.
+func SnapshotToDir(db *sql.DB, dir string) (string, error) {
+	name := filePrefix + time.Now().UTC().Format("20060102T150405.000Z") + ".db"
+	dest := filepath.Join(dir, name)
+	return dest, Snapshot(db, dest)
+}
+
+// Restore replaces the database at dbPath with the snapshot at src. The
+// server using dbPath must be stopped first.
+func Restore(src, dbPath string) error {
+	if err := Verify(src); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dbPath + ".restore"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Stale WAL files would be replayed on top of the restored database.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, dbPath)
+}
+
+// Verify checks that path is a readable SQLite database that passes
+// PRAGMA integrity_check.
+func Verify(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("%s is not a valid database: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s failed integrity check: %s", path, result)
+	}
+	return nil
+}
+
+// Destination is where snapshots are kept: Dir on the server, or Store,
+// such as an S3 bucket, under Prefix when it is set.
+type Destination struct {
+	Dir    string
+	Store  objectstore.Store
+	Prefix string
+}
+
+// Snapshot takes a snapshot and returns its path, or its object key. A
+// snapshot for the object store is taken into a temporary directory, then
+// uploaded in parts.
+func (d Destination) Snapshot(ctx context.Context, db *sql.DB) (string, error) {
+	if d.Store == nil {
+		return SnapshotToDir(db, d.Dir)
+	}
+	tmpDir, err := os.MkdirTemp("", "chat-backup")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := SnapshotToDir(db, tmpDir)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key := d.keyPrefix() + filepath.Base(path)
+	if err := d.Store.Upload(ctx, key, f, "application/vnd.sqlite3"); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Rotate takes a snapshot and keeps only the newest keep snapshots. It is
+// what scheduled backups run.
+func (d Destination) Rotate(ctx context.Context, db *sql.DB, keep int) error {
+	where, err := d.Snapshot(ctx, db)
+	if err != nil {
+		return fmt.Errorf("scheduled backup: %w", err)
+	}
+	log.Printf("[Backup] Wrote %s\n", where)
+
+	if d.Store != nil {
+		err = d.pruneStore(ctx, keep)
+	} else {
+		err = prune(d.Dir, keep)
+	}
+	if err != nil {
+		log.Printf("[Backup] Failed to prune old backups: %v", err)
+	}
+	return nil
+}
+
+func (d Destination) keyPrefix() string {
+	return d.Prefix + "backups/"
+}
+
+func (d Destination) pruneStore(ctx context.Context, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	keys, err := d.Store.List(ctx, d.keyPrefix()+filePrefix)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".db") {
+			names = append(names, key)
+		}
+	}
+	for len(names) > keep {
+		if err := d.Store.Delete(ctx, names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+func prune(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filePrefix) && strings.HasSuffix(e.Name(), ".db") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+	"lukagolubovic/middleware"
+	"lukagolubovic/webhook"
+)
+
+type ChatServerInfo struct {
+	Address      string `json:"address"`
+	Load         int    `json:"load"`
+	AdminAddress string `json:"admin_address,omitempty"`
+	// Pending counts clients sent to the server that it hasn't reported
+	// yet; it is only filled in by /servers.
+	Pending int `json:"pending,omitempty"`
+	// Assignment identifies this /get answer. Clients pass it to the server
+	// as the assignment query parameter of /ws, and the server hands it
+	// back to the load balancer with its next load report.
+	Assignment string `json:"assignment,omitempty"`
+
+	// assigned holds the pending clients, oldest first.
+	assigned []assignment
+	// failures counts the health checks failed in a row.
+	failures int
+}
+
+// assignment is a client sent to a server by /get.
+type assignment struct {
+	id string
+	at time.Time
+}
+
+// assignmentTTL is how long an assignment counts towards a server's load
+// without the server reporting the connection, e.g. when the client never
+// connects.
+const assignmentTTL = 10 * time.Second
+
+// effectiveLoad is the reported load plus the assignments still pending,
+// dropping expired ones.
+func (s *ChatServerInfo) effectiveLoad(now time.Time) int {
+	expired := 0
+	for expired < len(s.assigned) && now.Sub(s.assigned[expired].at) > assignmentTTL {
+		if id := s.assigned[expired].id; id != "" {
+			log.Printf("[LB] Assignment %s to %s was abandoned\n", id, s.Address)
+		}
+		expired++
+	}
+	metrics.LBAssignments.Add("abandoned", int64(expired))
+	s.assigned = s.assigned[expired:]
+	return s.Load + len(s.assigned)
+}
+
+// reported applies a load report. The assignment the server named, if
+// any, has connected, whether it was issued to this server or, as elsewhere
+// reports, to another; other connections the load grew by are taken to be
+// the oldest pending clients arriving.
+func (s *ChatServerInfo) reported(load int, id string, now time.Time, elsewhere func(id string) bool) {
+	grown := load - s.Load
+	s.Load = load
+	if id != "" && (s.connected(id, now) || elsewhere(id)) {
+		grown--
+	}
+	if grown > 0 {
+		n := min(grown, len(s.assigned))
+		metrics.LBAssignments.Add("unattributed", int64(n))
+		s.assigned = s.assigned[n:]
+	}
+}
+
+// connected removes the pending assignment id, if there is one, recording
+// how long its client took to connect.
+func (s *ChatServerInfo) connected(id string, now time.Time) bool {
+	for i, a := range s.assigned {
+		if a.id == id {
+			recordTimeToConnect(now.Sub(a.at))
+			s.assigned = append(s.assigned[:i:i], s.assigned[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func recordTimeToConnect(d time.Duration) {
+	metrics.LBAssignments.Add("connected", 1)
+	switch {
+	case d < 250*time.Millisecond:
+		metrics.LBTimeToConnect.Add("under_250ms", 1)
+	case d < time.Second:
+		metrics.LBTimeToConnect.Add("under_1s", 1)
+	case d < 5*time.Second:
+		metrics.LBTimeToConnect.Add("under_5s", 1)
+	default:
+		metrics.LBTimeToConnect.Add("under_10s", 1)
+	}
+}
+
+// AdminURL is the base URL of the server's admin API: its control-plane
+// listener if it registered one, otherwise its public address over HTTP.
+func (s ChatServerInfo) AdminURL() (string, error) {
+	if s.AdminAddress != "" {
+		return strings.TrimSuffix(s.AdminAddress, "/"), nil
+	}
+	u, err := url.Parse(s.Address)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = ""
+	return u.String(), nil
+}
+
+// Strategies for picking the server of a new client, as named by the load
+// balancer's -strategy flag.
+const (
+	// StrategyTwoChoices compares two of the least loaded servers, see
+	// pick. It is the default.
+	StrategyTwoChoices = "two-choices"
+	// StrategyLeastLoaded always picks the least loaded server.
+	StrategyLeastLoaded = "least-loaded"
+	// StrategyRoundRobin takes the servers in turn, whatever their load.
+	StrategyRoundRobin = "round-robin"
+)
+
+// Options are the load balancer's startup settings, from its flags.
+type Options struct {
+	// Strategy is one of the Strategy constants; empty is
+	// StrategyTwoChoices.
+	Strategy string
+	// Registry keeps the pool across restarts; nil keeps it in memory.
+	Registry Registry
+	// Transport carries health checks and shutdown notices, and may be
+	// nil.
+	Transport http.RoundTripper
+	// Secret is the -auth-secret, presented to servers with shutdown
+	// notices.
+	Secret string
+}
+
+func (o Options) Validate() error {
+	switch o.Strategy {
+	case "", StrategyTwoChoices, StrategyLeastLoaded, StrategyRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("strategy %q must be %s, %s or %s", o.Strategy, StrategyTwoChoices, StrategyLeastLoaded, StrategyRoundRobin)
+}
+
+type LoadBalancer struct {
+	mu      sync.Mutex
+	servers map[string]*ChatServerInfo
+	peak    int
+	peakAt  time.Time
+	samples []loadSample
+	hooks   *webhook.Dispatcher
+	cfg     *config.Store
+	opts    Options
+	// lastAdvice is the advice last sent as a webhook.
+	lastAdvice ScaleAdvice
+	// turn is the round-robin position.
+	turn int
+	// draining holds the servers that deregistered, with the time they
+	// did, so their load reports don't add them back; only /register does.
+	draining map[string]time.Time
+
+	saveMu sync.Mutex
+}
+
+// ClusterStats is the cluster-wide connection summary served from /stats.
+// The peak is kept in memory, so it covers the load balancer's uptime.
+type ClusterStats struct {
+	Servers         int       `json:"servers"`
+	Connections     int       `json:"connections"`
+	PeakConnections int       `json:"peak_connections"`
+	PeakAt          time.Time `json:"peak_at"`
+}
+
+// New returns an empty pool. hooks, which may be nil, is notified when
+// servers join or leave it; cfg supplies the scaling thresholds and
+// server selection settings.
+func New(hooks *webhook.Dispatcher, cfg *config.Store, opts Options) *LoadBalancer {
+	return &LoadBalancer{
+		servers:  make(map[string]*ChatServerInfo),
+		draining: make(map[string]time.Time),
+		hooks:    hooks,
+		cfg:      cfg,
+		opts:     opts,
+	}
+}
+
+func (lb *LoadBalancer) RegisterServer(w http.ResponseWriter, r *http.Request) {
+	s, ok := decodeRegistration(w, r)
+	if !ok {
+		return
+	}
+	lb.mu.Lock()
+	lb.servers[s.Address] = &ChatServerInfo{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress}
+	delete(lb.draining, s.Address)
+	lb.mu.Unlock()
+	log.Printf("[LB] Registered server %s with initial load %d\n", s.Address, s.Load)
+	lb.persist()
+	lb.hooks.Emit(webhook.EventServerRegistered, ChatServerInfo{Address: s.Address, Load: s.Load})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (lb *LoadBalancer) UpdateServer(w http.ResponseWriter, r *http.Request) {
+	s, ok := decodeRegistration(w, r)
+	if !ok {
+		return
+	}
+	lb.mu.Lock()
+	existing, known := lb.servers[s.Address]
+	_, drained := lb.draining[s.Address]
+	if known {
+		now := time.Now()
+		existing.reported(s.Load, s.Assignment, now, func(id string) bool { return lb.failedOver(id, now) })
+		existing.AdminAddress = s.AdminAddress
+	} else if !drained {
+		lb.servers[s.Address] = &ChatServerInfo{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress}
+	}
+	lb.recordPeak()
+	lb.mu.Unlock()
+	if drained {
+		// A draining server keeps reporting as its clients leave.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	log.Printf("[LB] Updated server %s load to %d\n", s.Address, s.Load)
+	// An update from an unknown server re-adds it, e.g. after a restart of
+	// the load balancer, unless it deregistered.
+	if !known {
+		lb.hooks.Emit(webhook.EventServerRegistered, ChatServerInfo{Address: s.Address, Load: s.Load})
+		lb.persist()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (lb *LoadBalancer) DeregisterServer(w http.ResponseWriter, r *http.Request) {
+	s, ok := decodeRegistration(w, r)
+	if !ok {
+		return
+	}
+	lb.mu.Lock()
+	_, known := lb.servers[s.Address]
+	delete(lb.servers, s.Address)
+	lb.drained(s.Address, time.Now())
+	lb.mu.Unlock()
+	log.Printf("[LB] Deregistered server %s\n", s.Address)
+	if known {
+		lb.hooks.Emit(webhook.EventServerDeregistered, ChatServerInfo{Address: s.Address})
+		lb.persist()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxDraining bounds how many deregistered servers are remembered, as
+// addresses of drained pods are rarely reused.
+const maxDraining = 1024
+
+// drained remembers a deregistered server, forgetting the one deregistered
+// longest ago once maxDraining are remembered.
+//
+// drained must be called with lb.mu held.
+func (lb *LoadBalancer) drained(address string, now time.Time) {
+	if len(lb.draining) >= maxDraining {
+		oldest, at := "", now
+		for a, t := range lb.draining {
+			if t.Before(at) {
+				oldest, at = a, t
+			}
+		}
+		delete(lb.draining, oldest)
+	}
+	lb.draining[address] = now
+}
+
+// GetServer names the server a new client should connect to, or with
+// CandidatesMediaType in the Accept header, the servers to try in order.
+func (lb *LoadBalancer) GetServer(w http.ResponseWriter, r *http.Request) {
+	count, listed, err := wantsCandidates(r)
+	if err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid count", err)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if len(lb.servers) == 0 {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "no available servers")
+		return
+	}
+
+	now := time.Now()
+	bestServer := lb.pick(now)
+	if bestServer == nil {
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "could not determine best server")
+		return
+	}
+	// The request id doubles as the assignment id, so the access log line
+	// of the /get can be found from the server's report.
+	id := middleware.RequestID(r)
+	bestServer.assigned = append(bestServer.assigned, assignment{id: id, at: now})
+	metrics.LBAssignments.Add("issued", 1)
+
+	log.Printf("[LB] Directing client to server %s (load=%d, pending=%d, assignment=%s)\n", bestServer.Address, bestServer.Load, len(bestServer.assigned), id)
+	var body interface{}
+	if listed {
+		w.Header().Set("Content-Type", CandidatesMediaType)
+		body = Candidates{Assignment: id, Servers: lb.candidates(bestServer, count, now)}
+	} else {
+		// Clients only need the public address; the control plane stays
+		// private.
+		w.Header().Set("Content-Type", "application/json")
+		body = ChatServerInfo{Address: bestServer.Address, Load: bestServer.Load, Assignment: id}
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		apierror.WriteDetails(w, http.StatusInternalServerError, apierror.CodeInternal, "failed to encode response", err.Error())
+	}
+}
+
+// pick chooses the server for a new client. By default that is two servers
+// drawn at random from the least loaded ones, preferring the lighter only
+// when it is lighter by more than the configured margin. Always picking the
+// least loaded would send every client to a newly registered, empty server
+// until its reports caught up. Servers report load when clients connect,
+// so clients sent since the last report count too.
+//
+// pick must be called with lb.mu held.
+func (lb *LoadBalancer) pick(now time.Time) *ChatServerInfo {
+	cfg := lb.cfg.Get().LoadBalancer
+
+	servers := make([]*ChatServerInfo, 0, len(lb.servers))
+	loads := make(map[*ChatServerInfo]int, len(lb.servers))
+	for _, s := range lb.servers {
+		servers = append(servers, s)
+		loads[s] = s.effectiveLoad(now)
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	if lb.opts.Strategy == StrategyRoundRobin {
+		sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+		lb.turn = (lb.turn + 1) % len(servers)
+		return servers[lb.turn]
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if loads[servers[i]] != loads[servers[j]] {
+			return loads[servers[i]] < loads[servers[j]]
+		}
+		return servers[i].Address < servers[j].Address
+	})
+
+	if lb.opts.Strategy == StrategyLeastLoaded {
+		return servers[0]
+	}
+	candidates := servers[:min(cfg.Choices, len(servers))]
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	first, second := candidates[i], candidates[j]
+	if loads[second]+cfg.LoadMargin < loads[first] {
+		return second
+	}
+	return first
+}
+
+func (lb *LoadBalancer) ListServers(w http.ResponseWriter, r *http.Request) {
+	lb.mu.Lock()
+	now := time.Now()
+	servers := make([]ChatServerInfo, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		info := ChatServerInfo{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress}
+		info.Pending = s.effectiveLoad(now) - s.Load
+		servers = append(servers, info)
+	}
+	lb.mu.Unlock()
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
+
+// recordPeak must be called with lb.mu held.
+func (lb *LoadBalancer) recordPeak() {
+	if total := lb.totalLoad(); total > lb.peak {
+		lb.peak = total
+		lb.peakAt = time.Now().UTC()
+	}
+}
+
+func (lb *LoadBalancer) totalLoad() int {
+	total := 0
+	for _, s := range lb.servers {
+		total += s.Load
+	}
+	return total
+}
+
+func (lb *LoadBalancer) Stats(w http.ResponseWriter, r *http.Request) {
+	lb.mu.Lock()
+	stats := ClusterStats{
+		Servers:         len(lb.servers),
+		Connections:     lb.totalLoad(),
+		PeakConnections: lb.peak,
+		PeakAt:          lb.peakAt,
+	}
+	lb.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lukagolubovic/metrics"
+)
+
+// CandidatesMediaType, in the Accept header of /get, asks for Candidates
+// instead of a single server.
+const CandidatesMediaType = "application/vnd.chat.candidates+json"
+
+const (
+	// defaultCandidates is how many servers Candidates lists unless the
+	// count parameter says otherwise.
+	defaultCandidates = 3
+	maxCandidates     = 10
+)
+
+// Candidates is the /get answer for clients that can fail over on their
+// own: servers in the order to try them, the first being the one a single
+// /get would have named. The assignment is issued to the first; a client
+// connecting to another passes it all the same.
+type Candidates struct {
+	Assignment string           `json:"assignment"`
+	Servers    []ChatServerInfo `json:"servers"`
+}
+
+// wantsCandidates reports whether r accepts CandidatesMediaType, and how
+// many servers it asked for with the count query parameter.
+func wantsCandidates(r *http.Request) (n int, ok bool, err error) {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && t == CandidatesMediaType {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	n = defaultCandidates
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCandidates {
+			return 0, true, FieldError{Field: "count", Reason: fmt.Sprintf("must be between 1 and %d", maxCandidates)}
+		}
+	}
+	return n, true, nil
+}
+
+// candidates lists first and then up to n-1 other servers, least loaded
+// first.
+//
+// candidates must be called with lb.mu held.
+func (lb *LoadBalancer) candidates(first *ChatServerInfo, n int, now time.Time) []ChatServerInfo {
+	others := make([]*ChatServerInfo, 0, len(lb.servers))
+	loads := make(map[*ChatServerInfo]int, len(lb.servers))
+	for _, s := range lb.servers {
+		if s != first {
+			others = append(others, s)
+			loads[s] = s.effectiveLoad(now)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		if loads[others[i]] != loads[others[j]] {
+			return loads[others[i]] < loads[others[j]]
+		}
+		return others[i].Address < others[j].Address
+	})
+
+	// Clients only need the public addresses; the control plane stays
+	// private.
+	list := []ChatServerInfo{{Address: first.Address, Load: first.Load}}
+	for _, s := range others[:min(n-1, len(others))] {
+		list = append(list, ChatServerInfo{Address: s.Address, Load: s.Load})
+	}
+	return list
+}
+
+// failedOver handles a server reporting an assignment issued to another
+// one, as happens when a client's first candidate failed: the client is no
+// longer pending there. It reports whether the assignment was pending
+// anywhere.
+//
+// failedOver must be called with lb.mu held.
+func (lb *LoadBalancer) failedOver(id string, now time.Time) bool {
+	for _, s := range lb.servers {
+		if s.connected(id, now) {
+			metrics.LBAssignments.Add("failed_over", 1)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"lukagolubovic/metrics"
+	"lukagolubovic/webhook"
+)
+
+const (
+	// healthTimeout bounds one server's health check.
+	healthTimeout = 2 * time.Second
+	// healthFailures is how many checks in a row a server may fail before
+	// it is removed from the pool.
+	healthFailures = 3
+)
+
+// CheckHealth asks every registered server's /healthz, on its control-plane
+// address if it has one, whether it is up. Servers that failed
+// healthFailures checks in a row are removed as if they had deregistered;
+// their next load report adds them back. It is scheduled every
+// -health-interval.
+func (lb *LoadBalancer) CheckHealth(ctx context.Context) error {
+	lb.mu.Lock()
+	targets := make(map[string]string, len(lb.servers))
+	for address, s := range lb.servers {
+		if base, err := s.AdminURL(); err == nil {
+			targets[address] = base
+		}
+	}
+	lb.mu.Unlock()
+
+	client := &http.Client{Timeout: healthTimeout, Transport: lb.opts.Transport}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		healthy = make(map[string]bool, len(targets))
+	)
+	for address, base := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok := probe(ctx, client, base+"/healthz")
+			mu.Lock()
+			healthy[address] = ok
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var removed []string
+	lb.mu.Lock()
+	for address, ok := range healthy {
+		s, known := lb.servers[address]
+		if !known {
+			continue
+		}
+		if ok {
+			s.failures = 0
+			continue
+		}
+		metrics.LBHealthChecks.Add("failed", 1)
+		s.failures++
+		if s.failures >= healthFailures {
+			delete(lb.servers, address)
+			removed = append(removed, address)
+		}
+	}
+	lb.mu.Unlock()
+
+	for _, address := range removed {
+		metrics.LBHealthChecks.Add("removed", 1)
+		log.Printf("[LB] Removed server %s after %d failed health checks\n", address, healthFailures)
+		lb.hooks.Emit(webhook.EventServerDeregistered, ChatServerInfo{Address: address})
+	}
+	if len(removed) > 0 {
+		lb.persist()
+	}
+	return nil
+}
+
+func probe(ctx context.Context, client *http.Client, url string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,68 @@
+package balancer
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+	"lukagolubovic/middleware"
+	"lukagolubovic/ratelimit"
+)
+
+// Protect guards next, meant for /get, with the load_balancer settings:
+// a per-IP rate limit that blocks persistent offenders, and User-Agent
+// checks against simple bots. Settings reload with the config.
+func Protect(cfg *config.Store, next http.Handler) http.Handler {
+	limiter := ratelimit.NewKeyed()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := cfg.Get().LoadBalancer
+		if reason := checkUserAgent(c, r.UserAgent()); reason != "" {
+			metrics.LBRejections.Add("user_agent", 1)
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, reason)
+			return
+		}
+
+		ip := middleware.ClientIP(r)
+		ok, retryAfter, blocked := limiter.Allow(ip, ratelimit.KeyedLimits{
+			Rate:       c.GetPerSecond,
+			Burst:      c.GetBurst,
+			BlockAfter: c.BlockAfter,
+			BlockFor:   time.Duration(c.BlockSeconds) * time.Second,
+		})
+		if !ok {
+			if blocked {
+				log.Printf("[LB] Blocking %s for %ds after repeated rate limit violations\n", ip, c.BlockSeconds)
+				metrics.LBRejections.Add("blocked", 1)
+			} else {
+				metrics.LBRejections.Add("rate_limited", 1)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkUserAgent returns why a User-Agent is refused, or "".
+func checkUserAgent(c config.LoadBalancer, ua string) string {
+	if ua == "" {
+		if c.RequireUserAgent {
+			return "a User-Agent header is required"
+		}
+		return ""
+	}
+	lower := strings.ToLower(ua)
+	for _, blocked := range c.BlockedUserAgents {
+		if strings.Contains(lower, strings.ToLower(blocked)) {
+			return "automated clients are not allowed"
+		}
+	}
+	return ""
+}
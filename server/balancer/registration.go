@@ -0,0 +1,104 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"lukagolubovic/apierror"
+)
+
+// SchemaVersion is the version of the registration body servers send to
+// /register, /update and /deregister. Bodies without a version are treated
+// as version 1, which is what servers sent before the field existed.
+const SchemaVersion = 1
+
+const maxRegistrationSize = 4 * 1024
+
+// MaxAssignmentLen is the longest assignment id accepted, the longest
+// request id the access log keeps.
+const MaxAssignmentLen = 64
+
+// Registration is the body of /register, /update and /deregister.
+type Registration struct {
+	Version int    `json:"version"`
+	Address string `json:"address"`
+	Load    int    `json:"load"`
+	// AdminAddress is the http:// or https:// base URL of the server's
+	// control-plane listener, when it runs on a separate port.
+	AdminAddress string `json:"admin_address,omitempty"`
+	// Assignment, on /update, is the assignment id of the client whose
+	// connection the report is for, if it came from /get.
+	Assignment string `json:"assignment,omitempty"`
+}
+
+// FieldError reports which field of a request body is invalid; it is sent
+// as the details of a bad_request error.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// Validate checks the version, that the address is an absolute ws:// or
+// wss:// URL, that the optional admin address is an http:// or https:// URL,
+// and that the load is not negative.
+func (reg Registration) Validate() error {
+	if reg.Version != 0 && reg.Version != SchemaVersion {
+		return FieldError{Field: "version", Reason: fmt.Sprintf("unsupported version %d, expected %d", reg.Version, SchemaVersion)}
+	}
+	if reg.Address == "" {
+		return FieldError{Field: "address", Reason: "required"}
+	}
+	u, err := url.Parse(reg.Address)
+	if err != nil {
+		return FieldError{Field: "address", Reason: err.Error()}
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return FieldError{Field: "address", Reason: "must be a ws:// or wss:// URL"}
+	}
+	if u.Host == "" {
+		return FieldError{Field: "address", Reason: "missing host"}
+	}
+	if reg.AdminAddress != "" {
+		u, err := url.Parse(reg.AdminAddress)
+		if err != nil {
+			return FieldError{Field: "admin_address", Reason: err.Error()}
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return FieldError{Field: "admin_address", Reason: "must be an http:// or https:// URL"}
+		}
+		if u.Host == "" {
+			return FieldError{Field: "admin_address", Reason: "missing host"}
+		}
+	}
+	if reg.Load < 0 {
+		return FieldError{Field: "load", Reason: "must not be negative"}
+	}
+	if len(reg.Assignment) > MaxAssignmentLen {
+		return FieldError{Field: "assignment", Reason: fmt.Sprintf("longer than %d bytes", MaxAssignmentLen)}
+	}
+	return nil
+}
+
+// decodeRegistration reads and validates a registration body, writing a
+// bad_request error and returning false if it is malformed.
+func decodeRegistration(w http.ResponseWriter, r *http.Request) (Registration, bool) {
+	var reg Registration
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxRegistrationSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&reg); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+		return reg, false
+	}
+	if err := reg.Validate(); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid registration", err)
+		return reg, false
+	}
+	return reg, true
+}
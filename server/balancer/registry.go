@@ -0,0 +1,125 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Registry backends, as named by the load balancer's -registry flag.
+const (
+	RegistryMemory = "memory"
+	RegistryFile   = "file"
+)
+
+// Registry keeps the pool of servers across restarts of the load balancer,
+// so servers that registered before one don't have to wait for their next
+// load report to get clients again.
+type Registry interface {
+	// Load returns the servers last saved, or none.
+	Load() ([]ChatServerInfo, error)
+	Save(servers []ChatServerInfo) error
+}
+
+// FileRegistry keeps the pool in a JSON file, replaced whole on every save.
+type FileRegistry struct {
+	Path string
+}
+
+func (f FileRegistry) Load() ([]ChatServerInfo, error) {
+	b, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var servers []ChatServerInfo
+	if err := json.Unmarshal(b, &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// Save writes a temporary file next to the registry and renames it into
+// place, so a crash mid-save leaves the previous snapshot.
+func (f FileRegistry) Save(servers []ChatServerInfo) error {
+	b, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Restore adds the servers saved in the registry to the pool, with the load
+// they last had. It returns how many there were.
+func (lb *LoadBalancer) Restore() (int, error) {
+	if lb.opts.Registry == nil {
+		return 0, nil
+	}
+	servers, err := lb.opts.Registry.Load()
+	if err != nil {
+		return 0, err
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, s := range servers {
+		if (Registration{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress}).Validate() != nil {
+			continue
+		}
+		lb.servers[s.Address] = &ChatServerInfo{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress}
+	}
+	return len(lb.servers), nil
+}
+
+// SaveRegistry saves the pool, with the servers' current loads, to the
+// registry, and returns how many servers it saved. Without a registry it
+// does nothing. Saves are serialized so an older snapshot never replaces a
+// newer one.
+func (lb *LoadBalancer) SaveRegistry() (int, error) {
+	if lb.opts.Registry == nil {
+		return 0, nil
+	}
+	lb.saveMu.Lock()
+	defer lb.saveMu.Unlock()
+	servers := lb.snapshot()
+	return len(servers), lb.opts.Registry.Save(servers)
+}
+
+// persist saves the pool after a server joined or left it.
+func (lb *LoadBalancer) persist() {
+	if _, err := lb.SaveRegistry(); err != nil {
+		log.Printf("[LB] Failed to save the server registry: %v", err)
+	}
+}
+
+// snapshot lists the registered servers as the registry keeps them.
+func (lb *LoadBalancer) snapshot() []ChatServerInfo {
+	lb.mu.Lock()
+	servers := make([]ChatServerInfo, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		servers = append(servers, ChatServerInfo{Address: s.Address, Load: s.Load, AdminAddress: s.AdminAddress})
+	}
+	lb.mu.Unlock()
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+	return servers
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/webhook"
+)
+
+const (
+	ScaleUp   = "up"
+	ScaleDown = "down"
+	ScaleHold = "hold"
+)
+
+// SampleInterval is how often SampleScale should run.
+const SampleInterval = 15 * time.Second
+
+// ScaleAdvice recommends a server count for external autoscalers. It is
+// only advice: the load balancer never starts or stops servers itself.
+type ScaleAdvice struct {
+	Servers     int     `json:"servers"`
+	Connections int     `json:"connections"`
+	Capacity    int     `json:"capacity_per_server"`
+	Utilization float64 `json:"utilization"`
+	// PeakUtilization is the highest utilization over the scale-down window.
+	PeakUtilization float64 `json:"peak_utilization"`
+	Recommendation  string  `json:"recommendation"`
+	Replicas        int     `json:"replicas"`
+	Reason          string  `json:"reason"`
+}
+
+type loadSample struct {
+	at    time.Time
+	total int
+}
+
+// capacity is the connections one server is sized for, zero when advice is
+// off.
+func capacity(cfg *config.Runtime) int {
+	if cfg.Scaling.ServerCapacity > 0 {
+		return cfg.Scaling.ServerCapacity
+	}
+	return cfg.MaxConnections
+}
+
+// advise must be called with lb.mu held.
+func (lb *LoadBalancer) advise(now time.Time) (ScaleAdvice, bool) {
+	cfg := lb.cfg.Get()
+	s := cfg.Scaling
+	perServer := capacity(cfg)
+	if perServer == 0 {
+		return ScaleAdvice{}, false
+	}
+
+	a := ScaleAdvice{Servers: len(lb.servers), Connections: lb.totalLoad(), Capacity: perServer}
+	peak := a.Connections
+	window := now.Add(-time.Duration(s.DownWindowSeconds) * time.Second)
+	for _, sample := range lb.samples {
+		if !sample.at.Before(window) && sample.total > peak {
+			peak = sample.total
+		}
+	}
+	// A window not yet covered by samples can't justify scaling down.
+	windowCovered := len(lb.samples) > 0 && !lb.samples[0].at.After(window)
+
+	clamp := func(n int) int {
+		if n < s.MinServers {
+			n = s.MinServers
+		}
+		if s.MaxServers > 0 && n > s.MaxServers {
+			n = s.MaxServers
+		}
+		return n
+	}
+	// needed is the server count that puts load at the target utilization.
+	needed := func(load int) int {
+		return clamp(int(math.Ceil(float64(load) / (float64(perServer) * s.TargetUtilization))))
+	}
+
+	if a.Servers == 0 {
+		a.Recommendation, a.Replicas = ScaleUp, needed(a.Connections)
+		a.Reason = "no servers are registered"
+		return a, true
+	}
+	total := float64(a.Servers * perServer)
+	a.Utilization = float64(a.Connections) / total
+	a.PeakUtilization = float64(peak) / total
+
+	switch {
+	case a.Servers < s.MinServers:
+		a.Recommendation, a.Replicas = ScaleUp, needed(a.Connections)
+		a.Reason = fmt.Sprintf("fewer servers than min_servers (%d)", s.MinServers)
+	case a.Utilization >= s.ScaleUpAt && needed(a.Connections) > a.Servers:
+		a.Recommendation, a.Replicas = ScaleUp, needed(a.Connections)
+		a.Reason = fmt.Sprintf("utilization %.2f is at or above scale_up_at %.2f", a.Utilization, s.ScaleUpAt)
+	case a.Utilization >= s.ScaleUpAt:
+		a.Recommendation, a.Replicas = ScaleHold, a.Servers
+		a.Reason = fmt.Sprintf("utilization %.2f is high, but the cluster is at max_servers (%d)", a.Utilization, s.MaxServers)
+	case windowCovered && a.PeakUtilization <= s.ScaleDownAt && needed(peak) < a.Servers:
+		a.Recommendation, a.Replicas = ScaleDown, needed(peak)
+		a.Reason = fmt.Sprintf("utilization stayed at or below scale_down_at %.2f for %ds", s.ScaleDownAt, s.DownWindowSeconds)
+	default:
+		a.Recommendation, a.Replicas = ScaleHold, a.Servers
+		a.Reason = "utilization is within thresholds"
+	}
+	return a, true
+}
+
+// ScaleAdviceHandler serves the current advice.
+func (lb *LoadBalancer) ScaleAdviceHandler(w http.ResponseWriter, r *http.Request) {
+	lb.mu.Lock()
+	advice, ok := lb.advise(time.Now())
+	lb.mu.Unlock()
+	if !ok {
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "scale advice needs scaling.server_capacity or max_connections in the config")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(advice)
+}
+
+// SampleScale samples the total load for scale-down windows, emitting a
+// scale.advice webhook whenever scaling up or down becomes advisable or the
+// advised count changes. It is scheduled every SampleInterval.
+func (lb *LoadBalancer) SampleScale(ctx context.Context) error {
+	now := time.Now()
+	lb.mu.Lock()
+	lb.recordSample(now)
+	advice, ok := lb.advise(now)
+	last := lb.lastAdvice
+	if !ok || advice.Recommendation == ScaleHold {
+		lb.lastAdvice = ScaleAdvice{}
+	} else {
+		lb.lastAdvice = advice
+	}
+	lb.mu.Unlock()
+
+	if !ok || advice.Recommendation == ScaleHold {
+		return nil
+	}
+	if advice.Recommendation != last.Recommendation || advice.Replicas != last.Replicas {
+		log.Printf("[LB] Scale advice: %s to %d servers (%s)\n", advice.Recommendation, advice.Replicas, advice.Reason)
+		lb.hooks.Emit(webhook.EventScaleAdvice, advice)
+	}
+	return nil
+}
+
+// recordSample must be called with lb.mu held. Samples older than the
+// longest window that could be configured are dropped.
+func (lb *LoadBalancer) recordSample(now time.Time) {
+	lb.samples = append(lb.samples, loadSample{at: now, total: lb.totalLoad()})
+	keep := now.Add(-time.Duration(lb.cfg.Get().Scaling.DownWindowSeconds)*time.Second - SampleInterval)
+	i := 0
+	for i < len(lb.samples)-1 && lb.samples[i].at.Before(keep) {
+		i++
+	}
+	lb.samples = lb.samples[i:]
+}
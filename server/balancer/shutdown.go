@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// NotifyShutdown tells every registered server that the load balancer is
+// going away, through POST /lb/shutdown on its control-plane address, so
+// it registers again with the load balancer that replaces this one instead
+// of counting itself as registered. It returns how many servers
+// acknowledged the notice.
+func (lb *LoadBalancer) NotifyShutdown(ctx context.Context) int {
+	lb.mu.Lock()
+	var targets []string
+	for _, s := range lb.servers {
+		if base, err := s.AdminURL(); err == nil {
+			targets = append(targets, base)
+		}
+	}
+	lb.mu.Unlock()
+
+	client := &http.Client{Timeout: healthTimeout, Transport: lb.opts.Transport}
+	var (
+		wg       sync.WaitGroup
+		notified atomic.Int32
+	)
+	for _, base := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lb.notify(ctx, client, base+"/lb/shutdown"); err != nil {
+				log.Printf("[LB] Failed to notify %s of the shutdown: %v", base, err)
+				return
+			}
+			notified.Add(1)
+		}()
+	}
+	wg.Wait()
+	return int(notified.Load())
+}
+
+func (lb *LoadBalancer) notify(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	if lb.opts.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+lb.opts.Secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package breaker stops calls to a dependency that keeps failing, so an
+// outage costs callers one quick error instead of a timeout each, and the
+// dependency gets room to recover. After enough failures in a row the
+// breaker opens and rejects calls; once the cooldown has passed it lets a
+// single probe through, closing again if the probe succeeds.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"lukagolubovic/metrics"
+)
+
+// ErrOpen is returned instead of calling the dependency while the breaker
+// is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+// Breaker guards one dependency. Its zero value is not usable; see New.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	onChange  func(name string, to State)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// New returns a closed breaker that opens after threshold failures in a
+// row and probes again after cooldown. onChange, if not nil, is called on
+// every change of state, without the breaker's lock held.
+func New(name string, threshold int, cooldown time.Duration, onChange func(name string, to State)) *Breaker {
+	return &Breaker{name: name, threshold: threshold, cooldown: cooldown, onChange: onChange, state: Closed}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State reports the state as of now: an open breaker whose cooldown has
+// passed is half open.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && time.Since(b.openedAt) >= b.cooldown {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Do calls fn unless the breaker is open, and records its outcome. A
+// context.Canceled error is the caller giving up, not the dependency
+// failing, so it doesn't count.
+func (b *Breaker) Do(fn func() error) error {
+	if !b.allow() {
+		metrics.CircuitBreakers.Add(b.name+"_rejected", 1)
+		return ErrOpen
+	}
+	err := fn()
+	b.record(err == nil || errors.Is(err, context.Canceled))
+	return err
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Closed:
+		return true
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = HalfOpen
+	}
+	// Half open: one probe at a time.
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *Breaker) record(ok bool) {
+	b.mu.Lock()
+	from := b.state
+	if from == HalfOpen {
+		b.probing = false
+	}
+	if ok {
+		b.failures = 0
+		b.state = Closed
+	} else {
+		b.failures++
+		if from == HalfOpen || b.failures >= b.threshold {
+			b.state = Open
+			b.openedAt = time.Now()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	// A failed probe reopens a breaker that was already reported open.
+	if to == from || (from == HalfOpen && to == Open) {
+		return
+	}
+	metrics.CircuitBreakers.Add(b.name+"_"+string(to), 1)
+	if b.onChange != nil {
+		b.onChange(b.name, to)
+	}
+}
@@ -0,0 +1,244 @@
+// Package bridge mirrors the default room to a channel on another chat
+// network, in both directions. It works at the Redis level like the chat
+// servers do: room messages are read from the room's channel and posted to
+// the remote, and remote messages are published to the room as if a chat
+// server had, so every server broadcasts and stores them.
+//
+// Remote users get cluster identities named "name@platform"; regular users
+// can't register such names (see config.BridgedPlatforms).
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/ingest"
+	"lukagolubovic/models"
+)
+
+const (
+	// outboundBuffer holds room messages waiting for the remote's rate
+	// limit; beyond it they are dropped.
+	outboundBuffer = 256
+	maxPostRetries = 3
+	reconnectDelay = 5 * time.Second
+)
+
+// Remote is one external chat network.
+type Remote interface {
+	// Platform names the network, e.g. "slack"; it must be one of
+	// config.BridgedPlatforms.
+	Platform() string
+	// Interval is the minimum time between two posts.
+	Interval() time.Duration
+	// Post sends text to the bridged channel under username. A
+	// *RateLimited error asks the caller to wait before retrying.
+	Post(ctx context.Context, username, text string) error
+	// Listen delivers messages people post in the bridged channel, never
+	// the bridge's own posts, until ctx is done or the connection fails.
+	Listen(ctx context.Context, deliver func(Inbound)) error
+}
+
+// Inbound is a message posted on the remote.
+type Inbound struct {
+	Username string
+	Text     string
+}
+
+// RateLimited is returned by Post when the remote refused the post for
+// being too fast.
+type RateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimited) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+type Bridge struct {
+	remote   Remote
+	rdb      redis.UniversalClient
+	cfg      *config.Store
+	pub      *ingest.Publisher
+	outbound chan models.Message
+}
+
+// New bridges the default room to remote. Messages it publishes carry
+// "bridge:<platform>" as their server, which is also how it recognises and
+// skips them when they come back from Redis.
+func New(remote Remote, rdb redis.UniversalClient, cfg *config.Store) *Bridge {
+	return &Bridge{
+		remote:   remote,
+		rdb:      rdb,
+		cfg:      cfg,
+		pub:      ingest.New(rdb, cfg, "bridge:"+remote.Platform()),
+		outbound: make(chan models.Message, outboundBuffer),
+	}
+}
+
+// ClaimNode claims the bridge's message id node; call it before Run.
+func (b *Bridge) ClaimNode(ctx context.Context) error {
+	return b.pub.ClaimNode(ctx)
+}
+
+// Run relays in both directions until ctx is done.
+func (b *Bridge) Run(ctx context.Context) {
+	go b.pub.HoldNode(ctx)
+	go b.pub.FollowRooms(ctx)
+	go b.postLoop(ctx)
+	go b.listenLoop(ctx)
+	b.subscribe(ctx)
+}
+
+// subscribe queues every chat message in the room that didn't come from
+// this bridge.
+func (b *Bridge) subscribe(ctx context.Context) {
+	shards := b.cfg.Get().Redis.Shards
+	pubsub := b.rdb.Subscribe(ctx, broker.Channel(models.DefaultRoom, shards))
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case raw, ok := <-ch:
+			if !ok {
+				return
+			}
+			var msg models.Message
+			if err := json.Unmarshal([]byte(raw.Payload), &msg); err != nil {
+				continue
+			}
+			if !models.IsChat(msg.Type) || msg.ID == 0 || msg.Server == b.pub.Source() {
+				continue
+			}
+			select {
+			case b.outbound <- msg:
+			default:
+				log.Printf("[Bridge %s] outbound queue full, dropping message %d", b.remote.Platform(), msg.ID)
+			}
+		}
+	}
+}
+
+// postLoop posts queued messages no faster than the remote allows, waiting
+// out rate-limit responses.
+func (b *Bridge) postLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.remote.Interval())
+	defer ticker.Stop()
+
+	for {
+		var msg models.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-b.outbound:
+		}
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := b.remote.Post(ctx, msg.Username, msg.Content)
+			var limited *RateLimited
+			if errors.As(err, &limited) && attempt < maxPostRetries {
+				log.Printf("[Bridge %s] %v", b.remote.Platform(), err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(limited.RetryAfter):
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("[Bridge %s] failed to post message %d: %v", b.remote.Platform(), msg.ID, err)
+			}
+			break
+		}
+	}
+}
+
+// listenLoop keeps a connection to the remote open, reconnecting after
+// failures.
+func (b *Bridge) listenLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := b.remote.Listen(ctx, func(in Inbound) { b.publish(ctx, in) })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[Bridge %s] listener stopped, reconnecting in %s: %v", b.remote.Platform(), reconnectDelay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// publish posts a remote message to the room under the sender's bridged
+// identity, as a chat server would for one of its clients.
+func (b *Bridge) publish(ctx context.Context, in Inbound) {
+	text := strings.TrimSpace(in.Text)
+	if text == "" {
+		return
+	}
+	if limit := b.cfg.Room(models.DefaultRoom).ContentLimit(models.MaxContentSize); len(text) > limit {
+		text = truncate(text, limit)
+	}
+
+	// Moderators ban and mute bridged users by their bridged name; their
+	// messages are dropped silently, as the remote can't be told.
+	userID, username, err := b.pub.Login(ctx, BridgedName(in.Username, b.remote.Platform()))
+	if errors.Is(err, ingest.ErrBanned) {
+		return
+	}
+	if err != nil {
+		log.Printf("[Bridge %s] failed to resolve user '%s': %v", b.remote.Platform(), in.Username, err)
+		return
+	}
+	err = b.pub.Publish(ctx, b.pub.NextID(), userID, username, text)
+	if err != nil && !errors.Is(err, ingest.ErrMuted) && !errors.Is(err, ingest.ErrBanned) {
+		log.Printf("[Bridge %s] failed to publish message from '%s': %v", b.remote.Platform(), username, err)
+	}
+}
+
+// BridgedName is the cluster username of a remote user: their display name,
+// cleaned up and shortened to fit, with "@platform" appended.
+func BridgedName(name, platform string) string {
+	suffix := "@" + platform
+	name = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) || r == '@' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		name = "unknown"
+	}
+	return strings.TrimSpace(truncate(name, config.MaxUsernameLength-len(suffix))) + suffix
+}
+
+// truncate cuts s to at most max bytes without splitting a UTF-8 sequence.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,220 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	discordGateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+	// Discord webhooks allow five posts every two seconds.
+	discordInterval = 400 * time.Millisecond
+
+	// Gateway opcodes and intents used by the bridge.
+	discordOpDispatch       = 0
+	discordOpHeartbeat      = 1
+	discordOpIdentify       = 2
+	discordOpReconnect      = 7
+	discordOpInvalidSession = 9
+	discordOpHello          = 10
+	discordIntentMessages   = 1 << 9
+	discordIntentContent    = 1 << 15
+)
+
+// Discord posts through a channel webhook, which can take any display name
+// per message, and receives over the Gateway as a bot with the message
+// content intent enabled.
+type Discord struct {
+	Token      string
+	Channel    string
+	WebhookURL string
+
+	client *http.Client
+}
+
+func NewDiscord(token, channel, webhookURL string) *Discord {
+	return &Discord{
+		Token:      token,
+		Channel:    channel,
+		WebhookURL: webhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (d *Discord) Platform() string        { return "discord" }
+func (d *Discord) Interval() time.Duration { return discordInterval }
+
+func (d *Discord) Post(ctx context.Context, username, text string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"content":  text,
+		"username": username,
+		// Chat users must not be able to ping @everyone or roles.
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var res struct {
+			RetryAfter float64 `json:"retry_after"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&res) == nil && res.RetryAfter > 0 {
+			return &RateLimited{RetryAfter: time.Duration(res.RetryAfter * float64(time.Second))}
+		}
+		return &RateLimited{RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+type discordPayload struct {
+	Op       int             `json:"op"`
+	Data     json.RawMessage `json:"d,omitempty"`
+	Sequence *int64          `json:"s,omitempty"`
+	Type     string          `json:"t,omitempty"`
+}
+
+type discordMessage struct {
+	ChannelID string `json:"channel_id"`
+	WebhookID string `json:"webhook_id"`
+	Content   string `json:"content"`
+	Author    struct {
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Bot        bool   `json:"bot"`
+	} `json:"author"`
+}
+
+// Listen runs one Gateway session. It identifies afresh on every call
+// rather than resuming, so messages sent while disconnected are missed.
+func (d *Discord) Listen(ctx context.Context, deliver func(Inbound)) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, discordGateway, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// stop ends this session's goroutines when it returns, so reconnects
+	// don't pile up closers waiting for ctx.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	var hello struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	var first discordPayload
+	if err := conn.ReadJSON(&first); err != nil {
+		return err
+	}
+	if first.Op != discordOpHello || json.Unmarshal(first.Data, &hello) != nil || hello.HeartbeatInterval <= 0 {
+		return errors.New("gateway did not send hello")
+	}
+
+	// Writes come from the heartbeat goroutine and this one.
+	var writeMu sync.Mutex
+	var seqMu sync.Mutex
+	var seq *int64
+	send := func(p interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(p)
+	}
+	heartbeat := func() error {
+		seqMu.Lock()
+		s := seq
+		seqMu.Unlock()
+		return send(map[string]interface{}{"op": discordOpHeartbeat, "d": s})
+	}
+
+	identify := map[string]interface{}{
+		"op": discordOpIdentify,
+		"d": map[string]interface{}{
+			"token":      d.Token,
+			"intents":    discordIntentMessages | discordIntentContent,
+			"properties": map[string]string{"os": "linux", "browser": "chat-bridge", "device": "chat-bridge"},
+		},
+	}
+	if err := send(identify); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(hello.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if heartbeat() != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var p discordPayload
+		if err := conn.ReadJSON(&p); err != nil {
+			return err
+		}
+		if p.Sequence != nil {
+			seqMu.Lock()
+			seq = p.Sequence
+			seqMu.Unlock()
+		}
+
+		switch p.Op {
+		case discordOpHeartbeat:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		case discordOpReconnect, discordOpInvalidSession:
+			return fmt.Errorf("gateway asked to reconnect (op %d)", p.Op)
+		case discordOpDispatch:
+			if p.Type != "MESSAGE_CREATE" {
+				continue
+			}
+			var msg discordMessage
+			if err := json.Unmarshal(p.Data, &msg); err != nil {
+				continue
+			}
+			// The bridge's own posts come back with a webhook id.
+			if msg.ChannelID != d.Channel || msg.WebhookID != "" || msg.Author.Bot {
+				continue
+			}
+			name := msg.Author.GlobalName
+			if name == "" {
+				name = msg.Author.Username
+			}
+			deliver(Inbound{Username: name, Text: msg.Content})
+		}
+	}
+}
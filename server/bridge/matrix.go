@@ -0,0 +1,369 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Homeservers exempt application services from rate limits by default;
+	// the interval only keeps bursts polite.
+	matrixInterval  = 200 * time.Millisecond
+	matrixMaxBody   = 4 << 20
+	matrixSeenTxns  = 1024
+	matrixClientAPI = "/_matrix/client/v3"
+)
+
+// Matrix is an application service: the homeserver pushes room events to
+// Listen's HTTP endpoint, and chat users are posted as puppet Matrix users
+// in the service's namespace ("@<prefix><name>:<domain>"), registered and
+// joined to the room the first time they speak.
+type Matrix struct {
+	Homeserver string
+	// ASToken authenticates the bridge to the homeserver; HSToken
+	// authenticates the homeserver's pushes to the bridge. Both come from
+	// the registration file.
+	ASToken string
+	HSToken string
+	// Domain is the homeserver's server name, the part after the colon in
+	// user ids.
+	Domain string
+	// Room is the id of the mirrored room, e.g. "!abc:example.org".
+	Room string
+	// SenderLocalpart is the service's own user; Prefix starts the
+	// localparts of puppets. Events from either are the bridge's own.
+	SenderLocalpart string
+	Prefix          string
+	// Addr is where Listen serves the application service API.
+	Addr string
+
+	client *http.Client
+	txnID  atomic.Int64
+
+	mu      sync.Mutex
+	puppets map[string]bool
+	names   map[string]string
+	seen    map[string]bool
+	order   []string
+}
+
+func NewMatrix(homeserver, asToken, hsToken, domain, room, addr string) *Matrix {
+	return &Matrix{
+		Homeserver:      strings.TrimRight(homeserver, "/"),
+		ASToken:         asToken,
+		HSToken:         hsToken,
+		Domain:          domain,
+		Room:            room,
+		SenderLocalpart: "chatbridge",
+		Prefix:          "chat_",
+		Addr:            addr,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		puppets:         make(map[string]bool),
+		names:           make(map[string]string),
+		seen:            make(map[string]bool),
+	}
+}
+
+func (m *Matrix) Platform() string        { return "matrix" }
+func (m *Matrix) Interval() time.Duration { return matrixInterval }
+
+// matrixError is the homeserver's error body.
+type matrixError struct {
+	ErrCode      string `json:"errcode"`
+	Message      string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+func (m *Matrix) Post(ctx context.Context, username, text string) error {
+	userID, err := m.puppet(ctx, username)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{"msgtype": "m.text", "body": text})
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(m.Room), m.nextTxnID())
+	return m.call(ctx, http.MethodPut, path, userID, body)
+}
+
+// puppet returns the Matrix user id standing in for a chat user, creating
+// the user and joining it to the room on first use.
+func (m *Matrix) puppet(ctx context.Context, username string) (string, error) {
+	localpart := m.Prefix + matrixLocalpart(username)
+	userID := "@" + localpart + ":" + m.Domain
+
+	m.mu.Lock()
+	ready := m.puppets[userID]
+	m.mu.Unlock()
+	if ready {
+		return userID, nil
+	}
+
+	register, _ := json.Marshal(map[string]string{"type": "m.login.application_service", "username": localpart})
+	err := m.call(ctx, http.MethodPost, "/register", "", register)
+	if err != nil && !isMatrixError(err, "M_USER_IN_USE") {
+		return "", fmt.Errorf("register %s: %w", userID, err)
+	}
+	displayName, _ := json.Marshal(map[string]string{"displayname": username})
+	if err := m.call(ctx, http.MethodPut, "/profile/"+url.PathEscape(userID)+"/displayname", userID, displayName); err != nil {
+		return "", fmt.Errorf("set display name of %s: %w", userID, err)
+	}
+	if err := m.call(ctx, http.MethodPost, "/join/"+url.PathEscape(m.Room), userID, []byte("{}")); err != nil {
+		return "", fmt.Errorf("join %s to %s: %w", userID, m.Room, err)
+	}
+
+	m.mu.Lock()
+	m.puppets[userID] = true
+	m.mu.Unlock()
+	return userID, nil
+}
+
+// call sends a client-server API request with the service's token, acting
+// as asUser when it is set.
+func (m *Matrix) call(ctx context.Context, method, path, asUser string, body []byte) error {
+	target := m.Homeserver + matrixClientAPI + path
+	if asUser != "" {
+		target += "?user_id=" + url.QueryEscape(asUser)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil
+	}
+
+	var res matrixError
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&res)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if res.RetryAfterMs > 0 {
+			return &RateLimited{RetryAfter: time.Duration(res.RetryAfterMs) * time.Millisecond}
+		}
+		return &RateLimited{RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	if res.ErrCode == "" {
+		res.ErrCode = resp.Status
+	}
+	return &res
+}
+
+func (e *matrixError) Error() string {
+	if e.Message == "" {
+		return e.ErrCode
+	}
+	return e.ErrCode + ": " + e.Message
+}
+
+func isMatrixError(err error, code string) bool {
+	merr, ok := err.(*matrixError)
+	return ok && merr.ErrCode == code
+}
+
+func (m *Matrix) nextTxnID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(m.txnID.Add(1), 36)
+}
+
+// matrixLocalpart maps a chat username onto the characters Matrix allows in
+// localparts, escaping the rest as "=xx" so distinct names stay distinct.
+func matrixLocalpart(name string) string {
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '_', c == '-', c == '/':
+			b.WriteByte(c)
+		case c >= 'A' && c <= 'Z':
+			// Usernames are case-insensitive, like localparts.
+			b.WriteByte(c + 'a' - 'A')
+		default:
+			fmt.Fprintf(&b, "=%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func (m *Matrix) Listen(ctx context.Context, deliver func(Inbound)) error {
+	mux := http.NewServeMux()
+	transactions := func(w http.ResponseWriter, r *http.Request) {
+		m.handleTransaction(w, r, deliver)
+	}
+	mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txnId}", transactions)
+	// Homeservers older than the v1 prefix push without it.
+	mux.HandleFunc("PUT /transactions/{txnId}", transactions)
+	// The bridge creates its puppets itself, so it never claims users or
+	// aliases the homeserver asks about.
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		if !m.authorized(r) {
+			writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+			return
+		}
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+	}
+	mux.HandleFunc("GET /_matrix/app/v1/users/{userId}", notFound)
+	mux.HandleFunc("GET /_matrix/app/v1/rooms/{alias}", notFound)
+	server := &http.Server{Addr: m.Addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	log.Printf("[Bridge matrix] receiving transactions on %s/_matrix/app/v1/transactions\n", m.Addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	RoomID  string `json:"room_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType   string          `json:"msgtype"`
+		Body      string          `json:"body"`
+		RelatesTo json.RawMessage `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+func (m *Matrix) handleTransaction(w http.ResponseWriter, r *http.Request, deliver func(Inbound)) {
+	if !m.authorized(r) {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+		return
+	}
+	var txn struct {
+		Events []matrixEvent `json:"events"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, matrixMaxBody)).Decode(&txn); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_BAD_JSON")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+
+	// The homeserver retries transactions it didn't see acknowledged.
+	if !m.firstDelivery(r.PathValue("txnId")) {
+		return
+	}
+	for _, ev := range txn.Events {
+		if ev.Type != "m.room.message" || ev.RoomID != m.Room || m.ownUser(ev.Sender) {
+			continue
+		}
+		// Edits arrive as new events relating to the original.
+		if len(ev.Content.RelatesTo) > 0 && strings.Contains(string(ev.Content.RelatesTo), `"m.replace"`) {
+			continue
+		}
+		text := ev.Content.Body
+		switch ev.Content.MsgType {
+		case "m.text", "m.notice":
+		case "m.emote":
+			text = "* " + text
+		default:
+			continue
+		}
+		deliver(Inbound{Username: m.displayName(r.Context(), ev.Sender), Text: text})
+	}
+}
+
+// authorized checks the homeserver's token, sent as a bearer token or, by
+// older homeservers, as the access_token query parameter.
+func (m *Matrix) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.HSToken)) == 1
+}
+
+func (m *Matrix) ownUser(userID string) bool {
+	localpart := strings.TrimPrefix(userID, "@")
+	if i := strings.IndexByte(localpart, ':'); i >= 0 {
+		if localpart[i+1:] != m.Domain {
+			return false
+		}
+		localpart = localpart[:i]
+	}
+	return localpart == m.SenderLocalpart || strings.HasPrefix(localpart, m.Prefix)
+}
+
+// displayName looks up a Matrix user's display name, caching the answer and
+// falling back to the localpart.
+func (m *Matrix) displayName(ctx context.Context, userID string) string {
+	m.mu.Lock()
+	name, ok := m.names[userID]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	name = strings.TrimPrefix(userID, "@")
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	target := m.Homeserver + matrixClientAPI + "/profile/" + url.PathEscape(userID) + "/displayname"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return name
+	}
+	req.Header.Set("Authorization", "Bearer "+m.ASToken)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("[Bridge matrix] display name of %s: %v", userID, err)
+		return name
+	}
+	defer resp.Body.Close()
+	var res struct {
+		DisplayName string `json:"displayname"`
+	}
+	if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&res) == nil && res.DisplayName != "" {
+		name = res.DisplayName
+	}
+
+	m.mu.Lock()
+	m.names[userID] = name
+	m.mu.Unlock()
+	return name
+}
+
+// firstDelivery remembers recent transaction ids and reports whether id is
+// new.
+func (m *Matrix) firstDelivery(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[id] {
+		return false
+	}
+	m.seen[id] = true
+	m.order = append(m.order, id)
+	if len(m.order) > matrixSeenTxns {
+		delete(m.seen, m.order[0])
+		m.order = m.order[1:]
+	}
+	return true
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": code})
+}
@@ -0,0 +1,281 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukagolubovic/apierror"
+)
+
+const (
+	slackAPI = "https://slack.com/api/"
+	// Slack allows about one message per second per channel.
+	slackInterval = time.Second
+	// slackMaxSkew rejects event requests signed longer ago than this, so
+	// captured requests can't be replayed.
+	slackMaxSkew    = 5 * time.Minute
+	slackMaxBody    = 1 << 20
+	slackSeenEvents = 1024
+)
+
+// Slack posts with the Web API (chat.postMessage, which needs the
+// chat:write and chat:write.customize scopes to post under other names)
+// and receives through the Events API, so Listen serves an HTTP endpoint
+// Slack must be able to reach.
+type Slack struct {
+	Token         string
+	SigningSecret string
+	Channel       string
+	// Addr is where Listen serves POST /slack/events.
+	Addr string
+
+	client *http.Client
+
+	mu    sync.Mutex
+	names map[string]string
+	seen  map[string]bool
+	order []string
+}
+
+func NewSlack(token, signingSecret, channel, addr string) *Slack {
+	return &Slack{
+		Token:         token,
+		SigningSecret: signingSecret,
+		Channel:       channel,
+		Addr:          addr,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		names:         make(map[string]string),
+		seen:          make(map[string]bool),
+	}
+}
+
+func (s *Slack) Platform() string        { return "slack" }
+func (s *Slack) Interval() time.Duration { return slackInterval }
+
+// slackEscaper escapes the characters Slack treats as markup, so chat
+// messages can't trigger @channel mentions or forge links.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (s *Slack) Post(ctx context.Context, username, text string) error {
+	body, _ := json.Marshal(map[string]string{
+		"channel":  s.Channel,
+		"text":     slackEscaper.Replace(text),
+		"username": username,
+	})
+	var res struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := s.call(ctx, "chat.postMessage", body, &res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("chat.postMessage: %s", res.Error)
+	}
+	return nil
+}
+
+// call posts a JSON body to a Web API method and decodes the response.
+func (s *Slack) call(ctx context.Context, method string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPI+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RateLimited{RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// userName looks up a Slack user's display name, caching the answer.
+func (s *Slack) userName(ctx context.Context, userID string) string {
+	s.mu.Lock()
+	name, ok := s.names[userID]
+	s.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, slackAPI+"users.info?user="+url.QueryEscape(userID), nil)
+	if err != nil {
+		return userID
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("[Bridge slack] users.info %s: %v", userID, err)
+		return userID
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		OK   bool `json:"ok"`
+		User struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || !res.OK {
+		return userID
+	}
+	name = res.User.Profile.DisplayName
+	if name == "" {
+		name = res.User.Name
+	}
+	s.mu.Lock()
+	s.names[userID] = name
+	s.mu.Unlock()
+	return name
+}
+
+func (s *Slack) Listen(ctx context.Context, deliver func(Inbound)) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /slack/events", func(w http.ResponseWriter, r *http.Request) {
+		s.handleEvent(w, r, deliver)
+	})
+	server := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	log.Printf("[Bridge slack] receiving events on %s/slack/events\n", s.Addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+type slackEnvelope struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	EventID   string `json:"event_id"`
+	Event     struct {
+		Type    string `json:"type"`
+		Subtype string `json:"subtype"`
+		Channel string `json:"channel"`
+		User    string `json:"user"`
+		BotID   string `json:"bot_id"`
+		Text    string `json:"text"`
+	} `json:"event"`
+}
+
+func (s *Slack) handleEvent(w http.ResponseWriter, r *http.Request, deliver func(Inbound)) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, slackMaxBody))
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "could not read the request body")
+		return
+	}
+	if err := s.verify(r.Header, body, time.Now()); err != nil {
+		log.Printf("[Bridge slack] rejected event: %v", err)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid signature")
+		return
+	}
+
+	var env slackEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid event payload")
+		return
+	}
+	if env.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, env.Challenge)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	ev := env.Event
+	// Edits, joins and the bridge's own posts all carry a subtype or bot id.
+	if env.Type != "event_callback" || ev.Type != "message" || ev.Subtype != "" || ev.BotID != "" || ev.Channel != s.Channel {
+		return
+	}
+	// Slack redelivers events it thinks timed out.
+	if !s.firstDelivery(env.EventID) {
+		return
+	}
+	deliver(Inbound{Username: s.userName(r.Context(), ev.User), Text: slackUnescape(ev.Text)})
+}
+
+// verify checks Slack's request signature: v0=HMAC-SHA256 of
+// "v0:<timestamp>:<body>" keyed with the signing secret.
+func (s *Slack) verify(h http.Header, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(h.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return errors.New("stale timestamp")
+	}
+	mac := hmac.New(sha256.New, []byte(s.SigningSecret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(h.Get("X-Slack-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// firstDelivery remembers recent event ids and reports whether id is new.
+func (s *Slack) firstDelivery(id string) bool {
+	if id == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[id] {
+		return false
+	}
+	s.seen[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > slackSeenEvents {
+		delete(s.seen, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+var slackUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+func slackUnescape(text string) string {
+	return slackUnescaper.Replace(text)
+}
+
+// retryAfter parses a Retry-After header in seconds, defaulting to one.
+func retryAfter(header string) time.Duration {
+	secs, err := strconv.ParseFloat(header, 64)
+	if err != nil || secs <= 0 {
+		return time.Second
+	}
+	return time.Duration(secs * float64(time.Second))
+}
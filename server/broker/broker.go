@@ -0,0 +1,66 @@
+// Package broker maps rooms to the Redis channels chat messages are
+// published on. With sharding enabled, the single "chat-messages" channel is
+// split into N channels chosen by a hash of the room name, so a server only
+// receives traffic for the rooms it hosts instead of the whole cluster's.
+//
+// Every server and the history service must use the same shard count;
+// changing it takes a restart of all of them.
+package broker
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"lukagolubovic/models"
+)
+
+// ControlChannel carries moderation and room commands to every process
+// that serves clients.
+const ControlChannel = "chat-control"
+
+// Prefix is the channel used without sharding and the prefix of the shard
+// channels ("chat-messages-0" to "chat-messages-<N-1>").
+const Prefix = "chat-messages"
+
+// Shard returns the shard room hashes to. It is 0 when shards is 0 or 1.
+func Shard(room string, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(room))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Channel is the channel messages for room are published on.
+func Channel(room string, shards int) string {
+	if shards <= 1 {
+		return Prefix
+	}
+	return Prefix + "-" + strconv.Itoa(Shard(room, shards))
+}
+
+// Channels lists every message channel, for consumers that need all rooms.
+func Channels(shards int) []string {
+	if shards <= 1 {
+		return []string{Prefix}
+	}
+	channels := make([]string, shards)
+	for i := range channels {
+		channels[i] = Prefix + "-" + strconv.Itoa(i)
+	}
+	return channels
+}
+
+// RoomOf returns the room a published message belongs to. Chat messages
+// without a room are in the default room.
+func RoomOf(payload []byte) string {
+	var msg struct {
+		Room *models.Room `json:"room"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Room == nil || msg.Room.Name == "" {
+		return models.DefaultRoom
+	}
+	return msg.Room.Name
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"time"
+
+	"lukagolubovic/metrics"
+)
+
+const (
+	// A chat message not acknowledged within ackTimeout is written again,
+	// up to maxRedeliveries times.
+	ackTimeout      = 5 * time.Second
+	ackCheckPeriod  = time.Second
+	maxRedeliveries = 3
+	// maxPending bounds the memory a client that stops acking can pin.
+	maxPending = 256
+)
+
+type pendingMessage struct {
+	payload  []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// EnableAcks turns on at-least-once delivery: every chat message is kept
+// until the client acks its id and redelivered if it doesn't. Clients opt in
+// because one that never acks would otherwise receive everything four times.
+// It must be called before SendHello.
+func (c *Client) EnableAcks() {
+	c.pending = make(map[int64]*pendingMessage)
+}
+
+func (c *Client) AcksEnabled() bool {
+	return c.pending != nil
+}
+
+// Track records a chat message queued on Send so it is redelivered unless
+// acked. It is a no-op for clients without acks and for messages without an
+// id.
+func (c *Client) Track(id int64, payload []byte) {
+	if c.pending == nil || id == 0 {
+		return
+	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	if len(c.pending) >= maxPending {
+		metrics.MessagesUnacked.Add(1)
+		return
+	}
+	c.pending[id] = &pendingMessage{payload: payload, sentAt: time.Now()}
+}
+
+func (c *Client) ack(id int64) {
+	if c.pending == nil {
+		return
+	}
+	c.pendingMu.Lock()
+	delete(c.pending, id)
+	c.pendingMu.Unlock()
+}
+
+// dueRedeliveries returns the payloads whose ack is overdue and gives up on
+// those already redelivered maxRedeliveries times.
+func (c *Client) dueRedeliveries(now time.Time) [][]byte {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	var due [][]byte
+	for id, p := range c.pending {
+		if now.Sub(p.sentAt) < ackTimeout {
+			continue
+		}
+		if p.attempts == maxRedeliveries {
+			delete(c.pending, id)
+			metrics.MessagesUnacked.Add(1)
+			continue
+		}
+		p.attempts++
+		p.sentAt = now
+		due = append(due, p.payload)
+	}
+	metrics.MessagesRedelivered.Add(int64(len(due)))
+	return due
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"time"
+
+	"lukagolubovic/metrics"
+)
+
+// Bandwidth reports the bytes of WebSocket messages read from and written
+// to the connection so far.
+func (c *Client) Bandwidth() (in, out int64) {
+	return c.bytesIn.Load(), c.bytesOut.Load()
+}
+
+// throttleIn accounts for a message of n bytes read, then waits out the
+// inbound cap. Not reading meanwhile lets TCP slow the client down instead
+// of its frames being dropped. It is called from ReadPump only.
+func (c *Client) throttleIn(n int64) {
+	c.bytesIn.Add(n)
+	metrics.Bandwidth.Add("bytes_in", n)
+	cfg := c.Hub.Config().Bandwidth
+	if wait := c.inLimit.Reserve(float64(cfg.InBytesPerSecond), cfg.BurstBytes, int(n)); wait > 0 {
+		metrics.Bandwidth.Add("throttled_in", 1)
+		time.Sleep(wait)
+	}
+}
+
+// throttleOut waits out the outbound cap before a message of n bytes is
+// written, then accounts for it. Chat queued meanwhile counts against the
+// send buffer, so a client that can't be kept up with within its cap is
+// dropped as a slow consumer. It is called from WritePump only.
+func (c *Client) throttleOut(n int) {
+	cfg := c.Hub.Config().Bandwidth
+	if wait := c.outLimit.Reserve(float64(cfg.OutBytesPerSecond), cfg.BurstBytes, n); wait > 0 {
+		metrics.Bandwidth.Add("throttled_out", 1)
+		time.Sleep(wait)
+	}
+	c.bytesOut.Add(int64(n))
+	metrics.Bandwidth.Add("bytes_out", int64(n))
+}
@@ -1,114 +1,729 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"lukagolubovic/authtoken"
+	"lukagolubovic/breaker"
+	"lukagolubovic/config"
+	"lukagolubovic/markup"
+	"lukagolubovic/metrics"
 	"lukagolubovic/models"
+	"lukagolubovic/ratelimit"
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	writeWait       = 10 * time.Second
+	pongWait        = 60 * time.Second
+	pingPeriod      = (pongWait * 9) / 10
+	maxUsernameSize = config.MaxUsernameLength
+
+	// messageTimeout bounds the database and Redis work done for one
+	// inbound frame, so a hung dependency can't stall ReadPump.
+	messageTimeout = 5 * time.Second
+
+	// WebRTC negotiation sends bursts of ICE candidates, so signaling has
+	// its own, more generous budget than chat messages.
+	signalsPerSecond = 20
+	signalBurst      = 50
+
+	// priorityBuffer is how many control frames may wait on Priority.
+	priorityBuffer = 32
 )
 
 type Client struct {
-	Hub       HubInterface
-	Conn      *websocket.Conn
+	Hub  HubInterface
+	Conn *websocket.Conn
+	// Send queues chat messages, and closing it closes the connection.
+	// Priority queues system and control frames (the hello, errors,
+	// reconnect hints, maintenance and the like), which WritePump writes
+	// ahead of any chat waiting on Send. Priority is never closed.
 	Send      chan []byte
-	Username  string
+	Priority  chan []byte
+	UserID    int64
 	CloseOnce sync.Once
+	// Guest marks an ephemeral guest identity, which may only chat. It is
+	// set before the pumps start.
+	Guest bool
+	// ConnectedAt is when the connection was accepted.
+	ConnectedAt time.Time
+	// Assignment is the load balancer's assignment id the client connected
+	// with, or empty. It is set before the client registers.
+	Assignment string
+	// ReplayAfter is the id of the last message the client saw before
+	// reconnecting; newer messages are replayed once it registers. Zero
+	// replays nothing.
+	ReplayAfter int64
+	// SessionID identifies the connection in the user's session list, and
+	// UserAgent and RemoteAddr describe the device it came from. The
+	// latter two are set before the client registers.
+	SessionID  string
+	UserAgent  string
+	RemoteAddr string
+	// Claims are those of the token the client connected with, or nil. They
+	// are set before the client registers.
+	Claims *authtoken.Claims
+
+	mu         sync.RWMutex
+	username   string
+	closeFrame []byte
+	rtt        rtt
+	done       chan struct{}
+
+	chatLimit   ratelimit.Bucket
+	signalLimit ratelimit.Bucket
+
+	// inLimit and outLimit cap the bytes read and written, which bytesIn
+	// and bytesOut count.
+	inLimit  ratelimit.Bucket
+	outLimit ratelimit.Bucket
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	pendingMu sync.Mutex
+	pending   map[int64]*pendingMessage
 }
 
 type HubInterface interface {
 	GetAddress() string
+	Config() *config.Runtime
+	RateFactor() float64
+	IsMuted(userID int64) bool
+	PublishControl(context.Context, models.ControlCommand) error
+	RenameUser(ctx context.Context, userID int64, oldName, newName string) error
+	Deliver(*Client, []byte)
+	PublishDirect(ctx context.Context, to string, payload []byte) error
+	NextMessageID() int64
 	UnregisterClient(*Client)
-	SaveMessage(models.Message) error
-	PublishMessage([]byte) error
+	SaveMessage(context.Context, models.Message) error
+	SlowModeWait(ctx context.Context, userID int64) (time.Duration, error)
+	SetSlowMode(ctx context.Context, by string, seconds int) error
+	Interact(c *Client, messageID int64, callbackID string) error
+	Sessions(ctx context.Context, userID int64) ([]models.Session, error)
+	RevokeSession(ctx context.Context, userID int64, sessionID string) error
+	Leave(ctx context.Context, c *Client) error
+	Forward(ctx context.Context, c *Client, messageID int64, room string) error
+	Quote(c *Client, messageID int64) (*models.Quote, error)
+	Attachment(ctx context.Context, id int64) (models.Attachment, error)
+}
+
+func New(hub HubInterface, conn *websocket.Conn, userID int64, username string) *Client {
+	return &Client{
+		Hub:         hub,
+		Conn:        conn,
+		Send:        make(chan []byte, 256),
+		Priority:    make(chan []byte, priorityBuffer),
+		UserID:      userID,
+		ConnectedAt: time.Now(),
+		SessionID:   newSessionID(),
+		username:    username,
+		done:        make(chan struct{}),
+	}
+}
+
+// Username is the user's current screen name; it changes when the user
+// renames themselves from any connection in the cluster.
+func (c *Client) Username() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username
+}
+
+func (c *Client) SetUsername(username string) {
+	c.mu.Lock()
+	c.username = username
+	c.mu.Unlock()
 }
 
+// CanRead and CanSend report whether the client's token lets it receive
+// the room's messages and post to it. Clients without a token may do both.
+func (c *Client) CanRead() bool {
+	return c.Claims == nil || c.Claims.Allows(authtoken.ScopeRead)
+}
+
+func (c *Client) CanSend() bool {
+	return c.Claims == nil || c.Claims.Allows(authtoken.ScopeSend)
+}
+
+// messageRate is the client's chat message limit: its token's tier if the
+// config still has it, otherwise the regular or guest one, scaled down
+// while the server is overloaded.
+func (c *Client) messageRate(cfg *config.Runtime) (float64, int) {
+	rate, burst := cfg.MessageRate(c.Guest)
+	if c.Claims != nil && c.Claims.Tier != "" {
+		if r, b, ok := cfg.TierRate(c.Claims.Tier); ok {
+			rate, burst = r, b
+		}
+	}
+	if f := c.Hub.RateFactor(); f < 1 && rate > 0 {
+		rate = rate * f
+		burst = max(1, int(float64(burst)*f))
+	}
+	return rate, burst
+}
+
+// SetCloseReason sets the close frame sent once the hub closes Send, so the
+// client can tell a deliberate close apart from a network failure.
+func (c *Client) SetCloseReason(code int, text string) {
+	c.mu.Lock()
+	c.closeFrame = websocket.FormatCloseMessage(code, text)
+	c.mu.Unlock()
+}
+
+// Done is closed once WritePump has flushed its last frame and returned.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// ReadPump and WritePump recover from panics so one bad frame or bug only
+// costs that connection: the deferred cleanup still unregisters the client
+// and closes the socket.
 func (c *Client) ReadPump() {
 	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("read_pump", v)
+		}
 		c.Hub.UnregisterClient(c)
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadLimit(config.MaxFrameCeiling)
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error {
+	c.Conn.SetPongHandler(func(data string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.pong(data)
 		return nil
 	})
 
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		// The frame size limits are those of the room when the read starts.
+		limits := c.Hub.Config()
+		message, size, err := c.readFrame(limits.MaxFrameLimit())
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived) {
-				log.Printf("[Server %s] Client '%s' unexpected close error: %v", c.Hub.GetAddress(), c.Username, err)
+				log.Printf("[Server %s] Client '%s' unexpected close error: %v", c.Hub.GetAddress(), c.Username(), err)
 			} else {
-				log.Printf("[Server %s] Client '%s' disconnected normally", c.Hub.GetAddress(), c.Username)
+				log.Printf("[Server %s] Client '%s' disconnected normally", c.Hub.GetAddress(), c.Username())
 			}
 			break
 		}
+		c.throttleIn(size)
+		if message == nil {
+			log.Printf("[Server %s] Client '%s' sent an oversized frame of %d bytes", c.Hub.GetAddress(), c.Username(), size)
+			c.sendFrameError(frameTooLarge(limits.MaxFrameLimit()))
+			continue
+		}
+		if frameErr := checkFrameSize(limits, message); frameErr != nil {
+			log.Printf("[Server %s] Client '%s' sent an oversized frame: %v", c.Hub.GetAddress(), c.Username(), frameErr)
+			c.sendFrameError(frameErr)
+			continue
+		}
+
+		incomingMsg, frameErr := decodeFrame(message)
+		if frameErr != nil {
+			log.Printf("[Server %s] Client '%s' sent an invalid frame: %v", c.Hub.GetAddress(), c.Username(), frameErr)
+			c.sendFrameError(frameErr)
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeAck {
+			c.ack(incomingMsg.ID)
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeLeave {
+			c.leave()
+			continue
+		}
+
+		if !c.CanSend() && incomingMsg.Type != models.MessageTypeSessions && incomingMsg.Type != models.MessageTypeRevokeSession {
+			c.sendError("not sent: this connection's token does not allow sending")
+			continue
+		}
+
+		// A muted user can't place calls either, so the check comes before
+		// signals are relayed.
+		if c.Hub.IsMuted(c.UserID) {
+			log.Printf("[Server %s] Client '%s' is muted, dropping message", c.Hub.GetAddress(), c.Username())
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeSignal {
+			c.relaySignal(incomingMsg)
+			continue
+		}
+
+		cfg := c.Hub.Config()
+		if !c.chatLimit.Allow(c.messageRate(cfg)) {
+			log.Printf("[Server %s] Client '%s' exceeded message rate limit, dropping message", c.Hub.GetAddress(), c.Username())
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeTopic {
+			c.setTopic(cfg, incomingMsg)
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeSessions {
+			c.listSessions()
+			continue
+		}
 
-		var incomingMsg models.Message
-		if err := json.Unmarshal(message, &incomingMsg); err != nil {
-			log.Printf("Error parsing incoming message JSON: %v", err)
+		if incomingMsg.Type == models.MessageTypeRevokeSession {
+			c.revokeSession(incomingMsg.Session)
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeInteraction {
+			if err := c.Hub.Interact(c, incomingMsg.ID, incomingMsg.Interaction.CallbackID); err != nil {
+				log.Printf("[Server %s] Client '%s' interaction with card %d failed: %v", c.Hub.GetAddress(), c.Username(), incomingMsg.ID, err)
+				c.sendError("interaction failed: " + err.Error())
+			}
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeRename {
+			c.rename(incomingMsg.Content)
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeSlowMode {
+			c.setSlowMode(cfg, incomingMsg.SlowMode.Seconds)
+			continue
+		}
+
+		if limit := cfg.ContentLimit(models.MaxContentSize); len(incomingMsg.Content) > limit {
+			c.sendError(fmt.Sprintf("message not sent: this room allows at most %d bytes", limit))
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeGIF && !cfg.GIFs.Enabled() {
+			c.sendError("message not sent: GIFs are disabled")
+			continue
+		}
+
+		if !cfg.IsModerator(c.Username()) && c.slowModeCooldown() {
+			continue
+		}
+
+		if incomingMsg.Type == models.MessageTypeForward {
+			c.forward(incomingMsg.ID, incomingMsg.ToRoom)
 			continue
 		}
 
 		msg := models.Message{
-			Username: c.Username,
-			Content:  incomingMsg.Content,
+			ID:       c.Hub.NextMessageID(),
+			UserID:   c.UserID,
+			Username: c.Username(),
 			Server:   c.Hub.GetAddress(),
 		}
+		switch incomingMsg.Type {
+		case models.MessageTypeLocation:
+			location := *incomingMsg.Location
+			location.Name = cfg.Censor(location.Name)
+			msg.Type, msg.Location, msg.Content = incomingMsg.Type, &location, location.Fallback()
+		case models.MessageTypeContact:
+			contact := *incomingMsg.Contact
+			contact.Name = cfg.Censor(contact.Name)
+			msg.Type, msg.Contact, msg.Content = incomingMsg.Type, &contact, contact.Fallback()
+		case models.MessageTypeGIF:
+			gif := *incomingMsg.GIF
+			gif.Title = cfg.Censor(gif.Title)
+			msg.Type, msg.GIF, msg.Content = incomingMsg.Type, &gif, gif.Fallback()
+		default:
+			msg.Content, msg.Entities = markup.Parse(cfg.Censor(incomingMsg.Content))
+		}
+		if incomingMsg.AttachmentID != 0 && !c.attach(&msg, incomingMsg.AttachmentID) {
+			continue
+		}
+		if incomingMsg.QuoteID != 0 {
+			if msg.Quote, err = c.Hub.Quote(c, incomingMsg.QuoteID); err != nil {
+				log.Printf("[Server %s] Client '%s' failed to quote message %d: %v", c.Hub.GetAddress(), c.Username(), incomingMsg.QuoteID, err)
+				c.sendError("message not sent: " + err.Error())
+				continue
+			}
+		}
 
-		if err := c.Hub.SaveMessage(msg); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+		err = c.Hub.SaveMessage(ctx, msg)
+		cancel()
+		if errors.Is(err, breaker.ErrOpen) {
+			// Already logged once, when the database breaker opened.
+			c.sendError("message not sent: the server can't store messages right now")
+		} else if err != nil {
 			log.Printf("Error saving message: %v", err)
-			continue
+			c.reportTimeout(ctx, "save", "message not sent")
 		}
+	}
+}
+
+// reportTimeout counts a failed operation whose budget ran out and tells
+// the client, which would otherwise never learn its frame was lost.
+func (c *Client) reportTimeout(ctx context.Context, op, text string) {
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	metrics.MessageTimeouts.Add(op, 1)
+	c.sendError(text + ": server timed out")
+}
+
+// relaySignal forwards WebRTC signaling to every connection of the target
+// user, on whichever server it lives. Signals are never persisted.
+func (c *Client) relaySignal(incomingMsg models.Inbound) {
+	if c.Guest {
+		c.sendError("guests can't place calls")
+		return
+	}
+	if !c.signalLimit.Allow(signalsPerSecond, signalBurst) {
+		log.Printf("[Server %s] Client '%s' exceeded signaling rate limit, dropping signal", c.Hub.GetAddress(), c.Username())
+		return
+	}
+
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeSignal,
+		Username: c.Username(),
+		To:       incomingMsg.To,
+		Server:   c.Hub.GetAddress(),
+		Signal:   incomingMsg.Signal,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.PublishDirect(ctx, incomingMsg.To, payload); err != nil {
+		log.Printf("Error relaying signal: %v", err)
+		c.reportTimeout(ctx, "signal", "signal not sent")
+	}
+}
 
-		msgBytes, _ := json.Marshal(msg)
-		if err := c.Hub.PublishMessage(msgBytes); err != nil {
-			log.Printf("Error publishing to Redis: %v", err)
+func (c *Client) rename(newName string) {
+	if c.Guest {
+		c.sendError("guests can't rename themselves")
+		return
+	}
+	usernames := c.Hub.Config().Usernames
+	if usernames.IsVisitor(c.Username()) {
+		c.sendError("widget visitors can't rename themselves")
+		return
+	}
+	newName = strings.TrimSpace(newName)
+	if err := usernames.Check(newName); err != nil {
+		c.sendError(err.Error())
+		return
+	}
+	if newName == c.Username() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.RenameUser(ctx, c.UserID, c.Username(), newName); err != nil {
+		log.Printf("[Server %s] Client '%s' rename to '%s' failed: %v", c.Hub.GetAddress(), c.Username(), newName, err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "rename", "rename failed")
+			return
 		}
+		c.sendError("rename failed: " + err.Error())
+	}
+}
+
+// leave takes the user out of the room. The hub then closes every one of
+// the user's connections, this one included.
+func (c *Client) leave() {
+	if c.Guest {
+		c.sendError("guests are not members; disconnect instead")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.Leave(ctx, c); err != nil {
+		log.Printf("[Server %s] Client '%s' failed to leave: %v", c.Hub.GetAddress(), c.Username(), err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "leave", "not left")
+			return
+		}
+		c.sendError("not left: " + err.Error())
+	}
+}
+
+// attach adds an uploaded file to msg, captioned with its name when msg
+// has no content. It tells the client and returns false when the file
+// can't be shared.
+func (c *Client) attach(msg *models.Message, id int64) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	a, err := c.Hub.Attachment(ctx, id)
+	if err != nil {
+		log.Printf("[Server %s] Client '%s' failed to share attachment %d: %v", c.Hub.GetAddress(), c.Username(), id, err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "attach", "message not sent")
+			return false
+		}
+		c.sendError("message not sent: " + err.Error())
+		return false
+	}
+	msg.Attachment = &a
+	if msg.Content == "" {
+		msg.Content = a.Name
+	}
+	return true
+}
+
+// forward copies a message to another room, as a new message from the
+// user.
+func (c *Client) forward(messageID int64, room string) {
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.Forward(ctx, c, messageID, room); err != nil {
+		log.Printf("[Server %s] Client '%s' failed to forward message %d to '%s': %v", c.Hub.GetAddress(), c.Username(), messageID, room, err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "forward", "not forwarded")
+			return
+		}
+		c.sendError("not forwarded: " + err.Error())
+	}
+}
+
+// SendHello queues the capability frame. It must be called before the
+// client is registered, while the send buffer is guaranteed to be empty.
+func (c *Client) SendHello(subprotocol string) {
+	cfg := c.Hub.Config()
+	rate, burst := c.messageRate(cfg)
+	var scopes []string
+	if c.Claims != nil {
+		for _, scope := range []string{authtoken.ScopeRead, authtoken.ScopeSend} {
+			if c.Claims.Allows(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeHello,
+		Username: "system",
+		Server:   c.Hub.GetAddress(),
+		Hello: &models.Hello{
+			ProtocolVersion:      models.ProtocolVersion,
+			Subprotocol:          subprotocol,
+			Server:               c.Hub.GetAddress(),
+			Encodings:            []string{"json"},
+			Compression:          false,
+			MaxFrameSize:         cfg.FrameLimit(""),
+			FrameLimits:          cfg.FrameLimits(),
+			MaxContentSize:       cfg.ContentLimit(models.MaxContentSize),
+			MaxUsernameSize:      cfg.Usernames.MaxLength,
+			MessagesPerSecond:    rate,
+			MessageBurst:         burst,
+			EventTypes:           models.EventTypes,
+			Features:             cfg.Features,
+			Acks:                 c.AcksEnabled(),
+			Username:             c.Username(),
+			Guest:                c.Guest,
+			SlowModeSeconds:      int(cfg.SlowMode() / time.Second),
+			LatencyReportSeconds: cfg.Latency.ReportSeconds,
+			Scopes:               scopes,
+		},
+	})
+	c.Priority <- payload
+}
+
+func (c *Client) sendError(text string) {
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeError,
+		Username: "system",
+		Content:  text,
+		Server:   c.Hub.GetAddress(),
+	})
+	c.Hub.Deliver(c, payload)
+}
+
+// sendFrameError rejects an inbound frame with a structured error.
+func (c *Client) sendFrameError(fe *models.FrameError) {
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeError,
+		Username: "system",
+		Content:  "invalid frame: " + fe.Error(),
+		Server:   c.Hub.GetAddress(),
+		Error:    fe,
+	})
+	c.Hub.Deliver(c, payload)
+}
+
+func (c *Client) setTopic(cfg *config.Runtime, incomingMsg models.Inbound) {
+	if !cfg.IsModerator(c.Username()) {
+		log.Printf("[Server %s] Client '%s' is not allowed to change the topic", c.Hub.GetAddress(), c.Username())
+		return
+	}
+
+	cmd := models.ControlCommand{
+		Type:     models.ControlTopic,
+		Username: c.Username(),
+		Topic:    cfg.Censor(incomingMsg.Content),
+	}
+	if incomingMsg.Room != nil {
+		cmd.Description = cfg.Censor(incomingMsg.Room.Description)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.PublishControl(ctx, cmd); err != nil {
+		log.Printf("Error publishing topic change: %v", err)
+		c.reportTimeout(ctx, "topic", "topic not changed")
+	}
+}
+
+// slowModeCooldown starts the client's slow mode cooldown, or reports that
+// it is still running and tells the client how long is left. Redis errors
+// let the message through rather than silencing the room.
+func (c *Client) slowModeCooldown() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	wait, err := c.Hub.SlowModeWait(ctx, c.UserID)
+	if err != nil {
+		log.Printf("[Server %s] Slow mode check for '%s' failed: %v", c.Hub.GetAddress(), c.Username(), err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	seconds := int((wait + time.Second - 1) / time.Second)
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeError,
+		Username: "system",
+		Content:  fmt.Sprintf("message not sent: slow mode is on, you can send another message in %ds", seconds),
+		Server:   c.Hub.GetAddress(),
+		SlowMode: &models.SlowMode{
+			Seconds:      int(c.Hub.Config().SlowMode() / time.Second),
+			RetryAfterMs: wait.Milliseconds(),
+		},
+	})
+	c.Hub.Deliver(c, payload)
+	return true
+}
+
+func (c *Client) setSlowMode(cfg *config.Runtime, seconds int) {
+	if !cfg.IsModerator(c.Username()) {
+		c.sendError("only moderators can change slow mode")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.SetSlowMode(ctx, c.Username(), seconds); err != nil {
+		log.Printf("Error changing slow mode: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "slow_mode", "slow mode not changed")
+			return
+		}
+		c.sendError("slow mode not changed: " + err.Error())
 	}
 }
 
 func (c *Client) WritePump() {
 	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("write_pump", v)
+		}
 		c.Conn.Close()
+		close(c.done)
 	}()
 
-	ticker := time.NewTicker(pingPeriod)
+	// Latency reports ping more often than keepalive needs.
+	interval := pingPeriod
+	if s := c.Hub.Config().Latency.ReportSeconds; s > 0 {
+		interval = min(interval, time.Duration(s)*time.Second)
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var redeliver <-chan time.Time
+	if c.AcksEnabled() {
+		redeliverTicker := time.NewTicker(ackCheckPeriod)
+		defer redeliverTicker.Stop()
+		redeliver = redeliverTicker.C
+	}
+
 	for {
+		// Control frames go out before anything else that is ready.
 		select {
+		case message := <-c.Priority:
+			if !c.write(message) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case message := <-c.Priority:
+			if !c.write(message) {
+				return
+			}
+
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// A reconnect hint queued just before the close must
+				// still reach the client.
+				for len(c.Priority) > 0 {
+					if !c.write(<-c.Priority) {
+						return
+					}
+				}
+				c.mu.RLock()
+				frame := c.closeFrame
+				c.mu.RUnlock()
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.Conn.WriteMessage(websocket.CloseMessage, frame)
 				return
 			}
 
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("[Server %s] Client '%s' write error: %v", c.Hub.GetAddress(), c.Username, err)
+			if !c.write(message) {
 				return
 			}
 
+		case now := <-redeliver:
+			for _, message := range c.dueRedeliveries(now) {
+				if !c.write(message) {
+					return
+				}
+			}
+
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("[Server %s] Client '%s' ping error: %v", c.Hub.GetAddress(), c.Username, err)
+			if err := c.Conn.WriteMessage(websocket.PingMessage, pingData(time.Now())); err != nil {
+				log.Printf("[Server %s] Client '%s' ping error: %v", c.Hub.GetAddress(), c.Username(), err)
 				return
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+// write writes one text frame, reporting false once the connection failed.
+func (c *Client) write(message []byte) bool {
+	c.throttleOut(len(message))
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.writeFrame(message); err != nil {
+		log.Printf("[Server %s] Client '%s' write error: %v", c.Hub.GetAddress(), c.Username(), err)
+		return false
+	}
+	return true
+}
+
+// writeFrame streams message through a writer, which splits one larger
+// than the connection's write buffer into fragments.
+func (c *Client) writeFrame(message []byte) error {
+	w, err := c.Conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+)
+
+const (
+	maxCallIDSize   = 64
+	maxRoomNameSize = 64
+)
+
+// readFrame reads the next message, reassembling its fragments as they
+// stream in. A message longer than limit isn't kept: the rest of it is
+// read and dropped, so the connection survives it, and message is nil.
+// size is the message's length either way.
+func (c *Client) readFrame(limit int) (message []byte, size int64, err error) {
+	_, r, err := c.Conn.NextReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	message, err = io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(message) <= limit {
+		return message, int64(len(message)), nil
+	}
+	rest, err := io.Copy(io.Discard, r)
+	return nil, int64(len(message)) + rest, err
+}
+
+// checkFrameSize rejects a frame larger than its type allows in the room.
+// Only frames over the default limit are decoded to find their type.
+func checkFrameSize(cfg *config.Runtime, raw []byte) *models.FrameError {
+	if len(raw) <= cfg.FrameLimit("") {
+		return nil
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return decodeError(err)
+	}
+	t := f.Type
+	if t == models.MessageTypeChat {
+		t = "chat"
+	}
+	if limit := cfg.FrameLimit(t); len(raw) > limit {
+		return frameTooLarge(limit)
+	}
+	return nil
+}
+
+func frameTooLarge(limit int) *models.FrameError {
+	return &models.FrameError{Reason: fmt.Sprintf("message too large (limit %d)", limit), Limit: limit}
+}
+
+// decodeFrame strictly decodes and validates one inbound frame: unknown
+// fields, wrong types, trailing data, missing required fields, oversized
+// values and fields that don't belong to the frame's type are all rejected.
+func decodeFrame(raw []byte) (models.Inbound, *models.FrameError) {
+	var f models.Inbound
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return f, decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return f, &models.FrameError{Reason: "unexpected data after the JSON object"}
+	}
+	return f, validateFrame(f)
+}
+
+func decodeError(err error) *models.FrameError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &models.FrameError{Field: typeErr.Field, Reason: "must be a " + typeErr.Type.String()}
+	}
+	// The decoder reports unknown fields only as text.
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &models.FrameError{Field: strings.Trim(name, `"`), Reason: "unknown field"}
+	}
+	return &models.FrameError{Reason: "invalid JSON: " + err.Error()}
+}
+
+func validateFrame(f models.Inbound) *models.FrameError {
+	switch f.Type {
+	case models.MessageTypeChat:
+		// A shared file may go without a caption.
+		if strings.TrimSpace(f.Content) == "" && f.AttachmentID == 0 {
+			return required("content")
+		}
+		if len(f.Content) > models.MaxContentSize {
+			return tooLong("content", models.MaxContentSize)
+		}
+	case models.MessageTypeTopic:
+		if len(f.Content) > models.MaxContentSize {
+			return tooLong("content", models.MaxContentSize)
+		}
+		if f.Room != nil && len(f.Room.Description) > models.MaxContentSize {
+			return tooLong("room.description", models.MaxContentSize)
+		}
+	case models.MessageTypeRename:
+		if strings.TrimSpace(f.Content) == "" {
+			return required("content")
+		}
+		if len(f.Content) > maxUsernameSize {
+			return tooLong("content", maxUsernameSize)
+		}
+	case models.MessageTypeSignal:
+		if f.To == "" {
+			return required("to")
+		}
+		if len(f.To) > maxUsernameSize {
+			return tooLong("to", maxUsernameSize)
+		}
+		if f.Signal == nil {
+			return required("signal")
+		}
+		if len(f.Signal.CallID) > maxCallIDSize {
+			return tooLong("signal.call_id", maxCallIDSize)
+		}
+		if !f.Signal.Valid() {
+			return &models.FrameError{Field: "signal", Reason: "needs a kind of offer, answer, candidate or hangup, a call_id, and data except for hangup"}
+		}
+	case models.MessageTypeSlowMode:
+		if f.SlowMode == nil {
+			return required("slow_mode")
+		}
+		if f.SlowMode.Seconds < 0 || f.SlowMode.Seconds > models.MaxSlowModeSeconds {
+			return &models.FrameError{Field: "slow_mode.seconds", Reason: fmt.Sprintf("must be between 0 and %d", models.MaxSlowModeSeconds)}
+		}
+		if f.SlowMode.RetryAfterMs != 0 {
+			return notAllowed("slow_mode.retry_after_ms", f.Type)
+		}
+	case models.MessageTypeAck:
+		if f.ID == 0 {
+			return required("id")
+		}
+	case models.MessageTypeInteraction:
+		if f.ID == 0 {
+			return required("id")
+		}
+		if f.Interaction == nil || f.Interaction.CallbackID == "" {
+			return required("interaction.callback_id")
+		}
+		if len(f.Interaction.CallbackID) > models.MaxCallbackID {
+			return tooLong("interaction.callback_id", models.MaxCallbackID)
+		}
+	case models.MessageTypeLocation:
+		if f.Location == nil {
+			return required("location")
+		}
+		if err := f.Location.Validate(); err != nil {
+			return &models.FrameError{Field: "location", Reason: err.Error()}
+		}
+	case models.MessageTypeContact:
+		if f.Contact == nil {
+			return required("contact")
+		}
+		if err := f.Contact.Validate(); err != nil {
+			return &models.FrameError{Field: "contact", Reason: err.Error()}
+		}
+	case models.MessageTypeGIF:
+		if f.GIF == nil {
+			return required("gif")
+		}
+		if err := f.GIF.Validate(); err != nil {
+			return &models.FrameError{Field: "gif", Reason: err.Error()}
+		}
+	case models.MessageTypeForward:
+		if f.ID == 0 {
+			return required("id")
+		}
+		if f.ToRoom == "" {
+			return required("to_room")
+		}
+		if len(f.ToRoom) > maxRoomNameSize {
+			return tooLong("to_room", maxRoomNameSize)
+		}
+	case models.MessageTypeSessions, models.MessageTypeLeave:
+	case models.MessageTypeRevokeSession:
+		if f.Session == "" {
+			return required("session")
+		}
+		if len(f.Session) > maxSessionIDSize {
+			return tooLong("session", maxSessionIDSize)
+		}
+	default:
+		return &models.FrameError{Field: "type", Reason: fmt.Sprintf("unknown frame type %q", f.Type)}
+	}
+
+	if f.Type != models.MessageTypeAck && f.Type != models.MessageTypeInteraction && f.Type != models.MessageTypeForward && f.ID != 0 {
+		return notAllowed("id", f.Type)
+	}
+	if f.Type != models.MessageTypeSignal && (f.To != "" || f.Signal != nil) {
+		field := "to"
+		if f.Signal != nil {
+			field = "signal"
+		}
+		return notAllowed(field, f.Type)
+	}
+	if f.Type != models.MessageTypeTopic && f.Room != nil {
+		return notAllowed("room", f.Type)
+	}
+	if f.Type != models.MessageTypeSlowMode && f.SlowMode != nil {
+		return notAllowed("slow_mode", f.Type)
+	}
+	if f.Type != models.MessageTypeInteraction && f.Interaction != nil {
+		return notAllowed("interaction", f.Type)
+	}
+	if f.Type != models.MessageTypeLocation && f.Location != nil {
+		return notAllowed("location", f.Type)
+	}
+	if f.Type != models.MessageTypeContact && f.Contact != nil {
+		return notAllowed("contact", f.Type)
+	}
+	if f.Type != models.MessageTypeGIF && f.GIF != nil {
+		return notAllowed("gif", f.Type)
+	}
+	if f.Type != models.MessageTypeRevokeSession && f.Session != "" {
+		return notAllowed("session", f.Type)
+	}
+	if f.Type != models.MessageTypeChat && f.AttachmentID != 0 {
+		return notAllowed("attachment_id", f.Type)
+	}
+	if f.QuoteID != 0 && !models.IsChat(f.Type) {
+		return notAllowed("quote_id", f.Type)
+	}
+	if f.Type != models.MessageTypeForward && f.ToRoom != "" {
+		return notAllowed("to_room", f.Type)
+	}
+	// Shared locations, contacts and GIFs carry everything in their
+	// payload; the server writes their content as a fallback for older
+	// clients.
+	if (f.Type == models.MessageTypeLocation || f.Type == models.MessageTypeContact || f.Type == models.MessageTypeGIF) && f.Content != "" {
+		return notAllowed("content", f.Type)
+	}
+	// A forward copies the original as it is.
+	if f.Type == models.MessageTypeForward && f.Content != "" {
+		return notAllowed("content", f.Type)
+	}
+	return nil
+}
+
+func required(field string) *models.FrameError {
+	return &models.FrameError{Field: field, Reason: "required"}
+}
+
+func tooLong(field string, max int) *models.FrameError {
+	return &models.FrameError{Field: field, Reason: fmt.Sprintf("must be at most %d bytes", max)}
+}
+
+func notAllowed(field, frameType string) *models.FrameError {
+	if frameType == models.MessageTypeChat {
+		frameType = "chat"
+	}
+	return &models.FrameError{Field: field, Reason: "not allowed in " + frameType + " frames"}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+)
+
+// rtt is a connection's measured round-trip time, kept as TCP keeps it
+// (RFC 6298): a smoothed average and the mean deviation from it.
+type rtt struct {
+	last, smoothed, jitter time.Duration
+	samples                int
+}
+
+func (r *rtt) add(d time.Duration) {
+	if r.samples == 0 {
+		r.smoothed, r.jitter = d, d/2
+	} else {
+		delta := r.smoothed - d
+		if delta < 0 {
+			delta = -delta
+		}
+		r.jitter = (3*r.jitter + delta) / 4
+		r.smoothed = (7*r.smoothed + d) / 8
+	}
+	r.last = d
+	r.samples++
+}
+
+// pingData is the payload of a ping: the time it was sent, which the pong
+// echoes.
+func pingData(now time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+}
+
+// pong records the round trip of the ping a pong answers, and sends a
+// latency frame if reports are on. Pongs without a ping's payload, which
+// clients may send unsolicited, are ignored.
+func (c *Client) pong(data string) {
+	if len(data) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+	d := time.Since(sent)
+	if d < 0 || d > pongWait {
+		return
+	}
+	recordRTT(d)
+
+	c.mu.Lock()
+	c.rtt.add(d)
+	latency := c.rtt.latency()
+	c.mu.Unlock()
+
+	if c.Hub.Config().Latency.ReportSeconds == 0 {
+		return
+	}
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeLatency,
+		Username: "system",
+		Server:   c.Hub.GetAddress(),
+		Latency:  &latency,
+	})
+	select {
+	case c.Priority <- payload:
+	default:
+	}
+}
+
+// Latency is the connection's round-trip time so far; ok is false before
+// the first pong.
+func (c *Client) Latency() (latency models.Latency, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rtt.latency(), c.rtt.samples > 0
+}
+
+func (r *rtt) latency() models.Latency {
+	return models.Latency{RTTMs: millis(r.last), SmoothedMs: millis(r.smoothed), JitterMs: millis(r.jitter)}
+}
+
+// millis rounds d to a tenth of a millisecond.
+func millis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+func recordRTT(d time.Duration) {
+	switch {
+	case d < 50*time.Millisecond:
+		metrics.ConnectionRTT.Add("under_50ms", 1)
+	case d < 200*time.Millisecond:
+		metrics.ConnectionRTT.Add("under_200ms", 1)
+	case d < time.Second:
+		metrics.ConnectionRTT.Add("under_1s", 1)
+	default:
+		metrics.ConnectionRTT.Add("over_1s", 1)
+	}
+}
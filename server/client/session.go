@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+
+	"lukagolubovic/models"
+)
+
+// maxSessionIDSize bounds the session named in revoke_session frames;
+// session ids are 16 hex digits.
+const maxSessionIDSize = 32
+
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// listSessions answers a sessions frame with the user's connections across
+// the cluster, marking this one as current. Anyone can connect under a
+// name without a token, so only token holders see and revoke sessions, and
+// the list leaves out client addresses.
+func (c *Client) listSessions() {
+	if c.Guest {
+		c.sendError("guests have no sessions")
+		return
+	}
+	if c.Claims == nil {
+		c.sendError("sessions are only listed for connections with a token")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	sessions, err := c.Hub.Sessions(ctx, c.UserID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "sessions", "sessions not listed")
+			return
+		}
+		c.sendError("sessions not listed: " + err.Error())
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == c.SessionID
+		sessions[i].RemoteAddr = ""
+	}
+	if sessions == nil {
+		sessions = []models.Session{}
+	}
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeSessions,
+		Username: "system",
+		Server:   c.Hub.GetAddress(),
+		Sessions: sessions,
+	})
+	c.Hub.Deliver(c, payload)
+}
+
+// revokeSession closes another of the user's sessions, such as one on a
+// lost device. Like listing, it needs a token.
+func (c *Client) revokeSession(sessionID string) {
+	if c.Guest {
+		c.sendError("guests have no sessions")
+		return
+	}
+	if c.Claims == nil {
+		c.sendError("session not revoked: sessions can only be revoked from connections with a token")
+		return
+	}
+	if sessionID == c.SessionID {
+		c.sendError("session not revoked: this is the current session; disconnect instead")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+	defer cancel()
+	if err := c.Hub.RevokeSession(ctx, c.UserID, sessionID); err != nil {
+		log.Printf("Error revoking session: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			c.reportTimeout(ctx, "revoke_session", "session not revoked")
+			return
+		}
+		c.sendError("session not revoked: " + err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+// Command bridge mirrors the default room to a Slack channel, a Discord
+// channel or a Matrix room, in both directions. Run one bridge process per
+// remote channel. Tokens are read from the environment so they stay out of
+// process listings.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"lukagolubovic/bridge"
+	"lukagolubovic/config"
+	"lukagolubovic/mtls"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/roomconfig"
+)
+
+func main() {
+	platform := flag.String("platform", "", "Network to bridge to: slack, discord or matrix")
+	channel := flag.String("channel", "", "Id of the Slack or Discord channel or Matrix room to mirror")
+	listen := flag.String("listen", ":9300", "Address to receive Slack events or Matrix transactions on (slack and matrix only)")
+	webhookURL := flag.String("discord-webhook", os.Getenv("DISCORD_WEBHOOK_URL"), "Discord channel webhook URL used to post (discord only)")
+	homeserver := flag.String("matrix-homeserver", "", "Client-server API URL of the Matrix homeserver, e.g. https://matrix.example.org (matrix only)")
+	domain := flag.String("matrix-domain", "", "Server name of the Matrix homeserver, as in @user:example.org (matrix only)")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file, for its redis section and banned words; reloaded on SIGHUP")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	var remote bridge.Remote
+	switch *platform {
+	case "slack":
+		token, secret := os.Getenv("SLACK_BOT_TOKEN"), os.Getenv("SLACK_SIGNING_SECRET")
+		if token == "" || secret == "" || *channel == "" {
+			log.Fatalf("slack needs SLACK_BOT_TOKEN, SLACK_SIGNING_SECRET and -channel")
+		}
+		remote = bridge.NewSlack(token, secret, *channel, *listen)
+	case "discord":
+		token := os.Getenv("DISCORD_BOT_TOKEN")
+		if token == "" || *webhookURL == "" || *channel == "" {
+			log.Fatalf("discord needs DISCORD_BOT_TOKEN, -discord-webhook and -channel")
+		}
+		remote = bridge.NewDiscord(token, *channel, *webhookURL)
+	case "matrix":
+		asToken, hsToken := os.Getenv("MATRIX_AS_TOKEN"), os.Getenv("MATRIX_HS_TOKEN")
+		if asToken == "" || hsToken == "" || *homeserver == "" || *domain == "" || *channel == "" {
+			log.Fatalf("matrix needs MATRIX_AS_TOKEN, MATRIX_HS_TOKEN, -matrix-homeserver, -matrix-domain and -channel")
+		}
+		remote = bridge.NewMatrix(*homeserver, asToken, hsToken, *domain, *channel, *listen)
+	default:
+		log.Fatalf("-platform must be slack, discord or matrix")
+	}
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		if certs == nil {
+			log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+		}
+		go certs.Watch(mtls.WatchInterval)
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[Bridge %s] config reload failed, keeping previous config: %v", *platform, err)
+				continue
+			}
+			if _, err := roomconfig.Sync(context.Background(), redisClient, cfg); err != nil {
+				log.Printf("[Bridge %s] failed to reload room overrides: %v", *platform, err)
+			}
+			log.Printf("[Bridge %s] config reloaded from %s\n", *platform, cfg.Path())
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		cancel()
+	}()
+
+	log.Printf("[Bridge %s] mirroring the default room to channel %s\n", *platform, *channel)
+	b := bridge.New(remote, redisClient, cfg)
+	if err := b.ClaimNode(ctx); err != nil {
+		log.Fatalf("[Bridge %s] %v", *platform, err)
+	}
+	b.Run(ctx)
+}
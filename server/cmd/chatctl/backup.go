@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"lukagolubovic/backup"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	client := adminFlags(fs)
+	out := fs.String("o", "", "Write the snapshot to this local file (default chat-<timestamp>.db)")
+	remote := fs.Bool("remote", false, "Store the snapshot in the server's backup directory instead of downloading it")
+	fs.Parse(args)
+
+	if *remote {
+		var res struct {
+			Path string `json:"path"`
+		}
+		if err := client.doJSON(http.MethodPost, "/admin/backup", nil, &res); err != nil {
+			return err
+		}
+		fmt.Printf("server wrote %s\n", res.Path)
+		return nil
+	}
+
+	dest := *out
+	if dest == "" {
+		dest = "chat-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	resp, err := client.do(http.MethodGet, "/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	if err := backup.Verify(dest); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%d bytes)\n", dest, n)
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Database file to replace (the server using it must be stopped)")
+	from := fs.String("from", "", "Snapshot file to restore")
+	fs.Parse(args)
+
+	if *dbPath == "" || *from == "" {
+		return errors.New("both -db and -from are required")
+	}
+
+	if err := backup.Restore(*from, *dbPath); err != nil {
+		return err
+	}
+	fmt.Printf("restored %s from %s\n", *dbPath, *from)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/mtls"
+)
+
+type adminClient struct {
+	server string
+	token  string
+	tls    *mtls.Files
+}
+
+func (c *adminClient) do(method, path string, body interface{}) (*http.Response, error) {
+	return c.send(&http.Client{Timeout: 5 * time.Minute}, method, path, body)
+}
+
+// stream is like do but without a client timeout, for long-lived responses.
+func (c *adminClient) stream(method, path string) (*http.Response, error) {
+	return c.send(&http.Client{}, method, path, nil)
+}
+
+func (c *adminClient) send(client *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	if c.tls != nil {
+		certs, err := mtls.Load(*c.tls)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = certs.Transport()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var apiErr apierror.Error
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s: %v", method, path, resp.Status, apiErr)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// doJSON performs the request and decodes a JSON response into out, which
+// may be nil when the response body is not needed.
+func (c *adminClient) doJSON(method, path string, body, out interface{}) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
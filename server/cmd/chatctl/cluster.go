@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"lukagolubovic/balancer"
+	"lukagolubovic/mtls"
+)
+
+type connectedUser struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Server   string `json:"server"`
+}
+
+func lbFlag(fs *flag.FlagSet) *adminClient {
+	c := &adminClient{}
+	fs.StringVar(&c.server, "lb", "http://127.0.0.1:9000", "Load balancer base URL")
+	fs.StringVar(&c.token, "lb-secret", os.Getenv("CHATCTL_LB_SECRET"), "Shared secret the load balancer was started with as -auth-secret")
+	c.tls = mtls.RegisterFlags(fs)
+	return c
+}
+
+func listServers(lb *adminClient) ([]balancer.ChatServerInfo, error) {
+	var servers []balancer.ChatServerInfo
+	err := lb.doJSON(http.MethodGet, "/servers", nil, &servers)
+	return servers, err
+}
+
+func runServers(args []string) error {
+	fs := flag.NewFlagSet("servers", flag.ExitOnError)
+	lb := lbFlag(fs)
+	fs.Parse(args)
+
+	servers, err := listServers(lb)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tLOAD")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "%s\t%d\n", s.Address, s.Load)
+	}
+	return tw.Flush()
+}
+
+func runDrain(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	client := adminFlags(fs)
+	evict := fs.Bool("evict", false, "Also close every connection with a hint to reconnect elsewhere")
+	fs.Parse(args)
+
+	if *evict {
+		var res struct {
+			Evicted int `json:"evicted"`
+		}
+		if err := client.doJSON(http.MethodPost, "/admin/drain", nil, &res); err != nil {
+			return err
+		}
+		fmt.Printf("%s drained, %d connections moved\n", client.server, res.Evicted)
+		return nil
+	}
+
+	if err := client.doJSON(http.MethodPost, "/drain", nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%s is draining\n", client.server)
+	return nil
+}
+
+func runEvict(args []string) error {
+	fs := flag.NewFlagSet("evict", flag.ExitOnError)
+	lb := lbFlag(fs)
+	address := fs.String("address", "", "Registered server address to remove (e.g. ws://10.0.0.5:8080/ws)")
+	fs.Parse(args)
+
+	if *address == "" {
+		return errors.New("-address is required")
+	}
+
+	body := balancer.Registration{Version: balancer.SchemaVersion, Address: *address}
+	if err := lb.doJSON(http.MethodPost, "/deregister", body, nil); err != nil {
+		return err
+	}
+	fmt.Printf("evicted %s\n", *address)
+	return nil
+}
+
+func runUsers(args []string) error {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	lb := lbFlag(fs)
+	token := fs.String("token", os.Getenv("CHATCTL_TOKEN"), "Admin bearer token")
+	fs.Parse(args)
+
+	servers, err := listServers(lb)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tUSER ID\tSERVER")
+	for _, s := range servers {
+		base, err := s.AdminURL()
+		if err != nil {
+			return err
+		}
+		var users []connectedUser
+		client := &adminClient{server: base, token: *token, tls: lb.tls}
+		if err := client.doJSON(http.MethodGet, "/admin/users", nil, &users); err != nil {
+			fmt.Fprintf(os.Stderr, "chatctl users: %s: %v\n", s.Address, err)
+			continue
+		}
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Username, u.UserID, u.Server)
+		}
+	}
+	return tw.Flush()
+}
+
+// moderate returns the run function for a control command that targets a
+// single user by name.
+func moderate(kind string) func(args []string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(kind, flag.ExitOnError)
+		client := adminFlags(fs)
+		user := fs.String("user", "", "Username to "+kind)
+		fs.Parse(args)
+
+		if *user == "" {
+			return errors.New("-user is required")
+		}
+
+		body := map[string]string{"type": kind, "username": *user}
+		if err := client.doJSON(http.MethodPost, "/admin/control", body, nil); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s: ok\n", kind, *user)
+		return nil
+	}
+}
+
+func runAnnounce(args []string) error {
+	fs := flag.NewFlagSet("announce", flag.ExitOnError)
+	client := adminFlags(fs)
+	message := fs.String("message", "", "Announcement text (defaults to the remaining arguments)")
+	fs.Parse(args)
+
+	text := *message
+	if text == "" {
+		text = strings.Join(fs.Args(), " ")
+	}
+	if text == "" {
+		return errors.New("an announcement message is required")
+	}
+
+	body := map[string]string{"type": "announce", "message": text}
+	return client.doJSON(http.MethodPost, "/admin/control", body, nil)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type createdInvite struct {
+	ID        string     `json:"id"`
+	Token     string     `json:"token"`
+	Room      string     `json:"room"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func runInvite(args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	client := adminFlags(fs)
+	room := fs.String("room", "", "Room to invite to (defaults to the default room)")
+	maxUses := fs.Int("max-uses", 0, "Number of times the invite can be redeemed (0 is unlimited)")
+	ttl := fs.Duration("ttl", 0, "How long the invite stays valid (0 never expires)")
+	fs.Parse(args)
+
+	body := map[string]interface{}{
+		"room":        *room,
+		"max_uses":    *maxUses,
+		"ttl_seconds": int(ttl.Seconds()),
+	}
+	var inv createdInvite
+	if err := client.doJSON(http.MethodPost, "/admin/invites", body, &inv); err != nil {
+		return err
+	}
+
+	fmt.Printf("id:      %s\n", inv.ID)
+	fmt.Printf("room:    %s\n", inv.Room)
+	if inv.ExpiresAt != nil {
+		fmt.Printf("expires: %s\n", inv.ExpiresAt.Format(time.RFC3339))
+	}
+	fmt.Printf("token:   %s\n", inv.Token)
+	return nil
+}
+
+func runRevokeInvite(args []string) error {
+	fs := flag.NewFlagSet("revoke-invite", flag.ExitOnError)
+	client := adminFlags(fs)
+	id := fs.String("id", "", "Id of the invite to revoke, as printed by chatctl invite")
+	fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+	if err := client.doJSON(http.MethodDelete, "/admin/invites/"+url.PathEscape(*id), nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("revoked %s\n", *id)
+	return nil
+}
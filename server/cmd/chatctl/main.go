@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"lukagolubovic/mtls"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"announce":      {usage: "announce [-server URL] -message TEXT", run: runAnnounce},
+	"backup":        {usage: "backup [-server URL] [-o FILE | -remote]", run: runBackup},
+	"ban":           {usage: "ban [-server URL] -user NAME", run: moderate("ban")},
+	"drain":         {usage: "drain [-server URL] [-evict]", run: runDrain},
+	"evict":         {usage: "evict [-lb URL] -address ADDR", run: runEvict},
+	"invite":        {usage: "invite [-server URL] [-room NAME] [-max-uses N] [-ttl DURATION]", run: runInvite},
+	"kick":          {usage: "kick [-server URL] -user NAME", run: moderate("kick")},
+	"maintenance":   {usage: "maintenance [-server URL] [-on [-message TEXT] | -off]", run: runMaintenance},
+	"mute":          {usage: "mute [-server URL] -user NAME", run: moderate("mute")},
+	"notify":        {usage: "notify [-server URL] -user NAME [-email ADDRESS] [-digest off|hourly|daily]", run: runNotify},
+	"restore":       {usage: "restore -db PATH -from FILE", run: runRestore},
+	"revoke-invite": {usage: "revoke-invite [-server URL] -id ID", run: runRevokeInvite},
+	"room-config":   {usage: "room-config [-server URL] [-room NAME] [-set JSON | -clear]", run: runRoomConfig},
+	"send-template": {usage: "send-template [-server URL] -name NAME -as USER [-var KEY=VALUE]...", run: runSendTemplate},
+	"servers":       {usage: "servers [-lb URL]", run: runServers},
+	"sessions":      {usage: "sessions [-server URL] -user NAME [-revoke ID | -revoke-all]", run: runSessions},
+	"tail":          {usage: "tail [-server URL] [-room NAME] [-user NAME] [-match REGEXP] [-json]", run: runTail},
+	"template":      {usage: "template [-server URL] [-name NAME [-set CONTENT [-description TEXT] | -delete]]", run: runTemplate},
+	"unban":         {usage: "unban [-server URL] -user NAME", run: moderate("unban")},
+	"unmute":        {usage: "unmute [-server URL] -user NAME", run: moderate("unmute")},
+	"users":         {usage: "users [-lb URL]", run: runUsers},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: chatctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Admin API calls read the bearer token from $CHATCTL_TOKEN or -token.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "chatctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// adminFlags registers the flags shared by every command that talks to a
+// chat server's admin API.
+func adminFlags(fs *flag.FlagSet) *adminClient {
+	c := &adminClient{}
+	fs.StringVar(&c.server, "server", "http://127.0.0.1:8080", "Chat server admin base URL (its -admin-port listener, if it has one)")
+	fs.StringVar(&c.token, "token", os.Getenv("CHATCTL_TOKEN"), "Admin bearer token")
+	c.tls = mtls.RegisterFlags(fs)
+	return c
+}
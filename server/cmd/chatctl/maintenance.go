@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lukagolubovic/models"
+)
+
+// runMaintenance shows the cluster's maintenance state, turning it on or
+// off first with -on or -off.
+func runMaintenance(args []string) error {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	client := adminFlags(fs)
+	on := fs.Bool("on", false, "Start maintenance: refuse new connections on every server")
+	off := fs.Bool("off", false, "End maintenance")
+	message := fs.String("message", "", "Banner shown to clients during maintenance (with -on)")
+	fs.Parse(args)
+
+	if *on && *off {
+		return errors.New("-on and -off are exclusive")
+	}
+	if *message != "" && !*on {
+		return errors.New("-message requires -on")
+	}
+	var m models.Maintenance
+	var err error
+	if *on || *off {
+		err = client.doJSON(http.MethodPut, "/admin/maintenance", map[string]interface{}{"enabled": *on, "message": *message}, &m)
+	} else {
+		err = client.doJSON(http.MethodGet, "/admin/maintenance", nil, &m)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !m.Enabled {
+		fmt.Println("maintenance: off")
+		return nil
+	}
+	if m.Since != nil {
+		fmt.Printf("maintenance: on since %s\n", m.Since.Local().Format(time.RFC1123))
+	} else {
+		fmt.Println("maintenance: on")
+	}
+	fmt.Println(m.Message)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type notificationPrefs struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Digest   string `json:"digest"`
+}
+
+// runNotify shows a user's notification preferences, changing the ones
+// given first.
+func runNotify(args []string) error {
+	fs := flag.NewFlagSet("notify", flag.ExitOnError)
+	client := adminFlags(fs)
+	user := fs.String("user", "", "User whose preferences to show or change")
+	email := fs.String("email", "", "Email address digests go to")
+	digest := fs.String("digest", "", "How often to email missed mentions: off, hourly or daily")
+	fs.Parse(args)
+
+	if *user == "" {
+		return errors.New("-user is required")
+	}
+	path := "/admin/notifications/" + url.PathEscape(*user)
+	var prefs notificationPrefs
+	if err := client.doJSON(http.MethodGet, path, nil, &prefs); err != nil {
+		return err
+	}
+	if *email != "" || *digest != "" {
+		if *email != "" {
+			prefs.Email = *email
+		}
+		if *digest != "" {
+			prefs.Digest = *digest
+		}
+		body := map[string]string{"email": prefs.Email, "digest": prefs.Digest}
+		if err := client.doJSON(http.MethodPut, path, body, &prefs); err != nil {
+			return err
+		}
+	}
+
+	digestSetting := prefs.Digest
+	if digestSetting == "" {
+		digestSetting = "off"
+	}
+	fmt.Printf("user:   %s (%s)\n", prefs.Username, prefs.UserID)
+	fmt.Printf("email:  %s\n", prefs.Email)
+	fmt.Printf("digest: %s\n", digestSetting)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type roomOverrides struct {
+	Room      string          `json:"room"`
+	Overrides json.RawMessage `json:"overrides"`
+}
+
+// runRoomConfig shows a room's configuration overrides, replacing them
+// first with -set or removing them with -clear.
+func runRoomConfig(args []string) error {
+	fs := flag.NewFlagSet("room-config", flag.ExitOnError)
+	client := adminFlags(fs)
+	room := fs.String("room", "general", "Room whose overrides to show or change")
+	set := fs.String("set", "", `New overrides as JSON, e.g. '{"messages_per_second": 1, "banned_words": ["spoiler"]}'`)
+	remove := fs.Bool("clear", false, "Remove the room's overrides")
+	fs.Parse(args)
+
+	if *set != "" && *remove {
+		return errors.New("-set and -clear are exclusive")
+	}
+	path := "/admin/rooms/" + url.PathEscape(*room) + "/config"
+	var out roomOverrides
+	var err error
+	switch {
+	case *remove:
+		err = client.doJSON(http.MethodPut, path, json.RawMessage("{}"), &out)
+	case *set != "":
+		if !json.Valid([]byte(*set)) {
+			return errors.New("-set is not valid JSON")
+		}
+		err = client.doJSON(http.MethodPut, path, json.RawMessage(*set), &out)
+	default:
+		err = client.doJSON(http.MethodGet, path, nil, &out)
+	}
+	if err != nil {
+		return err
+	}
+
+	pretty, err := json.MarshalIndent(out.Overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s overrides: %s\n", out.Room, pretty)
+	return nil
+}
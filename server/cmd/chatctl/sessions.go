@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type session struct {
+	ID          string    `json:"id"`
+	Server      string    `json:"server"`
+	UserAgent   string    `json:"user_agent"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// runSessions lists a user's sessions across the cluster, or revokes one or
+// all of them.
+func runSessions(args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	client := adminFlags(fs)
+	user := fs.String("user", "", "User whose sessions to list or revoke")
+	revoke := fs.String("revoke", "", "Session id to revoke")
+	revokeAll := fs.Bool("revoke-all", false, "Revoke every session of the user")
+	fs.Parse(args)
+
+	if *user == "" {
+		return errors.New("-user is required")
+	}
+	if *revoke != "" && *revokeAll {
+		return errors.New("-revoke and -revoke-all are mutually exclusive")
+	}
+	path := "/admin/users/" + url.PathEscape(*user) + "/sessions"
+	if *revoke != "" || *revokeAll {
+		if *revoke != "" {
+			path += "/" + url.PathEscape(*revoke)
+		}
+		if err := client.doJSON(http.MethodDelete, path, nil, nil); err != nil {
+			return err
+		}
+		fmt.Println("revoked")
+		return nil
+	}
+
+	var resp struct {
+		Sessions []session `json:"sessions"`
+	}
+	if err := client.doJSON(http.MethodGet, path, nil, &resp); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSERVER\tADDRESS\tCONNECTED\tUSER AGENT")
+	for _, s := range resp.Sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Server, s.RemoteAddr, s.ConnectedAt.Local().Format(time.DateTime), s.UserAgent)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type tailMessage struct {
+	Type      string `json:"type"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+	Server    string `json:"server"`
+	Timestamp string `json:"timestamp"`
+}
+
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	client := adminFlags(fs)
+	room := fs.String("room", "", "Only show messages in this room")
+	user := fs.String("user", "", "Only show messages from this username")
+	match := fs.String("match", "", "Only show messages whose content matches this regular expression")
+	raw := fs.Bool("json", false, "Print the raw JSON of each message")
+	fs.Parse(args)
+
+	query := url.Values{}
+	if *room != "" {
+		query.Set("room", *room)
+	}
+	if *user != "" {
+		query.Set("user", *user)
+	}
+	if *match != "" {
+		query.Set("match", *match)
+	}
+	path := "/admin/tail"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := client.stream(http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if *raw {
+			fmt.Println(data)
+			continue
+		}
+
+		var msg tailMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			continue
+		}
+		ts := msg.Timestamp
+		if ts == "" {
+			ts = time.Now().UTC().Format(time.RFC3339)
+		}
+		if msg.Type != "" {
+			fmt.Printf("%s [%s] %s: %s\n", ts, msg.Type, msg.Username, msg.Content)
+		} else {
+			fmt.Printf("%s %s: %s\n", ts, msg.Username, msg.Content)
+		}
+	}
+	return scanner.Err()
+}
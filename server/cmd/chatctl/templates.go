@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type messageTemplate struct {
+	Name        string   `json:"name"`
+	Content     string   `json:"content"`
+	Description string   `json:"description"`
+	Variables   []string `json:"variables"`
+}
+
+// runTemplate lists the message templates, or shows one with -name,
+// replacing it first with -set or removing it with -delete.
+func runTemplate(args []string) error {
+	fs := flag.NewFlagSet("template", flag.ExitOnError)
+	client := adminFlags(fs)
+	name := fs.String("name", "", "Template to show or change (lists every template when empty)")
+	set := fs.String("set", "", `New content, naming variables in braces, e.g. 'Ticket {ticket} is {status}'`)
+	description := fs.String("description", "", "What the template is for (with -set)")
+	remove := fs.Bool("delete", false, "Delete the template")
+	fs.Parse(args)
+
+	if *name == "" {
+		if *set != "" || *remove {
+			return errors.New("-set and -delete require -name")
+		}
+		var templates []messageTemplate
+		if err := client.doJSON(http.MethodGet, "/admin/templates", nil, &templates); err != nil {
+			return err
+		}
+		for _, t := range templates {
+			printTemplate(t)
+		}
+		return nil
+	}
+
+	if *set != "" && *remove {
+		return errors.New("-set and -delete are exclusive")
+	}
+	if *description != "" && *set == "" {
+		return errors.New("-description requires -set")
+	}
+	path := "/admin/templates/" + url.PathEscape(*name)
+	var t messageTemplate
+	switch {
+	case *remove:
+		if err := client.doJSON(http.MethodDelete, path, nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("deleted %s\n", *name)
+		return nil
+	case *set != "":
+		if err := client.doJSON(http.MethodPut, path, map[string]string{"content": *set, "description": *description}, &t); err != nil {
+			return err
+		}
+	default:
+		if err := client.doJSON(http.MethodGet, path, nil, &t); err != nil {
+			return err
+		}
+	}
+	printTemplate(t)
+	return nil
+}
+
+func printTemplate(t messageTemplate) {
+	fmt.Printf("%s (%s)\n", t.Name, strings.Join(t.Variables, ", "))
+	if t.Description != "" {
+		fmt.Printf("  %s\n", t.Description)
+	}
+	fmt.Printf("  %s\n", t.Content)
+}
+
+// variableFlags collects repeated -var KEY=VALUE flags.
+type variableFlags map[string]string
+
+func (v variableFlags) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v variableFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return errors.New("expected KEY=VALUE")
+	}
+	v[key] = value
+	return nil
+}
+
+func runSendTemplate(args []string) error {
+	fs := flag.NewFlagSet("send-template", flag.ExitOnError)
+	client := adminFlags(fs)
+	name := fs.String("name", "", "Template to send")
+	as := fs.String("as", "", "Username to post the message as")
+	vars := variableFlags{}
+	fs.Var(vars, "var", "Variable value as KEY=VALUE (repeatable)")
+	fs.Parse(args)
+
+	if *name == "" || *as == "" {
+		return errors.New("-name and -as are required")
+	}
+	var msg struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	}
+	body := map[string]interface{}{"username": *as, "variables": vars}
+	if err := client.doJSON(http.MethodPost, "/admin/templates/"+url.PathEscape(*name)+"/send", body, &msg); err != nil {
+		return err
+	}
+	fmt.Printf("sent %s: %s\n", msg.ID, msg.Content)
+	return nil
+}
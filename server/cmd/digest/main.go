@@ -0,0 +1,122 @@
+// Command digest emails users the mentions they missed while offline, as
+// set in their notification preferences. It reads messages from a copy of
+// the message store and runs on a schedule of its own. Several may run for
+// availability; each run is led by one of them through Redis.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/mtls"
+	"lukagolubovic/notify"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/scheduler"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "Read-only copy of a chat server's or the history service's database")
+	interval := flag.Duration("interval", 10*time.Minute, "How often to look for due digests (0 runs once and exits)")
+	smtpAddr := flag.String("smtp", "", "SMTP relay host:port; digests are only logged when empty")
+	smtpUser := flag.String("smtp-user", "", "SMTP username, with the password from $SMTP_PASSWORD")
+	from := flag.String("from", "", "Sender address of digests, e.g. chat@example.org (required with -smtp)")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file, for its notifications and redis sections; reloaded on SIGHUP")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *dbPath == "" {
+		log.Fatalf("-db is required")
+	}
+	var sender notify.Sender = notify.Log{}
+	if *smtpAddr != "" {
+		if *from == "" {
+			log.Fatalf("-smtp requires -from")
+		}
+		sender = notify.SMTP{Addr: *smtpAddr, Username: *smtpUser, Password: os.Getenv("SMTP_PASSWORD"), From: *from}
+	} else {
+		log.Printf("[Digest] no -smtp given, digests will only be logged")
+	}
+
+	db, err := database.OpenReadOnly(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.Get().Notifications.Enabled() {
+		log.Fatalf("The config's notifications section needs a secret to sign unsubscribe links")
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		if certs == nil {
+			log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+		}
+		go certs.Watch(mtls.WatchInterval)
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	digester := notify.NewDigester(redisClient, db, cfg, sender)
+	if *interval == 0 {
+		if err := digester.RunOnce(context.Background(), time.Now()); err != nil {
+			log.Fatalf("Digest run failed: %v", err)
+		}
+		return
+	}
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[Digest] config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			log.Printf("[Digest] config reloaded from %s\n", cfg.Path())
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		cancel()
+	}()
+
+	// Several digest processes may run for availability; each run goes to
+	// one of them.
+	host, _ := os.Hostname()
+	jobs := scheduler.New(fmt.Sprintf("digest@%s:%d", host, os.Getpid()), redisClient)
+	jobs.MustAdd(scheduler.Job{Name: "digest", Every: *interval, RunAtStart: true, Leader: true, Run: func(ctx context.Context) error {
+		return digester.RunOnce(ctx, time.Now())
+	}})
+	log.Printf("[Digest] checking for due digests every %s\n", *interval)
+	jobs.Run(ctx)
+}
@@ -0,0 +1,180 @@
+// Command history is an optional cluster-wide history service. It stores
+// every chat message broadcast over Redis in its own database and serves
+// /history and /search for the whole cluster; chat servers started with
+// -history-url proxy those requests to it instead of reading their own
+// SQLite files.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/antientropy"
+	"lukagolubovic/archive"
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/handlers"
+	"lukagolubovic/loadbalancer"
+	"lukagolubovic/middleware"
+	"lukagolubovic/models"
+	"lukagolubovic/mtls"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/scheduler"
+	"lukagolubovic/search"
+)
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "Host to listen on")
+	port := flag.Int("port", 9200, "Port to listen on")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file; only its redis, archive, queries, search and retention_days settings are used")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	dbPath := flag.String("db", "./history.db", "Path to the history database file")
+	lbURL := flag.String("lb", "http://127.0.0.1:9000", "Load balancer URL, used to find servers to backfill from")
+	lbSecret := flag.String("lb-secret", "", "Shared secret the load balancer was started with as -auth-secret")
+	syncToken := flag.String("sync-token", "", "The chat servers' -sync-token; enables backfilling missed messages from them")
+	syncInterval := flag.Duration("sync-interval", time.Minute, "Backfill from chat servers this often (0 disables)")
+	accessLogSample := flag.Float64("access-log-sample", 1, "Fraction of successful HTTP requests to log (errors are always logged)")
+	syncWindow := flag.Duration("sync-window", 24*time.Hour, "How far back each periodic backfill compares history")
+	flag.Parse()
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	if certs != nil {
+		go certs.Watch(mtls.WatchInterval)
+	} else if *redisTLS {
+		log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+	}
+
+	db, err := database.InitDB(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	writer := database.NewWriter(db)
+	go writer.Run()
+	defer writer.Close()
+
+	reads, err := database.OpenReadPool(db, nil)
+	if err != nil {
+		log.Fatalf("Failed to open read pool: %v", err)
+	}
+
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consume(ctx, redisClient, writer, redisCfg.Shards)
+	jobs := scheduler.New("history", redisClient)
+	// The service archives its own database like the chat servers, sharing
+	// their index.
+	if archiver := archive.New("history", redisClient, db, writer, cfg.Get().Archive); archiver != nil {
+		jobs.MustAdd(scheduler.Job{Name: "archive", Every: time.Hour, Jitter: time.Minute, Run: func(ctx context.Context) error {
+			return archiver.RunOnce(ctx, time.Now())
+		}})
+	}
+	if *syncInterval > 0 && *syncToken != "" {
+		if *lbSecret == "" && !tlsFiles.Enabled() {
+			log.Fatalf("Backfilling requires -lb-secret or mutual TLS: it sends -sync-token to every server the load balancer lists")
+		}
+		syncer := antientropy.New("", db, writer, loadbalancer.New(*lbURL, *lbSecret, "", "", certs.Transport()), cfg, *syncToken, *syncWindow, certs.Transport())
+		jobs.MustAdd(scheduler.Job{Name: "anti-entropy", Every: *syncInterval, RunAtStart: true, Run: syncer.RunOnce})
+	}
+	go jobs.Run(ctx)
+
+	mux := http.NewServeMux()
+	archived := archive.NewReader(redisClient, cfg.Get().Archive)
+	mux.HandleFunc("GET /history", handlers.GetHistory(reads, archived, cfg))
+	// Chat servers index messages into an external search engine; the
+	// service only searches it.
+	searchEngine, _ := search.New(cfg, reads)
+	mux.HandleFunc("GET /search", handlers.Search(searchEngine, cfg))
+	mux.HandleFunc("GET /messages/{id}/context", handlers.MessageContext(reads, archived, cfg))
+	mux.HandleFunc("GET /sync", handlers.Resync(reads, cfg))
+	mux.HandleFunc("GET /healthz", handlers.Liveness())
+
+	accessLog := middleware.AccessLogOptions{SampleRate: *accessLogSample, Skip: []string{"/healthz"}}
+	listenAddr := fmt.Sprintf("%s:%d", *host, *port)
+	server := &http.Server{Addr: listenAddr, Handler: middleware.AccessLog(accessLog, middleware.Recover(middleware.CORS(nil, middleware.Routes(mux))))}
+	listen := server.ListenAndServe
+	if certs != nil {
+		// Chat servers proxy to this service, so under mutual TLS only they
+		// may call it.
+		server.TLSConfig = certs.ServerConfig(tls.RequireAndVerifyClientCert)
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	go func() {
+		log.Printf("[History] serving /history, /search and /sync on %s\n", listenAddr)
+		if err := listen(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+}
+
+// consume stores every chat message broadcast by any server, subscribing
+// to every shard.
+func consume(ctx context.Context, redisClient redis.UniversalClient, writer *database.Writer, shards int) {
+	pubsub := redisClient.Subscribe(ctx, broker.Channels(shards)...)
+	defer pubsub.Close()
+
+	for rawMsg := range pubsub.Channel() {
+		var msg models.Message
+		if err := json.Unmarshal([]byte(rawMsg.Payload), &msg); err != nil {
+			continue
+		}
+		if !models.IsStored(msg.Type) || msg.ID == 0 {
+			continue
+		}
+
+		row := database.RowFromMessage(msg)
+		err := writer.Tx(func(tx *sql.Tx) error {
+			_, err := database.InsertReplicated(tx, row)
+			return err
+		})
+		if err != nil {
+			log.Printf("[History] Failed to store message %d: %v", msg.ID, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"lukagolubovic/balancer"
+	"lukagolubovic/config"
+	"lukagolubovic/middleware"
+	"lukagolubovic/mtls"
+	"lukagolubovic/scheduler"
+	"lukagolubovic/webhook"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "Address to listen on")
+	healthInterval := flag.Duration("health-interval", 0, "Check every server's /healthz this often, removing servers that fail 3 checks in a row (0 disables)")
+	strategy := flag.String("strategy", balancer.StrategyTwoChoices, "How /get picks a server: two-choices, least-loaded or round-robin")
+	authSecret := flag.String("auth-secret", "", "Shared secret servers must send as a bearer token to /register, /update, /deregister, /servers and /debug/vars (empty disables)")
+	registry := flag.String("registry", balancer.RegistryMemory, "Where the pool of servers is kept: memory, or file to survive restarts in -registry-file")
+	registryFile := flag.String("registry-file", "./lb-registry.json", "Registry file for -registry file")
+	notifyServers := flag.Bool("notify-on-shutdown", false, "On SIGTERM, tell every registered server to register again once a load balancer is back")
+	accessLogSample := flag.Float64("access-log-sample", 1, "Fraction of successful HTTP requests to log (errors are always logged)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file, reloaded on SIGHUP; only its webhooks, scaling, load_balancer, trusted_proxies and max_connections settings are used")
+	flag.Parse()
+	if err := config.ApplyEnv(flag.CommandLine, "LB"); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+
+	// Under mutual TLS, or with a secret, only chat servers (and chatctl) may
+	// change or list the pool; browsers still reach /get and /stats.
+	internal := func(h http.Handler) http.Handler { return middleware.RequireSecret(*authSecret, h) }
+	if certs != nil {
+		internal = func(h http.Handler) http.Handler {
+			return middleware.RequireClientCert(middleware.RequireSecret(*authSecret, h))
+		}
+		go certs.Watch(mtls.WatchInterval)
+	}
+
+	opts := balancer.Options{Strategy: *strategy, Transport: certs.Transport(), Secret: *authSecret}
+	switch *registry {
+	case balancer.RegistryMemory:
+	case balancer.RegistryFile:
+		opts.Registry = balancer.FileRegistry{Path: *registryFile}
+	default:
+		log.Fatalf("Invalid -registry %q: must be memory or file", *registry)
+	}
+	if err := opts.Validate(); err != nil {
+		log.Fatalf("Invalid -strategy: %v", err)
+	}
+
+	hooks := webhook.New("loadbalancer", func() []config.Webhook { return cfg.Get().Webhooks })
+	go hooks.Run(context.Background())
+	lb := balancer.New(hooks, cfg, opts)
+	if n, err := lb.Restore(); err != nil {
+		log.Fatalf("Failed to load the server registry: %v", err)
+	} else if n > 0 {
+		log.Printf("[LB] Restored %d servers from %s\n", n, *registryFile)
+	}
+	jobs := scheduler.New("loadbalancer", nil)
+	jobs.MustAdd(scheduler.Job{Name: "scale-advice", Every: balancer.SampleInterval, Run: lb.SampleScale})
+	if *healthInterval > 0 {
+		jobs.MustAdd(scheduler.Job{Name: "health-check", Every: *healthInterval, Run: lb.CheckHealth})
+	}
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go jobs.Run(jobsCtx)
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Printf("[LB] TLS certificate reload failed, keeping previous certificates: %v", err)
+				}
+			}
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[LB] config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			log.Printf("[LB] config reloaded from %s\n", cfg.Path())
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /register", internal(middleware.MaxBytes(middleware.SmallBody, http.HandlerFunc(lb.RegisterServer))))
+	mux.Handle("POST /update", internal(middleware.MaxBytes(middleware.SmallBody, http.HandlerFunc(lb.UpdateServer))))
+	mux.Handle("POST /deregister", internal(middleware.MaxBytes(middleware.SmallBody, http.HandlerFunc(lb.DeregisterServer))))
+	mux.Handle("GET /get", balancer.Protect(cfg, http.HandlerFunc(lb.GetServer)))
+	mux.Handle("GET /servers", internal(http.HandlerFunc(lb.ListServers)))
+	mux.HandleFunc("GET /stats", lb.Stats)
+	mux.HandleFunc("GET /scale-advice", lb.ScaleAdviceHandler)
+	mux.Handle("GET /debug/vars", internal(expvar.Handler()))
+
+	// Servers report load on every connect and disconnect, so /update is the
+	// noisiest endpoint; sample it down with -access-log-sample.
+	accessLog := middleware.AccessLogOptions{SampleRate: *accessLogSample}
+	// No route takes a large body, so every request is capped.
+	handler := middleware.RealIP(cfg, middleware.AccessLog(accessLog, middleware.Recover(middleware.CORS(nil, middleware.MaxBytes(middleware.SmallBody, middleware.Routes(mux))))))
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+		// Slow or oversized headers can't tie up connections.
+		ReadHeaderTimeout: 5 * time.Second,
+		MaxHeaderBytes:    8 << 10,
+	}
+	listen := server.ListenAndServe
+	if certs != nil {
+		server.TLSConfig = certs.ServerConfig(tls.VerifyClientCertIfGiven)
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+		log.Printf("[LB] Load Balancer is running on %s (TLS)\n", *addr)
+	} else {
+		log.Printf("[LB] Load Balancer is running on %s\n", *addr)
+	}
+	go func() {
+		if err := listen(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start load balancer: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	// Requests in flight finish before the pool is saved, so the snapshot
+	// has the last registration and load reports.
+	log.Println("[LB] shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[LB] shutdown error: %v", err)
+	}
+	stopJobs()
+	if n, err := lb.SaveRegistry(); err != nil {
+		log.Printf("[LB] Failed to save the server registry: %v", err)
+	} else if opts.Registry != nil {
+		log.Printf("[LB] Saved %d servers to %s\n", n, *registryFile)
+	}
+	if *notifyServers {
+		n := lb.NotifyShutdown(ctx)
+		log.Printf("[LB] Notified %d servers of the shutdown\n", n)
+	}
+	log.Println("[LB] stopped")
+}
@@ -0,0 +1,127 @@
+// Command mqttgateway lets devices publish to rooms and follow room traffic
+// over MQTT, as mapped by the config file's mqtt rules. It talks to Redis
+// like a chat server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+	"lukagolubovic/mqtt"
+	"lukagolubovic/mtls"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/roomconfig"
+)
+
+func main() {
+	listen := flag.String("listen", ":1883", "Address to accept MQTT connections on")
+	name := flag.String("name", "", "Name of this gateway, shown as the server of its messages (default the hostname)")
+	certFile := flag.String("mqtt-cert", "", "Certificate to serve MQTT over TLS with (requires -mqtt-key)")
+	keyFile := flag.String("mqtt-key", "", "Private key for -mqtt-cert")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file, for its mqtt rules, redis section and chat policies; reloaded on SIGHUP")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("-name is required when the hostname is unknown: %v", err)
+		}
+		*name = host
+	}
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	logRules(cfg.Get().MQTT)
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		if certs == nil {
+			log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+		}
+		go certs.Watch(mtls.WatchInterval)
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[MQTT] config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			if _, err := roomconfig.Sync(context.Background(), redisClient, cfg); err != nil {
+				log.Printf("[MQTT] failed to reload room overrides: %v", err)
+			}
+			log.Printf("[MQTT] config reloaded from %s\n", cfg.Path())
+			logRules(cfg.Get().MQTT)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		cancel()
+	}()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listen, err)
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load MQTT certificate: %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+	gw := mqtt.New(*name, redisClient, cfg)
+	if err := gw.ClaimNode(ctx); err != nil {
+		log.Fatalf("[MQTT] %v", err)
+	}
+	go gw.Run(ctx)
+
+	log.Printf("[MQTT] serving on %s\n", *listen)
+	if err := gw.Serve(ctx, ln); err != nil {
+		log.Fatalf("MQTT listener failed: %v", err)
+	}
+}
+
+// logRules warns about a config the gateway can't do much with.
+func logRules(m config.MQTT) {
+	if len(m.Rules) == 0 {
+		log.Printf("[MQTT] the config has no mqtt rules, devices can neither publish nor subscribe")
+	}
+	for _, rule := range m.Rules {
+		if rule.Room != models.DefaultRoom {
+			log.Printf("[MQTT] rule for topic '%s' maps to room '%s', but only %s is bridged; it is ignored", rule.Topic, rule.Room, models.DefaultRoom)
+		}
+	}
+}
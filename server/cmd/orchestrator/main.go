@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/balancer"
+	"lukagolubovic/middleware"
+)
+
+const stopTimeout = 10 * time.Second
+
+type instance struct {
+	Port    int    `json:"port"`
+	Address string `json:"address"`
+	PID     int    `json:"pid"`
+	cmd     *exec.Cmd
+	done    chan struct{}
+}
+
+type Orchestrator struct {
+	mu        sync.Mutex
+	bin       string
+	host      string
+	basePort  int
+	redisAddr string
+	dataDir   string
+	instances map[int]*instance
+}
+
+func (o *Orchestrator) Scale(replicas int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for len(o.instances) < replicas {
+		port := o.basePort
+		for o.instances[port] != nil {
+			port++
+		}
+		if err := o.start(port); err != nil {
+			return err
+		}
+	}
+
+	if len(o.instances) > replicas {
+		ports := o.ports()
+		for _, port := range ports[replicas:] {
+			o.stop(o.instances[port])
+			delete(o.instances, port)
+		}
+	}
+
+	return nil
+}
+
+func (o *Orchestrator) start(port int) error {
+	cmd := exec.Command(o.bin,
+		"-host", o.host,
+		"-port", fmt.Sprint(port),
+		"-redis", o.redisAddr,
+		"-db", filepath.Join(o.dataDir, fmt.Sprintf("chat-%d.db", port)),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start instance on port %d: %w", port, err)
+	}
+
+	inst := &instance{
+		Port:    port,
+		Address: fmt.Sprintf("ws://%s:%d", o.host, port),
+		PID:     cmd.Process.Pid,
+		cmd:     cmd,
+		done:    make(chan struct{}),
+	}
+	o.instances[port] = inst
+	log.Printf("[Orchestrator] Started instance %s (pid %d)\n", inst.Address, inst.PID)
+
+	go func() {
+		err := cmd.Wait()
+		close(inst.done)
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if o.instances[port] == inst {
+			delete(o.instances, port)
+			log.Printf("[Orchestrator] Instance %s exited unexpectedly: %v\n", inst.Address, err)
+		}
+	}()
+
+	return nil
+}
+
+func (o *Orchestrator) stop(inst *instance) {
+	log.Printf("[Orchestrator] Stopping instance %s (pid %d)\n", inst.Address, inst.PID)
+	inst.cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-inst.done:
+	case <-time.After(stopTimeout):
+		log.Printf("[Orchestrator] Instance %s did not stop in %s, killing\n", inst.Address, stopTimeout)
+		inst.cmd.Process.Kill()
+		<-inst.done
+	}
+}
+
+func (o *Orchestrator) ports() []int {
+	ports := make([]int, 0, len(o.instances))
+	for port := range o.instances {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (o *Orchestrator) list() []*instance {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := make([]*instance, 0, len(o.instances))
+	for _, port := range o.ports() {
+		list = append(list, o.instances[port])
+	}
+	return list
+}
+
+func (o *Orchestrator) handleInstances(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o.list())
+}
+
+func (o *Orchestrator) handleScale(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Replicas int `json:"replicas"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+		return
+	}
+	if req.Replicas < 0 {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "replicas must not be negative")
+		return
+	}
+
+	if err := o.Scale(req.Replicas); err != nil {
+		apierror.WriteDetails(w, http.StatusInternalServerError, apierror.CodeInternal, "scale failed", err.Error())
+		log.Printf("[Orchestrator] Scale to %d failed: %v", req.Replicas, err)
+		return
+	}
+
+	log.Printf("[Orchestrator] Scaled to %d instances\n", req.Replicas)
+	o.handleInstances(w, r)
+}
+
+// autoscale follows the load balancer's scale advice every interval. The
+// load balancer may see servers this orchestrator didn't start, so the
+// difference between the advised and registered counts is applied to the
+// instances here.
+func (o *Orchestrator) autoscale(adviceURL string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for range time.Tick(interval) {
+		advice, err := fetchAdvice(client, adviceURL)
+		if err != nil {
+			log.Printf("[Orchestrator] Failed to fetch scale advice: %v", err)
+			continue
+		}
+		if advice.Recommendation == balancer.ScaleHold {
+			continue
+		}
+		target := len(o.list()) + advice.Replicas - advice.Servers
+		if target < 0 {
+			target = 0
+		}
+		log.Printf("[Orchestrator] Scaling %s to %d instances: %s\n", advice.Recommendation, target, advice.Reason)
+		if err := o.Scale(target); err != nil {
+			log.Printf("[Orchestrator] Scale to %d failed: %v", target, err)
+		}
+	}
+}
+
+func fetchAdvice(client *http.Client, adviceURL string) (balancer.ScaleAdvice, error) {
+	var advice balancer.ScaleAdvice
+	resp, err := client.Get(adviceURL)
+	if err != nil {
+		return advice, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return advice, fmt.Errorf("%s: %s", adviceURL, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&advice)
+	return advice, err
+}
+
+func main() {
+	replicas := flag.Int("n", 3, "Number of chat server instances to start")
+	bin := flag.String("bin", "", "Path to the chat server binary (built from ./cmd/server when empty)")
+	host := flag.String("host", "127.0.0.1", "Host the chat servers listen on")
+	basePort := flag.Int("base-port", 8080, "Port of the first chat server; others use sequential ports")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address passed to every instance")
+	dataDir := flag.String("data", "./data", "Directory holding one SQLite database per instance")
+	control := flag.String("control", "127.0.0.1:9100", "Address of the orchestrator control API")
+	autoscaleLB := flag.String("autoscale-lb", "", "Load balancer URL whose /scale-advice to follow, e.g. http://127.0.0.1:9000 (empty disables autoscaling)")
+	autoscaleInterval := flag.Duration("autoscale-interval", 30*time.Second, "How often to check the scale advice")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dataDir, 0o755); err != nil {
+		log.Fatalf("Failed to create data directory: %v", err)
+	}
+
+	if *bin == "" {
+		*bin = filepath.Join(*dataDir, "chatserver")
+		log.Printf("[Orchestrator] Building chat server into %s\n", *bin)
+		build := exec.Command("go", "build", "-o", *bin, "./cmd/server")
+		build.Stdout = os.Stdout
+		build.Stderr = os.Stderr
+		if err := build.Run(); err != nil {
+			log.Fatalf("Failed to build chat server: %v", err)
+		}
+	}
+
+	o := &Orchestrator{
+		bin:       *bin,
+		host:      *host,
+		basePort:  *basePort,
+		redisAddr: *redisAddr,
+		dataDir:   *dataDir,
+		instances: make(map[int]*instance),
+	}
+
+	if err := o.Scale(*replicas); err != nil {
+		log.Fatalf("Failed to start instances: %v", err)
+	}
+
+	if *autoscaleLB != "" {
+		go o.autoscale(strings.TrimRight(*autoscaleLB, "/")+"/scale-advice", *autoscaleInterval)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /instances", o.handleInstances)
+	mux.Handle("POST /scale", middleware.MaxBytes(middleware.SmallBody, http.HandlerFunc(o.handleScale)))
+
+	go func() {
+		log.Printf("[Orchestrator] control API on %s (/instances, /scale)\n", *control)
+		if err := http.ListenAndServe(*control, middleware.AccessLog(middleware.AccessLogOptions{SampleRate: 1}, middleware.Recover(middleware.Routes(mux)))); err != nil {
+			log.Fatalf("Failed to start control API: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("[Orchestrator] Shutting down all instances")
+	o.Scale(0)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lukagolubovic/database"
+	"lukagolubovic/idgen"
+	"lukagolubovic/models"
+)
+
+type benchQuery struct {
+	name string
+	sql  string
+	args []interface{}
+	run  func() error
+}
+
+func main() {
+	rows := flag.Int("rows", 100000, "Number of messages to seed")
+	users := flag.Int("users", 200, "Number of distinct users to seed")
+	iterations := flag.Int("n", 200, "Iterations per query")
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "querybench")
+	if err != nil {
+		log.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := database.InitDB(filepath.Join(dir, "bench.db"))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to begin seed transaction: %v", err)
+	}
+	for u := 1; u <= *users; u++ {
+		if _, err := tx.Exec("INSERT INTO users(id, username) VALUES(?, ?)", u, fmt.Sprintf("user%d", u)); err != nil {
+			log.Fatalf("Failed to seed users: %v", err)
+		}
+	}
+	for i := 1; i <= *rows; i++ {
+		if _, err := tx.Exec("INSERT INTO messages(id, room_id, user_id, message, server, timestamp) VALUES(?, ?, ?, ?, ?, datetime('now', ?))",
+			i, models.DefaultRoomID, i%*users+1, "benchmark message", "ws://bench", fmt.Sprintf("-%d minutes", *rows-i)); err != nil {
+			log.Fatalf("Failed to seed messages: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit seed data: %v", err)
+	}
+	if _, err := db.Exec("ANALYZE"); err != nil {
+		log.Fatalf("Failed to analyze: %v", err)
+	}
+	fmt.Printf("seeded %d messages from %d users in %s\n\n", *rows, *users, time.Since(start).Round(time.Millisecond))
+
+	queries := []benchQuery{
+		{
+			name: "recent history",
+			sql:  database.RecentMessagesSQL,
+			args: []interface{}{models.DefaultRoomID, 50},
+			run: func() error {
+				_, err := database.RecentMessages(context.Background(), db, models.DefaultRoomID, 50)
+				return err
+			},
+		},
+		{
+			name: "archive page before newest",
+			sql:  database.ArchiveBeforeSQL,
+			args: []interface{}{models.DefaultRoomID, 0, int64(math.MaxInt64), "", "9999-12-31 23:59:59", 50},
+			run: func() error {
+				_, err := database.ArchivedMessages(context.Background(), db, models.DefaultRoomID, database.ArchiveQuery{Last: true, Limit: 50})
+				return err
+			},
+		},
+		{
+			name: "search in the last day",
+			sql:  database.SearchMessagesSQL,
+			args: []interface{}{models.DefaultRoomID, idgen.MinID(time.Now().Add(-24 * time.Hour)), int64(math.MaxInt64), "%hello%", 50},
+			run: func() error {
+				_, err := database.SearchMessages(context.Background(), db, models.DefaultRoomID, "hello", idgen.MinID(time.Now().Add(-24*time.Hour)), 0, 50)
+				return err
+			},
+		},
+		{
+			name: "history stream",
+			sql:  database.StreamMessagesSQL,
+			args: []interface{}{models.DefaultRoomID, 0, int64(math.MaxInt64)},
+			run: func() error {
+				return database.EachMessage(context.Background(), db, models.DefaultRoomID, 0, 0, func(models.Message) error { return nil })
+			},
+		},
+		{
+			name: "message context",
+			sql:  database.RoomMessageSQL,
+			args: []interface{}{models.DefaultRoomID, int64(*rows / 2)},
+			run: func() error {
+				_, _, _, err := database.MessageContext(context.Background(), db, models.DefaultRoomID, int64(*rows/2), 25)
+				return err
+			},
+		},
+		{
+			name: "digest mentions in the last day",
+			sql:  database.MentionsSQL,
+			args: []interface{}{models.DefaultRoomID, time.Now().Add(-24 * time.Hour).UTC().Format("2006-01-02 15:04:05"), 42, "%@user42%", 100},
+			run: func() error {
+				_, err := database.Mentions(db, models.DefaultRoomID, 42, "user42", time.Now().Add(-24*time.Hour), 100)
+				return err
+			},
+		},
+		{
+			name: "retention prune (no matches)",
+			sql:  database.PruneMessagesSQL,
+			args: []interface{}{models.DefaultRoomID, "-3650 days"},
+			run: func() error {
+				_, err := database.PruneMessages(db, models.DefaultRoomID, 3650)
+				return err
+			},
+		},
+		{
+			name: "archive delete (no matches)",
+			sql:  database.DeleteArchivedSQL,
+			args: []interface{}{models.DefaultRoomID, 0, "2000-01-01 00:00:00"},
+			run: func() error {
+				_, err := database.DeleteArchived(db, models.DefaultRoomID, 0, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+				return err
+			},
+		},
+		{
+			name: "user lookup by name",
+			sql:  "SELECT id FROM users WHERE username = ?",
+			args: []interface{}{"user42"},
+			run: func() error {
+				var id int64
+				return db.QueryRow("SELECT id FROM users WHERE username = ?", "user42").Scan(&id)
+			},
+		},
+	}
+
+	failed := false
+	for _, q := range queries {
+		plan, err := database.ExplainQueryPlan(db, q.sql, q.args...)
+		if err != nil {
+			log.Fatalf("Failed to explain %s: %v", q.name, err)
+		}
+
+		start := time.Now()
+		for i := 0; i < *iterations; i++ {
+			if err := q.run(); err != nil {
+				log.Fatalf("Query %s failed: %v", q.name, err)
+			}
+		}
+		perOp := time.Since(start) / time.Duration(*iterations)
+
+		fmt.Printf("%s: %s/op\n", q.name, perOp)
+		for _, step := range plan {
+			marker := ""
+			// A bare "SCAN <table>" without an index means a full table scan.
+			if strings.HasPrefix(step, "SCAN ") && !strings.Contains(step, "INDEX") {
+				marker = "  <-- full table scan"
+				failed = true
+			}
+			fmt.Printf("    %s%s\n", step, marker)
+		}
+		fmt.Println()
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
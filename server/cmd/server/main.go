@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"lukagolubovic/antientropy"
+	"lukagolubovic/archive"
+	"lukagolubovic/backup"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/gif"
+	"lukagolubovic/handlers"
+	"lukagolubovic/hub"
+	"lukagolubovic/loadbalancer"
+	"lukagolubovic/lockout"
+	"lukagolubovic/middleware"
+	"lukagolubovic/models"
+	"lukagolubovic/mtls"
+	"lukagolubovic/objectstore"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/scheduler"
+	"lukagolubovic/search"
+	"lukagolubovic/translate"
+)
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "Host to run the server on")
+	port := flag.Int("port", 8080, "Port to run the server on")
+	adminHost := flag.String("admin-host", "", "Host for the control-plane listener (defaults to -host)")
+	adminPort := flag.Int("admin-port", 0, "Serve /admin, /debug, /drain and health checks on this separate port so it can be firewalled (0 serves them on -port)")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	dbPath := flag.String("db", "./chat.db", "Path to the SQLite database file")
+	spillPath := flag.String("spill", "./chat.spill", "Append-only file keeping control commands published while Redis is down, replayed once it is back (empty disables)")
+	readDBs := flag.String("read-db", "", "Comma-separated read replica database paths used by /history (defaults to the primary)")
+	advertise := flag.String("advertise", "", "Host advertised to the load balancer (defaults to POD_IP, then the hostname when listening on all interfaces)")
+	lbURL := flag.String("lb", "http://127.0.0.1:9000", "Load balancer URL")
+	lbSecret := flag.String("lb-secret", "", "Shared secret the load balancer was started with as -auth-secret")
+	configPath := flag.String("config", "", "Path to a JSON runtime config file, reloaded on SIGHUP")
+	adminToken := flag.String("admin-token", "", "Bearer token for /admin endpoints (disabled when empty)")
+	syncToken := flag.String("sync-token", "", "Bearer token servers present to each other's /admin/sync endpoints for anti-entropy (disabled when empty)")
+	backupDir := flag.String("backup-dir", "./backups", "Directory for database snapshots")
+	backupInterval := flag.Duration("backup-interval", 0, "Take a snapshot into -backup-dir this often (0 disables scheduled backups)")
+	backupCron := flag.String("backup-cron", "", "Take a snapshot into -backup-dir at the times of this cron expression, e.g. \"0 3 * * *\" (overrides -backup-interval)")
+	backupKeep := flag.Int("backup-keep", 7, "Number of scheduled snapshots to keep")
+	accessLogSample := flag.Float64("access-log-sample", 1, "Fraction of successful HTTP requests to log (errors are always logged)")
+	historyURL := flag.String("history-url", "", "Proxy /history, /search and /sync to this cluster-wide history service instead of the local database")
+	syncInterval := flag.Duration("sync-interval", time.Minute, "Reconcile history with peer servers this often (0 disables anti-entropy; requires -sync-token)")
+	syncWindow := flag.Duration("sync-window", 24*time.Hour, "How far back each periodic anti-entropy pass compares history")
+	flag.Parse()
+	if err := config.ApplyEnv(flag.CommandLine, "CHAT"); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	if certs != nil {
+		// Browsers don't hold cluster certificates, so mutual TLS can only
+		// guard a control plane that has a listener of its own.
+		if *adminPort == 0 {
+			log.Fatalf("-tls-cert requires -admin-port")
+		}
+		go certs.Watch(mtls.WatchInterval)
+	} else if *redisTLS {
+		log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+	}
+
+	address := fmt.Sprintf("ws://%s:%d", advertisedHost(*advertise, *host), *port)
+	if *adminHost == "" {
+		*adminHost = *host
+	}
+	adminAddress := ""
+	if *adminPort != 0 {
+		scheme := "http"
+		if certs != nil {
+			scheme = "https"
+		}
+		adminAddress = fmt.Sprintf("%s://%s:%d", scheme, advertisedHost(*advertise, *adminHost), *adminPort)
+	}
+
+	db, err := database.InitDB(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	writer := database.NewWriter(db)
+	go writer.Run()
+	defer writer.Close()
+
+	reads, err := database.OpenReadPool(db, strings.Split(*readDBs, ","))
+	if err != nil {
+		log.Fatalf("Failed to open read replicas: %v", err)
+	}
+	defer reads.Close()
+	if reads.Size() > 0 {
+		log.Printf("[ChatServer] serving history reads from %d replica(s)\n", reads.Size())
+	}
+
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	lbClient := loadbalancer.New(*lbURL, *lbSecret, address, adminAddress, certs.Transport())
+	lbClient.Register()
+
+	hub := hub.New(address, redisClient, db, writer, lbClient, cfg)
+	if err := hub.ClaimNode(context.Background()); err != nil {
+		log.Fatalf("Failed to claim an id generator node: %v", err)
+	}
+	if *spillPath != "" {
+		if err := hub.OpenSpill(*spillPath); err != nil {
+			log.Fatalf("Failed to open spill file: %v", err)
+		}
+	}
+	// Search is read at startup only. With an external engine, every
+	// server indexes the messages it accepts.
+	searchEngine, searchIndex := search.New(cfg, reads)
+	var reindexer *search.Reindexer
+	if searchIndex != nil {
+		setupCtx, cancelSetup := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := searchIndex.Setup(setupCtx); err != nil {
+			log.Printf("[ChatServer] search index setup failed, searches may fail until it succeeds: %v", err)
+		}
+		cancelSetup()
+		if err := hub.RegisterPersistHook(search.Hook(searchIndex)); err != nil {
+			log.Fatalf("Invalid persistence hooks: %v", err)
+		}
+	}
+	go hub.Run()
+
+	// Snapshots go to -backup-dir unless the config names an object store;
+	// like the archive, that is only read at startup.
+	backups := backup.Destination{Dir: *backupDir}
+	if b := cfg.Get().Backups; b.Enabled() {
+		backups = backup.Destination{Store: objectstore.New(b.ObjectStorage), Prefix: b.Prefix}
+	}
+
+	// Jobs of the process itself; the hub schedules its own.
+	jobs := scheduler.New(address, redisClient)
+	if *backupInterval > 0 || *backupCron != "" {
+		every := *backupInterval
+		if *backupCron != "" {
+			every = 0
+		}
+		err := jobs.Add(scheduler.Job{Name: "backup", Every: every, Cron: *backupCron, Run: func(ctx context.Context) error {
+			return backups.Rotate(ctx, db, *backupKeep)
+		}})
+		if err != nil {
+			log.Fatalf("Invalid backup schedule: %v", err)
+		}
+	}
+	if *syncInterval > 0 && *syncToken != "" {
+		if *lbSecret == "" && !tlsFiles.Enabled() {
+			// The token goes to every server the load balancer lists, so
+			// only servers that proved themselves to it may be listed.
+			log.Fatalf("Anti-entropy requires -lb-secret or mutual TLS: it sends -sync-token to every server the load balancer lists")
+		}
+		syncer := antientropy.New(address, db, writer, lbClient, cfg, *syncToken, *syncWindow, certs.Transport())
+		jobs.MustAdd(scheduler.Job{Name: "anti-entropy", Every: *syncInterval, RunAtStart: true, Run: syncer.RunOnce})
+	} else if *syncInterval > 0 {
+		log.Printf("[ChatServer] anti-entropy disabled: it authenticates to peers with -sync-token")
+	}
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go jobs.Run(jobsCtx)
+	if searchIndex != nil {
+		reindexer = search.NewReindexer(jobsCtx, address, searchIndex, db)
+	}
+
+	mux := http.NewServeMux()
+	archived := archive.NewReader(redisClient, cfg.Get().Archive)
+	if *historyURL != "" {
+		proxy, err := handlers.HistoryProxy(*historyURL, certs.Transport())
+		if err != nil {
+			log.Fatalf("Invalid -history-url: %v", err)
+		}
+		mux.Handle("GET /history", proxy)
+		mux.Handle("GET /search", proxy)
+		mux.Handle("GET /messages/{id}/context", proxy)
+		mux.Handle("GET /sync", proxy)
+	} else {
+		mux.HandleFunc("GET /history", handlers.GetHistory(reads, archived, cfg))
+		mux.HandleFunc("GET /search", handlers.Search(searchEngine, cfg))
+		mux.HandleFunc("GET /messages/{id}/context", handlers.MessageContext(reads, archived, cfg))
+		mux.HandleFunc("GET /sync", handlers.Resync(reads, cfg))
+	}
+	mux.HandleFunc("GET /room", handlers.GetRoom(db))
+	mux.HandleFunc("GET /rooms/{room}/members", handlers.ListMembers(hub))
+	mux.HandleFunc("GET /gif/search", handlers.SearchGIFs(gif.NewSearcher(redisClient, cfg), cfg))
+	mux.HandleFunc("POST /attachments", handlers.UploadAttachment(hub))
+	mux.HandleFunc("GET /attachments/{id}", handlers.GetAttachment(hub))
+	mux.HandleFunc("GET /attachments/{id}/thumbnails/{size}", handlers.GetThumbnail(hub))
+	mux.HandleFunc("GET /attachments/{id}/link", handlers.AttachmentLink(hub))
+	mux.HandleFunc("GET /attachments/usage", handlers.AttachmentUsage(hub))
+	mux.HandleFunc("GET /messages/{id}/translate", handlers.TranslateMessage(reads, archived, translate.NewTranslator(redisClient, cfg), cfg))
+	mux.Handle("POST /invites/redeem", middleware.MaxBytes(middleware.SmallBody, handlers.RedeemInvite(hub)))
+	mux.Handle("POST /widget/tokens", middleware.MaxBytes(middleware.SmallBody, handlers.MintWidgetToken(hub)))
+	mux.HandleFunc("GET /users/{username}/drafts", handlers.ListDrafts(hub))
+	mux.HandleFunc("GET /users/{username}/drafts/{room}", handlers.GetDraft(hub))
+	mux.Handle("PUT /users/{username}/drafts/{room}", middleware.MaxBytes(middleware.SmallBody, handlers.SaveDraft(hub)))
+	mux.HandleFunc("DELETE /users/{username}/drafts/{room}", handlers.DeleteDraft(hub))
+	mux.HandleFunc("GET /unsubscribe", handlers.Unsubscribe(hub))
+	mux.Handle("POST /unsubscribe", middleware.MaxBytes(middleware.SmallBody, handlers.Unsubscribe(hub)))
+	mux.HandleFunc("GET /stats/rooms", handlers.RoomStats(reads, cfg))
+	mux.HandleFunc("GET /stats/global", handlers.GlobalStats(reads, lbClient, cfg))
+	mux.HandleFunc("GET /stats/limits", handlers.LimitsStats(hub))
+	mux.HandleFunc("GET /openapi.json", handlers.OpenAPI())
+	mux.HandleFunc("GET /healthz", handlers.Liveness())
+	mux.HandleFunc("GET /readyz", handlers.Readiness(lbClient))
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ServeWS(hub, w, r)
+	})
+
+	// The control plane shares the data-plane mux unless -admin-port gives
+	// it a listener of its own.
+	control := mux
+	if *adminPort != 0 {
+		control = http.NewServeMux()
+		control.HandleFunc("GET /healthz", handlers.Liveness())
+		control.HandleFunc("GET /readyz", handlers.Readiness(lbClient))
+	}
+	// /drain is left open for preStop hooks only on a control-plane
+	// listener of its own; on the public port anyone could drain the server.
+	drain := http.Handler(handlers.Drain(lbClient))
+	if *adminPort == 0 {
+		drain = middleware.AdminAuth(*adminToken, drain)
+	}
+	control.Handle("GET /drain", drain)
+	control.Handle("POST /drain", drain)
+	control.Handle("POST /lb/shutdown", middleware.RequireSecret(*lbSecret, handlers.LoadBalancerShutdown(lbClient)))
+	control.Handle("POST /admin/drain", middleware.AdminAuth(*adminToken, handlers.EvictingDrain(lbClient, hub)))
+	control.Handle("POST /admin/control", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.ControlBody, handlers.Control(hub))))
+	control.Handle("GET /admin/tail", middleware.AdminAuth(*adminToken, handlers.Tail(hub)))
+	control.Handle("GET /admin/sync/digest", middleware.AdminAuth(*syncToken, handlers.SyncDigest(reads, cfg)))
+	control.Handle("GET /admin/sync/messages", middleware.AdminAuth(*syncToken, handlers.SyncMessages(reads, cfg)))
+	control.Handle("POST /admin/invites", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.CreateInvite(hub))))
+	control.Handle("DELETE /admin/invites/{id}", middleware.AdminAuth(*adminToken, handlers.RevokeInvite(hub)))
+	control.Handle("GET /admin/attachments/quarantine", middleware.AdminAuth(*adminToken, handlers.QuarantinedAttachments(hub)))
+	control.Handle("DELETE /admin/attachments/{id}", middleware.AdminAuth(*adminToken, handlers.DeleteAttachment(hub)))
+	control.Handle("GET /admin/users", middleware.AdminAuth(*adminToken, handlers.ConnectedUsers(hub)))
+	control.Handle("GET /admin/audit", middleware.AdminAuth(*adminToken, handlers.AuditLog(hub)))
+	control.Handle("GET /admin/users/{username}/attachment-quota", middleware.AdminAuth(*adminToken, handlers.GetAttachmentQuota(hub)))
+	control.Handle("PUT /admin/users/{username}/attachment-quota", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SetAttachmentQuota(hub))))
+	control.Handle("DELETE /admin/users/{username}/attachment-quota", middleware.AdminAuth(*adminToken, handlers.SetAttachmentQuota(hub)))
+	control.Handle("GET /admin/users/{username}/sessions", middleware.AdminAuth(*adminToken, handlers.ListSessions(hub)))
+	control.Handle("DELETE /admin/users/{username}/sessions", middleware.AdminAuth(*adminToken, handlers.RevokeSession(hub)))
+	control.Handle("DELETE /admin/users/{username}/sessions/{id}", middleware.AdminAuth(*adminToken, handlers.RevokeSession(hub)))
+	control.Handle("GET /admin/notifications/{username}", middleware.AdminAuth(*adminToken, handlers.GetNotificationPrefs(hub)))
+	control.Handle("PUT /admin/notifications/{username}", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SetNotificationPrefs(hub))))
+	control.Handle("GET /admin/rooms/{room}/config", middleware.AdminAuth(*adminToken, handlers.GetRoomOverrides(hub)))
+	control.Handle("PUT /admin/rooms/{room}/config", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SetRoomOverrides(hub))))
+	control.Handle("GET /admin/maintenance", middleware.AdminAuth(*adminToken, handlers.GetMaintenance(hub)))
+	control.Handle("PUT /admin/maintenance", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SetMaintenance(hub))))
+	control.Handle("GET /admin/templates", middleware.AdminAuth(*adminToken, handlers.ListTemplates(hub)))
+	control.Handle("GET /admin/templates/{name}", middleware.AdminAuth(*adminToken, handlers.GetTemplate(hub)))
+	control.Handle("PUT /admin/templates/{name}", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SetTemplate(hub))))
+	control.Handle("DELETE /admin/templates/{name}", middleware.AdminAuth(*adminToken, handlers.DeleteTemplate(hub)))
+	control.Handle("POST /admin/templates/{name}/send", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.SmallBody, handlers.SendTemplate(hub))))
+	control.Handle("POST /admin/cards", middleware.AdminAuth(*adminToken, middleware.MaxBytes(middleware.ControlBody, handlers.PostCard(hub))))
+	control.Handle("GET /admin/search/reindex", middleware.AdminAuth(*adminToken, handlers.SearchReindexStatus(reindexer)))
+	control.Handle("POST /admin/search/reindex", middleware.AdminAuth(*adminToken, handlers.ReindexSearch(reindexer)))
+	control.Handle("GET /admin/dead-letters", middleware.AdminAuth(*adminToken, handlers.DeadLetters(hub)))
+	control.Handle("POST /admin/dead-letters/{id}/retry", middleware.AdminAuth(*adminToken, handlers.RetryDeadLetter(hub)))
+	control.Handle("DELETE /admin/dead-letters/{id}", middleware.AdminAuth(*adminToken, handlers.DiscardDeadLetter(hub)))
+	control.Handle("GET /admin/backup", middleware.AdminAuth(*adminToken, handlers.DownloadBackup(db)))
+	control.Handle("POST /admin/backup", middleware.AdminAuth(*adminToken, handlers.CreateBackup(db, backups)))
+	control.Handle("GET /debug/vars", middleware.AdminAuth(*adminToken, expvar.Handler()))
+	control.Handle("GET /debug/pprof/", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Index)))
+	control.Handle("GET /debug/pprof/cmdline", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Cmdline)))
+	control.Handle("GET /debug/pprof/profile", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Profile)))
+	control.Handle("GET /debug/pprof/symbol", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Symbol)))
+	control.Handle("POST /debug/pprof/symbol", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Symbol)))
+	control.Handle("GET /debug/pprof/trace", middleware.AdminAuth(*adminToken, http.HandlerFunc(pprof.Trace)))
+
+	accessLog := middleware.AccessLogOptions{SampleRate: *accessLogSample, Skip: []string{"/healthz", "/readyz"}}
+	guard := lockout.New(redisClient, cfg, hub.Audit())
+	handler := middleware.RealIP(cfg, middleware.AccessLog(accessLog, middleware.Recover(middleware.CORS(cfg, middleware.Lockout(guard, middleware.Routes(mux))))))
+
+	listenAddr := fmt.Sprintf("%s:%d", *host, *port)
+	log.Printf("[ChatServer] starting on %s (advertised as %s), serving /ws and /history\n", listenAddr, address)
+	server := &http.Server{Addr: listenAddr, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Operators and peers call the control plane directly, never a browser,
+	// so it gets no CORS handling.
+	var adminServer *http.Server
+	if *adminPort != 0 {
+		adminListenAddr := fmt.Sprintf("%s:%d", *adminHost, *adminPort)
+		log.Printf("[ChatServer] control plane on %s (advertised as %s)\n", adminListenAddr, adminAddress)
+		adminServer = &http.Server{Addr: adminListenAddr, Handler: middleware.RealIP(cfg, middleware.AccessLog(accessLog, middleware.Recover(middleware.Lockout(guard, middleware.Routes(control)))))}
+		listen := adminServer.ListenAndServe
+		if certs != nil {
+			adminServer.TLSConfig = certs.ServerConfig(tls.RequireAndVerifyClientCert)
+			listen = func() error { return adminServer.ListenAndServeTLS("", "") }
+		}
+		go func() {
+			if err := listen(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Printf("[ChatServer] TLS certificate reload failed, keeping previous certificates: %v", err)
+				}
+			}
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[ChatServer] config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			hub.ReloadRoomOverrides()
+			log.Printf("[ChatServer] config reloaded from %s\n", cfg.Path())
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Printf("[ChatServer] shutting down %s\n", address)
+	lbClient.Deregister()
+	stopJobs()
+	hub.Evict(models.ReconnectShutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[ChatServer] shutdown error: %v", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Printf("[ChatServer] control plane shutdown error: %v", err)
+		}
+	}
+	hub.Stop()
+}
+
+func advertisedHost(advertise, host string) string {
+	if advertise != "" {
+		return advertise
+	}
+	if podIP := os.Getenv("POD_IP"); podIP != "" {
+		return podIP
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname
+		}
+	}
+	return host
+}
\ No newline at end of file
@@ -0,0 +1,130 @@
+// Command xmppgateway lets XMPP clients, such as mobile apps, join the
+// default room as a multi-user chat. It talks to Redis like a chat server
+// and reads history from a copy of the message store.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/mtls"
+	"lukagolubovic/redisconn"
+	"lukagolubovic/roomconfig"
+	"lukagolubovic/xmpp"
+)
+
+func main() {
+	listen := flag.String("listen", ":5222", "Address to accept XMPP client connections on")
+	domain := flag.String("domain", "", "XMPP domain users sign in to, e.g. chat.example.org")
+	mucDomain := flag.String("muc-domain", "", "Domain of the multi-user chat service (default rooms.<domain>)")
+	dbPath := flag.String("db", "", "Read-only copy of a chat server's or the history service's database, for room history and archive queries")
+	certFile := flag.String("xmpp-cert", "", "Certificate offered to clients with STARTTLS (requires -xmpp-key)")
+	keyFile := flag.String("xmpp-key", "", "Private key for -xmpp-cert")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address (the config file's redis section takes precedence)")
+	configPath := flag.String("config", "", "Path to the chat servers' JSON config file, for its redis section and chat policies; reloaded on SIGHUP")
+	redisTLS := flag.Bool("redis-tls", false, "Connect to Redis over mutual TLS with -tls-cert (requires -tls-cert)")
+	tlsFiles := mtls.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *domain == "" {
+		log.Fatalf("-domain is required")
+	}
+	if *mucDomain == "" {
+		*mucDomain = "rooms." + *domain
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load XMPP certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	} else {
+		log.Printf("[XMPP] no -xmpp-cert given, streams will not be encrypted")
+	}
+
+	var db *sql.DB
+	if *dbPath != "" {
+		var err error
+		db, err = database.OpenReadOnly(*dbPath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+	}
+
+	cfg, err := config.NewStore(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	certs, err := mtls.Load(*tlsFiles)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	var redisDial redisconn.Dialer
+	if *redisTLS {
+		if certs == nil {
+			log.Fatalf("-redis-tls requires -tls-cert, -tls-key and -tls-ca")
+		}
+		go certs.Watch(mtls.WatchInterval)
+		redisDial = certs.DialContext
+	}
+	redisCfg := cfg.Get().Redis
+	redisClient, err := redisconn.New(redisCfg, *redisAddr, redisDial)
+	if err != nil {
+		log.Fatalf("Invalid Redis config: %v", err)
+	}
+	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
+		log.Fatalf("Could not connect to Redis (%s): %v", redisconn.Describe(redisCfg, *redisAddr), err)
+	}
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := cfg.Reload(); err != nil {
+				log.Printf("[XMPP] config reload failed, keeping previous config: %v", err)
+				continue
+			}
+			if _, err := roomconfig.Sync(context.Background(), redisClient, cfg); err != nil {
+				log.Printf("[XMPP] failed to reload room overrides: %v", err)
+			}
+			log.Printf("[XMPP] config reloaded from %s\n", cfg.Path())
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		cancel()
+	}()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listen, err)
+	}
+	gw := xmpp.New(*domain, *mucDomain, redisClient, db, cfg, tlsConfig)
+	if err := gw.ClaimNode(ctx); err != nil {
+		log.Fatalf("[XMPP] %v", err)
+	}
+	go gw.Run(ctx)
+
+	log.Printf("[XMPP] serving %s on %s, room %s@%s\n", *domain, *listen, models.DefaultRoom, *mucDomain)
+	if err := gw.Serve(ctx, ln); err != nil {
+		log.Fatalf("XMPP listener failed: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import "errors"
+
+// AdaptiveLimits tightens every client's chat message limit while the
+// server is overloaded and relaxes it again once it is healthy. The
+// server is overloaded when any one measurement exceeds its threshold;
+// a zero threshold isn't checked.
+type AdaptiveLimits struct {
+	Enabled bool `json:"enabled"`
+	// SampleSeconds is how often the load is measured and the limits
+	// adjusted.
+	SampleSeconds int `json:"sample_seconds"`
+	// MaxSendBacklog is the average fill of clients' send buffers, from 0
+	// to 1, above which fan-out is falling behind.
+	MaxSendBacklog float64 `json:"max_send_backlog"`
+	// MaxRedisLatencyMS and MaxDBWriteLatencyMS bound a Redis round trip
+	// and the wait for an empty write transaction, which queues behind
+	// the messages being stored.
+	MaxRedisLatencyMS   int `json:"max_redis_latency_ms"`
+	MaxDBWriteLatencyMS int `json:"max_db_write_latency_ms"`
+	// Each overloaded sample multiplies the limits by TightenFactor, down
+	// to MinFactor of the configured ones; each healthy sample adds
+	// RelaxStep back, up to the configured limits.
+	TightenFactor float64 `json:"tighten_factor"`
+	MinFactor     float64 `json:"min_factor"`
+	RelaxStep     float64 `json:"relax_step"`
+}
+
+func defaultAdaptiveLimits() AdaptiveLimits {
+	return AdaptiveLimits{
+		SampleSeconds:       2,
+		MaxSendBacklog:      0.5,
+		MaxRedisLatencyMS:   50,
+		MaxDBWriteLatencyMS: 200,
+		TightenFactor:       0.5,
+		MinFactor:           0.1,
+		RelaxStep:           0.1,
+	}
+}
+
+func (a AdaptiveLimits) Validate() error {
+	if a.SampleSeconds <= 0 {
+		return errors.New("sample_seconds must be positive")
+	}
+	if a.MaxSendBacklog < 0 || a.MaxSendBacklog > 1 {
+		return errors.New("max_send_backlog must be between 0 and 1")
+	}
+	if a.MaxRedisLatencyMS < 0 || a.MaxDBWriteLatencyMS < 0 {
+		return errors.New("max_redis_latency_ms and max_db_write_latency_ms must not be negative")
+	}
+	if a.TightenFactor <= 0 || a.TightenFactor >= 1 {
+		return errors.New("tighten_factor must be between 0 and 1")
+	}
+	if a.MinFactor <= 0 || a.MinFactor > 1 {
+		return errors.New("min_factor must be above 0 and at most 1")
+	}
+	if a.RelaxStep <= 0 {
+		return errors.New("relax_step must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	AnalyticsFile       = "file"
+	AnalyticsClickHouse = "clickhouse"
+	AnalyticsKafka      = "kafka"
+	// AnalyticsObjects writes each batch as an object, e.g. to S3.
+	AnalyticsObjects = "objectstore"
+)
+
+// Analytics sends anonymized usage events to a sink outside the chat
+// servers. Like Redis it is only read at startup.
+type Analytics struct {
+	// Sink is "file", "clickhouse", "kafka" or "objectstore"; empty
+	// disables analytics.
+	Sink string `json:"sink"`
+	// Dir is where the file sink writes one NDJSON file per day.
+	Dir string `json:"dir"`
+	// URL is ClickHouse's HTTP interface or a Kafka REST proxy.
+	URL string `json:"url"`
+	// Table is the ClickHouse table events are inserted into, and Username
+	// and Password authenticate with it.
+	Table    string `json:"table"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Topic is the Kafka topic events are produced to.
+	Topic string `json:"topic"`
+	// Storage is where the objectstore sink writes.
+	Storage ObjectStorage `json:"storage"`
+	// Salt keys the hash that replaces user ids in events and must be the
+	// same on every server. Changing it unlinks later events from earlier
+	// ones.
+	Salt string `json:"salt"`
+}
+
+func (a Analytics) Enabled() bool {
+	return a.Sink != ""
+}
+
+func (a Analytics) Validate() error {
+	switch a.Sink {
+	case "":
+		return nil
+	case AnalyticsFile:
+		if a.Dir == "" {
+			return errors.New("dir is required for the file sink")
+		}
+	case AnalyticsClickHouse, AnalyticsKafka:
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http:// or https:// URL", a.URL)
+		}
+		if a.Sink == AnalyticsClickHouse && a.Table == "" {
+			return errors.New("table is required for the clickhouse sink")
+		}
+		if a.Sink == AnalyticsKafka && a.Topic == "" {
+			return errors.New("topic is required for the kafka sink")
+		}
+	case AnalyticsObjects:
+		if err := a.Storage.Validate(); err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+	default:
+		return fmt.Errorf("sink %q must be file, clickhouse, kafka or objectstore", a.Sink)
+	}
+	if a.Salt == "" {
+		return errors.New("salt is required, or user ids could be recovered from their hashes")
+	}
+	return nil
+}
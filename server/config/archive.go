@@ -0,0 +1,32 @@
+package config
+
+import "errors"
+
+// ArchiveS3 and ArchiveDir are the archive's names for the object stores.
+const (
+	ArchiveS3  = ObjectStoreS3
+	ArchiveDir = ObjectStoreDir
+)
+
+// Archive moves messages older than AfterDays out of the servers' SQLite
+// files into object storage. Like Redis it is only read at startup.
+type Archive struct {
+	// AfterDays is the age at which messages are archived; zero disables
+	// archiving.
+	AfterDays int `json:"after_days"`
+	ObjectStorage
+}
+
+func (a Archive) Enabled() bool {
+	return a.AfterDays > 0
+}
+
+func (a Archive) Validate() error {
+	if a.AfterDays < 0 {
+		return errors.New("after_days must not be negative")
+	}
+	if !a.Enabled() {
+		return nil
+	}
+	return a.ObjectStorage.Validate()
+}
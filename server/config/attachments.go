@@ -0,0 +1,149 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// MaxThumbnailSize bounds thumbnail sizes; larger images are better
+// served as they are.
+const MaxThumbnailSize = 2048
+
+const (
+	ScannerClamAV  = "clamav"
+	ScannerICAP    = "icap"
+	ScannerWebhook = "webhook"
+)
+
+// Attachments stores files shared in messages in object storage. Files are
+// stored once per content however often they are uploaded. Like the
+// archive, where and how files are stored is only read at startup; how
+// they are served can be reloaded.
+type Attachments struct {
+	// ObjectStorage is where files are stored; an empty store disables
+	// attachments.
+	ObjectStorage
+	// MaxBytes caps the size of one file.
+	MaxBytes int64 `json:"max_bytes"`
+	// QuotaBytes caps the total size of each user's attachments; zero is
+	// unlimited. Admins can give users their own.
+	QuotaBytes int64 `json:"quota_bytes"`
+	// SigningKey signs download URLs, which then expire, and must be the
+	// same on every server. Empty serves attachments at permanent public
+	// paths.
+	SigningKey    string `json:"signing_key"`
+	URLTTLSeconds int    `json:"url_ttl_seconds"`
+	// ClockSkewSeconds is how long past its expiry a URL is still
+	// accepted, since the server checking it may run ahead of the one that
+	// signed it.
+	ClockSkewSeconds int `json:"clock_skew_seconds"`
+	// RoomChecks only signs URLs for users who can read the room the
+	// attachment is shared in.
+	RoomChecks bool `json:"room_checks"`
+	// ThumbnailSizes are the sizes images are scaled down to, by their
+	// longer side.
+	ThumbnailSizes []int `json:"thumbnail_sizes"`
+	// Scan is the virus scanner new files go through before they are
+	// stored.
+	Scan AttachmentScan `json:"scan"`
+}
+
+// AttachmentScan configures the virus scanner. Flagged files are
+// quarantined instead of stored, and moderators are told.
+type AttachmentScan struct {
+	// Scanner is "clamav" for a clamd daemon, "icap" for an ICAP service
+	// or "webhook" for an HTTP service; empty stores files unscanned.
+	Scanner string `json:"scanner"`
+	// Address is clamd's host:port, the ICAP service URL such as
+	// "icap://icap:1344/avscan", or the webhook's URL.
+	Address string `json:"address"`
+	// Secret is sent to the webhook as a bearer token.
+	Secret         string `json:"secret"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	// FailOpen stores files the scanner couldn't check; by default they
+	// are refused.
+	FailOpen bool `json:"fail_open"`
+}
+
+func (s AttachmentScan) Enabled() bool {
+	return s.Scanner != ""
+}
+
+func (s AttachmentScan) Validate() error {
+	switch s.Scanner {
+	case "":
+		return nil
+	case ScannerClamAV:
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("address %q must be clamd's host:port", s.Address)
+		}
+	case ScannerICAP:
+		u, err := url.Parse(s.Address)
+		if err != nil || u.Scheme != "icap" || u.Host == "" {
+			return fmt.Errorf("address %q must be an icap:// URL", s.Address)
+		}
+	case ScannerWebhook:
+		u, err := url.Parse(s.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("address %q must be an http:// or https:// URL", s.Address)
+		}
+	default:
+		return fmt.Errorf("scanner %q must be clamav, icap or webhook", s.Scanner)
+	}
+	if s.TimeoutSeconds <= 0 {
+		return errors.New("timeout_seconds must be positive")
+	}
+	return nil
+}
+
+func defaultAttachments() Attachments {
+	return Attachments{
+		MaxBytes:         10 << 20,
+		URLTTLSeconds:    3600,
+		ClockSkewSeconds: 30,
+		ThumbnailSizes:   []int{160, 480},
+		Scan:             AttachmentScan{TimeoutSeconds: 30},
+	}
+}
+
+func (a Attachments) Enabled() bool {
+	return a.Store != ""
+}
+
+func (a Attachments) Validate() error {
+	if !a.Enabled() {
+		return nil
+	}
+	if err := a.ObjectStorage.Validate(); err != nil {
+		return err
+	}
+	if a.MaxBytes <= 0 {
+		return errors.New("max_bytes must be positive")
+	}
+	if a.QuotaBytes < 0 {
+		return errors.New("quota_bytes must not be negative")
+	}
+	if a.SigningKey != "" && len(a.SigningKey) < minAppKeyLength {
+		return fmt.Errorf("signing_key must be at least %d characters", minAppKeyLength)
+	}
+	if a.RoomChecks && a.SigningKey == "" {
+		return errors.New("room_checks needs a signing_key, or attachments stay public")
+	}
+	if a.URLTTLSeconds <= 0 {
+		return errors.New("url_ttl_seconds must be positive")
+	}
+	if a.ClockSkewSeconds < 0 {
+		return errors.New("clock_skew_seconds must not be negative")
+	}
+	for _, size := range a.ThumbnailSizes {
+		if size <= 0 || size > MaxThumbnailSize {
+			return fmt.Errorf("thumbnail_sizes must be between 1 and %d", MaxThumbnailSize)
+		}
+	}
+	if err := a.Scan.Validate(); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package config
+
+import "errors"
+
+// minBandwidthBurst is the default frame size limit, so a burst fits any
+// ordinary frame; larger ones go into debt.
+const minBandwidthBurst = 16 * 1024
+
+// Bandwidth caps the WebSocket traffic of each connection, in bytes of
+// message payload. A connection going past its cap is slowed down rather
+// than cut off: the server stops reading from it, or waits before writing
+// to it. Zero rates are unlimited.
+type Bandwidth struct {
+	InBytesPerSecond  int `json:"in_bytes_per_second"`
+	OutBytesPerSecond int `json:"out_bytes_per_second"`
+	// BurstBytes is how far either direction may run ahead of its rate.
+	BurstBytes int `json:"burst_bytes"`
+}
+
+func defaultBandwidth() Bandwidth {
+	return Bandwidth{BurstBytes: 64 * 1024}
+}
+
+func (b Bandwidth) Validate() error {
+	if b.InBytesPerSecond < 0 || b.OutBytesPerSecond < 0 {
+		return errors.New("in_bytes_per_second and out_bytes_per_second must not be negative")
+	}
+	if b.BurstBytes < minBandwidthBurst {
+		return errors.New("burst_bytes must be at least 16384, the frame size limit")
+	}
+	return nil
+}
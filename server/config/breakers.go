@@ -0,0 +1,25 @@
+package config
+
+import "errors"
+
+// CircuitBreakers guard the server's calls to Redis and the database. It is
+// read at startup only.
+type CircuitBreakers struct {
+	// FailureThreshold is how many calls in a row must fail for a breaker
+	// to open.
+	FailureThreshold int `json:"failure_threshold"`
+	// CooldownSeconds is how long an open breaker rejects calls before
+	// letting one through to probe the dependency.
+	CooldownSeconds int `json:"cooldown_seconds"`
+}
+
+func defaultCircuitBreakers() CircuitBreakers {
+	return CircuitBreakers{FailureThreshold: 5, CooldownSeconds: 10}
+}
+
+func (c CircuitBreakers) Validate() error {
+	if c.FailureThreshold <= 0 || c.CooldownSeconds <= 0 {
+		return errors.New("failure_threshold and cooldown_seconds must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Runtime struct {
+	AllowedOrigins    []string        `json:"allowed_origins"`
+	MessagesPerSecond float64         `json:"messages_per_second"`
+	MessageBurst      int             `json:"message_burst"`
+	RetentionDays     int             `json:"retention_days"`
+	BannedWords       []string        `json:"banned_words"`
+	Moderators        []string        `json:"moderators"`
+	Features          map[string]bool `json:"features"`
+	// AdaptiveLimits scales the message limits down under load.
+	AdaptiveLimits AdaptiveLimits `json:"adaptive_limits"`
+	// TrustedProxies are the proxies whose forwarded client IPs are used.
+	TrustedProxies TrustedProxies `json:"trusted_proxies"`
+	// Frames bounds the size of inbound WebSocket frames.
+	Frames Frames `json:"frames"`
+	// Bandwidth caps each connection's traffic.
+	Bandwidth Bandwidth `json:"bandwidth"`
+	// Latency reports each connection's round-trip time to it.
+	Latency Latency `json:"latency"`
+	// MaxConnections caps connections per server; further clients are
+	// pointed at another server. Zero means unlimited.
+	MaxConnections int `json:"max_connections"`
+	// Usernames is the policy names are checked against on connect and
+	// rename.
+	Usernames Usernames `json:"usernames"`
+	Guests    Guests    `json:"guests"`
+	Invites   Invites   `json:"invites"`
+	// Tokens admits users with JWTs minted by another service.
+	Tokens Tokens `json:"tokens"`
+	// JoinHooks run when a user joins a room for the first time.
+	JoinHooks JoinHooks `json:"join_hooks"`
+	Webhooks  []Webhook `json:"webhooks"`
+	MQTT      MQTT      `json:"mqtt"`
+	// Notifications configures email digests of missed mentions.
+	Notifications Notifications `json:"notifications"`
+	// GIFs configures GIF search and GIF messages.
+	GIFs GIFs `json:"gifs"`
+	// Translation configures translating messages on demand.
+	Translation Translation `json:"translation"`
+	// Lockout locks out clients guessing the admin token or MQTT password.
+	Lockout Lockout `json:"lockout"`
+	// Analytics is read at startup only.
+	Analytics Analytics `json:"analytics"`
+	// Archive is read at startup only.
+	Archive Archive `json:"archive"`
+	// The attachment store is read at startup only; max_bytes may change.
+	Attachments Attachments `json:"attachments"`
+	// Backups is read at startup only.
+	Backups Backups `json:"backups"`
+	// Persistence is read at startup only.
+	Persistence Persistence `json:"persistence"`
+	// Search is read at startup only.
+	Search Search `json:"search"`
+	// Queries bounds the database reads requests make.
+	Queries Queries `json:"queries"`
+	// Scaling and LoadBalancer are used by the load balancer.
+	Scaling      Scaling      `json:"scaling"`
+	LoadBalancer LoadBalancer `json:"load_balancer"`
+	// Redis is the connection to Redis, read at startup only.
+	Redis Redis `json:"redis"`
+	// CircuitBreakers is read at startup only.
+	CircuitBreakers CircuitBreakers `json:"circuit_breakers"`
+
+	// Room holds the overrides applied by ForRoom; it is empty in the
+	// global configuration.
+	Room RoomOverrides `json:"-"`
+}
+
+func Default() *Runtime {
+	return &Runtime{
+		AllowedOrigins:    []string{"*"},
+		MessagesPerSecond: 5,
+		MessageBurst:      10,
+		AdaptiveLimits:    defaultAdaptiveLimits(),
+		Frames:            defaultFrames(),
+		Bandwidth:         defaultBandwidth(),
+		Features:          map[string]bool{},
+		Usernames:         defaultUsernames(),
+		Guests:            defaultGuests(),
+		GIFs:              defaultGIFs(),
+		Translation:       defaultTranslation(),
+		Lockout:           defaultLockout(),
+		Attachments:       defaultAttachments(),
+		Persistence:       defaultPersistence(),
+		Search:            defaultSearch(),
+		Queries:           defaultQueries(),
+		Scaling:           defaultScaling(),
+		LoadBalancer:      defaultLoadBalancer(),
+		CircuitBreakers:   defaultCircuitBreakers(),
+	}
+}
+
+func (r *Runtime) Feature(name string) bool {
+	return r.Features[name]
+}
+
+// MessageRate is the chat message limit for a regular user or a guest.
+func (r *Runtime) MessageRate(guest bool) (float64, int) {
+	if guest {
+		return r.Guests.MessagesPerSecond, r.Guests.MessageBurst
+	}
+	return r.MessagesPerSecond, r.MessageBurst
+}
+
+func (r *Runtime) IsModerator(username string) bool {
+	for _, m := range r.Moderators {
+		if strings.EqualFold(m, username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runtime) OriginAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range r.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runtime) AllowsAnyOrigin() bool {
+	for _, allowed := range r.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Censor masks every banned word in content, ignoring case.
+func (r *Runtime) Censor(content string) string {
+	lower := strings.ToLower(content)
+	if len(lower) != len(content) {
+		// Case folding changed byte offsets; fall back to exact matching.
+		lower = content
+	}
+	for _, word := range r.BannedWords {
+		if word == "" {
+			continue
+		}
+		w := strings.ToLower(word)
+		mask := strings.Repeat("*", len(w))
+		for start := 0; ; {
+			i := strings.Index(lower[start:], w)
+			if i < 0 {
+				break
+			}
+			i += start
+			content = content[:i] + mask + content[i+len(w):]
+			lower = lower[:i] + mask + lower[i+len(w):]
+			start = i + len(w)
+		}
+	}
+	return content
+}
+
+// Store holds the active runtime configuration. Readers always see a
+// complete snapshot; Reload swaps it atomically.
+type Store struct {
+	path    string
+	current atomic.Pointer[Runtime]
+
+	roomsMu sync.Mutex
+	rooms   atomic.Pointer[rooms]
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	s.current.Store(Default())
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Get() *Runtime {
+	if s == nil {
+		return Default()
+	}
+	return s.current.Load()
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	cfg := Default()
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return err
+	}
+	if cfg.Features == nil {
+		cfg.Features = map[string]bool{}
+	}
+	if err := cfg.AdaptiveLimits.Validate(); err != nil {
+		return fmt.Errorf("adaptive_limits: %w", err)
+	}
+	if err := cfg.TrustedProxies.Validate(); err != nil {
+		return fmt.Errorf("trusted_proxies%w", err)
+	}
+	if err := cfg.Frames.Validate(); err != nil {
+		return fmt.Errorf("frames: %w", err)
+	}
+	if err := cfg.Bandwidth.Validate(); err != nil {
+		return fmt.Errorf("bandwidth: %w", err)
+	}
+	if err := cfg.Latency.Validate(); err != nil {
+		return fmt.Errorf("latency: %w", err)
+	}
+	if err := cfg.Usernames.Validate(); err != nil {
+		return fmt.Errorf("usernames: %w", err)
+	}
+	if err := cfg.Guests.Validate(); err != nil {
+		return fmt.Errorf("guests: %w", err)
+	}
+	if err := cfg.Invites.Validate(); err != nil {
+		return fmt.Errorf("invites: %w", err)
+	}
+	if err := cfg.Tokens.Validate(); err != nil {
+		return fmt.Errorf("tokens: %w", err)
+	}
+	cfg.Usernames.reserveVisitors(cfg.Tokens.Apps)
+	if err := cfg.JoinHooks.Validate(); err != nil {
+		return fmt.Errorf("join_hooks: %w", err)
+	}
+	for i, hook := range cfg.Webhooks {
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+	}
+	if err := cfg.MQTT.Validate(); err != nil {
+		return fmt.Errorf("mqtt: %w", err)
+	}
+	if err := cfg.Notifications.Validate(); err != nil {
+		return fmt.Errorf("notifications: %w", err)
+	}
+	if err := cfg.GIFs.Validate(); err != nil {
+		return fmt.Errorf("gifs: %w", err)
+	}
+	if err := cfg.Translation.Validate(); err != nil {
+		return fmt.Errorf("translation: %w", err)
+	}
+	if err := cfg.Lockout.Validate(); err != nil {
+		return fmt.Errorf("lockout: %w", err)
+	}
+	if err := cfg.Analytics.Validate(); err != nil {
+		return fmt.Errorf("analytics: %w", err)
+	}
+	if err := cfg.Archive.Validate(); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	if err := cfg.Attachments.Validate(); err != nil {
+		return fmt.Errorf("attachments: %w", err)
+	}
+	if err := cfg.Backups.Validate(); err != nil {
+		return fmt.Errorf("backups: %w", err)
+	}
+	if err := cfg.Persistence.Validate(); err != nil {
+		return fmt.Errorf("persistence: %w", err)
+	}
+	if err := cfg.Search.Validate(); err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	if err := cfg.Queries.Validate(); err != nil {
+		return fmt.Errorf("queries: %w", err)
+	}
+	if cfg.Archive.Enabled() && cfg.RetentionDays > 0 && cfg.RetentionDays <= cfg.Archive.AfterDays {
+		return fmt.Errorf("retention_days (%d) must exceed archive.after_days (%d), or messages are pruned before they are archived", cfg.RetentionDays, cfg.Archive.AfterDays)
+	}
+	if err := cfg.Scaling.Validate(); err != nil {
+		return fmt.Errorf("scaling: %w", err)
+	}
+	if err := cfg.LoadBalancer.Validate(); err != nil {
+		return fmt.Errorf("load_balancer: %w", err)
+	}
+	if err := cfg.Redis.Validate(); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if err := cfg.CircuitBreakers.Validate(); err != nil {
+		return fmt.Errorf("circuit_breakers: %w", err)
+	}
+
+	// Room overrides are applied to the new configuration, which is
+	// refused if it conflicts with one of them.
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	var overrides map[string]RoomOverrides
+	if r := s.rooms.Load(); r != nil {
+		overrides = r.overrides
+	}
+	if err := s.mergeRooms(cfg, overrides); err != nil {
+		return err
+	}
+	s.current.Store(cfg)
+	return nil
+}
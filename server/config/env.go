@@ -0,0 +1,37 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ApplyEnv sets every flag of fs not given on the command line from the
+// environment, so binaries can be configured the same way in containers.
+// The variable for a flag is prefix, an underscore and the flag's name in
+// upper case with dashes as underscores: LB_HEALTH_INTERVAL for prefix "LB"
+// and -health-interval. Call it after fs.Parse.
+func ApplyEnv(fs *flag.FlagSet, prefix string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		name := EnvName(prefix, f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// EnvName is the environment variable ApplyEnv reads for a flag.
+func EnvName(prefix, flagName string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+)
+
+const (
+	// MaxFrameCeiling is the most any frame limit may be set to. A message
+	// past it closes the connection; up to it, an oversized frame is read
+	// and dropped, and the client told.
+	MaxFrameCeiling = 1 << 20
+	// minFrameSize keeps room for a frame of any type.
+	minFrameSize = 1024
+)
+
+// Frames bounds the size of the WebSocket frames clients send, in bytes.
+type Frames struct {
+	// MaxSize is the limit of the frame types not in Types.
+	MaxSize int `json:"max_size"`
+	// Types sets the limit of single frame types, "chat" for chat frames,
+	// such as signal frames carrying WebRTC offers with large SDP
+	// descriptions.
+	Types map[string]int `json:"types"`
+}
+
+func defaultFrames() Frames {
+	return Frames{MaxSize: 16 * 1024, Types: map[string]int{"signal": 64 * 1024}}
+}
+
+func (f Frames) Validate() error {
+	if f.MaxSize < minFrameSize || f.MaxSize > MaxFrameCeiling {
+		return fmt.Errorf("max_size must be between %d and %d", minFrameSize, MaxFrameCeiling)
+	}
+	for t, n := range f.Types {
+		if n < minFrameSize || n > MaxFrameCeiling {
+			return fmt.Errorf("types[%q] must be between %d and %d", t, minFrameSize, MaxFrameCeiling)
+		}
+	}
+	return nil
+}
+
+// FrameLimit is the largest frame of type t the room accepts; t is "chat"
+// for chat frames.
+func (r *Runtime) FrameLimit(t string) int {
+	limit := r.Frames.MaxSize
+	if n, ok := r.Frames.Types[t]; ok {
+		limit = n
+	}
+	if n := r.Room.MaxFrameSize; n != nil && *n < limit {
+		return *n
+	}
+	return limit
+}
+
+// MaxFrameLimit is the largest frame of any type the room accepts: how
+// much of a message is read before its type is known.
+func (r *Runtime) MaxFrameLimit() int {
+	limit := r.FrameLimit("")
+	for t := range r.Frames.Types {
+		limit = max(limit, r.FrameLimit(t))
+	}
+	return limit
+}
+
+// FrameLimits are the limits of the frame types in Types, as the room
+// applies them.
+func (r *Runtime) FrameLimits() map[string]int {
+	limits := maps.Clone(r.Frames.Types)
+	for t := range limits {
+		limits[t] = r.FrameLimit(t)
+	}
+	return limits
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	GIFProviderGiphy = "giphy"
+	GIFProviderTenor = "tenor"
+)
+
+// GIFs configures the GIF search proxy. Clients search through the chat
+// servers, so the provider's API key never leaves them.
+type GIFs struct {
+	// Provider is "giphy" or "tenor"; empty disables GIF search and GIF
+	// messages.
+	Provider string `json:"provider"`
+	APIKey   string `json:"api_key"`
+	// Rating is the most mature content returned: g, pg, pg-13 or r.
+	Rating string `json:"rating"`
+	// CacheSeconds is how long results are cached in Redis, shared by
+	// every server.
+	CacheSeconds int `json:"cache_seconds"`
+	// SearchesPerSecond and SearchBurst limit searches per client IP, to
+	// protect the provider's quota; zero disables the limit.
+	SearchesPerSecond float64 `json:"searches_per_second"`
+	SearchBurst       int     `json:"search_burst"`
+}
+
+func defaultGIFs() GIFs {
+	return GIFs{Rating: "g", CacheSeconds: 3600, SearchesPerSecond: 1, SearchBurst: 5}
+}
+
+func (g GIFs) Enabled() bool {
+	return g.Provider != ""
+}
+
+func (g GIFs) Validate() error {
+	switch g.Provider {
+	case "":
+		return nil
+	case GIFProviderGiphy, GIFProviderTenor:
+	default:
+		return fmt.Errorf("provider %q must be giphy or tenor", g.Provider)
+	}
+	if g.APIKey == "" {
+		return errors.New("api_key is required")
+	}
+	switch g.Rating {
+	case "g", "pg", "pg-13", "r":
+	default:
+		return fmt.Errorf("rating %q must be g, pg, pg-13 or r", g.Rating)
+	}
+	if g.CacheSeconds < 0 {
+		return errors.New("cache_seconds must not be negative")
+	}
+	if g.SearchesPerSecond < 0 || g.SearchBurst < 0 {
+		return errors.New("searches_per_second and search_burst must not be negative")
+	}
+	return nil
+}
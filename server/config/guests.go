@@ -0,0 +1,36 @@
+package config
+
+import "errors"
+
+// GuestPrefix starts every guest name. Regular users can't pick names with
+// it, so a guest can't be mistaken for a registered user or vice versa.
+const GuestPrefix = "guest-"
+
+// Guests lets people join without choosing a name. Each guest connection
+// gets an ephemeral guest-XXXX identity, freed again on disconnect, and may
+// only chat: guests can't rename themselves or send or receive call
+// signaling.
+type Guests struct {
+	Enabled bool `json:"enabled"`
+	// MessagesPerSecond and MessageBurst replace the regular message rate
+	// limit for guests.
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst"`
+}
+
+func defaultGuests() Guests {
+	return Guests{
+		MessagesPerSecond: 1,
+		MessageBurst:      3,
+	}
+}
+
+func (g Guests) Validate() error {
+	if g.MessagesPerSecond < 0 {
+		return errors.New("messages_per_second must not be negative")
+	}
+	if g.MessageBurst < 0 {
+		return errors.New("message_burst must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import "errors"
+
+// Invites makes rooms invite-only. Members are added by redeeming invite
+// tokens, which an admin creates through /admin/invites.
+type Invites struct {
+	// Secret signs invite tokens and must be the same on every server.
+	// Changing it invalidates every outstanding token. Empty disables
+	// invites.
+	Secret string `json:"secret"`
+	// PrivateRooms can only be joined by their members.
+	PrivateRooms []string `json:"private_rooms"`
+}
+
+func (i Invites) Enabled() bool {
+	return i.Secret != ""
+}
+
+func (i Invites) Private(room string) bool {
+	for _, r := range i.PrivateRooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+func (i Invites) Validate() error {
+	if len(i.PrivateRooms) > 0 && !i.Enabled() {
+		return errors.New("private_rooms need a secret, or nobody could join them")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RoleModerator is the only role a join hook can give: the user is added
+// to the room's moderators.
+const RoleModerator = "moderator"
+
+// maxJoinMessage is the protocol's limit on message content.
+const maxJoinMessage = 512
+
+// JoinHooks run the first time a registered user joins a room. Messages
+// may use {username} and {room}, which are replaced when they are sent.
+type JoinHooks struct {
+	// WelcomeDM is sent only to the connection that joined.
+	WelcomeDM string `json:"welcome_dm"`
+	// Announcement is broadcast to the room as a system message.
+	Announcement string `json:"announcement"`
+	// Roles are given to the user in the room.
+	Roles []string `json:"roles"`
+	// NotifyModerators sends the room's moderators who are online a
+	// direct message about the new member.
+	NotifyModerators bool `json:"notify_moderators"`
+}
+
+func (j JoinHooks) Enabled() bool {
+	return j.WelcomeDM != "" || j.Announcement != "" || len(j.Roles) > 0 || j.NotifyModerators
+}
+
+func (j JoinHooks) Validate() error {
+	if len(j.WelcomeDM) > maxJoinMessage {
+		return fmt.Errorf("welcome_dm must be at most %d bytes", maxJoinMessage)
+	}
+	if len(j.Announcement) > maxJoinMessage {
+		return fmt.Errorf("announcement must be at most %d bytes", maxJoinMessage)
+	}
+	for _, role := range j.Roles {
+		if role != RoleModerator {
+			return errors.New(`roles may only contain "moderator"`)
+		}
+	}
+	return nil
+}
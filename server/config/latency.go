@@ -0,0 +1,22 @@
+package config
+
+import "errors"
+
+// minLatencyReport keeps latency pings from becoming traffic of their own.
+const minLatencyReport = 5
+
+// Latency configures reporting each connection's round-trip time to it.
+// The time is always measured with the keepalive pings; reports are sent
+// only when ReportSeconds is set. It applies to new connections.
+type Latency struct {
+	// ReportSeconds is how often a connection is pinged and sent a latency
+	// frame; zero sends none.
+	ReportSeconds int `json:"report_seconds"`
+}
+
+func (l Latency) Validate() error {
+	if l.ReportSeconds != 0 && l.ReportSeconds < minLatencyReport {
+		return errors.New("report_seconds must be 0 or at least 5")
+	}
+	return nil
+}
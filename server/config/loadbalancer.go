@@ -0,0 +1,59 @@
+package config
+
+import "errors"
+
+// LoadBalancer tunes how the load balancer's /get picks a server and
+// protects it from misbehaving clients. Clients are told apart by IP, so
+// leave the rate limit off when every client reaches the load balancer
+// through one proxy that isn't listed in trusted_proxies.
+type LoadBalancer struct {
+	// Choices is how many of the least loaded servers /get considers; it
+	// compares two of them at random. 1 always picks the least loaded.
+	Choices int `json:"choices"`
+	// Of the two servers compared, the first one drawn wins unless the
+	// other has more than LoadMargin fewer connections, so near-equal
+	// servers share new clients instead of one taking all of them.
+	LoadMargin int `json:"load_margin"`
+
+	// GetPerSecond and GetBurst limit /get per client IP; zero disables
+	// the limit.
+	GetPerSecond float64 `json:"get_per_second"`
+	GetBurst     int     `json:"get_burst"`
+	// An IP rejected BlockAfter times within a minute is refused for
+	// BlockSeconds; zero never blocks.
+	BlockAfter   int `json:"block_after"`
+	BlockSeconds int `json:"block_seconds"`
+	// RequireUserAgent refuses requests without a User-Agent header, and
+	// BlockedUserAgents those whose User-Agent contains one of the strings,
+	// ignoring case.
+	RequireUserAgent  bool     `json:"require_user_agent"`
+	BlockedUserAgents []string `json:"blocked_user_agents"`
+}
+
+func defaultLoadBalancer() LoadBalancer {
+	return LoadBalancer{Choices: 2, LoadMargin: 2}
+}
+
+func (l LoadBalancer) Validate() error {
+	if l.Choices < 1 {
+		return errors.New("choices must be at least 1")
+	}
+	if l.LoadMargin < 0 {
+		return errors.New("load_margin must not be negative")
+	}
+	if l.GetPerSecond < 0 || l.GetBurst < 0 {
+		return errors.New("get_per_second and get_burst must not be negative")
+	}
+	if l.BlockAfter < 0 || l.BlockSeconds < 0 {
+		return errors.New("block_after and block_seconds must not be negative")
+	}
+	if l.BlockAfter > 0 && l.BlockSeconds == 0 {
+		return errors.New("block_seconds is required with block_after")
+	}
+	for _, ua := range l.BlockedUserAgents {
+		if ua == "" {
+			return errors.New("blocked_user_agents must not contain an empty string")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// Lockout protects the credentials the servers check, the admin token and
+// the MQTT password, against guessing. Failures are counted per client IP
+// and, where there is one, per account; a subject reaching MaxFailures
+// within WindowSeconds is locked out, for BaseSeconds at first and twice as
+// long for every further failure, up to MaxSeconds.
+type Lockout struct {
+	// MaxFailures is the failures allowed per window; zero disables
+	// lockouts.
+	MaxFailures   int `json:"max_failures"`
+	WindowSeconds int `json:"window_seconds"`
+	BaseSeconds   int `json:"base_seconds"`
+	MaxSeconds    int `json:"max_seconds"`
+}
+
+func defaultLockout() Lockout {
+	return Lockout{MaxFailures: 5, WindowSeconds: 900, BaseSeconds: 30, MaxSeconds: 3600}
+}
+
+func (l Lockout) Enabled() bool {
+	return l.MaxFailures > 0
+}
+
+// Duration is how long a subject with failures failed attempts in the
+// current window is locked out; zero while it stays under MaxFailures.
+func (l Lockout) Duration(failures int64) time.Duration {
+	if !l.Enabled() || failures < int64(l.MaxFailures) {
+		return 0
+	}
+	limit := time.Duration(l.MaxSeconds) * time.Second
+	d := time.Duration(l.BaseSeconds) * time.Second
+	for n := int64(l.MaxFailures); n < failures && d < limit; n++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+func (l Lockout) Validate() error {
+	if l.MaxFailures < 0 {
+		return errors.New("max_failures must not be negative")
+	}
+	if !l.Enabled() {
+		return nil
+	}
+	if l.WindowSeconds <= 0 || l.BaseSeconds <= 0 {
+		return errors.New("window_seconds and base_seconds must be positive")
+	}
+	if l.MaxSeconds < l.BaseSeconds {
+		return errors.New("max_seconds must not be less than base_seconds")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MQTT configures cmd/mqttgateway, which lets devices publish to rooms and
+// follow room traffic over MQTT.
+type MQTT struct {
+	// Password, when set, must be sent by every device that connects.
+	Password string     `json:"password"`
+	Rules    []MQTTRule `json:"rules"`
+}
+
+// MQTTRule maps a topic to a room. Inbound rules ("in") post every message
+// devices publish on a matching topic to the room; Topic may be a filter
+// with + and # wildcards. Outbound rules ("out") publish the room's
+// messages on Topic, which must then be a plain topic. "both" does both.
+type MQTTRule struct {
+	Topic     string `json:"topic"`
+	Room      string `json:"room"`
+	Direction string `json:"direction"`
+}
+
+func (r MQTTRule) Inbound() bool  { return r.Direction == "in" || r.Direction == "both" }
+func (r MQTTRule) Outbound() bool { return r.Direction == "out" || r.Direction == "both" }
+
+func (m MQTT) Validate() error {
+	for i, rule := range m.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r MQTTRule) validate() error {
+	if r.Room == "" {
+		return errors.New("room is required")
+	}
+	if !r.Inbound() && !r.Outbound() {
+		return fmt.Errorf("direction %q must be in, out or both", r.Direction)
+	}
+	if r.Topic == "" || strings.ContainsRune(r.Topic, 0) {
+		return fmt.Errorf("topic %q is not a valid topic", r.Topic)
+	}
+	levels := strings.Split(r.Topic, "/")
+	for i, level := range levels {
+		wildcard := strings.ContainsAny(level, "+#")
+		if wildcard && r.Outbound() {
+			return fmt.Errorf("topic %q: outbound topics can't have wildcards", r.Topic)
+		}
+		if wildcard && level != "+" && !(level == "#" && i == len(levels)-1) {
+			return fmt.Errorf("topic %q: + and # must fill a whole level, and # must be last", r.Topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Notifications configures the email digests cmd/digest sends users who
+// were mentioned while offline.
+type Notifications struct {
+	// Secret signs the unsubscribe links in digests and must be the same
+	// on every server. Changing it invalidates links already sent. Empty
+	// disables digests.
+	Secret string `json:"secret"`
+	// UnsubscribeURL is the public address of a chat server's /unsubscribe
+	// endpoint, e.g. "https://chat.example.org/unsubscribe".
+	UnsubscribeURL string `json:"unsubscribe_url"`
+}
+
+func (n Notifications) Enabled() bool {
+	return n.Secret != ""
+}
+
+func (n Notifications) Validate() error {
+	if !n.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(n.UnsubscribeURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("unsubscribe_url %q must be an http:// or https:// URL", n.UnsubscribeURL)
+	}
+	if u.RawQuery != "" {
+		return errors.New("unsubscribe_url can't have a query, the token is added to it")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	ObjectStoreS3  = "s3"
+	ObjectStoreDir = "dir"
+
+	// minPartSize is S3's smallest part but the last.
+	minPartSize = 5 << 20
+)
+
+// ObjectStorage is where a feature keeps its objects: S3-compatible
+// storage, such as AWS S3 or MinIO, or a local directory for development.
+// The archive, attachments, backups and the analytics sink embed it, so
+// they share its keys, and each can use its own bucket or prefix.
+type ObjectStorage struct {
+	// Store is "s3" or "dir".
+	Store string `json:"store"`
+	Dir   string `json:"dir"`
+	// Endpoint is the S3 service URL, e.g. "http://minio:9000".
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// Prefix is prepended to object keys.
+	Prefix string `json:"prefix"`
+	// PartSize is the size of the parts large objects, such as backups,
+	// are uploaded to S3 in; zero means 8 MiB.
+	PartSize int64 `json:"part_size"`
+}
+
+func (o ObjectStorage) Validate() error {
+	switch o.Store {
+	case ObjectStoreDir:
+		if o.Dir == "" {
+			return errors.New("dir is required for the dir store")
+		}
+	case ObjectStoreS3:
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint %q must be an http:// or https:// URL", o.Endpoint)
+		}
+		if o.Region == "" || o.Bucket == "" {
+			return errors.New("region and bucket are required for the s3 store")
+		}
+		if o.AccessKey == "" || o.SecretKey == "" {
+			return errors.New("access_key and secret_key are required for the s3 store")
+		}
+	default:
+		return fmt.Errorf("store %q must be s3 or dir", o.Store)
+	}
+	if o.PartSize != 0 && o.PartSize < minPartSize {
+		return fmt.Errorf("part_size must be at least %d bytes", minPartSize)
+	}
+	return nil
+}
+
+// Backups keeps database snapshots in object storage instead of the
+// server's -backup-dir. Like the archive it is only read at startup.
+type Backups struct {
+	ObjectStorage
+}
+
+func (b Backups) Enabled() bool {
+	return b.Store != ""
+}
+
+func (b Backups) Validate() error {
+	if !b.Enabled() {
+		return nil
+	}
+	return b.ObjectStorage.Validate()
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// PersistHTTP posts each message to a URL, signed like a webhook.
+const PersistHTTP = "http"
+
+// Persistence mirrors stored messages to external systems, such as a
+// search index or a data warehouse, through hooks run in the background.
+// It is read at startup only.
+type Persistence struct {
+	Hooks []PersistHook `json:"hooks"`
+	// Workers is how many messages are handed to hooks at once.
+	Workers int `json:"workers"`
+	// MaxAttempts includes the first try; retries wait RetrySeconds, then
+	// twice as long each time. Messages still failing are kept as dead
+	// letters.
+	MaxAttempts  int `json:"max_attempts"`
+	RetrySeconds int `json:"retry_seconds"`
+}
+
+// PersistHook is one external system messages are written through to.
+type PersistHook struct {
+	// Name identifies the hook in dead letters and metrics, and must be
+	// unique.
+	Name string `json:"name"`
+	// Type is "http".
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Secret keys the HMAC-SHA256 signature of each request.
+	Secret string `json:"secret"`
+}
+
+func defaultPersistence() Persistence {
+	return Persistence{Workers: 2, MaxAttempts: 5, RetrySeconds: 1}
+}
+
+func (p Persistence) Enabled() bool {
+	return len(p.Hooks) > 0
+}
+
+func (p Persistence) Validate() error {
+	if p.Workers <= 0 || p.MaxAttempts <= 0 || p.RetrySeconds <= 0 {
+		return errors.New("workers, max_attempts and retry_seconds must be positive")
+	}
+	names := make(map[string]bool)
+	for i, hook := range p.Hooks {
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("hooks[%d]: %w", i, err)
+		}
+		if names[hook.Name] {
+			return fmt.Errorf("hooks[%d]: name %q is used twice", i, hook.Name)
+		}
+		names[hook.Name] = true
+	}
+	return nil
+}
+
+func (h PersistHook) Validate() error {
+	if h.Name == "" {
+		return errors.New("name is required")
+	}
+	switch h.Type {
+	case PersistHTTP:
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http:// or https:// URL", h.URL)
+		}
+		if h.Secret == "" {
+			return errors.New("secret is required so receivers can verify requests")
+		}
+	default:
+		return fmt.Errorf("type %q must be http", h.Type)
+	}
+	return nil
+}
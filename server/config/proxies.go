@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies lists the reverse proxies, as CIDRs or single IPs, whose
+// X-Forwarded-For and X-Real-IP headers name the client. Requests from
+// anywhere else are taken to come from their peer address, whatever
+// headers they carry.
+type TrustedProxies []string
+
+func (t TrustedProxies) Validate() error {
+	for i, p := range t {
+		if _, err := parseProxy(p); err != nil {
+			return fmt.Errorf("[%d]: %q is not a CIDR or IP address", i, p)
+		}
+	}
+	return nil
+}
+
+// Trusts reports whether addr is one of the proxies.
+func (t TrustedProxies) Trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t {
+		if prefix, err := parseProxy(p); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProxy(p string) (netip.Prefix, error) {
+	if !strings.Contains(p, "/") {
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(p)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
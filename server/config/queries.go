@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// Queries bounds the database reads made for requests, such as history,
+// search, statistics and anti-entropy digests, so one heavy request can't
+// hold SQLite while messages wait to be stored.
+type Queries struct {
+	// TimeoutSeconds cancels a query still running after it; zero never
+	// does.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// StreamTimeoutSeconds is the same for streamed history, which reads
+	// far more.
+	StreamTimeoutSeconds int `json:"stream_timeout_seconds"`
+	// MaxStreamRows ends a history stream after that many messages; the
+	// client resumes from the last one. Zero is unlimited.
+	MaxStreamRows int `json:"max_stream_rows"`
+	// MaxConcurrent is how many of these queries a server runs at once;
+	// further requests get a 503. Zero is unlimited.
+	MaxConcurrent int `json:"max_concurrent"`
+	// MaxSearchLength caps the length of a search query.
+	MaxSearchLength int `json:"max_search_length"`
+}
+
+func defaultQueries() Queries {
+	return Queries{
+		TimeoutSeconds:       5,
+		StreamTimeoutSeconds: 300,
+		MaxStreamRows:        1_000_000,
+		MaxConcurrent:        8,
+		MaxSearchLength:      200,
+	}
+}
+
+func (q Queries) Timeout() time.Duration {
+	return time.Duration(q.TimeoutSeconds) * time.Second
+}
+
+func (q Queries) StreamTimeout() time.Duration {
+	return time.Duration(q.StreamTimeoutSeconds) * time.Second
+}
+
+func (q Queries) Validate() error {
+	if q.TimeoutSeconds < 0 || q.StreamTimeoutSeconds < 0 {
+		return errors.New("timeout_seconds and stream_timeout_seconds must not be negative")
+	}
+	if q.MaxStreamRows < 0 || q.MaxConcurrent < 0 {
+		return errors.New("max_stream_rows and max_concurrent must not be negative")
+	}
+	if q.MaxSearchLength <= 0 {
+		return errors.New("max_search_length must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	RedisSingle   = "single"
+	RedisSentinel = "sentinel"
+	RedisCluster  = "cluster"
+)
+
+// Redis selects how servers reach Redis. Unlike the rest of the file it is
+// only read at startup; changing it takes a restart.
+type Redis struct {
+	// Mode is "single" (the default), "sentinel" or "cluster".
+	Mode string `json:"mode"`
+	// Addrs is the server address in single mode, the sentinel addresses in
+	// sentinel mode and the seed nodes in cluster mode. When empty the
+	// -redis flag is used.
+	Addrs []string `json:"addrs"`
+	// MasterName is the master set the sentinels monitor.
+	MasterName string `json:"master_name"`
+
+	// Username and Password authenticate with AUTH, or as an ACL user when
+	// Username is set. The sentinel variants apply to the sentinels
+	// themselves, which are often configured without ACLs.
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	SentinelUsername string `json:"sentinel_username"`
+	SentinelPassword string `json:"sentinel_password"`
+	// DB is the database number; cluster mode only has database 0.
+	DB int `json:"db"`
+	// TLS encrypts connections, verifying the servers against TLSCAFile or,
+	// when that is empty, the system roots. Servers started with -redis-tls
+	// use their mutual TLS certificates instead.
+	TLS       bool   `json:"tls"`
+	TLSCAFile string `json:"tls_ca_file"`
+	// PoolSize is the number of connections per node; zero keeps the
+	// library default of ten per CPU.
+	PoolSize int `json:"pool_size"`
+	// Shards splits chat messages over this many channels by room; zero
+	// or one keeps the single chat-messages channel. Every server and the
+	// history service must agree on it.
+	Shards int `json:"shards"`
+}
+
+func (r Redis) Validate() error {
+	switch r.Mode {
+	case "", RedisSingle:
+		if len(r.Addrs) > 1 {
+			return errors.New("single mode takes one address; use sentinel or cluster mode for several")
+		}
+	case RedisSentinel:
+		if r.MasterName == "" {
+			return errors.New("sentinel mode needs master_name")
+		}
+		if len(r.Addrs) == 0 {
+			return errors.New("sentinel mode needs the sentinel addrs")
+		}
+	case RedisCluster:
+		if r.DB != 0 {
+			return errors.New("cluster mode only supports db 0")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected single, sentinel or cluster", r.Mode)
+	}
+	if r.DB < 0 {
+		return errors.New("db must not be negative")
+	}
+	if r.Shards < 0 {
+		return errors.New("shards must not be negative")
+	}
+	if r.PoolSize < 0 {
+		return errors.New("pool_size must not be negative")
+	}
+	if r.TLSCAFile != "" && !r.TLS {
+		return errors.New("tls_ca_file needs tls")
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"lukagolubovic/models"
+)
+
+// RoomOverrides replaces parts of the configuration for one room. They are
+// stored in the servers' databases rather than the config file, and unset
+// fields keep the global value.
+type RoomOverrides struct {
+	// MaxMessageLength lowers the longest message, in bytes, the room
+	// accepts.
+	MaxMessageLength *int `json:"max_message_length,omitempty"`
+	// MaxFrameSize lowers the largest frame, of any type, the room accepts.
+	MaxFrameSize      *int     `json:"max_frame_size,omitempty"`
+	RetentionDays     *int     `json:"retention_days,omitempty"`
+	MessagesPerSecond *float64 `json:"messages_per_second,omitempty"`
+	MessageBurst      *int     `json:"message_burst,omitempty"`
+	// SlowModeSeconds is the minimum interval between two messages of one
+	// user; moderators are exempt.
+	SlowModeSeconds *int `json:"slow_mode_seconds,omitempty"`
+	// JoinHooks replace the global join hooks.
+	JoinHooks *JoinHooks `json:"join_hooks,omitempty"`
+	// BannedWords and Moderators add to the global lists.
+	BannedWords []string `json:"banned_words,omitempty"`
+	Moderators  []string `json:"moderators,omitempty"`
+}
+
+func (o RoomOverrides) IsZero() bool {
+	return o.MaxMessageLength == nil && o.MaxFrameSize == nil && o.RetentionDays == nil && o.MessagesPerSecond == nil &&
+		o.MessageBurst == nil && o.SlowModeSeconds == nil && o.JoinHooks == nil && len(o.BannedWords) == 0 && len(o.Moderators) == 0
+}
+
+func (o RoomOverrides) Validate() error {
+	if o.MaxMessageLength != nil && *o.MaxMessageLength < 1 {
+		return errors.New("max_message_length must be at least 1")
+	}
+	if o.MaxFrameSize != nil && *o.MaxFrameSize < minFrameSize {
+		return fmt.Errorf("max_frame_size must be at least %d", minFrameSize)
+	}
+	if o.RetentionDays != nil && *o.RetentionDays < 0 {
+		return errors.New("retention_days must not be negative")
+	}
+	if o.MessagesPerSecond != nil && *o.MessagesPerSecond <= 0 {
+		return errors.New("messages_per_second must be positive")
+	}
+	if o.MessageBurst != nil && *o.MessageBurst < 1 {
+		return errors.New("message_burst must be at least 1")
+	}
+	if o.SlowModeSeconds != nil && (*o.SlowModeSeconds < 0 || *o.SlowModeSeconds > models.MaxSlowModeSeconds) {
+		return fmt.Errorf("slow_mode_seconds must be between 0 and %d", models.MaxSlowModeSeconds)
+	}
+	if o.JoinHooks != nil {
+		if err := o.JoinHooks.Validate(); err != nil {
+			return fmt.Errorf("join_hooks: %w", err)
+		}
+	}
+	return nil
+}
+
+// ForRoom returns a copy of r with a room's overrides applied.
+func (r *Runtime) ForRoom(o RoomOverrides) (*Runtime, error) {
+	merged := *r
+	merged.Room = o
+	if o.RetentionDays != nil {
+		merged.RetentionDays = *o.RetentionDays
+	}
+	if o.MessagesPerSecond != nil {
+		merged.MessagesPerSecond = *o.MessagesPerSecond
+	}
+	if o.MessageBurst != nil {
+		merged.MessageBurst = *o.MessageBurst
+	}
+	if o.JoinHooks != nil {
+		merged.JoinHooks = *o.JoinHooks
+	}
+	if len(o.BannedWords) > 0 {
+		merged.BannedWords = append(append([]string(nil), r.BannedWords...), o.BannedWords...)
+	}
+	if len(o.Moderators) > 0 {
+		merged.Moderators = append(append([]string(nil), r.Moderators...), o.Moderators...)
+	}
+	if r.Archive.Enabled() && merged.RetentionDays > 0 && merged.RetentionDays <= r.Archive.AfterDays {
+		return nil, fmt.Errorf("retention_days (%d) must exceed archive.after_days (%d)", merged.RetentionDays, r.Archive.AfterDays)
+	}
+	return &merged, nil
+}
+
+// ContentLimit is the longest message content, in bytes, the room allows,
+// never more than max.
+func (r *Runtime) ContentLimit(max int) int {
+	if n := r.Room.MaxMessageLength; n != nil && *n < max {
+		return *n
+	}
+	return max
+}
+
+// SlowMode is the minimum interval between two messages of one user, zero
+// when slow mode is off.
+func (r *Runtime) SlowMode() time.Duration {
+	if n := r.Room.SlowModeSeconds; n != nil {
+		return time.Duration(*n) * time.Second
+	}
+	return 0
+}
+
+// rooms is a snapshot of the room overrides and the configuration they
+// give each room.
+type rooms struct {
+	overrides map[string]RoomOverrides
+	merged    map[string]*Runtime
+}
+
+// Room returns the configuration of a room: the global configuration with
+// the room's overrides applied.
+func (s *Store) Room(name string) *Runtime {
+	if s == nil {
+		return Default()
+	}
+	if r := s.rooms.Load(); r != nil {
+		if cfg, ok := r.merged[name]; ok {
+			return cfg
+		}
+	}
+	return s.Get()
+}
+
+func (s *Store) RoomOverrides(name string) RoomOverrides {
+	if s == nil {
+		return RoomOverrides{}
+	}
+	if r := s.rooms.Load(); r != nil {
+		return r.overrides[name]
+	}
+	return RoomOverrides{}
+}
+
+// OverriddenRooms returns the names of the rooms with overrides.
+func (s *Store) OverriddenRooms() []string {
+	if s == nil {
+		return nil
+	}
+	r := s.rooms.Load()
+	if r == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.overrides))
+	for room := range r.overrides {
+		names = append(names, room)
+	}
+	return names
+}
+
+// SetRoomOverrides replaces a room's overrides; zero overrides remove
+// them.
+func (s *Store) SetRoomOverrides(name string, o RoomOverrides) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	return s.setRoomOverrides(name, o)
+}
+
+// UpdateRoomOverrides changes a room's overrides with update and returns
+// the result. Updates of the same store happen one at a time, so none is
+// lost to another.
+func (s *Store) UpdateRoomOverrides(name string, update func(*RoomOverrides)) (RoomOverrides, error) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	o := s.RoomOverrides(name)
+	update(&o)
+	if err := o.Validate(); err != nil {
+		return RoomOverrides{}, err
+	}
+	return o, s.setRoomOverrides(name, o)
+}
+
+// setRoomOverrides replaces a room's overrides. The caller holds roomsMu.
+func (s *Store) setRoomOverrides(name string, o RoomOverrides) error {
+	overrides := make(map[string]RoomOverrides)
+	if r := s.rooms.Load(); r != nil {
+		for room, existing := range r.overrides {
+			overrides[room] = existing
+		}
+	}
+	if o.IsZero() {
+		delete(overrides, name)
+	} else {
+		overrides[name] = o
+	}
+	return s.mergeRooms(s.Get(), overrides)
+}
+
+// mergeRooms applies the overrides to cfg and swaps in the result. The
+// caller holds roomsMu.
+func (s *Store) mergeRooms(cfg *Runtime, overrides map[string]RoomOverrides) error {
+	merged := make(map[string]*Runtime, len(overrides))
+	for room, o := range overrides {
+		roomCfg, err := cfg.ForRoom(o)
+		if err != nil {
+			return fmt.Errorf("room %s: %w", room, err)
+		}
+		merged[room] = roomCfg
+	}
+	s.rooms.Store(&rooms{overrides: overrides, merged: merged})
+	return nil
+}
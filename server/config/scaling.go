@@ -0,0 +1,50 @@
+package config
+
+import "errors"
+
+// Scaling tunes the load balancer's scale advice. Utilization is the
+// cluster's connections over the capacity of its servers.
+type Scaling struct {
+	// ServerCapacity is how many connections one server is sized for. Zero
+	// falls back to max_connections; advice is off when both are zero.
+	ServerCapacity int `json:"server_capacity"`
+	// TargetUtilization is what recommended server counts aim for.
+	TargetUtilization float64 `json:"target_utilization"`
+	// Scaling up is advised at ScaleUpAt utilization, and scaling down once
+	// utilization stayed at or below ScaleDownAt for DownWindowSeconds.
+	ScaleUpAt         float64 `json:"scale_up_at"`
+	ScaleDownAt       float64 `json:"scale_down_at"`
+	DownWindowSeconds int     `json:"down_window_seconds"`
+	MinServers        int     `json:"min_servers"`
+	// MaxServers caps advice; zero is unlimited.
+	MaxServers int `json:"max_servers"`
+}
+
+func defaultScaling() Scaling {
+	return Scaling{
+		TargetUtilization: 0.6,
+		ScaleUpAt:         0.8,
+		ScaleDownAt:       0.3,
+		DownWindowSeconds: 300,
+		MinServers:        1,
+	}
+}
+
+func (s Scaling) Validate() error {
+	if s.ServerCapacity < 0 {
+		return errors.New("server_capacity must not be negative")
+	}
+	if !(0 < s.ScaleDownAt && s.ScaleDownAt < s.TargetUtilization && s.TargetUtilization < s.ScaleUpAt) {
+		return errors.New("thresholds must satisfy 0 < scale_down_at < target_utilization < scale_up_at")
+	}
+	if s.DownWindowSeconds < 0 {
+		return errors.New("down_window_seconds must not be negative")
+	}
+	if s.MinServers < 1 {
+		return errors.New("min_servers must be at least 1")
+	}
+	if s.MaxServers != 0 && s.MaxServers < s.MinServers {
+		return errors.New("max_servers must be zero or at least min_servers")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	SearchElasticsearch = "elasticsearch"
+	SearchMeilisearch   = "meilisearch"
+)
+
+// Search moves /search from the database to an external search engine,
+// which ranks results by relevance and tolerates typos. Messages are
+// indexed in the background as they are stored. It is read at startup
+// only.
+type Search struct {
+	// Engine is "elasticsearch" or "meilisearch"; empty searches the
+	// database.
+	Engine string `json:"engine"`
+	URL    string `json:"url"`
+	// Index is the Elasticsearch index or Meilisearch index uid, shared by
+	// every server.
+	Index string `json:"index"`
+	// APIKey authenticates with either engine; Username and Password are
+	// Elasticsearch's basic authentication instead.
+	APIKey   string `json:"api_key"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func defaultSearch() Search {
+	return Search{Index: "chat-messages"}
+}
+
+func (s Search) Enabled() bool {
+	return s.Engine != ""
+}
+
+func (s Search) Validate() error {
+	switch s.Engine {
+	case "":
+		return nil
+	case SearchElasticsearch, SearchMeilisearch:
+	default:
+		return fmt.Errorf("engine %q must be elasticsearch or meilisearch", s.Engine)
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http:// or https:// URL", s.URL)
+	}
+	if s.Index == "" {
+		return errors.New("index is required")
+	}
+	return nil
+}
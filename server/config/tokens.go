@@ -0,0 +1,122 @@
+package config
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// minAppKeyLength keeps app keys long enough not to be guessed.
+const minAppKeyLength = 16
+
+// appNamePattern keeps app names usable as a username suffix.
+var appNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Tokens lets another service admit users to /ws with signed JWTs (see
+// package authtoken) instead of a bare username.
+type Tokens struct {
+	// Secret is the HS256 key tokens are signed with, shared with the
+	// services minting them. Empty disables tokens.
+	Secret string `json:"secret"`
+	// Required refuses connections without a token, guests included: on
+	// /ws, the XMPP and MQTT gateways and invite redemption. Bridged users
+	// are namespaced by platform and need none.
+	Required bool `json:"required"`
+	// Tiers are the message rate limits a token's tier claim can pick,
+	// such as a slower one for embedded widgets.
+	Tiers map[string]RateTier `json:"tiers"`
+	// Apps are the trusted services that mint widget tokens through
+	// POST /widget/tokens.
+	Apps []TokenApp `json:"apps"`
+}
+
+// TokenApp is a service embedding the chat, such as a support widget on a
+// third-party site. It authenticates with its key and can only bind
+// visitors to its own rooms, under names ending in "@<name>".
+type TokenApp struct {
+	Name string `json:"name"`
+	// Key is sent as "Authorization: Bearer <key>".
+	Key   string   `json:"key"`
+	Rooms []string `json:"rooms"`
+	// Tier is the rate tier of the app's tokens; empty uses the regular
+	// message rate limit.
+	Tier string `json:"tier"`
+	// TTLSeconds is how long the app's tokens last; zero means 15 minutes.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// App returns the app whose key is key.
+func (t Tokens) App(key string) (TokenApp, bool) {
+	for _, app := range t.Apps {
+		if subtle.ConstantTimeCompare([]byte(app.Key), []byte(key)) == 1 {
+			return app, true
+		}
+	}
+	return TokenApp{}, false
+}
+
+func (a TokenApp) AllowsRoom(room string) bool {
+	return slices.Contains(a.Rooms, room)
+}
+
+// RateTier is a chat message rate limit; zero disables it, as for the
+// regular one.
+type RateTier struct {
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst"`
+}
+
+func (t Tokens) Enabled() bool {
+	return t.Secret != ""
+}
+
+func (t Tokens) Validate() error {
+	if t.Required && !t.Enabled() {
+		return errors.New("required needs a secret, or nobody could connect")
+	}
+	for name, tier := range t.Tiers {
+		if tier.MessagesPerSecond < 0 || tier.MessageBurst < 0 {
+			return fmt.Errorf("tiers[%q]: messages_per_second and message_burst must not be negative", name)
+		}
+	}
+	if len(t.Apps) > 0 && !t.Enabled() {
+		return errors.New("apps need a secret to sign their tokens")
+	}
+	keys := make(map[string]bool, len(t.Apps))
+	names := make(map[string]bool, len(t.Apps))
+	for i, app := range t.Apps {
+		switch {
+		case app.Name == "":
+			return fmt.Errorf("apps[%d]: name is required", i)
+		case !appNamePattern.MatchString(app.Name):
+			return fmt.Errorf("apps[%d]: name may only contain lower case letters, digits and dashes", i)
+		case slices.Contains(BridgedPlatforms, app.Name):
+			return fmt.Errorf("apps[%d]: name %q is taken by the bridge", i, app.Name)
+		case names[app.Name]:
+			return fmt.Errorf("apps[%d]: name is used by another app", i)
+		case len(app.Key) < minAppKeyLength:
+			return fmt.Errorf("apps[%d]: key must be at least %d characters", i, minAppKeyLength)
+		case keys[app.Key]:
+			return fmt.Errorf("apps[%d]: key is used by another app", i)
+		case len(app.Rooms) == 0:
+			return fmt.Errorf("apps[%d]: rooms must not be empty", i)
+		case app.TTLSeconds < 0 || app.TTLSeconds > 86400:
+			return fmt.Errorf("apps[%d]: ttl_seconds must be between 0 and 86400", i)
+		}
+		if _, ok := t.Tiers[app.Tier]; app.Tier != "" && !ok {
+			return fmt.Errorf("apps[%d]: unknown tier %q", i, app.Tier)
+		}
+		keys[app.Key] = true
+		names[app.Name] = true
+	}
+	return nil
+}
+
+// TierRate is the message rate limit of the named tier; ok is false for
+// unknown ones.
+func (r *Runtime) TierRate(tier string) (rate float64, burst int, ok bool) {
+	t, ok := r.Tokens.Tiers[tier]
+	return t.MessagesPerSecond, t.MessageBurst, ok
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	TranslationProviderDeepL          = "deepl"
+	TranslationProviderLibreTranslate = "libretranslate"
+)
+
+// Translation configures on-demand translation of messages. Like GIF
+// search, clients go through the chat servers, so the provider's API key
+// never leaves them.
+type Translation struct {
+	// Provider is "deepl" or "libretranslate"; empty disables translation.
+	Provider string `json:"provider"`
+	// APIKey is required for DeepL and optional for a LibreTranslate
+	// instance that doesn't ask for one.
+	APIKey string `json:"api_key"`
+	// URL is the LibreTranslate instance, such as a self-hosted one.
+	URL string `json:"url"`
+	// CacheSeconds is how long translations are cached in Redis, shared by
+	// every server.
+	CacheSeconds int `json:"cache_seconds"`
+	// RequestsPerSecond and RequestBurst limit translations per client IP,
+	// to protect the provider's quota; zero disables the limit.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	RequestBurst      int     `json:"request_burst"`
+}
+
+func defaultTranslation() Translation {
+	return Translation{URL: "https://libretranslate.com", CacheSeconds: 7 * 86400, RequestsPerSecond: 1, RequestBurst: 10}
+}
+
+func (t Translation) Enabled() bool {
+	return t.Provider != ""
+}
+
+func (t Translation) Validate() error {
+	switch t.Provider {
+	case "":
+		return nil
+	case TranslationProviderDeepL:
+		if t.APIKey == "" {
+			return errors.New("api_key is required for deepl")
+		}
+	case TranslationProviderLibreTranslate:
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http or https URL", t.URL)
+		}
+	default:
+		return fmt.Errorf("provider %q must be deepl or libretranslate", t.Provider)
+	}
+	if t.CacheSeconds < 0 {
+		return errors.New("cache_seconds must not be negative")
+	}
+	if t.RequestsPerSecond < 0 || t.RequestBurst < 0 {
+		return errors.New("requests_per_second and request_burst must not be negative")
+	}
+	return nil
+}
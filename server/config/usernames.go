@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// BridgedPlatforms are the chat networks cmd/bridge relays. Their users
+// appear as "name@platform", a suffix regular users can't take.
+var BridgedPlatforms = []string{"slack", "discord", "matrix"}
+
+// MaxUsernameLength is the protocol's ceiling on names; the policy can only
+// lower it.
+const MaxUsernameLength = 64
+
+// Usernames is the policy names must satisfy when a user connects or
+// renames. Names that differ only in case belong to the same user.
+type Usernames struct {
+	// MinLength and MaxLength bound a name in bytes.
+	MinLength int `json:"min_length"`
+	MaxLength int `json:"max_length"`
+	// Pattern is a regular expression the whole name must match, such as
+	// "^[A-Za-z0-9_.-]+$". Empty allows any printable characters.
+	Pattern string `json:"pattern"`
+	// Reserved names can't be taken by anyone, whatever their case.
+	Reserved []string `json:"reserved"`
+
+	pattern *regexp.Regexp
+	// visitorSuffixes are "@<app>" for each of tokens.apps. Widget visitors
+	// are named "<name>@<app>", so nobody else may take those names.
+	visitorSuffixes []string
+}
+
+func defaultUsernames() Usernames {
+	return Usernames{
+		MinLength: 1,
+		MaxLength: 32,
+		// Server notices are sent as "system".
+		Reserved: []string{"admin", "system"},
+	}
+}
+
+// NormalizeUsername is the form names are stored and compared in, so "Bob"
+// and "bob" can't be told apart.
+func NormalizeUsername(name string) string {
+	return strings.ToLower(name)
+}
+
+// Validate checks the limits and compiles Pattern.
+func (u *Usernames) Validate() error {
+	if u.MinLength < 1 {
+		return errors.New("min_length must be at least 1")
+	}
+	if u.MaxLength < u.MinLength || u.MaxLength > MaxUsernameLength {
+		return fmt.Errorf("max_length must be between min_length and %d", MaxUsernameLength)
+	}
+	u.pattern = nil
+	if u.Pattern != "" {
+		re, err := regexp.Compile(u.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		u.pattern = re
+	}
+	return nil
+}
+
+// Check returns why name breaks the policy, or nil if it doesn't.
+func (u *Usernames) Check(name string) error {
+	if len(name) < u.MinLength || len(name) > u.MaxLength {
+		return fmt.Errorf("usernames must be %d-%d bytes", u.MinLength, u.MaxLength)
+	}
+	if strings.TrimSpace(name) != name {
+		return errors.New("usernames can't start or end with spaces")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return errors.New("usernames may only contain printable characters")
+		}
+	}
+	if u.pattern != nil && !u.pattern.MatchString(name) {
+		return fmt.Errorf("usernames must match %s", u.Pattern)
+	}
+	normalized := NormalizeUsername(name)
+	if strings.HasPrefix(normalized, GuestPrefix) {
+		return fmt.Errorf("names starting with %q are reserved for guests", GuestPrefix)
+	}
+	for _, platform := range BridgedPlatforms {
+		if strings.HasSuffix(normalized, "@"+platform) {
+			return fmt.Errorf("names ending in @%s are reserved for bridged %s users", platform, platform)
+		}
+	}
+	for _, suffix := range u.visitorSuffixes {
+		if strings.HasSuffix(normalized, suffix) {
+			return fmt.Errorf("names ending in %s are reserved for the visitors of widget app %s", suffix, suffix[1:])
+		}
+	}
+	for _, reserved := range u.Reserved {
+		if NormalizeUsername(reserved) == normalized {
+			return fmt.Errorf("%q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// VisitorName is the name of a widget app's visitor: the name the app
+// picked, with the app's name as a suffix.
+func VisitorName(name, app string) string {
+	return name + "@" + app
+}
+
+// CheckVisitor checks a name a widget app picked for its visitor.
+func (u *Usernames) CheckVisitor(name, app string) error {
+	if err := u.Check(name); err != nil {
+		return err
+	}
+	if full := VisitorName(name, app); len(full) > MaxUsernameLength {
+		return fmt.Errorf("%q is longer than %d bytes", full, MaxUsernameLength)
+	}
+	return nil
+}
+
+// CheckSubject is Check for the subject of an access token, which may also
+// name a widget visitor.
+func (u *Usernames) CheckSubject(name string) error {
+	if base, ok := u.visitorBase(name); ok {
+		return u.Check(base)
+	}
+	return u.Check(name)
+}
+
+// IsVisitor reports whether name is a widget visitor's.
+func (u *Usernames) IsVisitor(name string) bool {
+	_, ok := u.visitorBase(name)
+	return ok
+}
+
+func (u *Usernames) visitorBase(name string) (string, bool) {
+	for _, suffix := range u.visitorSuffixes {
+		if n := len(name) - len(suffix); n > 0 && strings.EqualFold(name[n:], suffix) {
+			return name[:n], true
+		}
+	}
+	return "", false
+}
+
+// reserveVisitors keeps the names of the apps' visitors for them.
+func (u *Usernames) reserveVisitors(apps []TokenApp) {
+	u.visitorSuffixes = nil
+	for _, app := range apps {
+		u.visitorSuffixes = append(u.visitorSuffixes, "@"+NormalizeUsername(app.Name))
+	}
+}
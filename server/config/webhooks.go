@@ -0,0 +1,47 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Webhook is an HTTP endpoint notified of cluster lifecycle events. Events
+// lists the event types it wants, such as "user.joined"; "*" or an empty
+// list subscribes to all of them.
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret keys the HMAC-SHA256 signature sent with every delivery.
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	// Bot is the username of the bot the hook belongs to. Only its hooks
+	// receive the interactions with the cards it posted.
+	Bot string `json:"bot,omitempty"`
+}
+
+func (w Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Webhook) BelongsTo(bot string) bool {
+	return w.Bot != "" && NormalizeUsername(w.Bot) == NormalizeUsername(bot)
+}
+
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http:// or https:// URL", w.URL)
+	}
+	if w.Secret == "" {
+		return errors.New("secret is required so receivers can verify deliveries")
+	}
+	return nil
+}
@@ -2,13 +2,16 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"lukagolubovic/models"
 )
 
 func InitDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL")
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
 	}
@@ -18,6 +21,11 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -36,5 +44,133 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	if err := addColumn(db, "messages", "entities", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		log.Printf("Failed to add entities column: %v", err)
+		return err
+	}
+
+	if err := addColumn(db, "messages", "user_id", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+		log.Printf("Failed to add user_id column: %v", err)
+		return err
+	}
+
+	createUsersSQL := `CREATE TABLE IF NOT EXISTS users (
+		"id" INTEGER NOT NULL PRIMARY KEY,
+		"username" TEXT NOT NULL,
+		"updated_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(createUsersSQL); err != nil {
+		log.Printf("Failed to create users table: %v", err)
+		return err
+	}
+
+	createOutboxSQL := `CREATE TABLE IF NOT EXISTS outbox (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"payload" BLOB NOT NULL,
+		"attempts" INTEGER NOT NULL DEFAULT 0,
+		"created_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(createOutboxSQL); err != nil {
+		log.Printf("Failed to create outbox table: %v", err)
+		return err
+	}
+
+	createRoomsSQL := `CREATE TABLE IF NOT EXISTS rooms (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"topic" TEXT NOT NULL DEFAULT '',
+		"description" TEXT NOT NULL DEFAULT '',
+		"updated_by" TEXT NOT NULL DEFAULT '',
+		"updated_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(createRoomsSQL); err != nil {
+		log.Printf("Failed to create rooms table: %v", err)
+		return err
+	}
+
+	if _, err := db.Exec("INSERT OR IGNORE INTO rooms(name) VALUES(?)", models.DefaultRoom); err != nil {
+		log.Printf("Failed to seed default room: %v", err)
+		return err
+	}
+
 	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// since SQLite has no ADD COLUMN IF NOT EXISTS.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %q %s", table, column, definition))
+	return err
+}
+
+func SaveUser(db Execer, id int64, username string) error {
+	_, err := db.Exec(`INSERT INTO users(id, username, updated_at) VALUES(?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(id) DO UPDATE SET username = excluded.username, updated_at = excluded.updated_at
+		WHERE users.username != excluded.username`, id, username)
+	return err
+}
+
+func GetRoom(db *sql.DB, name string) (models.Room, error) {
+	var room models.Room
+	err := db.QueryRow("SELECT id, name, topic, description, updated_by, updated_at FROM rooms WHERE name = ?", name).
+		Scan(&room.ID, &room.Name, &room.Topic, &room.Description, &room.UpdatedBy, &room.UpdatedAt)
+	return room, err
+}
+
+// RoomOverrides returns the configuration overrides of every room that has
+// them, as stored JSON.
+func RoomOverrides(db *sql.DB) (map[string][]byte, error) {
+	rows, err := db.Query("SELECT name, overrides FROM rooms WHERE overrides != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string][]byte)
+	for rows.Next() {
+		var name, raw string
+		if err := rows.Scan(&name, &raw); err != nil {
+			return nil, err
+		}
+		overrides[name] = []byte(raw)
+	}
+	return overrides, rows.Err()
+}
+
+// SaveRoomOverrides stores a room's configuration overrides; empty raw
+// clears them.
+func SaveRoomOverrides(db Execer, name string, raw []byte) error {
+	_, err := db.Exec(`INSERT INTO rooms(name, overrides) VALUES(?, ?)
+		ON CONFLICT(name) DO UPDATE SET overrides = excluded.overrides`, name, string(raw))
+	return err
+}
+
+func SaveRoom(db Execer, room models.Room) error {
+	_, err := db.Exec(`INSERT INTO rooms(name, topic, description, updated_by, updated_at) VALUES(?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET topic = excluded.topic, description = excluded.description,
+		updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		room.Name, room.Topic, room.Description, room.UpdatedBy)
+	return err
 }
\ No newline at end of file
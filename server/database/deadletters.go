@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DeadLetter is a stored message a persistence hook gave up on. Payload is
+// the message as the hook was given it.
+type DeadLetter struct {
+	ID        int64     `json:"id,string"`
+	Hook      string    `json:"hook"`
+	MessageID int64     `json:"message_id,string"`
+	Payload   []byte    `json:"-"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+func InsertDeadLetter(db Execer, d DeadLetter) error {
+	_, err := db.Exec("INSERT INTO dead_letters(hook, message_id, payload, error, attempts) VALUES(?, ?, ?, ?, ?)",
+		d.Hook, d.MessageID, d.Payload, d.Error, d.Attempts)
+	return err
+}
+
+// DeadLetters lists up to limit dead letters after the one with id after,
+// oldest first, optionally only those of one hook.
+func DeadLetters(ctx context.Context, db *sql.DB, hook string, after int64, limit int) ([]DeadLetter, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, hook, message_id, payload, error, attempts, failed_at FROM dead_letters
+		WHERE id > ? AND (? = '' OR hook = ?) ORDER BY id LIMIT ?`, after, hook, hook, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+func GetDeadLetter(db *sql.DB, id int64) (DeadLetter, error) {
+	rows, err := db.Query("SELECT id, hook, message_id, payload, error, attempts, failed_at FROM dead_letters WHERE id = ?", id)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return DeadLetter{}, err
+		}
+		return DeadLetter{}, sql.ErrNoRows
+	}
+	return scanDeadLetter(rows)
+}
+
+// DeleteDeadLetter reports whether the dead letter existed.
+func DeleteDeadLetter(db Execer, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM dead_letters WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanDeadLetter(rows *sql.Rows) (DeadLetter, error) {
+	var d DeadLetter
+	err := rows.Scan(&d.ID, &d.Hook, &d.MessageID, &d.Payload, &d.Error, &d.Attempts, &d.FailedAt)
+	return d, err
+}
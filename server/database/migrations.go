@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations run in order, once each, after createTables. Each runs in its
+// own transaction with foreign keys disabled so tables can be rebuilt.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "reference users and rooms by id from messages",
+		statements: []string{
+			`CREATE TABLE rooms_new (
+				"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				"name" TEXT NOT NULL UNIQUE,
+				"topic" TEXT NOT NULL DEFAULT '',
+				"description" TEXT NOT NULL DEFAULT '',
+				"updated_by" TEXT NOT NULL DEFAULT '',
+				"updated_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`INSERT INTO rooms_new(name, topic, description, updated_by, updated_at)
+				SELECT name, topic, description, updated_by, updated_at FROM rooms
+				ORDER BY name = 'general' DESC, name`,
+			`DROP TABLE rooms`,
+			`ALTER TABLE rooms_new RENAME TO rooms`,
+
+			// Rows written before user ids existed get local users with
+			// negative ids, which never collide with cluster-issued ids.
+			`INSERT INTO users(id, username)
+				SELECT -ROW_NUMBER() OVER (ORDER BY username), username
+				FROM (SELECT DISTINCT COALESCE(username, '') AS username FROM messages WHERE user_id = 0)`,
+			`UPDATE messages SET user_id = (
+				SELECT u.id FROM users u WHERE u.id < 0 AND u.username = COALESCE(messages.username, '')
+			) WHERE user_id = 0`,
+			`INSERT OR IGNORE INTO users(id, username)
+				SELECT user_id, MAX(COALESCE(username, '')) FROM messages GROUP BY user_id`,
+
+			`CREATE TABLE messages_new (
+				"id" INTEGER NOT NULL PRIMARY KEY,
+				"room_id" INTEGER NOT NULL DEFAULT 1 REFERENCES rooms(id),
+				"user_id" INTEGER NOT NULL REFERENCES users(id),
+				"message" TEXT,
+				"server" TEXT,
+				"timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP,
+				"entities" TEXT NOT NULL DEFAULT ''
+			)`,
+			`INSERT INTO messages_new(id, room_id, user_id, message, server, timestamp, entities)
+				SELECT id, 1, user_id, message, server, timestamp, entities FROM messages`,
+			`DROP TABLE messages`,
+			`ALTER TABLE messages_new RENAME TO messages`,
+			`CREATE INDEX idx_messages_room_id ON messages(room_id, id)`,
+			`CREATE INDEX idx_messages_user_id ON messages(user_id, id)`,
+		},
+	},
+	{
+		version:     2,
+		description: "index message timestamps and usernames",
+		statements: []string{
+			`CREATE INDEX idx_messages_timestamp ON messages(timestamp)`,
+			`CREATE INDEX idx_users_username ON users(username)`,
+		},
+	},
+	{
+		version:     3,
+		description: "store per-room configuration overrides",
+		statements: []string{
+			`ALTER TABLE rooms ADD COLUMN "overrides" TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     4,
+		description: "store typed messages",
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN "type" TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages ADD COLUMN "payload" TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     5,
+		description: "keep messages persistence hooks gave up on",
+		statements: []string{
+			`CREATE TABLE dead_letters (
+				"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				"hook" TEXT NOT NULL,
+				"message_id" INTEGER NOT NULL,
+				"payload" BLOB NOT NULL,
+				"error" TEXT NOT NULL DEFAULT '',
+				"attempts" INTEGER NOT NULL DEFAULT 0,
+				"failed_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE INDEX idx_dead_letters_hook ON dead_letters(hook, id)`,
+		},
+	},
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		"version" INTEGER NOT NULL PRIMARY KEY,
+		"applied_at" DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			log.Printf("Migration %d (%s) failed: %v", m.version, m.description, err)
+			return err
+		}
+		log.Printf("Applied migration %d: %s\n", m.version, m.description)
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations(version) VALUES(?)", m.version); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	violation := rows.Next()
+	rows.Close()
+	if violation {
+		return fmt.Errorf("migration %d leaves foreign key violations", m.version)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,317 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"lukagolubovic/models"
+)
+
+// Hot-path queries live here so handlers and cmd/querybench share the exact
+// SQL whose query plans are checked.
+const (
+	RecentMessagesSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ?
+		ORDER BY m.id DESC LIMIT ?`
+
+	// SearchMessagesSQL searches a room's messages between two ids, which
+	// bound the index scan to a time window.
+	SearchMessagesSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.id > ? AND m.id < ? AND m.message LIKE ? ESCAPE '\'
+		ORDER BY m.id DESC LIMIT ?`
+
+	// MentionsSQL narrows a room's messages since a "YYYY-MM-DD HH:MM:SS"
+	// time to those containing a pattern, from anyone but one user.
+	MentionsSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.timestamp > ? AND m.user_id != ? AND m.message LIKE ? ESCAPE '\'
+		ORDER BY m.id ASC LIMIT ?`
+
+	// OldestMessageSQL finds where a room's stored history starts.
+	OldestMessageSQL = `SELECT COALESCE(MIN(id), 0) FROM messages WHERE room_id = ?`
+
+	MessageByIDSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.id = ?`
+
+	RoomMessageSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.id = ?`
+
+	PruneMessagesSQL = `DELETE FROM messages WHERE room_id = ? AND timestamp < datetime('now', ?)`
+
+	// DeleteArchivedSQL removes a room's messages up to an id that are
+	// older than a "YYYY-MM-DD HH:MM:SS" time, once they are archived.
+	DeleteArchivedSQL = `DELETE FROM messages WHERE room_id = ? AND id <= ? AND timestamp <= ?`
+
+	// The archive queries page through a room by id within a time range;
+	// the range bounds are "YYYY-MM-DD HH:MM:SS" strings, like timestamps.
+	// Pages back are also bounded below by an id.
+	ArchiveBeforeSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.id > ? AND m.id < ? AND m.timestamp >= ? AND m.timestamp <= ?
+		ORDER BY m.id DESC LIMIT ?`
+
+	ArchiveAfterSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.id > ? AND m.timestamp >= ? AND m.timestamp <= ?
+		ORDER BY m.id ASC LIMIT ?`
+
+	// StreamMessagesSQL reads a room's messages between two ids, without a
+	// limit, for streaming.
+	StreamMessagesSQL = `SELECT m.id, m.user_id, u.username, m.message, m.server, m.timestamp, m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ? AND m.id > ? AND m.id < ?
+		ORDER BY m.id ASC`
+)
+
+// ArchiveQuery selects one page of a room's archive. Without Before or
+// Last the page starts after After (from the oldest message when it is 0);
+// otherwise it is the newest page before Before (or before now), of
+// messages after After.
+type ArchiveQuery struct {
+	After  int64
+	Before int64
+	Last   bool
+	// Start and End bound message timestamps when they are set.
+	Start time.Time
+	End   time.Time
+	Limit int
+}
+
+const archiveTimeLayout = "2006-01-02 15:04:05"
+
+// ArchivedMessages returns a page of a room's messages, oldest first.
+func ArchivedMessages(ctx context.Context, db *sql.DB, roomID int64, q ArchiveQuery) ([]models.Message, error) {
+	start, end := "", "9999-12-31 23:59:59"
+	if !q.Start.IsZero() {
+		start = q.Start.UTC().Format(archiveTimeLayout)
+	}
+	if !q.End.IsZero() {
+		end = q.End.UTC().Format(archiveTimeLayout)
+	}
+	if q.Before == 0 && !q.Last {
+		return queryMessages(ctx, db, ArchiveAfterSQL, roomID, q.After, start, end, q.Limit)
+	}
+
+	before := q.Before
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	messages, err := queryMessages(ctx, db, ArchiveBeforeSQL, roomID, q.After, before, start, end, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// RecentMessages returns the newest limit messages of a room, oldest first.
+func RecentMessages(ctx context.Context, db *sql.DB, roomID int64, limit int) ([]models.Message, error) {
+	messages, err := queryMessages(ctx, db, RecentMessagesSQL, roomID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// SearchMessages returns up to limit messages of a room containing text
+// with ids between after and before, exclusive, newest first. A zero
+// before is unbounded. The match is a case-insensitive substring match for
+// ASCII.
+func SearchMessages(ctx context.Context, db *sql.DB, roomID int64, text string, after, before int64, limit int) ([]models.Message, error) {
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+	return queryMessages(ctx, db, SearchMessagesSQL, roomID, after, before, "%"+escaped+"%", limit)
+}
+
+// Mentions returns up to limit messages of a room sent after since by
+// other users that mention username as "@username", oldest first.
+func Mentions(db *sql.DB, roomID, userID int64, username string, since time.Time, limit int) ([]models.Message, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(username)
+	candidates, err := queryMessages(context.Background(), db, MentionsSQL, roomID, since.UTC().Format(archiveTimeLayout), userID, "%@"+escaped+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	// LIKE also matches longer names starting with username.
+	var messages []models.Message
+	for _, msg := range candidates {
+		if mentions(msg.Content, username) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// mentions reports whether content has "@username" not followed by a
+// character that could continue a name.
+func mentions(content, username string) bool {
+	lower, target := strings.ToLower(content), "@"+strings.ToLower(username)
+	for i := strings.Index(lower, target); i >= 0; {
+		end := i + len(target)
+		if end == len(lower) || !isNameChar(lower[end]) {
+			return true
+		}
+		next := strings.Index(lower[end:], target)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+// isNameChar is true for the characters that continue a name; "@" keeps
+// "@alice@slack" from mentioning alice.
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '@' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 0x80
+}
+
+// OldestMessageID returns the id of a room's oldest stored message, or 0
+// when it has none.
+func OldestMessageID(ctx context.Context, db *sql.DB, roomID int64) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, OldestMessageSQL, roomID).Scan(&id)
+	return id, err
+}
+
+// GetMessage returns one message, or sql.ErrNoRows.
+func GetMessage(db *sql.DB, id int64) (models.Message, error) {
+	messages, err := queryMessages(context.Background(), db, MessageByIDSQL, id)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if len(messages) == 0 {
+		return models.Message{}, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
+
+// MessageContext returns a room's message with up to n messages before and
+// after it, each oldest first, or sql.ErrNoRows when the room has no such
+// message.
+func MessageContext(ctx context.Context, db *sql.DB, roomID, id int64, n int) (msg models.Message, before, after []models.Message, err error) {
+	messages, err := queryMessages(ctx, db, RoomMessageSQL, roomID, id)
+	if err != nil {
+		return msg, nil, nil, err
+	}
+	if len(messages) == 0 {
+		return msg, nil, nil, sql.ErrNoRows
+	}
+	if before, err = ArchivedMessages(ctx, db, roomID, ArchiveQuery{Before: id, Limit: n}); err != nil {
+		return msg, nil, nil, err
+	}
+	if after, err = ArchivedMessages(ctx, db, roomID, ArchiveQuery{After: id, Limit: n}); err != nil {
+		return msg, nil, nil, err
+	}
+	return messages[0], before, after, nil
+}
+
+// EachMessage calls fn with a room's messages with ids between after and
+// before, exclusive, oldest first, as they are scanned, and stops at the
+// first error. A zero before is unbounded. Nothing is buffered, so it
+// suits ranges too large to hold in memory.
+func EachMessage(ctx context.Context, db *sql.DB, roomID, after, before int64, fn func(models.Message) error) error {
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	rows, err := db.QueryContext(ctx, StreamMessagesSQL, roomID, after, before)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func queryMessages(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// scanMessage reads a row of the message queries above.
+func scanMessage(rows *sql.Rows) (models.Message, error) {
+	var msg models.Message
+	var entities, payload string
+	if err := rows.Scan(&msg.ID, &msg.UserID, &msg.Username, &msg.Content, &msg.Server, &msg.Timestamp, &entities, &msg.Type, &payload); err != nil {
+		return models.Message{}, err
+	}
+	msg.Entities = models.DecodeEntities(entities)
+	models.DecodePayload(&msg, payload)
+	return msg, nil
+}
+
+// PruneMessages deletes a room's messages older than olderThanDays.
+func PruneMessages(db Execer, roomID int64, olderThanDays int) (int64, error) {
+	res, err := db.Exec(PruneMessagesSQL, roomID, fmt.Sprintf("-%d days", olderThanDays))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteArchived deletes a room's messages with ids up to throughID sent at
+// or before cutoff.
+func DeleteArchived(db Execer, roomID, throughID int64, cutoff time.Time) (int64, error) {
+	res, err := db.Exec(DeleteArchivedSQL, roomID, throughID, cutoff.UTC().Format(archiveTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ExplainQueryPlan returns SQLite's plan for query, one line per step.
+func ExplainQueryPlan(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			return nil, err
+		}
+		plan = append(plan, detail)
+	}
+	return plan, rows.Err()
+}
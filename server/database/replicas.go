@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReadPool spreads read-only queries over replica databases round-robin so
+// heavy history traffic does not compete with the write path. Without
+// replicas every read goes to the primary.
+type ReadPool struct {
+	primary  *sql.DB
+	replicas []*sql.DB
+	next     atomic.Uint64
+	// running counts the queries admitted by Begin.
+	running atomic.Int64
+}
+
+// ErrTooManyQueries is returned by Begin when the pool already runs as
+// many queries as it may.
+var ErrTooManyQueries = errors.New("too many queries running")
+
+// OpenReadPool opens each replica path read-only. Replicas are expected to
+// be kept up to date externally (for example by litestream or a file sync).
+func OpenReadPool(primary *sql.DB, paths []string) (*ReadPool, error) {
+	pool := &ReadPool{primary: primary}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		db, err := OpenReadOnly(path)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.replicas = append(pool.replicas, db)
+	}
+	return pool, nil
+}
+
+// OpenReadOnly opens a database file for reading only, for processes that
+// serve history from a database another process writes. It leaves the
+// journal mode alone: a read-only connection can't set it, and WAL, set by
+// the writer, is kept in the file.
+func OpenReadOnly(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (p *ReadPool) DB() *sql.DB {
+	if len(p.replicas) == 0 {
+		return p.primary
+	}
+	n := p.next.Add(1)
+	return p.replicas[n%uint64(len(p.replicas))]
+}
+
+// Primary returns the primary database, for reads that must not lag
+// behind it.
+func (p *ReadPool) Primary() *sql.DB {
+	return p.primary
+}
+
+// Begin admits a request's queries while fewer than max run, and returns
+// the context to run them with, cancelled after timeout, and the release
+// to call once they are done. Zero max or timeout is no limit. Requests
+// over the limit are refused rather than queued, so a burst of heavy ones
+// sheds load instead of piling up behind SQLite.
+func (p *ReadPool) Begin(ctx context.Context, max int, timeout time.Duration) (context.Context, func(), error) {
+	if n := p.running.Add(1); max > 0 && n > int64(max) {
+		p.running.Add(-1)
+		return nil, nil, ErrTooManyQueries
+	}
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {
+		cancel()
+		p.running.Add(-1)
+	}, nil
+}
+
+func (p *ReadPool) Size() int {
+	return len(p.replicas)
+}
+
+// Close closes the replicas; the primary is owned by the caller.
+func (p *ReadPool) Close() {
+	for _, db := range p.replicas {
+		db.Close()
+	}
+}
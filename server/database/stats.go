@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"lukagolubovic/models"
+)
+
+const topRoomLimit = 5
+
+// roomFilter narrows a stats query to one room; roomID 0 means all rooms.
+func roomFilter(roomID int64) (string, []interface{}) {
+	if roomID == 0 {
+		return "", nil
+	}
+	return " AND room_id = ?", []interface{}{roomID}
+}
+
+func countMessages(ctx context.Context, db *sql.DB, roomID int64, since string) (int64, error) {
+	filter, args := roomFilter(roomID)
+	var n int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE timestamp >= datetime('now', ?)"+filter,
+		append([]interface{}{since}, args...)...).Scan(&n)
+	return n, err
+}
+
+func countActiveUsers(ctx context.Context, db *sql.DB, roomID int64, since string) (int64, error) {
+	filter, args := roomFilter(roomID)
+	var n int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT user_id) FROM messages WHERE timestamp >= datetime('now', ?)"+filter,
+		append([]interface{}{since}, args...)...).Scan(&n)
+	return n, err
+}
+
+// messageBuckets groups messages newer than since into buckets using the
+// strftime layout, e.g. one per hour or per day.
+func messageBuckets(ctx context.Context, db *sql.DB, roomID int64, layout, since string) ([]models.StatsBucket, error) {
+	filter, args := roomFilter(roomID)
+	rows, err := db.QueryContext(ctx, `SELECT strftime(?, timestamp) AS bucket, COUNT(*) FROM messages
+		WHERE timestamp >= datetime('now', ?)`+filter+`
+		GROUP BY bucket ORDER BY bucket`,
+		append([]interface{}{layout, since}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []models.StatsBucket{}
+	for rows.Next() {
+		var b models.StatsBucket
+		if err := rows.Scan(&b.Start, &b.Count); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func fillRoomStats(ctx context.Context, db *sql.DB, s *models.RoomStats) error {
+	var err error
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE room_id = ?", s.ID).Scan(&s.TotalMessages); err != nil {
+		return err
+	}
+	if s.Messages24h, err = countMessages(ctx, db, s.ID, "-24 hours"); err != nil {
+		return err
+	}
+	if s.ActiveUsers24h, err = countActiveUsers(ctx, db, s.ID, "-24 hours"); err != nil {
+		return err
+	}
+	if s.Hourly, err = messageBuckets(ctx, db, s.ID, "%Y-%m-%dT%H:00:00Z", "-24 hours"); err != nil {
+		return err
+	}
+	s.Daily, err = messageBuckets(ctx, db, s.ID, "%Y-%m-%d", "-30 days")
+	return err
+}
+
+// RoomStatistics returns message and activity figures for every room.
+func RoomStatistics(ctx context.Context, db *sql.DB) ([]models.RoomStats, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM rooms ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var rooms []models.RoomStats
+	for rows.Next() {
+		var s models.RoomStats
+		if err := rows.Scan(&s.ID, &s.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rooms = append(rooms, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rooms {
+		if err := fillRoomStats(ctx, db, &rooms[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rooms, nil
+}
+
+// GlobalStatistics returns cluster-wide message and activity figures. The
+// connection figures are not stored in the database and are left zero.
+func GlobalStatistics(ctx context.Context, db *sql.DB) (models.GlobalStats, error) {
+	var s models.GlobalStats
+	var err error
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages").Scan(&s.TotalMessages); err != nil {
+		return s, err
+	}
+	if s.Messages24h, err = countMessages(ctx, db, 0, "-24 hours"); err != nil {
+		return s, err
+	}
+	if s.ActiveUsers24h, err = countActiveUsers(ctx, db, 0, "-24 hours"); err != nil {
+		return s, err
+	}
+	if s.ActiveUsers7d, err = countActiveUsers(ctx, db, 0, "-7 days"); err != nil {
+		return s, err
+	}
+	if s.Hourly, err = messageBuckets(ctx, db, 0, "%Y-%m-%dT%H:00:00Z", "-24 hours"); err != nil {
+		return s, err
+	}
+	if s.Daily, err = messageBuckets(ctx, db, 0, "%Y-%m-%d", "-30 days"); err != nil {
+		return s, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT r.id, r.name, COUNT(*) AS n FROM messages m JOIN rooms r ON r.id = m.room_id
+		WHERE m.timestamp >= datetime('now', '-7 days')
+		GROUP BY r.id ORDER BY n DESC LIMIT ?`, topRoomLimit)
+	if err != nil {
+		return s, err
+	}
+	s.TopRooms = []models.RoomStats{}
+	for rows.Next() {
+		var room models.RoomStats
+		var n int64
+		if err := rows.Scan(&room.ID, &room.Name, &n); err != nil {
+			rows.Close()
+			return s, err
+		}
+		s.TopRooms = append(s.TopRooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	for i := range s.TopRooms {
+		if err := fillRoomStats(ctx, db, &s.TopRooms[i]); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"lukagolubovic/idgen"
+	"lukagolubovic/models"
+)
+
+// Snowflake ids carry their creation time in the bits above
+// idgen.TimeShift, so messages can be bucketed by hour from the primary key
+// alone.
+const (
+	msPerSyncBucket = 3600 * 1000
+	checksumPrime   = 1000000007
+)
+
+// FirstSyncedID is the smallest id exchanged between servers. Ids below it
+// are legacy ones each server assigned from its own counter before
+// snowflakes, so the same id names different messages on different servers
+// and can't be reconciled by id.
+const FirstSyncedID int64 = 1 << idgen.TimeShift
+
+// SyncBucket summarises one hour of messages. Two servers holding the same
+// messages for that hour produce the same Count and Checksum.
+type SyncBucket struct {
+	Bucket   int64 `json:"bucket"`
+	Count    int64 `json:"count"`
+	Checksum int64 `json:"checksum"`
+}
+
+// MessageRow is a messages row as exchanged between servers. Rooms are sent
+// by name because room ids are assigned independently on each server.
+type MessageRow struct {
+	ID        int64  `json:"id,string"`
+	Room      string `json:"room"`
+	UserID    int64  `json:"user_id,string"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	Server    string `json:"server"`
+	Timestamp string `json:"timestamp"`
+	Entities  string `json:"entities"`
+	// Type and Payload are empty for plain chat messages, and unknown to
+	// servers older than typed messages.
+	Type    string `json:"type,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// SyncDigest returns per-hour digests of every message with an id of at
+// least sinceID, leaving out legacy ids.
+func SyncDigest(ctx context.Context, db *sql.DB, sinceID int64) ([]SyncBucket, error) {
+	rows, err := db.QueryContext(ctx, `SELECT (id >> ?) / ? AS bucket, COUNT(*), SUM(id % ?) FROM messages
+		WHERE id >= ? GROUP BY bucket ORDER BY bucket`,
+		idgen.TimeShift, msPerSyncBucket, checksumPrime, max(sinceID, FirstSyncedID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []SyncBucket{}
+	for rows.Next() {
+		var b SyncBucket
+		if err := rows.Scan(&b.Bucket, &b.Count, &b.Checksum); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// BucketMessages returns every message in one hour bucket, leaving out
+// legacy ids.
+func BucketMessages(ctx context.Context, db *sql.DB, bucket int64) ([]MessageRow, error) {
+	lo := max(bucket*msPerSyncBucket<<idgen.TimeShift, FirstSyncedID)
+	hi := (bucket + 1) * msPerSyncBucket << idgen.TimeShift
+	rows, err := db.QueryContext(ctx, `SELECT m.id, r.name, m.user_id, u.username, m.message, m.server,
+		COALESCE(strftime('%Y-%m-%d %H:%M:%S', m.timestamp), ''), m.entities, m.type, m.payload
+		FROM messages m JOIN users u ON u.id = m.user_id JOIN rooms r ON r.id = m.room_id
+		WHERE m.id >= ? AND m.id < ? ORDER BY m.id`, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []MessageRow{}
+	for rows.Next() {
+		var m MessageRow
+		if err := rows.Scan(&m.ID, &m.Room, &m.UserID, &m.Username, &m.Message, &m.Server, &m.Timestamp, &m.Entities, &m.Type, &m.Payload); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// RowFromMessage converts a broadcast chat message into a row. Broadcasts
+// carry no timestamp, so it is taken from the snowflake id.
+func RowFromMessage(msg models.Message) MessageRow {
+	return MessageRow{
+		ID:        msg.ID,
+		Room:      models.DefaultRoom,
+		UserID:    msg.UserID,
+		Username:  msg.Username,
+		Message:   msg.Content,
+		Server:    msg.Server,
+		Timestamp: idgen.Time(msg.ID).UTC().Format("2006-01-02 15:04:05"),
+		Entities:  models.EncodeEntities(msg.Entities),
+		Type:      msg.Type,
+		Payload:   models.EncodePayload(msg),
+	}
+}
+
+// InsertReplicated stores a message that was written by another server. It
+// is a no-op if the message is already present, and creates the user and
+// room if this server has never seen them.
+func InsertReplicated(tx *sql.Tx, m MessageRow) (bool, error) {
+	if m.Room == "" {
+		m.Room = models.DefaultRoom
+	}
+	if _, err := tx.Exec("INSERT OR IGNORE INTO users(id, username) VALUES(?, ?)", m.UserID, m.Username); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT OR IGNORE INTO rooms(name) VALUES(?)", m.Room); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO messages(id, room_id, user_id, message, server, timestamp, entities, type, payload)
+		VALUES(?, (SELECT id FROM rooms WHERE name = ?), ?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.Room, m.UserID, m.Message, m.Server, m.Timestamp, m.Entities, m.Type, m.Payload)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReplicaConflicts reports whether this server stores a different message
+// under m's id: one by another user or with other text. InsertReplicated
+// keeps the stored message in that case, so callers check after an insert
+// that changed nothing.
+func ReplicaConflicts(tx *sql.Tx, m MessageRow) (bool, error) {
+	var userID int64
+	var message string
+	err := tx.QueryRow("SELECT user_id, message FROM messages WHERE id = ?", m.ID).Scan(&userID, &message)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return userID != m.UserID || message != m.Message, nil
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	writeQueueSize     = 1024
+	busyRetries        = 5
+	checkpointInterval = time.Minute
+)
+
+var ErrWriterClosed = errors.New("database writer is closed")
+
+// Execer is satisfied by *sql.DB and *sql.Tx so helpers can run either
+// directly or inside a Writer transaction.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Job states. A job leaves jobQueued exactly once: the writer claims it by
+// starting it, or its caller claims it by giving up.
+const (
+	jobQueued int32 = iota
+	jobStarted
+	jobAbandoned
+)
+
+type writeJob struct {
+	ctx   context.Context
+	fn    func(*sql.Tx) error
+	done  chan error
+	state *atomic.Int32
+}
+
+// abandon withdraws a job that has not started yet. It reports false if the
+// writer already started it, in which case its result is still coming.
+func (j writeJob) abandon() bool {
+	return j.state.CompareAndSwap(jobQueued, jobAbandoned)
+}
+
+// Writer funnels every write through one goroutine and one connection.
+// SQLite allows a single writer at a time, so serializing here turns lock
+// contention (SQLITE_BUSY) into an orderly queue.
+type Writer struct {
+	db     *sql.DB
+	jobs   chan writeJob
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewWriter(db *sql.DB) *Writer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Writer{
+		db:     db,
+		jobs:   make(chan writeJob, writeQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Close stops the writer; queued and future writes fail with
+// ErrWriterClosed.
+func (w *Writer) Close() {
+	w.cancel()
+}
+
+func (w *Writer) Run() {
+	ctx := w.ctx
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		log.Printf("Database writer failed to acquire connection: %v", err)
+		w.drain(err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.drain(ErrWriterClosed)
+			return
+		case job := <-w.jobs:
+			// A caller that gave up while the job was queued has already
+			// reported failure, so the write must not happen behind its back.
+			if err := job.ctx.Err(); err != nil {
+				job.abandon()
+				job.done <- err
+				continue
+			}
+			if !job.state.CompareAndSwap(jobQueued, jobStarted) {
+				continue
+			}
+			// Once started, the job runs to the end on the writer's own
+			// context: the caller waits for the commit's real outcome.
+			job.done <- w.execute(ctx, conn, job.fn)
+		case <-ticker.C:
+			w.checkpoint(ctx, conn)
+		}
+	}
+}
+
+// Tx queues fn to run in its own transaction and waits for the result.
+func (w *Writer) Tx(fn func(*sql.Tx) error) error {
+	return w.TxContext(context.Background(), fn)
+}
+
+// TxContext is Tx with a deadline for getting a turn: it returns ctx.Err()
+// if ctx ends while the job is still queued, and the job is then skipped.
+// Once the transaction has begun, ctx no longer matters and TxContext
+// returns the result of the commit, so an error always means nothing was
+// written.
+func (w *Writer) TxContext(ctx context.Context, fn func(*sql.Tx) error) error {
+	job := writeJob{ctx: ctx, fn: fn, done: make(chan error, 1), state: new(atomic.Int32)}
+	select {
+	case w.jobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.ctx.Done():
+		return ErrWriterClosed
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		if job.abandon() {
+			return ctx.Err()
+		}
+	case <-w.ctx.Done():
+		if job.abandon() {
+			return ErrWriterClosed
+		}
+	}
+	return <-job.done
+}
+
+func (w *Writer) execute(ctx context.Context, conn *sql.Conn, fn func(*sql.Tx) error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := w.runTx(ctx, conn, fn)
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Writer) runTx(ctx context.Context, conn *sql.Conn, fn func(*sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkpoint keeps the WAL file from growing without bound. It runs on the
+// writer connection, so no write is in flight while it truncates the log.
+func (w *Writer) checkpoint(ctx context.Context, conn *sql.Conn) {
+	var busy, logFrames, checkpointed int
+	err := conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		log.Printf("WAL checkpoint failed: %v", err)
+		return
+	}
+	if busy != 0 {
+		log.Printf("WAL checkpoint incomplete: readers still active (%d/%d frames)", checkpointed, logFrames)
+	}
+}
+
+func (w *Writer) drain(err error) {
+	for {
+		select {
+		case job := <-w.jobs:
+			job.done <- err
+		default:
+			return
+		}
+	}
+}
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+// Package gif searches Giphy or Tenor on behalf of clients. The API key
+// stays on the servers, and results are cached in Redis so every server
+// shares them and popular searches don't use up the provider's quota.
+package gif
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+)
+
+const (
+	giphySearchURL = "https://api.giphy.com/v1/gifs/search"
+	tenorSearchURL = "https://tenor.googleapis.com/v2/search"
+
+	cachePrefix    = "chat:gifs:"
+	requestTimeout = 10 * time.Second
+	// maxResponse bounds the provider's response; a page of 50 results is
+	// well under it.
+	maxResponse = 4 << 20
+)
+
+var ErrDisabled = errors.New("GIF search is disabled")
+
+// tenorFilters maps ratings to Tenor's content filters.
+var tenorFilters = map[string]string{"g": "high", "pg": "medium", "pg-13": "low", "r": "off"}
+
+type Searcher struct {
+	rdb    redis.UniversalClient
+	cfg    *config.Store
+	client *http.Client
+}
+
+func NewSearcher(rdb redis.UniversalClient, cfg *config.Store) *Searcher {
+	return &Searcher{rdb: rdb, cfg: cfg, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// Search returns up to limit GIFs matching query, from the cache when an
+// identical search was made recently. A cache that can't be read or written
+// only costs a request to the provider.
+func (s *Searcher) Search(ctx context.Context, query string, limit int) ([]models.GIF, error) {
+	c := s.cfg.Get().GIFs
+	if !c.Enabled() {
+		return nil, ErrDisabled
+	}
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	sum := sha256.Sum256([]byte(query))
+	key := fmt.Sprintf("%s%s:%s:%d:%s", cachePrefix, c.Provider, c.Rating, limit, hex.EncodeToString(sum[:16]))
+
+	if c.CacheSeconds > 0 {
+		raw, err := s.rdb.Get(ctx, key).Bytes()
+		if err == nil {
+			var gifs []models.GIF
+			if err := json.Unmarshal(raw, &gifs); err == nil {
+				metrics.GIFSearches.Add("cached", 1)
+				return gifs, nil
+			}
+		} else if err != redis.Nil {
+			log.Printf("[GIF] Failed to read cached results: %v", err)
+		}
+	}
+
+	var gifs []models.GIF
+	var err error
+	switch c.Provider {
+	case config.GIFProviderGiphy:
+		gifs, err = s.giphy(ctx, c, query, limit)
+	case config.GIFProviderTenor:
+		gifs, err = s.tenor(ctx, c, query, limit)
+	}
+	if err != nil {
+		metrics.GIFSearches.Add("failed", 1)
+		return nil, err
+	}
+	metrics.GIFSearches.Add("fetched", 1)
+
+	if c.CacheSeconds > 0 {
+		raw, _ := json.Marshal(gifs)
+		if err := s.rdb.Set(ctx, key, raw, time.Duration(c.CacheSeconds)*time.Second).Err(); err != nil {
+			log.Printf("[GIF] Failed to cache results: %v", err)
+		}
+	}
+	return gifs, nil
+}
+
+func (s *Searcher) giphy(ctx context.Context, c config.GIFs, query string, limit int) ([]models.GIF, error) {
+	params := url.Values{
+		"api_key": {c.APIKey},
+		"q":       {query},
+		"limit":   {strconv.Itoa(limit)},
+		"rating":  {c.Rating},
+	}
+	type image struct {
+		URL    string `json:"url"`
+		Width  string `json:"width"`
+		Height string `json:"height"`
+	}
+	var body struct {
+		Data []struct {
+			ID     string `json:"id"`
+			Title  string `json:"title"`
+			Images struct {
+				Original   image `json:"original"`
+				FixedWidth image `json:"fixed_width"`
+			} `json:"images"`
+		} `json:"data"`
+	}
+	if err := s.get(ctx, giphySearchURL+"?"+params.Encode(), &body); err != nil {
+		return nil, err
+	}
+	gifs := make([]models.GIF, 0, len(body.Data))
+	for _, d := range body.Data {
+		width, _ := strconv.Atoi(d.Images.Original.Width)
+		height, _ := strconv.Atoi(d.Images.Original.Height)
+		gifs = appendValid(gifs, models.GIF{
+			Provider:   config.GIFProviderGiphy,
+			ID:         d.ID,
+			Title:      d.Title,
+			URL:        d.Images.Original.URL,
+			PreviewURL: d.Images.FixedWidth.URL,
+			Width:      width,
+			Height:     height,
+		})
+	}
+	return gifs, nil
+}
+
+func (s *Searcher) tenor(ctx context.Context, c config.GIFs, query string, limit int) ([]models.GIF, error) {
+	params := url.Values{
+		"key":           {c.APIKey},
+		"q":             {query},
+		"limit":         {strconv.Itoa(limit)},
+		"contentfilter": {tenorFilters[c.Rating]},
+		"media_filter":  {"gif,tinygif"},
+	}
+	type media struct {
+		URL  string `json:"url"`
+		Dims []int  `json:"dims"`
+	}
+	var body struct {
+		Results []struct {
+			ID           string `json:"id"`
+			Description  string `json:"content_description"`
+			MediaFormats struct {
+				GIF     media `json:"gif"`
+				TinyGIF media `json:"tinygif"`
+			} `json:"media_formats"`
+		} `json:"results"`
+	}
+	if err := s.get(ctx, tenorSearchURL+"?"+params.Encode(), &body); err != nil {
+		return nil, err
+	}
+	gifs := make([]models.GIF, 0, len(body.Results))
+	for _, r := range body.Results {
+		g := models.GIF{
+			Provider:   config.GIFProviderTenor,
+			ID:         r.ID,
+			Title:      r.Description,
+			URL:        r.MediaFormats.GIF.URL,
+			PreviewURL: r.MediaFormats.TinyGIF.URL,
+		}
+		if dims := r.MediaFormats.GIF.Dims; len(dims) == 2 {
+			g.Width, g.Height = dims[0], dims[1]
+		}
+		gifs = appendValid(gifs, g)
+	}
+	return gifs, nil
+}
+
+// appendValid drops results a gif message couldn't carry, so clients can
+// send back whatever the search returned.
+func appendValid(gifs []models.GIF, g models.GIF) []models.GIF {
+	if len(g.Title) > models.MaxGIFTitle {
+		g.Title = strings.ToValidUTF8(g.Title[:models.MaxGIFTitle], "")
+	}
+	if g.Validate() != nil {
+		return gifs
+	}
+	return append(gifs, g)
+}
+
+func (s *Searcher) get(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The error includes the URL, and with it the API key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("provider request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponse))
+		return fmt.Errorf("provider returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(v); err != nil {
+		return fmt.Errorf("invalid provider response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+func Control(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cmd models.ControlCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		if !cmd.Valid() {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid control command")
+			return
+		}
+
+		if err := hub.PublishControl(r.Context(), cmd); err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to publish control command")
+			log.Printf("Control publish error: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// maxAuditEntries bounds the limit parameter of AuditLog.
+const maxAuditEntries = 1000
+
+// AuditLog lists the latest audit log entries, newest first: 100 by
+// default, up to maxAuditEntries with ?limit=.
+func AuditLog(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxAuditEntries {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditEntries))
+				return
+			}
+			limit = n
+		}
+		entries, err := hub.Audit().Recent(r.Context(), limit)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to read the audit log")
+			log.Printf("Audit log read error: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+func ConnectedUsers(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.ConnectedUsers())
+	}
+}
@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/attachment"
+	"lukagolubovic/authtoken"
+	"lukagolubovic/config"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+// UploadAttachment stores the request body as a file to share in
+// messages, named by ?name= and typed by the Content-Type header. Chat
+// frames then share it by its id. The uploader, named by ?token= or
+// ?username=, is charged for it; with a default quota, uploads must name
+// one.
+func UploadAttachment(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := hub.Config()
+		userID, ok := identifyUser(w, r, hub, cfg, cfg.Attachments.QuotaBytes > 0)
+		if !ok {
+			return
+		}
+		limit := cfg.Attachments.MaxBytes
+		if r.ContentLength > limit {
+			apierror.WriteDetails(w, http.StatusRequestEntityTooLarge, apierror.CodeBadRequest, "file too large",
+				map[string]int64{"max": limit})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apierror.WriteDetails(w, http.StatusRequestEntityTooLarge, apierror.CodeBadRequest, "file too large",
+				map[string]int64{"max": limit})
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "failed to read the file")
+			return
+		}
+
+		a, err := hub.UploadAttachment(r.Context(), userID, r.URL.Query().Get("name"), r.Header.Get("Content-Type"), body)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+// GetAttachment downloads a file. Its ETag is the content's digest, so
+// clients revalidate cached copies without downloading them again, even
+// across attachments sharing the content.
+func GetAttachment(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkSignature(w, r, hub.Config()) {
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid attachment id")
+			return
+		}
+		a, err := hub.Attachment(r.Context(), id)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+
+		etag := `"` + a.SHA256 + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		body, err := hub.OpenAttachment(r.Context(), a)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+
+		// Only images are shown inline; anything else, HTML included, is
+		// downloaded rather than rendered on this origin.
+		disposition := "attachment"
+		if strings.HasPrefix(a.ContentType, "image/") && !strings.HasPrefix(a.ContentType, "image/svg") {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		uploaded, _ := time.Parse(time.RFC3339, a.UploadedAt)
+		http.ServeContent(w, r, a.Name, uploaded, bytes.NewReader(body))
+	}
+}
+
+// GetThumbnail downloads a thumbnail of an image attachment, by the size
+// of its longer side. Like downloads, thumbnails carry their content's
+// digest, with the size, as their ETag.
+func GetThumbnail(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkSignature(w, r, hub.Config()) {
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid attachment id")
+			return
+		}
+		size, err := strconv.Atoi(r.PathValue("size"))
+		if err != nil || size <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid thumbnail size")
+			return
+		}
+		a, err := hub.Attachment(r.Context(), id)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		if !a.HasThumbnail(size) {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "thumbnail not found")
+			return
+		}
+
+		etag := fmt.Sprintf(`"%s-%d"`, a.SHA256, size)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		body, contentType, err := hub.OpenThumbnail(r.Context(), a, size)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "inline")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		uploaded, _ := time.Parse(time.RFC3339, a.UploadedAt)
+		http.ServeContent(w, r, "", uploaded, bytes.NewReader(body))
+	}
+}
+
+type attachmentLink struct {
+	URL        string            `json:"url"`
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+	ExpiresAt  string            `json:"expires_at,omitempty"`
+}
+
+// AttachmentLink returns the paths an attachment and its thumbnails are
+// downloaded from. With a signing key they are signed and expire, and with
+// room checks only users who can read the attachment's room get them:
+// the token, or the username when tokens aren't required, is checked as
+// when connecting. Attachments are shared in the default room for now.
+func AttachmentLink(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid attachment id")
+			return
+		}
+		cfg := hub.Config()
+		if cfg.Attachments.RoomChecks && !authorizeRoomRead(w, r, hub, cfg, models.DefaultRoom) {
+			return
+		}
+		a, err := hub.Attachment(r.Context(), id)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+
+		path := "/attachments/" + strconv.FormatInt(a.ID, 10)
+		sign := func(p string) string { return p }
+		var link attachmentLink
+		if key := cfg.Attachments.SigningKey; key != "" {
+			expires := time.Now().Add(time.Duration(cfg.Attachments.URLTTLSeconds) * time.Second)
+			sign = func(p string) string { return attachment.SignPath([]byte(key), p, expires) }
+			link.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		}
+		link.URL = sign(path)
+		if len(a.Thumbnails) > 0 {
+			link.Thumbnails = make(map[string]string, len(a.Thumbnails))
+			for _, size := range a.Thumbnails {
+				link.Thumbnails[strconv.Itoa(size)] = sign(path + "/thumbnails/" + strconv.Itoa(size))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(link)
+	}
+}
+
+// identifyUser resolves the requesting user from the token query
+// parameter or, when tokens aren't required, the username one, and
+// refuses banned users. Without either it returns a zero id, unless
+// required. It writes the error response and returns false if the request
+// must be refused.
+func identifyUser(w http.ResponseWriter, r *http.Request, hub *hub.Hub, cfg *config.Runtime, required bool) (int64, bool) {
+	userID, _, ok := identify(w, r, hub, cfg, required)
+	return userID, ok
+}
+
+func identify(w http.ResponseWriter, r *http.Request, hub *hub.Hub, cfg *config.Runtime, required bool) (int64, *authtoken.Claims, bool) {
+	username := r.URL.Query().Get("username")
+	claims, ok := verifyToken(w, r, cfg, username)
+	if !ok {
+		return 0, nil, false
+	}
+	if claims != nil {
+		username = claims.Subject
+	}
+	if username == "" {
+		if required {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "username or token required")
+			return 0, nil, false
+		}
+		return 0, nil, true
+	}
+	check := cfg.Usernames.Check
+	if claims != nil {
+		check = cfg.Usernames.CheckSubject
+	}
+	if err := check(username); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+		return 0, nil, false
+	}
+	userID, _, err := hub.ResolveUser(username)
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to resolve user")
+		log.Printf("resolve user error: %v", err)
+		return 0, nil, false
+	}
+	if hub.IsBanned(userID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "user is banned")
+		return 0, nil, false
+	}
+	return userID, claims, true
+}
+
+// authorizeRoomRead checks that the requesting user, identified as by
+// identifyUser, may read room. It writes the error response and returns
+// false if not.
+func authorizeRoomRead(w http.ResponseWriter, r *http.Request, hub *hub.Hub, cfg *config.Runtime, room string) bool {
+	userID, claims, ok := identify(w, r, hub, cfg, true)
+	if !ok {
+		return false
+	}
+	if claims != nil && (!claims.Allows(authtoken.ScopeRead) || !claims.AllowsRoom(room)) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "token does not allow reading this room")
+		return false
+	}
+	member, err := hub.IsMember(r.Context(), room, userID)
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to check membership")
+		log.Printf("membership error: %v", err)
+		return false
+	}
+	if !member {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "not a member of this room")
+		return false
+	}
+	return true
+}
+
+// AttachmentUsage returns how much of their quota the requesting user's
+// attachments take, identified as for uploads.
+func AttachmentUsage(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := identifyUser(w, r, hub, hub.Config(), true)
+		if !ok {
+			return
+		}
+		usage, err := hub.AttachmentUsage(r.Context(), userID)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+type attachmentQuota struct {
+	UserID   int64  `json:"user_id,string"`
+	Username string `json:"username"`
+	models.AttachmentUsage
+}
+
+// GetAttachmentQuota returns a user's attachment usage and quota.
+func GetAttachmentQuota(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, username, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		usage, err := hub.AttachmentUsage(r.Context(), userID)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(attachmentQuota{UserID: userID, Username: username, AttachmentUsage: usage})
+	}
+}
+
+// SetAttachmentQuota gives a user their own quota with
+// {"quota_bytes": n}, zero being unlimited. DELETE puts them back on the
+// config's.
+func SetAttachmentQuota(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var quota *int64
+		if r.Method != http.MethodDelete {
+			var req struct {
+				QuotaBytes *int64 `json:"quota_bytes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+				return
+			}
+			if req.QuotaBytes == nil {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "quota_bytes is required")
+				return
+			}
+			quota = req.QuotaBytes
+		}
+		userID, username, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		if err := hub.SetAttachmentQuota(r.Context(), userID, quota); err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		usage, err := hub.AttachmentUsage(r.Context(), userID)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(attachmentQuota{UserID: userID, Username: username, AttachmentUsage: usage})
+	}
+}
+
+// checkSignature checks a download's signature when URLs are signed. It
+// writes the error response and returns false if the download must be
+// refused.
+func checkSignature(w http.ResponseWriter, r *http.Request, cfg *config.Runtime) bool {
+	key := cfg.Attachments.SigningKey
+	if key == "" {
+		return true
+	}
+	skew := time.Duration(cfg.Attachments.ClockSkewSeconds) * time.Second
+	switch err := attachment.VerifyPath([]byte(key), r.URL.Path, r.URL.Query(), time.Now(), skew); {
+	case errors.Is(err, attachment.ErrURLExpired):
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "the URL has expired")
+		return false
+	case err != nil:
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "invalid or missing signature")
+		return false
+	}
+	return true
+}
+
+// DeleteAttachment deletes a file; its content goes once no other
+// attachment shares it.
+func DeleteAttachment(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid attachment id")
+			return
+		}
+		if err := hub.DeleteAttachment(r.Context(), id); err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// QuarantinedAttachments lists the uploads the virus scanner flagged,
+// for moderators to review.
+func QuarantinedAttachments(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := hub.QuarantinedAttachments(r.Context())
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrAttachmentsDisabled):
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "attachments are disabled")
+	case errors.Is(err, hub.ErrInvalidAttachment), errors.Is(err, attachment.ErrInvalidImage):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	case errors.As(err, new(*attachment.QuarantineError)):
+		apierror.Write(w, http.StatusUnprocessableEntity, apierror.CodeBadRequest, err.Error())
+	case errors.As(err, new(*attachment.QuotaError)):
+		var quota *attachment.QuotaError
+		errors.As(err, &quota)
+		apierror.WriteDetails(w, http.StatusForbidden, apierror.CodeForbidden, "attachment quota exceeded",
+			map[string]int64{"used_bytes": quota.Used, "quota_bytes": quota.Quota})
+	case errors.Is(err, attachment.ErrScanFailed):
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, err.Error())
+	case errors.Is(err, attachment.ErrNotFound):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "attachment not found")
+	default:
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "attachment storage failed")
+		log.Printf("Attachment error: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/backup"
+)
+
+// CreateBackup stores a snapshot of the database at dest, a directory on
+// the server or an object store.
+func CreateBackup(db *sql.DB, dest backup.Destination) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		where, err := dest.Snapshot(r.Context(), db)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create backup")
+			log.Printf("Backup error: %v", err)
+			return
+		}
+		log.Printf("[Backup] Wrote %s\n", where)
+
+		field := "path"
+		if dest.Store != nil {
+			field = "key"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{field: where})
+	}
+}
+
+// DownloadBackup streams a fresh snapshot of the database to the caller.
+func DownloadBackup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tmpDir, err := os.MkdirTemp("", "chat-backup")
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create backup")
+			log.Printf("Backup temp dir error: %v", err)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+
+		path := filepath.Join(tmpDir, "chat.db")
+		if err := backup.Snapshot(db, path); err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create backup")
+			log.Printf("Backup error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", `attachment; filename="chat.db"`)
+		http.ServeFile(w, r, path)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+type postCardRequest struct {
+	// Username is the bot the card is posted as; button clicks go to the
+	// webhooks whose bot it is.
+	Username string      `json:"username"`
+	Card     models.Card `json:"card"`
+}
+
+// PostCard posts a card message to the room, taking
+// {"username": "...", "card": {...}}, and returns the message sent.
+func PostCard(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req postCardRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		msg, err := hub.PostCard(r.Context(), req.Username, req.Card)
+		if err != nil {
+			writeCardError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+func writeCardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrInvalidCard), errors.Is(err, hub.ErrInvalidSender):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	case errors.Is(err, hub.ErrSenderBlocked):
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, err.Error())
+	default:
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "failed to post card")
+		log.Printf("Card error: %v", err)
+	}
+}
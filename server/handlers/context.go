@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/archive"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+const (
+	defaultContextLimit = 25
+	maxContextLimit     = 100
+)
+
+type messageContext struct {
+	Message models.Message   `json:"message"`
+	Before  []models.Message `json:"before"`
+	After   []models.Message `json:"after"`
+}
+
+// MessageContext returns a message of the default room with up to ?limit=
+// messages on each side, for deep links and jumping to search results.
+// Messages before it that were archived are read back from the archive.
+// Reads are bounded by the config's queries section.
+func MessageContext(reads *database.ReadPool, archived *archive.Reader, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid message id")
+			return
+		}
+		limit := defaultContextLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 || n > maxContextLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 0, "max": maxContextLimit})
+				return
+			}
+			limit = n
+		}
+
+		queries := cfg.Get().Queries
+		ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
+		if err != nil {
+			writeQueryError(w, err, "")
+			return
+		}
+		defer done()
+
+		msg, before, after, err := database.MessageContext(ctx, reads.DB(), models.DefaultRoomID, id, limit)
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "message not found")
+			return
+		}
+		if err != nil {
+			writeQueryError(w, err, "Failed to retrieve message context")
+			return
+		}
+
+		if len(before) < limit && archived != nil {
+			oldest := id
+			if len(before) > 0 {
+				oldest = before[0].ID
+			}
+			older, err := archived.Before(ctx, models.DefaultRoom, oldest, limit-len(before))
+			if err != nil {
+				writeQueryError(w, err, "Failed to retrieve archived history")
+				return
+			}
+			before = append(older, before...)
+		}
+		if before == nil {
+			before = []models.Message{}
+		}
+		if after == nil {
+			after = []models.Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messageContext{Message: msg, Before: before, After: after})
+	}
+}
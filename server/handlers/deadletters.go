@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/persist"
+)
+
+const (
+	defaultDeadLetterLimit = 100
+	maxDeadLetterLimit     = 1000
+)
+
+// DeadLetters lists the messages persistence hooks gave up on, oldest
+// first. ?hook= keeps one hook's, and ?after= pages on from the last id
+// seen.
+func DeadLetters(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultDeadLetterLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxDeadLetterLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 1, "max": maxDeadLetterLimit})
+				return
+			}
+			limit = n
+		}
+		var after int64
+		if raw := r.URL.Query().Get("after"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "after must be a dead letter id")
+				return
+			}
+			after = n
+		}
+
+		letters, err := hub.DeadLetters(r.Context(), r.URL.Query().Get("hook"), after, limit)
+		if err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(letters)
+	}
+}
+
+// RetryDeadLetter hands a dead letter to its hook again, as a new first
+// attempt.
+func RetryDeadLetter(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := deadLetterID(w, r)
+		if !ok {
+			return
+		}
+		if err := hub.RetryDeadLetter(id); err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// DiscardDeadLetter deletes a dead letter without retrying it.
+func DiscardDeadLetter(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := deadLetterID(w, r)
+		if !ok {
+			return
+		}
+		if err := hub.DiscardDeadLetter(id); err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func deadLetterID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid dead letter id")
+		return 0, false
+	}
+	return id, true
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, persist.ErrNotFound):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "dead letter not found")
+	case errors.Is(err, persist.ErrUnknownHook):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "the dead letter's hook is no longer configured")
+	default:
+		log.Printf("Dead letters: %v", err)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to access dead letters")
+	}
+}
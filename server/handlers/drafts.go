@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+)
+
+type draftRequest struct {
+	Content string `json:"content"`
+}
+
+// ListDrafts returns the drafts a user is composing, one per room.
+func ListDrafts(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _, ok := ownPathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		drafts, err := hub.Drafts(r.Context(), userID)
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drafts)
+	}
+}
+
+func GetDraft(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _, ok := ownPathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		draft, err := hub.Draft(r.Context(), userID, r.PathValue("room"))
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(draft)
+	}
+}
+
+// SaveDraft creates or replaces a user's draft in a room, taking
+// {"content": "..."}.
+func SaveDraft(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req draftRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		userID, _, ok := ownPathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		draft, err := hub.SaveDraft(r.Context(), userID, r.PathValue("room"), req.Content)
+		if err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(draft)
+	}
+}
+
+func DeleteDraft(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _, ok := ownPathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		if err := hub.DeleteDraft(r.Context(), userID, r.PathValue("room")); err != nil {
+			writeDraftError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ownPathUser resolves {username} for endpoints only that user may call:
+// the request must carry an access token for them as
+// "Authorization: Bearer <token>", since anyone can claim a name.
+func ownPathUser(w http.ResponseWriter, r *http.Request, hub *hub.Hub) (int64, string, bool) {
+	cfg := hub.Config()
+	name := r.PathValue("username")
+	if !verifyBearer(w, r, cfg, name, true) {
+		return 0, "", false
+	}
+	if err := cfg.Usernames.CheckSubject(name); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+		return 0, "", false
+	}
+	userID, username, err := hub.ResolveUser(name)
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to resolve user")
+		log.Printf("resolve user error: %v", err)
+		return 0, "", false
+	}
+	return userID, username, true
+}
+
+func writeDraftError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrDraftNotFound), errors.Is(err, hub.ErrUnknownRoom):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+	case errors.Is(err, hub.ErrInvalidDraft):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	default:
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "draft operation failed")
+		log.Printf("Draft error: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/gif"
+	"lukagolubovic/metrics"
+	"lukagolubovic/middleware"
+	"lukagolubovic/models"
+	"lukagolubovic/ratelimit"
+)
+
+const (
+	defaultGIFLimit = 20
+	maxGIFLimit     = 50
+	maxGIFQuery     = 100
+)
+
+// SearchGIFs proxies GIF searches to the configured provider, limiting
+// each client IP to the gifs section's rate.
+func SearchGIFs(searcher *gif.Searcher, cfg *config.Store) http.HandlerFunc {
+	limiter := ratelimit.NewKeyed()
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := cfg.Get().GIFs
+		if !c.Enabled() {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "GIF search is disabled")
+			return
+		}
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "q is required")
+			return
+		}
+		if len(q) > maxGIFQuery {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "q is too long",
+				map[string]int{"max": maxGIFQuery})
+			return
+		}
+		limit := defaultGIFLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxGIFLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 1, "max": maxGIFLimit})
+				return
+			}
+			limit = n
+		}
+
+		ip := middleware.ClientIP(r)
+		ok, retryAfter, _ := limiter.Allow(ip, ratelimit.KeyedLimits{Rate: c.SearchesPerSecond, Burst: c.SearchBurst})
+		if !ok {
+			metrics.GIFSearches.Add("rate_limited", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "too many GIF searches")
+			return
+		}
+
+		gifs, err := searcher.Search(r.Context(), q, limit)
+		if errors.Is(err, gif.ErrDisabled) {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "GIF search is disabled")
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "GIF search failed")
+			log.Printf("GIF search error: %v", err)
+			return
+		}
+		if gifs == nil {
+			gifs = []models.GIF{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(c.CacheSeconds))
+		json.NewEncoder(w).Encode(gifs)
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/loadbalancer"
+	"lukagolubovic/models"
+)
+
+func Liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// Readiness reports ready only while the server is registered with the load
+// balancer, so a drained server stops receiving traffic from both.
+func Readiness(lbClient *loadbalancer.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !lbClient.Registered() {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "not registered with load balancer")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	}
+}
+
+// Drain is meant for a preStop hook: it removes the server from the load
+// balancer so no new clients are routed here while existing ones finish.
+func Drain(lbClient *loadbalancer.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lbClient.Deregister()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("draining"))
+	}
+}
+
+// LoadBalancerShutdown is called by a load balancer shutting down, so the
+// server registers again with the one that replaces it instead of counting
+// itself as registered with one that is gone.
+func LoadBalancerShutdown(lbClient *loadbalancer.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lbClient.Rejoin()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("rejoining"))
+	}
+}
+
+// EvictingDrain deregisters like Drain, then closes every connection with a
+// reconnect hint so clients move to another server straight away.
+func EvictingDrain(lbClient *loadbalancer.Client, hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lbClient.Deregister()
+		n := hub.Evict(models.ReconnectDrain)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"evicted": n})
+	}
+}
@@ -1,40 +1,286 @@
 package handlers
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"lukagolubovic/apierror"
+	"lukagolubovic/archive"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/idgen"
+	"lukagolubovic/metrics"
 	"lukagolubovic/models"
+	"lukagolubovic/search"
 )
 
-func GetHistory(db *sql.DB) http.HandlerFunc {
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// GetHistory returns the default room's newest messages, or with ?before=
+// the page of messages before that id, oldest first. ?from= and ?to= narrow
+// it to a time window. Pages reaching past what the database still holds
+// continue from the archive. With ?format=ndjson, or an Accept header
+// asking for NDJSON, it streams the whole range instead; see
+// streamHistory. Reads are bounded by the config's queries section.
+func GetHistory(reads *database.ReadPool, archived *archive.Reader, cfg *config.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, username, message, server, timestamp FROM messages ORDER BY timestamp DESC LIMIT 50")
+		if wantsNDJSON(r) {
+			streamHistory(w, r, reads, archived, cfg.Get().Queries)
+			return
+		}
+		limit := defaultHistoryLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxHistoryLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 1, "max": maxHistoryLimit})
+				return
+			}
+			limit = n
+		}
+		var before int64
+		if raw := r.URL.Query().Get("before"); raw != "" {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || id <= 0 {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid before")
+				return
+			}
+			before = id
+		}
+		after, end, ok := parseWindow(w, r)
+		if !ok {
+			return
+		}
+		if end != 0 && (before == 0 || end < before) {
+			before = end
+		}
+
+		queries := cfg.Get().Queries
+		ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
 		if err != nil {
-			http.Error(w, "Failed to retrieve message history", http.StatusInternalServerError)
-			log.Printf("DB query error: %v", err)
+			writeQueryError(w, err, "")
 			return
 		}
-		defer rows.Close()
+		defer done()
 
 		var messages []models.Message
-		for rows.Next() {
-			var msg models.Message
-			if err := rows.Scan(&msg.ID, &msg.Username, &msg.Content, &msg.Server, &msg.Timestamp); err != nil {
-				http.Error(w, "Failed to scan message row", http.StatusInternalServerError)
-				log.Printf("DB scan error: %v", err)
+		if before == 0 && after == 0 {
+			messages, err = database.RecentMessages(ctx, reads.DB(), models.DefaultRoomID, limit)
+		} else {
+			messages, err = database.ArchivedMessages(ctx, reads.DB(), models.DefaultRoomID, database.ArchiveQuery{After: after, Before: before, Last: true, Limit: limit})
+		}
+		if err != nil {
+			writeQueryError(w, err, "Failed to retrieve message history")
+			return
+		}
+
+		if len(messages) < limit && archived != nil {
+			oldest := before
+			if len(messages) > 0 {
+				oldest = messages[0].ID
+			} else if oldest == 0 {
+				oldest = math.MaxInt64
+			}
+			if oldest > after+1 {
+				older, err := archived.Before(ctx, models.DefaultRoom, oldest, limit-len(messages))
+				if err != nil {
+					writeQueryError(w, err, "Failed to retrieve archived history")
+					return
+				}
+				// Messages before the window start the page; dropping
+				// them leaves it short, as the window's first page.
+				for len(older) > 0 && older[0].ID <= after {
+					older = older[1:]
+				}
+				messages = append(older, messages...)
+			}
+		}
+		if messages == nil {
+			messages = []models.Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+// wantsNDJSON reports whether a request asks for a streamed response.
+func wantsNDJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "ndjson"
+	}
+	return strings.Contains(r.Header.Get("Accept"), ndjsonType)
+}
+
+const ndjsonType = "application/x-ndjson"
+
+// streamHistory writes the default room's messages with ids between
+// ?after= and ?before=, both optional and exclusive, and within the ?from=
+// and ?to= window, oldest first, one JSON object per line. Archived
+// messages come first, then the database's, each written as it is read, so
+// memory stays flat however large the range. A stream ends after
+// queries.max_stream_rows messages, and clients continue after the last
+// one. An error once rows are written, a timeout included, can only cut the
+// response short, which clients see as an incomplete body.
+func streamHistory(w http.ResponseWriter, r *http.Request, reads *database.ReadPool, archived *archive.Reader, queries config.Queries) {
+	var after, before int64
+	for name, v := range map[string]*int64{"after": &after, "before": &before} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || id <= 0 {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid "+name)
 				return
 			}
-			messages = append(messages, msg)
+			*v = id
 		}
+	}
+	start, end, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	after = max(after, start)
+	if end != 0 && (before == 0 || end < before) {
+		before = end
+	}
+
+	ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.StreamTimeout())
+	if err != nil {
+		writeQueryError(w, err, "")
+		return
+	}
+	defer done()
 
-		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-			messages[i], messages[j] = messages[j], messages[i]
+	w.Header().Set("Content-Type", ndjsonType)
+	enc := json.NewEncoder(w)
+	last, written := after, 0
+	write := func(msg models.Message) error {
+		if msg.ID <= last {
+			return nil
+		}
+		if before != 0 && msg.ID >= before || queries.MaxStreamRows > 0 && written == queries.MaxStreamRows {
+			return errStreamDone
+		}
+		last = msg.ID
+		written++
+		return enc.Encode(msg)
+	}
+
+	err = archived.Each(ctx, models.DefaultRoom, after, write)
+	if err == nil {
+		// Messages both archived and not yet pruned were written already.
+		err = database.EachMessage(ctx, reads.DB(), models.DefaultRoomID, last, before, write)
+	}
+	if err != nil && !errors.Is(err, errStreamDone) {
+		if written == 0 {
+			writeQueryError(w, err, "Failed to retrieve message history")
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			metrics.Queries.Add("timed_out", 1)
+		}
+		if r.Context().Err() == nil {
+			log.Printf("History stream error after message %d: %v", last, err)
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// errStreamDone stops a stream that reached the end of its range.
+var errStreamDone = errors.New("end of range")
+
+// parseWindow reads the optional ?from= and ?to= RFC 3339 times as the ids
+// bounding messages sent from from up to, but not including, to: after and
+// before, exclusive, or zero when unset. Ids start with the time they were
+// issued, so a window is a range of the (room, id) index. It writes the
+// error response and returns false if they are invalid.
+func parseWindow(w http.ResponseWriter, r *http.Request) (after, before int64, ok bool) {
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			v, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid "+name, "an RFC 3339 time")
+				return 0, 0, false
+			}
+			*t = v
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "from must be before to")
+		return 0, 0, false
+	}
+	if !from.IsZero() {
+		after = max(idgen.MinID(from)-1, 0)
+	}
+	// Times past the last id there can be leave the window open.
+	if !to.IsZero() && to.Before(idgen.Time(math.MaxInt64)) {
+		before = max(idgen.MinID(to), 1)
+	}
+	return after, before, true
+}
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+// Search finds messages in the default room matching ?q=, within the
+// ?from= and ?to= window if given, through the configured search engine.
+// Searches are bounded by the config's queries section.
+func Search(engine search.Engine, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queries := cfg.Get().Queries
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "q is required")
+			return
+		}
+		if utf8.RuneCountInString(q) > queries.MaxSearchLength {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "q is too long",
+				map[string]int{"max": queries.MaxSearchLength})
+			return
+		}
+		limit := defaultSearchLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxSearchLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 1, "max": maxSearchLimit})
+				return
+			}
+			limit = n
+		}
+		after, before, ok := parseWindow(w, r)
+		if !ok {
+			return
+		}
+
+		messages, err := engine.Search(r.Context(), search.Query{Room: models.DefaultRoom, Text: q, After: after, Before: before, Limit: limit})
+		if errors.Is(err, search.ErrEngine) && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Search: %v", err)
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "search is unavailable")
+			return
+		}
+		if err != nil {
+			writeQueryError(w, err, "Failed to search messages")
+			return
+		}
+		if messages == nil {
+			messages = []models.Message{}
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(messages)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/invite"
+	"lukagolubovic/models"
+)
+
+type createInviteRequest struct {
+	Room       string `json:"room"`
+	MaxUses    int    `json:"max_uses"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+type redeemInviteRequest struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+}
+
+// CreateInvite issues an invite token for a room, the default room when
+// none is named.
+func CreateInvite(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createInviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		if req.Room == "" {
+			req.Room = models.DefaultRoom
+		}
+		if req.Room != models.DefaultRoom {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "unknown room")
+			return
+		}
+		if req.MaxUses < 0 || req.TTLSeconds < 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "max_uses and ttl_seconds must not be negative")
+			return
+		}
+
+		inv, err := hub.CreateInvite(r.Context(), req.Room, req.MaxUses, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil {
+			writeInviteError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(inv)
+	}
+}
+
+func RevokeInvite(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.RevokeInvite(r.Context(), r.PathValue("id")); err != nil {
+			if inviteNotFound(err) {
+				apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+				return
+			}
+			writeInviteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RedeemInvite makes the named user a member of the invite's room. With
+// tokens.required, the request must carry an access token for the user.
+func RedeemInvite(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req redeemInviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		if req.Token == "" {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "token required")
+			return
+		}
+		cfg := hub.Config()
+		if err := cfg.Usernames.Check(req.Username); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+			return
+		}
+		if !verifyBearer(w, r, cfg, req.Username, cfg.Tokens.Required) {
+			return
+		}
+
+		userID, username, err := hub.ResolveUser(req.Username)
+		if err != nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to resolve user")
+			log.Printf("resolve user error: %v", err)
+			return
+		}
+		if hub.IsBanned(userID) {
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "user is banned")
+			return
+		}
+
+		room, err := hub.RedeemInvite(r.Context(), req.Token, userID)
+		if err != nil {
+			writeInviteError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"room":     room,
+			"user_id":  userID,
+			"username": username,
+		})
+	}
+}
+
+func writeInviteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrInvitesDisabled):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+	case errors.Is(err, invite.ErrInvalid):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	case errors.Is(err, invite.ErrExpired), errors.Is(err, hub.ErrInviteNotFound),
+		errors.Is(err, hub.ErrInviteRevoked), errors.Is(err, hub.ErrInviteUsedUp):
+		apierror.Write(w, http.StatusGone, apierror.CodeGone, err.Error())
+	default:
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "invite operation failed")
+		log.Printf("Invite error: %v", err)
+	}
+}
+
+func inviteNotFound(err error) bool {
+	return errors.Is(err, hub.ErrInviteNotFound)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+)
+
+// GetMaintenance returns the maintenance state this server enforces.
+func GetMaintenance(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.Maintenance())
+	}
+}
+
+// SetMaintenance turns cluster-wide maintenance on or off, taking
+// {"enabled": true, "message": "..."}.
+func SetMaintenance(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		m, err := hub.SetMaintenance(r.Context(), req.Enabled, req.Message)
+		if err != nil {
+			writeMaintenanceError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+func writeMaintenanceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrInvalidMaintenance):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "maintenance message is too long")
+	default:
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to set maintenance")
+		log.Printf("Maintenance error: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+const (
+	defaultMembersLimit = 50
+	maxMembersLimit     = 200
+)
+
+type membersResponse struct {
+	Members []models.Member `json:"members"`
+	// Next is the after cursor of the following page, absent on the last.
+	Next string `json:"next,omitempty"`
+}
+
+// ListMembers returns a page of a room's current members with when they
+// joined and whether they are online, longest-standing first. ?after= takes
+// the next cursor of the previous page.
+func ListMembers(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if room != models.DefaultRoom {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "unknown room")
+			return
+		}
+		limit := defaultMembersLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxMembersLimit {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid limit",
+					map[string]int{"min": 1, "max": maxMembersLimit})
+				return
+			}
+			limit = n
+		}
+
+		members, next, err := hub.Members(r.Context(), room, r.URL.Query().Get("after"), limit)
+		if err != nil {
+			writeMembersError(w, err)
+			return
+		}
+		if members == nil {
+			members = []models.Member{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(membersResponse{Members: members, Next: next})
+	}
+}
+
+func writeMembersError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrInvalidCursor):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid after")
+	default:
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to list members")
+		log.Printf("Members error: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/notify"
+)
+
+type notificationPrefs struct {
+	UserID   int64  `json:"user_id,string"`
+	Username string `json:"username"`
+	notify.Prefs
+}
+
+// GetNotificationPrefs returns a user's notification preferences.
+func GetNotificationPrefs(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, username, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		prefs, err := hub.NotificationPrefs(r.Context(), userID)
+		if err != nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to load preferences")
+			log.Printf("Notification preferences error: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notificationPrefs{UserID: userID, Username: username, Prefs: prefs})
+	}
+}
+
+// SetNotificationPrefs replaces a user's notification preferences, such as
+// the email address digests go to.
+func SetNotificationPrefs(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var prefs notify.Prefs
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		if err := prefs.Validate(); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid preferences", err.Error())
+			return
+		}
+		userID, username, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		if err := hub.SetNotificationPrefs(r.Context(), userID, prefs); err != nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to save preferences")
+			log.Printf("Notification preferences error: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notificationPrefs{UserID: userID, Username: username, Prefs: prefs})
+	}
+}
+
+// resolvePathUser resolves the {username} path value, writing the error
+// response when that fails.
+func resolvePathUser(w http.ResponseWriter, r *http.Request, hub *hub.Hub) (int64, string, bool) {
+	name := r.PathValue("username")
+	if err := hub.Config().Usernames.Check(name); err != nil {
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+		return 0, "", false
+	}
+	userID, username, err := hub.ResolveUser(name)
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to resolve user")
+		log.Printf("resolve user error: %v", err)
+		return 0, "", false
+	}
+	return userID, username, true
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Email digests</title></head>
+<body>{{if .Done}}<p>You won't get digest emails anymore.</p>{{else}}
+<form method="post"><p>Stop getting emails about mentions you missed?</p>
+<input type="hidden" name="token" value="{{.Token}}"><button type="submit">Unsubscribe</button></form>{{end}}
+</body></html>
+`))
+
+// Unsubscribe serves the link at the bottom of every digest. GET only
+// shows a confirmation form, since mail scanners follow links; POST, from
+// the form or a mail client's one-click unsubscribe, turns digests off.
+func Unsubscribe(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		if token == "" {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "token required")
+			return
+		}
+		if r.Method == http.MethodPost {
+			if err := hub.Unsubscribe(r.Context(), token); err != nil {
+				writeUnsubscribeError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(w, struct {
+			Token string
+			Done  bool
+		}{token, r.Method == http.MethodPost})
+	}
+}
+
+func writeUnsubscribeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrNotificationsDisabled):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+	case errors.Is(err, notify.ErrInvalidToken):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	default:
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to unsubscribe")
+		log.Printf("Unsubscribe error: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the HTTP endpoints and the WebSocket message
+// envelope. Keep it in step with the handlers when routes change.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func OpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	}
+}
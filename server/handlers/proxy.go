@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"lukagolubovic/apierror"
+)
+
+// HistoryProxy forwards history reads to the cluster-wide history service.
+// CORS headers are added by this server, so the service's are dropped.
+// transport may be nil; under mutual TLS it presents the client certificate.
+func HistoryProxy(target string, transport http.RoundTripper) (http.Handler, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute URL", target)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del("Access-Control-Allow-Origin")
+		resp.Header.Del("Access-Control-Allow-Methods")
+		resp.Header.Del("Access-Control-Allow-Headers")
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("History service error: %v", err)
+		apierror.Write(w, http.StatusBadGateway, apierror.CodeUnavailable, "history service unavailable")
+	}
+	return proxy, nil
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/database"
+	"lukagolubovic/metrics"
+)
+
+// writeQueryError writes the response for a failed read: a 503 when too
+// many queries ran or it took too long, otherwise a 500 with message.
+func writeQueryError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, database.ErrTooManyQueries):
+		metrics.Queries.Add("rejected", 1)
+		w.Header().Set("Retry-After", "1")
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "too many queries are running; try again")
+	case errors.Is(err, context.DeadlineExceeded):
+		metrics.Queries.Add("timed_out", 1)
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "the query took too long; narrow it down")
+	default:
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, message)
+		log.Printf("%s: %v", message, err)
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+// Resync catches a reconnecting client up with the messages of ?room=
+// after ?after_id=, the last one it saw. When more than models.MaxResync
+// were sent since, or the database no longer holds the message it saw,
+// the gap is too large to replay and the client is told to reload its
+// history instead. Reads are bounded by the config's queries section.
+func Resync(reads *database.ReadPool, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.URL.Query().Get("room")
+		if room == "" {
+			room = models.DefaultRoom
+		}
+		if room != models.DefaultRoom {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "unknown room")
+			return
+		}
+		after, err := strconv.ParseInt(r.URL.Query().Get("after_id"), 10, 64)
+		if err != nil || after <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "after_id must be the id of a message")
+			return
+		}
+
+		queries := cfg.Get().Queries
+		ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
+		if err != nil {
+			writeQueryError(w, err, "")
+			return
+		}
+		defer done()
+
+		db := reads.DB()
+		resync := models.Resync{Messages: []models.Message{}}
+		oldest, err := database.OldestMessageID(ctx, db, models.DefaultRoomID)
+		if err != nil {
+			writeQueryError(w, err, "Failed to retrieve message history")
+			return
+		}
+		if after < oldest {
+			// Messages after the one the client saw may have been pruned
+			// or archived with it.
+			resync.ResyncRequired, resync.Reason = true, models.ResyncHistoryPruned
+		} else {
+			messages, err := database.ArchivedMessages(ctx, db, models.DefaultRoomID, database.ArchiveQuery{After: after, Limit: models.MaxResync + 1})
+			if err != nil {
+				writeQueryError(w, err, "Failed to retrieve message history")
+				return
+			}
+			if len(messages) > models.MaxResync {
+				resync.ResyncRequired, resync.Reason = true, models.ResyncTooManyMessages
+			} else if messages != nil {
+				resync.Messages = messages
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resync)
+	}
+}
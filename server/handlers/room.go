@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+func GetRoom(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := database.GetRoom(db, models.DefaultRoom)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to retrieve room")
+			log.Printf("DB room query error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/hub"
+)
+
+type roomOverrides struct {
+	Room      string               `json:"room"`
+	Overrides config.RoomOverrides `json:"overrides"`
+}
+
+// GetRoomOverrides returns the configuration overrides of the {room} path
+// value.
+func GetRoomOverrides(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		o, err := hub.RoomOverrides(room)
+		if err != nil {
+			writeRoomOverridesError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roomOverrides{Room: room, Overrides: o})
+	}
+}
+
+// SetRoomOverrides replaces a room's overrides on every server; an empty
+// object removes them.
+func SetRoomOverrides(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var o config.RoomOverrides
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&o); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		room := r.PathValue("room")
+		if err := hub.SetRoomOverrides(r.Context(), room, o); err != nil {
+			writeRoomOverridesError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roomOverrides{Room: room, Overrides: o})
+	}
+}
+
+func writeRoomOverridesError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrUnknownRoom):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "unknown room")
+	case errors.Is(err, hub.ErrInvalidOverrides):
+		apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid overrides", err.Error())
+	default:
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "failed to access room overrides")
+		log.Printf("Room overrides error: %v", err)
+	}
+}
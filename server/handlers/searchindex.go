@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/search"
+)
+
+// ReindexSearch starts indexing this server's messages into the search
+// engine, after ?after= when given. It answers 202 with the new run's
+// status, or 200 with the status of one already running.
+func ReindexSearch(rx *search.Reindexer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rx == nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "no search engine is configured")
+			return
+		}
+		var after int64
+		if raw := r.URL.Query().Get("after"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "after must be a message id")
+				return
+			}
+			after = n
+		}
+
+		status, started := rx.Start(after)
+		w.Header().Set("Content-Type", "application/json")
+		if started {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// SearchReindexStatus reports the progress of this server's last reindex.
+func SearchReindexStatus(rx *search.Reindexer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rx == nil {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "no search engine is configured")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rx.Status())
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+type userSessions struct {
+	UserID   int64            `json:"user_id,string"`
+	Username string           `json:"username"`
+	Sessions []models.Session `json:"sessions"`
+}
+
+// ListSessions returns a user's connections across the cluster, for
+// security pages and support.
+func ListSessions(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, username, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		sessions, err := hub.Sessions(r.Context(), userID)
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(userSessions{UserID: userID, Username: username, Sessions: sessions})
+	}
+}
+
+// RevokeSession closes one of a user's sessions, or all of them without an
+// {id}, on whichever servers hold them.
+func RevokeSession(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _, ok := resolvePathUser(w, r, hub)
+		if !ok {
+			return
+		}
+		if err := hub.RevokeSession(r.Context(), userID, r.PathValue("id")); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, hub.ErrSessionNotFound) {
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+		return
+	}
+	apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "session operation failed")
+	log.Printf("Session error: %v", err)
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/hub"
+	"lukagolubovic/loadbalancer"
+)
+
+const statsCacheTTL = time.Minute
+
+// statsCache keeps the last result of an expensive stats query so
+// dashboards polling every few seconds don't rescan the messages table.
+type statsCache struct {
+	mu      sync.Mutex
+	value   interface{}
+	expires time.Time
+}
+
+// get returns the cached value or computes a new one. Computing is a
+// request's query, bounded by the config's queries section.
+func (c *statsCache) get(r *http.Request, reads *database.ReadPool, cfg *config.Store, compute func(context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.value != nil && time.Now().Before(c.expires) {
+		return c.value, nil
+	}
+	queries := cfg.Get().Queries
+	ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	value, err := compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.value = value
+	c.expires = time.Now().Add(statsCacheTTL)
+	return value, nil
+}
+
+func RoomStats(reads *database.ReadPool, cfg *config.Store) http.HandlerFunc {
+	cache := &statsCache{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := cache.get(r, reads, cfg, func(ctx context.Context) (interface{}, error) {
+			return database.RoomStatistics(ctx, reads.DB())
+		})
+		if err != nil {
+			writeQueryError(w, err, "Failed to compute room statistics")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// GlobalStats combines message figures from the database with connection
+// figures from the load balancer, which is the only component that sees the
+// load of every server.
+func GlobalStats(reads *database.ReadPool, lbClient *loadbalancer.Client, cfg *config.Store) http.HandlerFunc {
+	cache := &statsCache{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := cache.get(r, reads, cfg, func(ctx context.Context) (interface{}, error) {
+			s, err := database.GlobalStatistics(ctx, reads.DB())
+			if err != nil {
+				return nil, err
+			}
+			if cluster, err := lbClient.Stats(); err != nil {
+				log.Printf("Load balancer stats error: %v", err)
+			} else {
+				s.Connections = cluster.Connections
+				s.PeakConnections = cluster.PeakConnections
+				s.PeakAt = cluster.PeakAt
+			}
+			s.GeneratedAt = time.Now().UTC()
+			return s, nil
+		})
+		if err != nil {
+			writeQueryError(w, err, "Failed to compute statistics")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// LimitsStats reports this server's adaptive rate limiting: how far the
+// message limits are scaled down and the load measurements behind it.
+func LimitsStats(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.LimitsStats())
+	}
+}
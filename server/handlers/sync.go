@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+)
+
+// SyncDigest serves hourly message digests to peers running anti-entropy,
+// from the primary database, bounded by the config's queries section.
+func SyncDigest(reads *database.ReadPool, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid since", err.Error())
+			return
+		}
+
+		queries := cfg.Get().Queries
+		ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
+		if err != nil {
+			writeQueryError(w, err, "")
+			return
+		}
+		defer done()
+		buckets, err := database.SyncDigest(ctx, reads.Primary(), since)
+		if err != nil {
+			writeQueryError(w, err, "Failed to compute digest")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buckets)
+	}
+}
+
+// SyncMessages serves every message of one hour bucket to a peer, like
+// SyncDigest.
+func SyncMessages(reads *database.ReadPool, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, err := strconv.ParseInt(r.URL.Query().Get("bucket"), 10, 64)
+		if err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid bucket", err.Error())
+			return
+		}
+
+		queries := cfg.Get().Queries
+		ctx, done, err := reads.Begin(r.Context(), queries.MaxConcurrent, queries.Timeout())
+		if err != nil {
+			writeQueryError(w, err, "")
+			return
+		}
+		defer done()
+		messages, err := database.BucketMessages(ctx, reads.Primary(), bucket)
+		if err != nil {
+			writeQueryError(w, err, "Failed to retrieve messages")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messages)
+	}
+}
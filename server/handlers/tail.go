@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+const tailKeepAlive = 15 * time.Second
+
+type tailFilter struct {
+	room  string
+	user  string
+	match *regexp.Regexp
+}
+
+func (f tailFilter) matches(msg models.Message) bool {
+	if f.room != "" {
+		room := models.DefaultRoom
+		if msg.Room != nil && msg.Room.Name != "" {
+			room = msg.Room.Name
+		}
+		if room != f.room {
+			return false
+		}
+	}
+	if f.user != "" && msg.Username != f.user {
+		return false
+	}
+	if f.match != nil && !f.match.MatchString(msg.Content) {
+		return false
+	}
+	return true
+}
+
+// Tail streams every broadcast message as Server-Sent Events, optionally
+// filtered by ?room=, ?user= and a ?match= regular expression on the content.
+// The operator is not registered as a client, so it never shows up in the
+// room or in the server's load.
+func Tail(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "streaming unsupported")
+			return
+		}
+
+		query := r.URL.Query()
+		filter := tailFilter{room: query.Get("room"), user: query.Get("user")}
+		if expr := query.Get("match"); expr != "" {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid match expression", err.Error())
+				return
+			}
+			filter.match = re
+		}
+
+		messages, cancel := hub.Tail()
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(tailKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case payload := <-messages:
+				var msg models.Message
+				if err := json.Unmarshal(payload, &msg); err != nil || !filter.matches(msg) {
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", payload)
+				flusher.Flush()
+			}
+		}
+	}
+}
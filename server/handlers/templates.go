@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/hub"
+)
+
+type setTemplateRequest struct {
+	Content     string `json:"content"`
+	Description string `json:"description"`
+}
+
+type sendTemplateRequest struct {
+	// Username is the bot or agent the message is posted as.
+	Username  string            `json:"username"`
+	Variables map[string]string `json:"variables"`
+}
+
+func ListTemplates(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		templates, err := hub.Templates(r.Context())
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(templates)
+	}
+}
+
+func GetTemplate(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := hub.Template(r.Context(), r.PathValue("name"))
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// SetTemplate creates or replaces a template, taking
+// {"content": "...", "description": "..."}.
+func SetTemplate(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req setTemplateRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		t, err := hub.SetTemplate(r.Context(), r.PathValue("name"), req.Content, req.Description)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+func DeleteTemplate(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := hub.DeleteTemplate(r.Context(), r.PathValue("name")); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SendTemplate posts a template to the room, taking
+// {"username": "...", "variables": {...}}, and returns the message sent.
+func SendTemplate(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req sendTemplateRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		msg, err := hub.SendTemplate(r.Context(), r.PathValue("name"), req.Username, req.Variables)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, hub.ErrTemplateNotFound):
+		apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, err.Error())
+	case errors.Is(err, hub.ErrInvalidTemplate), errors.Is(err, hub.ErrTemplateValues), errors.Is(err, hub.ErrInvalidSender):
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
+	case errors.Is(err, hub.ErrSenderBlocked):
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, err.Error())
+	default:
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "template operation failed")
+		log.Printf("Template error: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/archive"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/metrics"
+	"lukagolubovic/middleware"
+	"lukagolubovic/models"
+	"lukagolubovic/ratelimit"
+	"lukagolubovic/translate"
+)
+
+type translation struct {
+	ID         int64  `json:"id,string"`
+	Lang       string `json:"lang"`
+	SourceLang string `json:"source_lang,omitempty"`
+	Text       string `json:"text"`
+}
+
+// TranslateMessage translates a stored message's content into ?lang=
+// through the configured provider, limiting each client IP to the
+// translation section's rate. Messages that were archived are read back
+// from the archive. The stored message is never changed.
+func TranslateMessage(reads *database.ReadPool, archived *archive.Reader, translator *translate.Translator, cfg *config.Store) http.HandlerFunc {
+	limiter := ratelimit.NewKeyed()
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := cfg.Get().Translation
+		if !c.Enabled() {
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "translation is disabled")
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid message id")
+			return
+		}
+		lang, err := translate.NormalizeLang(r.URL.Query().Get("lang"))
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "lang must be a language code such as de or pt-br")
+			return
+		}
+
+		msg, err := database.GetMessage(reads.DB(), id)
+		if errors.Is(err, sql.ErrNoRows) && archived != nil {
+			msg, err = archivedMessage(r.Context(), archived, id)
+		}
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !models.IsChat(msg.Type)) {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "message not found")
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to retrieve message")
+			log.Printf("DB query error: %v", err)
+			return
+		}
+
+		ip := middleware.ClientIP(r)
+		ok, retryAfter, _ := limiter.Allow(ip, ratelimit.KeyedLimits{Rate: c.RequestsPerSecond, Burst: c.RequestBurst})
+		if !ok {
+			metrics.Translations.Add("rate_limited", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "too many translations")
+			return
+		}
+
+		result, err := translator.Translate(r.Context(), msg.Content, lang)
+		switch {
+		case errors.Is(err, translate.ErrDisabled):
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "translation is disabled")
+			return
+		case errors.Is(err, translate.ErrUnsupportedLanguage):
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "the provider doesn't support this language")
+			return
+		case err != nil:
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "translation failed")
+			log.Printf("Translation error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(c.CacheSeconds))
+		json.NewEncoder(w).Encode(translation{ID: msg.ID, Lang: lang, SourceLang: result.SourceLang, Text: result.Text})
+	}
+}
+
+// archivedMessage looks up a message of the default room in the archive,
+// returning sql.ErrNoRows like the database when it isn't there.
+func archivedMessage(ctx context.Context, archived *archive.Reader, id int64) (models.Message, error) {
+	messages, err := archived.Before(ctx, models.DefaultRoom, id+1, 1)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if len(messages) == 0 || messages[0].ID != id {
+		return models.Message{}, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
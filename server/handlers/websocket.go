@@ -3,41 +3,236 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 
+	"lukagolubovic/apierror"
+	"lukagolubovic/authtoken"
+	"lukagolubovic/balancer"
 	"lukagolubovic/client"
+	"lukagolubovic/config"
 	"lukagolubovic/hub"
+	"lukagolubovic/middleware"
+	"lukagolubovic/models"
 )
 
+// maxUserAgentSize bounds the User-Agent kept in the session list.
+const maxUserAgentSize = 256
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{models.Subprotocol},
 }
 
 func ServeWS(hub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	cfg := hub.Config()
 	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "username required", http.StatusBadRequest)
+	guest := r.URL.Query().Get("guest") == "1"
+
+	claims, ok := verifyToken(w, r, cfg, username)
+	if !ok {
+		return
+	}
+	if claims != nil {
+		username, guest = claims.Subject, false
+	}
+
+	var userID int64
+	var err error
+	if guest {
+		if !cfg.Guests.Enabled {
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "guest access is disabled")
+			return
+		}
+		userID, username, err = hub.NewGuest()
+	} else {
+		if username == "" {
+			apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "username required")
+			return
+		}
+		check := cfg.Usernames.Check
+		if claims != nil {
+			check = cfg.Usernames.CheckSubject
+		}
+		if err := check(username); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+			return
+		}
+		userID, username, err = hub.ResolveUser(username)
+	}
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to resolve user")
+		log.Printf("resolve user error: %v", err)
+		return
+	}
+	if hub.IsBanned(userID) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "user is banned")
+		return
+	}
+	member, err := hub.IsMember(r.Context(), models.DefaultRoom, userID)
+	if err != nil {
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "failed to check room membership")
+		log.Printf("membership check error: %v", err)
 		return
 	}
+	if !member {
+		if guest {
+			hub.ReleaseGuest(username)
+		}
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "room is invite-only")
+		return
+	}
+	// A guest name is only freed by the hub once the client registers, so
+	// every earlier exit frees it here.
+	release := func() {
+		if guest {
+			hub.ReleaseGuest(username)
+		}
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	up := upgrader
+	up.CheckOrigin = func(r *http.Request) bool {
+		return cfg.OriginAllowed(r.Header.Get("Origin"))
+	}
+	up.Error = upgradeError
+
+	// The chat message limit applies per connection, so a fresh connection
+	// starts with the full burst available.
+	header := http.Header{}
+	rate, burst := cfg.MessageRate(guest)
+	if claims != nil && claims.Tier != "" {
+		rate, burst, _ = cfg.TierRate(claims.Tier)
+	}
+	if rate > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		apierror.SetRateLimit(header, burst, burst, 0)
+	}
+
+	conn, err := up.Upgrade(w, r, header)
 	if err != nil {
 		log.Println("upgrade error:", err)
+		release()
+		return
+	}
+
+	if hub.InMaintenance() {
+		hub.RefuseForMaintenance(conn)
+		release()
+		return
+	}
+
+	if hub.Overloaded() {
+		hub.TurnAway(conn)
+		release()
 		return
 	}
 
-	client := &client.Client{
-		Hub:      hub,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Username: username,
+	client := client.New(hub, conn, userID, username)
+	client.Guest = guest
+	client.Claims = claims
+	client.UserAgent = r.UserAgent()
+	if len(client.UserAgent) > maxUserAgentSize {
+		client.UserAgent = client.UserAgent[:maxUserAgentSize]
+	}
+	client.RemoteAddr = middleware.ClientIP(r)
+	if assignment := r.URL.Query().Get("assignment"); len(assignment) <= balancer.MaxAssignmentLen {
+		client.Assignment = assignment
+	}
+	if since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64); err == nil && since > 0 {
+		client.ReplayAfter = since
+	}
+	if r.URL.Query().Get("ack") == "1" {
+		client.EnableAcks()
 	}
+	client.SendHello(conn.Subprotocol())
 
-	hub.RegisterClient(client)
+	if err := hub.RegisterClient(client); err != nil {
+		conn.Close()
+		release()
+		return
+	}
 
 	go client.WritePump()
 	go client.ReadPump()
-}
\ No newline at end of file
+}
+
+// verifyToken checks the token query parameter, if any, against the
+// config, and returns its claims. It writes the error response and returns
+// false if the connection must be refused.
+func verifyToken(w http.ResponseWriter, r *http.Request, cfg *config.Runtime, username string) (*authtoken.Claims, bool) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		if cfg.Tokens.Required {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "token required")
+			return nil, false
+		}
+		return nil, true
+	}
+	if !cfg.Tokens.Enabled() {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "tokens are disabled")
+		return nil, false
+	}
+	claims, err := authtoken.Verify([]byte(cfg.Tokens.Secret), token, time.Now())
+	if err != nil {
+		apierror.WriteDetails(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid token", err.Error())
+		return nil, false
+	}
+	if username != "" && config.NormalizeUsername(username) != config.NormalizeUsername(claims.Subject) {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "username does not match the token")
+		return nil, false
+	}
+	if !claims.AllowsRoom(models.DefaultRoom) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "token does not allow this room")
+		return nil, false
+	}
+	if claims.Tier != "" {
+		if _, _, ok := cfg.TierRate(claims.Tier); !ok {
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "unknown rate tier")
+			return nil, false
+		}
+	}
+	return &claims, true
+}
+
+// verifyBearer checks "Authorization: Bearer <token>" on HTTP endpoints
+// that act for username, like verifyToken does for /ws. Without a token
+// the request passes unless required is set. It writes the error response
+// and returns false if the request must be refused.
+func verifyBearer(w http.ResponseWriter, r *http.Request, cfg *config.Runtime, username string, required bool) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		if required {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "token required")
+			return false
+		}
+		return true
+	}
+	if !cfg.Tokens.Enabled() {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeBadRequest, "tokens are disabled")
+		return false
+	}
+	claims, err := authtoken.Verify([]byte(cfg.Tokens.Secret), token, time.Now())
+	if err != nil {
+		apierror.WriteDetails(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid token", err.Error())
+		return false
+	}
+	if config.NormalizeUsername(username) != config.NormalizeUsername(claims.Subject) {
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "token is for another user")
+		return false
+	}
+	return true
+}
+
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	code := apierror.CodeBadRequest
+	if status == http.StatusForbidden {
+		code = apierror.CodeForbidden
+	}
+	apierror.WriteDetails(w, status, code, "websocket upgrade failed", reason.Error())
+}
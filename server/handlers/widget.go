@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/authtoken"
+	"lukagolubovic/config"
+	"lukagolubovic/hub"
+	"lukagolubovic/models"
+)
+
+// defaultWidgetTTL is how long widget tokens last when the app sets no
+// ttl_seconds.
+const defaultWidgetTTL = 15 * time.Minute
+
+type widgetTokenRequest struct {
+	Username string `json:"username"`
+	Room     string `json:"room"`
+}
+
+type widgetTokenResponse struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	Room      string    `json:"room"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MintWidgetToken lets a trusted app, authenticated by its key, mint a
+// short-lived token binding a visitor to one of its rooms, for a chat
+// widget embedded on the app's site. Visitors are named "<name>@<app>", so
+// an app can't mint tokens for the cluster's other users.
+func MintWidgetToken(hub *hub.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := hub.Config()
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !cfg.Tokens.Enabled() {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "unauthorized")
+			return
+		}
+		app, ok := cfg.Tokens.App(key)
+		if !ok {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "unauthorized")
+			return
+		}
+
+		var req widgetTokenRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid request body", err.Error())
+			return
+		}
+		if req.Room == "" {
+			req.Room = models.DefaultRoom
+		}
+		if !app.AllowsRoom(req.Room) {
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "room is not one of the app's rooms")
+			return
+		}
+		if err := cfg.Usernames.CheckVisitor(req.Username, app.Name); err != nil {
+			apierror.WriteDetails(w, http.StatusBadRequest, apierror.CodeBadRequest, "invalid username", err.Error())
+			return
+		}
+		username := config.VisitorName(req.Username, app.Name)
+
+		ttl := defaultWidgetTTL
+		if app.TTLSeconds > 0 {
+			ttl = time.Duration(app.TTLSeconds) * time.Second
+		}
+		now := time.Now()
+		claims := authtoken.Claims{
+			Subject:  username,
+			Rooms:    []string{req.Room},
+			Scope:    authtoken.ScopeRead + " " + authtoken.ScopeSend,
+			Tier:     app.Tier,
+			Expires:  now.Add(ttl).Unix(),
+			IssuedAt: now.Unix(),
+		}
+		token, err := authtoken.Sign([]byte(cfg.Tokens.Secret), claims)
+		if err != nil {
+			log.Printf("widget token error: %v", err)
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "failed to sign token")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(widgetTokenResponse{
+			Token:     token,
+			Username:  username,
+			Room:      req.Room,
+			ExpiresAt: time.Unix(claims.Expires, 0).UTC(),
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+)
+
+// adaptive is the state of adaptive rate limiting. factor scales every
+// client's chat message limit; sampleLoad adjusts it.
+type adaptive struct {
+	mu     sync.Mutex
+	factor float64
+	last   models.LimitsStats
+}
+
+// RateFactor is what the configured chat message limits are multiplied by
+// right now: 1 unless adaptive limiting has tightened them.
+func (h *Hub) RateFactor() float64 {
+	h.adaptive.mu.Lock()
+	defer h.adaptive.mu.Unlock()
+	if h.adaptive.factor == 0 {
+		return 1
+	}
+	return h.adaptive.factor
+}
+
+// LimitsStats reports the last load sample and the factor it set.
+func (h *Hub) LimitsStats() models.LimitsStats {
+	cfg := h.cfg.Get().AdaptiveLimits
+	h.adaptive.mu.Lock()
+	stats := h.adaptive.last
+	h.adaptive.mu.Unlock()
+
+	stats.Server = h.address
+	stats.Enabled = cfg.Enabled
+	stats.Factor = h.RateFactor()
+	if stats.Overloaded == nil {
+		stats.Overloaded = []string{}
+	}
+	stats.Thresholds = models.LimitsBounds{
+		SendBacklog:      cfg.MaxSendBacklog,
+		RedisLatencyMS:   cfg.MaxRedisLatencyMS,
+		DBWriteLatencyMS: cfg.MaxDBWriteLatencyMS,
+	}
+	return stats
+}
+
+// adaptLimits samples the load every sample_seconds until the hub stops.
+// The interval is re-read each time, so reloads apply.
+func (h *Hub) adaptLimits() {
+	for {
+		cfg := h.cfg.Get().AdaptiveLimits
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(time.Duration(cfg.SampleSeconds) * time.Second):
+		}
+		if cfg = h.cfg.Get().AdaptiveLimits; !cfg.Enabled {
+			h.adaptive.mu.Lock()
+			h.adaptive.factor, h.adaptive.last = 1, models.LimitsStats{}
+			h.adaptive.mu.Unlock()
+			continue
+		}
+		h.sampleLoad()
+	}
+}
+
+// sampleLoad measures the send backlog, a Redis round trip and the wait
+// for an empty write transaction, then tightens the limits if any is over
+// its threshold and relaxes them otherwise.
+func (h *Hub) sampleLoad() {
+	cfg := h.cfg.Get().AdaptiveLimits
+	budget := time.Duration(cfg.SampleSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(h.ctx, budget)
+	defer cancel()
+
+	now := time.Now().UTC()
+	sample := models.LimitsStats{SendBacklog: h.sendBacklog(), SampledAt: &now}
+	// A probe that fails or times out counts as taking the whole budget.
+	start := time.Now()
+	if err := h.redisClient.Ping(ctx).Err(); err != nil {
+		sample.RedisLatencyMS = float64(budget.Milliseconds())
+	} else {
+		sample.RedisLatencyMS = milliseconds(time.Since(start))
+	}
+	start = time.Now()
+	if err := h.writer.TxContext(ctx, func(*sql.Tx) error { return nil }); err != nil {
+		sample.DBWriteLatencyMS = float64(budget.Milliseconds())
+	} else {
+		sample.DBWriteLatencyMS = milliseconds(time.Since(start))
+	}
+	if h.ctx.Err() != nil {
+		return
+	}
+
+	if cfg.MaxSendBacklog > 0 && sample.SendBacklog > cfg.MaxSendBacklog {
+		sample.Overloaded = append(sample.Overloaded, "send_backlog")
+	}
+	if cfg.MaxRedisLatencyMS > 0 && sample.RedisLatencyMS > float64(cfg.MaxRedisLatencyMS) {
+		sample.Overloaded = append(sample.Overloaded, "redis_latency")
+	}
+	if cfg.MaxDBWriteLatencyMS > 0 && sample.DBWriteLatencyMS > float64(cfg.MaxDBWriteLatencyMS) {
+		sample.Overloaded = append(sample.Overloaded, "db_write_latency")
+	}
+
+	h.adaptive.mu.Lock()
+	defer h.adaptive.mu.Unlock()
+	old := h.adaptive.factor
+	if old == 0 {
+		old = 1
+	}
+	factor := math.Min(1, old+cfg.RelaxStep)
+	if len(sample.Overloaded) > 0 {
+		factor = math.Max(cfg.MinFactor, old*cfg.TightenFactor)
+	}
+	h.adaptive.factor, h.adaptive.last = factor, sample
+
+	switch {
+	case factor < old:
+		metrics.AdaptiveLimits.Add("tightened", 1)
+		log.Printf("[Server %s] Tightening message limits to %.0f%%: %v over threshold", h.address, factor*100, sample.Overloaded)
+	case factor > old:
+		metrics.AdaptiveLimits.Add("relaxed", 1)
+		if factor == 1 {
+			log.Printf("[Server %s] Message limits back to normal", h.address)
+		}
+	}
+}
+
+// sendBacklog is the average fill of the clients' send buffers.
+func (h *Hub) sendBacklog() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var queued, capacity int
+	for c := range h.clients {
+		queued += len(c.Send)
+		capacity += cap(c.Send)
+	}
+	if capacity == 0 {
+		return 0
+	}
+	return float64(queued) / float64(capacity)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,163 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+
+	"lukagolubovic/attachment"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+	"lukagolubovic/webhook"
+)
+
+var (
+	ErrAttachmentsDisabled = errors.New("attachments are disabled")
+	ErrInvalidAttachment   = errors.New("invalid attachment")
+)
+
+// UploadAttachment stores a file for messages to share. Its name is
+// reduced to the base name without control characters, and content that
+// is already stored is shared with the attachments before it. The file
+// counts against userID's quota, unless it is zero for an anonymous
+// upload.
+func (h *Hub) UploadAttachment(ctx context.Context, userID int64, name, contentType string, body []byte) (models.Attachment, error) {
+	if h.attachments == nil {
+		return models.Attachment{}, ErrAttachmentsDisabled
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, path.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "" || name == "." || name == "/" {
+		return models.Attachment{}, fmt.Errorf("%w: name is required", ErrInvalidAttachment)
+	}
+	if len(name) > models.MaxAttachmentName {
+		return models.Attachment{}, fmt.Errorf("%w: name must be at most %d bytes", ErrInvalidAttachment, models.MaxAttachmentName)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("%w: invalid content type", ErrInvalidAttachment)
+	}
+	if len(body) == 0 {
+		return models.Attachment{}, fmt.Errorf("%w: the file is empty", ErrInvalidAttachment)
+	}
+	up := attachment.Uploader{ID: userID}
+	if userID != 0 {
+		usage, err := h.AttachmentUsage(ctx, userID)
+		if err != nil {
+			return models.Attachment{}, err
+		}
+		up.Quota = usage.QuotaBytes
+	}
+	a, err := h.attachments.Upload(ctx, h.NextMessageID(), up, name, mime.FormatMediaType(mediaType, params), body)
+	var quarantined *attachment.QuarantineError
+	if errors.As(err, new(*attachment.QuotaError)) {
+		metrics.Attachments.Add("over_quota", 1)
+	}
+	if errors.As(err, &quarantined) {
+		h.reportQuarantine(ctx, quarantined.File)
+	}
+	return a, err
+}
+
+// reportQuarantine tells the moderators and the webhooks about a file the
+// scanner flagged.
+func (h *Hub) reportQuarantine(ctx context.Context, q attachment.Quarantined) {
+	log.Printf("[Server %s] Quarantined upload '%s' (%s): %s", h.address, q.Name, q.SHA256, q.Threat)
+	h.webhooks.Emit(webhook.EventAttachmentQuarantined, q)
+
+	threat := q.Threat
+	if threat == "" {
+		threat = "unnamed threat"
+	}
+	content := fmt.Sprintf("An upload of '%s' (sha256 %s) was flagged as malware (%s) and quarantined", q.Name, q.SHA256, threat)
+	for _, moderator := range h.Config().Moderators {
+		if err := h.noticeModerator(ctx, moderator, content); err != nil {
+			log.Printf("[Server %s] Failed to notify moderator '%s' of a quarantined upload: %v", h.address, moderator, err)
+		}
+	}
+}
+
+// AttachmentUsage returns how much of their quota a user's attachments
+// take: the one an admin set them, or the config's.
+func (h *Hub) AttachmentUsage(ctx context.Context, userID int64) (models.AttachmentUsage, error) {
+	if h.attachments == nil {
+		return models.AttachmentUsage{}, ErrAttachmentsDisabled
+	}
+	used, err := h.attachments.Usage(ctx, userID)
+	if err != nil {
+		return models.AttachmentUsage{}, err
+	}
+	quota, override, err := h.attachments.QuotaOverride(ctx, userID)
+	if err != nil {
+		return models.AttachmentUsage{}, err
+	}
+	if !override {
+		quota = h.Config().Attachments.QuotaBytes
+	}
+	return models.AttachmentUsage{UsedBytes: used, QuotaBytes: quota, Override: override}, nil
+}
+
+// SetAttachmentQuota gives a user their own quota, zero being unlimited,
+// or puts them back on the config's when quota is nil.
+func (h *Hub) SetAttachmentQuota(ctx context.Context, userID int64, quota *int64) error {
+	if h.attachments == nil {
+		return ErrAttachmentsDisabled
+	}
+	if quota == nil {
+		return h.attachments.ClearQuotaOverride(ctx, userID)
+	}
+	if *quota < 0 {
+		return fmt.Errorf("%w: quota must not be negative", ErrInvalidAttachment)
+	}
+	return h.attachments.SetQuotaOverride(ctx, userID, *quota)
+}
+
+// QuarantinedAttachments lists the files the scanner flagged.
+func (h *Hub) QuarantinedAttachments(ctx context.Context) ([]attachment.Quarantined, error) {
+	if h.attachments == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	return h.attachments.Quarantined(ctx)
+}
+
+func (h *Hub) Attachment(ctx context.Context, id int64) (models.Attachment, error) {
+	if h.attachments == nil {
+		return models.Attachment{}, ErrAttachmentsDisabled
+	}
+	return h.attachments.Get(ctx, id)
+}
+
+func (h *Hub) OpenAttachment(ctx context.Context, a models.Attachment) ([]byte, error) {
+	if h.attachments == nil {
+		return nil, ErrAttachmentsDisabled
+	}
+	return h.attachments.Open(ctx, a)
+}
+
+func (h *Hub) OpenThumbnail(ctx context.Context, a models.Attachment, size int) ([]byte, string, error) {
+	if h.attachments == nil {
+		return nil, "", ErrAttachmentsDisabled
+	}
+	return h.attachments.OpenThumbnail(ctx, a, size)
+}
+
+// DeleteAttachment deletes an attachment. Messages sharing it keep its
+// description, but it can't be downloaded anymore.
+func (h *Hub) DeleteAttachment(ctx context.Context, id int64) error {
+	if h.attachments == nil {
+		return ErrAttachmentsDisabled
+	}
+	return h.attachments.Delete(ctx, id)
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"lukagolubovic/breaker"
+	"lukagolubovic/client"
+	"lukagolubovic/models"
+)
+
+// degradedMessages are the banners shown while a dependency is lost, and
+// recoveredMessages once it is back.
+var (
+	degradedMessages = map[string]string{
+		models.DependencyRedis:    "Messages only reach people connected to this server until its connection to the rest of the chat is restored.",
+		models.DependencyDatabase: "Messages can't be sent right now.",
+	}
+	recoveredMessages = map[string]string{
+		models.DependencyRedis:    "Messages reach everyone again.",
+		models.DependencyDatabase: "Messages can be sent again.",
+	}
+)
+
+func (h *Hub) newBreakers() {
+	cfg := h.cfg.Get().CircuitBreakers
+	cooldown := time.Duration(cfg.CooldownSeconds) * time.Second
+	h.redisBreaker = breaker.New(models.DependencyRedis, cfg.FailureThreshold, cooldown, h.breakerChanged)
+	h.dbBreaker = breaker.New(models.DependencyDatabase, cfg.FailureThreshold, cooldown, h.breakerChanged)
+}
+
+// breakerChanged warns this server's clients when a dependency is lost or
+// back. Only the change is logged, not every call the breaker rejects.
+func (h *Hub) breakerChanged(name string, to breaker.State) {
+	degraded := to == breaker.Open
+	if degraded {
+		log.Printf("[Server %s] Circuit breaker for %s opened, running degraded", h.address, name)
+	} else {
+		log.Printf("[Server %s] Circuit breaker for %s closed, %s is back", h.address, name, name)
+	}
+	h.broadcast(h.degradedMessage(name, degraded))
+}
+
+func (h *Hub) degradedMessage(dependency string, degraded bool) []byte {
+	d := models.Degraded{Dependency: dependency, Degraded: degraded, Message: recoveredMessages[dependency]}
+	if degraded {
+		d.Message = degradedMessages[dependency]
+	}
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeDegraded,
+		Username: "system",
+		Content:  d.Message,
+		Server:   h.address,
+		Degraded: &d,
+	})
+	return payload
+}
+
+// warnDegraded tells a new client about the dependencies this server is
+// running without.
+func (h *Hub) warnDegraded(c *client.Client) {
+	for _, b := range []*breaker.Breaker{h.redisBreaker, h.dbBreaker} {
+		if b.State() == breaker.Closed {
+			continue
+		}
+		select {
+		case c.Priority <- h.degradedMessage(b.Name(), true):
+		default:
+		}
+	}
+}
+
+// deliverLocally hands a stored message to this server's clients while
+// Redis is unreachable. It stays in the outbox and is published once Redis
+// is back, when dispatch skips it here since it was already delivered.
+func (h *Hub) deliverLocally(id int64, payload []byte) {
+	if h.seen.add(id) {
+		h.broadcast(payload)
+		h.publishTail(payload)
+	}
+}
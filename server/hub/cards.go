@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"lukagolubovic/client"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/webhook"
+)
+
+var (
+	ErrInvalidCard     = errors.New("invalid card")
+	ErrUnknownCard     = errors.New("unknown card")
+	ErrUnknownCallback = errors.New("the card has no such button")
+)
+
+// CardInteraction is the card.interaction webhook payload: a user clicked
+// a button of a card the bot posted.
+type CardInteraction struct {
+	MessageID  int64  `json:"message_id,string"`
+	CallbackID string `json:"callback_id"`
+	Bot        string `json:"bot"`
+	UserID     int64  `json:"user_id,string"`
+	Username   string `json:"username"`
+	Server     string `json:"server"`
+}
+
+// PostCard posts a card to the default room as the bot username. Its
+// content is the card as plain text.
+func (h *Hub) PostCard(ctx context.Context, username string, card models.Card) (models.Message, error) {
+	if err := card.Validate(); err != nil {
+		return models.Message{}, fmt.Errorf("%w: %v", ErrInvalidCard, err)
+	}
+	censorCard(h.Config(), &card)
+	return h.postAs(ctx, username, models.Message{Type: models.MessageTypeCard, Content: card.Fallback(), Card: &card})
+}
+
+func censorCard(cfg *config.Runtime, card *models.Card) {
+	card.Title = cfg.Censor(card.Title)
+	card.Text = cfg.Censor(card.Text)
+	card.Fields = append([]models.CardField(nil), card.Fields...)
+	for i := range card.Fields {
+		card.Fields[i].Name = cfg.Censor(card.Fields[i].Name)
+		card.Fields[i].Value = cfg.Censor(card.Fields[i].Value)
+	}
+	card.Buttons = append([]models.CardButton(nil), card.Buttons...)
+	for i := range card.Buttons {
+		card.Buttons[i].Label = cfg.Censor(card.Buttons[i].Label)
+	}
+}
+
+// Interact delivers a click on a card's button to the webhooks of the bot
+// that posted the card. The card is looked up in this server's database,
+// which holds every server's messages once replicated.
+func (h *Hub) Interact(c *client.Client, messageID int64, callbackID string) error {
+	msg, err := database.GetMessage(h.db, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && msg.Card == nil) {
+		return ErrUnknownCard
+	}
+	if err != nil {
+		return err
+	}
+	if !msg.Card.HasCallback(callbackID) {
+		return ErrUnknownCallback
+	}
+	log.Printf("[Server %s] '%s' clicked '%s' on card %d from '%s'", h.address, c.Username(), callbackID, messageID, msg.Username)
+	h.webhooks.EmitTo(msg.Username, webhook.EventCardInteraction, CardInteraction{
+		MessageID:  messageID,
+		CallbackID: callbackID,
+		Bot:        msg.Username,
+		UserID:     c.UserID,
+		Username:   c.Username(),
+		Server:     h.address,
+	})
+	return nil
+}
@@ -0,0 +1,280 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"lukagolubovic/audit"
+	"lukagolubovic/broker"
+	"lukagolubovic/client"
+	"lukagolubovic/database"
+	"lukagolubovic/identity"
+	"lukagolubovic/models"
+)
+
+const (
+	controlChannel = broker.ControlChannel
+	bannedSet      = identity.BannedKey
+	mutedSet       = identity.MutedKey
+)
+
+// legacyModerationSets maps the sets bans and mutes were kept in before
+// they targeted user ids, which hold usernames, to their current sets.
+var legacyModerationSets = map[string]string{
+	"chat:banned": bannedSet,
+	"chat:muted":  mutedSet,
+}
+
+// migrateModeration moves the users in the legacy ban and mute sets to the
+// current ones, so bans and mutes issued before user ids still apply. A
+// name is removed from its legacy set only once its id is in the new one,
+// so servers starting together can't drop any.
+func (h *Hub) migrateModeration() {
+	for legacy, key := range legacyModerationSets {
+		names, err := h.redisClient.SMembers(h.ctx, legacy).Result()
+		if err != nil {
+			log.Printf("[Server %s] Failed to read %s: %v", h.address, legacy, err)
+			continue
+		}
+		migrated := 0
+		for _, name := range names {
+			userID, _, err := h.ResolveUser(name)
+			if err == nil {
+				err = h.redisClient.SAdd(h.ctx, key, userID).Err()
+			}
+			if err == nil {
+				err = h.redisClient.SRem(h.ctx, legacy, name).Err()
+			}
+			if err != nil {
+				log.Printf("[Server %s] Failed to migrate '%s' from %s to %s: %v", h.address, name, legacy, key, err)
+				continue
+			}
+			migrated++
+		}
+		if migrated > 0 {
+			log.Printf("[Server %s] Migrated %d users from %s to %s\n", h.address, migrated, legacy, key)
+		}
+	}
+}
+
+// loadModeration seeds the local ban and mute lists from Redis so a server
+// that starts after a command was issued still enforces it.
+func (h *Hub) loadModeration() {
+	banned, err := h.redisClient.SMembers(h.ctx, bannedSet).Result()
+	if err != nil {
+		log.Printf("[Server %s] Failed to load banned users: %v", h.address, err)
+	}
+	muted, err := h.redisClient.SMembers(h.ctx, mutedSet).Result()
+	if err != nil {
+		log.Printf("[Server %s] Failed to load muted users: %v", h.address, err)
+	}
+
+	h.mu.Lock()
+	for _, id := range banned {
+		if userID, err := strconv.ParseInt(id, 10, 64); err == nil {
+			h.banned[userID] = true
+		}
+	}
+	for _, id := range muted {
+		if userID, err := strconv.ParseInt(id, 10, 64); err == nil {
+			h.muted[userID] = true
+		}
+	}
+	h.mu.Unlock()
+}
+
+// PublishControl records persistent moderation state in Redis and fans the
+// command out to every server, including this one.
+func (h *Hub) PublishControl(ctx context.Context, cmd models.ControlCommand) error {
+	cmd.Origin = h.address
+
+	// Moderation targets the stable user id so it survives renames.
+	if cmd.UserID == 0 && cmd.NeedsUser() {
+		userID, _, err := h.ResolveUser(cmd.Username)
+		if err != nil {
+			return err
+		}
+		cmd.UserID = userID
+	}
+
+	var err error
+	switch cmd.Type {
+	case models.ControlBan:
+		err = h.redisClient.SAdd(ctx, bannedSet, cmd.UserID).Err()
+	case models.ControlUnban:
+		err = h.redisClient.SRem(ctx, bannedSet, cmd.UserID).Err()
+	case models.ControlMute:
+		err = h.redisClient.SAdd(ctx, mutedSet, cmd.UserID).Err()
+	case models.ControlUnmute:
+		err = h.redisClient.SRem(ctx, mutedSet, cmd.UserID).Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd.ID = h.idGen.Next()
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	spilled, err := h.publishOrSpill(ctx, controlChannel, payload)
+	if err != nil {
+		return err
+	}
+	// Other servers get a spilled command once Redis is back; this one
+	// applies it now and skips the replayed copy.
+	if spilled {
+		h.handleControl(string(payload))
+	}
+	if cmd.NeedsUser() {
+		h.audit.Record(ctx, audit.Entry{
+			Type:    audit.TypeModeration,
+			Action:  cmd.Type,
+			Subject: cmd.Username,
+			UserID:  cmd.UserID,
+		})
+	}
+	// A kick takes the user out of the room; it still counts if recording
+	// that fails.
+	if cmd.Type == models.ControlKick {
+		if err := h.kicked(ctx, cmd); err != nil {
+			log.Printf("[Server %s] Failed to record the kick of user %d: %v", h.address, cmd.UserID, err)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) handleControl(payload string) {
+	var cmd models.ControlCommand
+	if err := json.Unmarshal([]byte(payload), &cmd); err != nil {
+		log.Printf("[Server %s] Invalid control command: %v", h.address, err)
+		return
+	}
+	if !h.seen.add(cmd.ID) {
+		return
+	}
+
+	log.Printf("[Server %s] Control command '%s' from %s (user '%s')\n", h.address, cmd.Type, cmd.Origin, cmd.Username)
+
+	switch cmd.Type {
+	case models.ControlBan:
+		h.mu.Lock()
+		h.banned[cmd.UserID] = true
+		h.mu.Unlock()
+		h.disconnectUser(cmd.UserID)
+	case models.ControlUnban:
+		h.mu.Lock()
+		delete(h.banned, cmd.UserID)
+		h.mu.Unlock()
+	case models.ControlMute:
+		h.mu.Lock()
+		h.muted[cmd.UserID] = true
+		h.mu.Unlock()
+	case models.ControlUnmute:
+		h.mu.Lock()
+		delete(h.muted, cmd.UserID)
+		h.mu.Unlock()
+	case models.ControlKick:
+		h.disconnectUser(cmd.UserID)
+	case models.ControlRename:
+		h.applyRename(cmd)
+	case models.ControlReload:
+		if err := h.cfg.Reload(); err != nil {
+			log.Printf("[Server %s] Config reload failed, keeping previous config: %v", h.address, err)
+			break
+		}
+		h.loadRoomOverrides()
+	case models.ControlAnnounce:
+		msg, _ := json.Marshal(models.Message{
+			Username: "system",
+			Content:  cmd.Message,
+			Server:   h.address,
+		})
+		h.broadcast(msg)
+	case models.ControlTopic:
+		h.applyTopic(cmd)
+	case models.ControlRoomConfig:
+		h.applyRoomOverrides(cmd)
+	case models.ControlGrantModerator:
+		h.applyGrantModerator(cmd)
+	case models.ControlSlowMode:
+		h.applySlowMode(cmd)
+	case models.ControlRevokeSession:
+		h.applyRevokeSession(cmd)
+	case models.ControlLeave:
+		h.applyLeave(cmd)
+	case models.ControlMaintenance:
+		if err := h.loadMaintenance(h.ctx); err != nil {
+			log.Printf("[Server %s] %v", h.address, err)
+		}
+	default:
+		log.Printf("[Server %s] Unknown control command '%s'", h.address, cmd.Type)
+	}
+}
+
+// applyTopic runs on every server: each one persists the change to its own
+// database and notifies its local clients.
+func (h *Hub) applyTopic(cmd models.ControlCommand) {
+	room := models.Room{
+		Name:        models.DefaultRoom,
+		Topic:       cmd.Topic,
+		Description: cmd.Description,
+		UpdatedBy:   cmd.Username,
+	}
+	if err := h.writer.Tx(func(tx *sql.Tx) error { return database.SaveRoom(tx, room) }); err != nil {
+		log.Printf("[Server %s] Failed to save room topic: %v", h.address, err)
+		return
+	}
+	if saved, err := database.GetRoom(h.db, room.Name); err == nil {
+		room = saved
+	}
+
+	updatedBy := cmd.Username
+	if updatedBy == "" {
+		updatedBy = "An administrator"
+	}
+	msg, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeRoom,
+		Username: "system",
+		Content:  fmt.Sprintf("%s changed the topic to: %s", updatedBy, room.Topic),
+		Server:   h.address,
+		Room:     &room,
+	})
+	h.broadcast(msg)
+}
+
+func (h *Hub) disconnectUser(userID int64) {
+	h.mu.Lock()
+	var matched []*client.Client
+	for c := range h.clients {
+		if c.UserID == userID {
+			matched = append(matched, c)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, c := range matched {
+		h.UnregisterClient(c)
+	}
+}
+
+// Audit returns the audit log moderation commands are recorded in.
+func (h *Hub) Audit() *audit.Log {
+	return h.audit
+}
+
+func (h *Hub) IsBanned(userID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.banned[userID]
+}
+
+func (h *Hub) IsMuted(userID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.muted[userID]
+}
@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/database"
+)
+
+// draftsPrefix is followed by a user id; each key is a hash of the user's
+// drafts by room, shared by every server so any device can pick them up.
+const draftsPrefix = "chat:{users}:drafts:"
+
+const (
+	// MaxDraftSize leaves room to trim a draft down to the message limit
+	// before sending it.
+	MaxDraftSize = 2048
+	// draftTTL is how long a user's drafts are kept after the last save.
+	draftTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrDraftNotFound = errors.New("draft not found")
+	ErrInvalidDraft  = errors.New("invalid draft")
+)
+
+// Draft is a message a user started composing in a room.
+type Draft struct {
+	Room      string    `json:"room"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func draftsKey(userID int64) string {
+	return draftsPrefix + strconv.FormatInt(userID, 10)
+}
+
+// Drafts returns a user's drafts, ordered by room.
+func (h *Hub) Drafts(ctx context.Context, userID int64) ([]Draft, error) {
+	raw, err := h.redisClient.HGetAll(ctx, draftsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	drafts := make([]Draft, 0, len(raw))
+	for _, value := range raw {
+		var d Draft
+		if err := json.Unmarshal([]byte(value), &d); err != nil {
+			continue
+		}
+		drafts = append(drafts, d)
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].Room < drafts[j].Room })
+	return drafts, nil
+}
+
+func (h *Hub) Draft(ctx context.Context, userID int64, room string) (Draft, error) {
+	var d Draft
+	raw, err := h.redisClient.HGet(ctx, draftsKey(userID), room).Bytes()
+	if err == redis.Nil {
+		return d, ErrDraftNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(raw, &d)
+	return d, err
+}
+
+// SaveDraft creates or replaces a user's draft in room. Saving keeps all of
+// the user's drafts for another 30 days.
+func (h *Hub) SaveDraft(ctx context.Context, userID int64, room, content string) (Draft, error) {
+	if _, err := database.GetRoom(h.db, room); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Draft{}, ErrUnknownRoom
+		}
+		return Draft{}, err
+	}
+	if strings.TrimSpace(content) == "" {
+		return Draft{}, fmt.Errorf("%w: content is required; delete the draft instead", ErrInvalidDraft)
+	}
+	if len(content) > MaxDraftSize {
+		return Draft{}, fmt.Errorf("%w: content must be at most %d bytes", ErrInvalidDraft, MaxDraftSize)
+	}
+	d := Draft{Room: room, Content: content, UpdatedAt: time.Now().UTC()}
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return Draft{}, err
+	}
+	key := draftsKey(userID)
+	pipe := h.redisClient.TxPipeline()
+	pipe.HSet(ctx, key, room, raw)
+	pipe.Expire(ctx, key, draftTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Draft{}, err
+	}
+	return d, nil
+}
+
+func (h *Hub) DeleteDraft(ctx context.Context, userID int64, room string) error {
+	n, err := h.redisClient.HDel(ctx, draftsKey(userID), room).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDraftNotFound
+	}
+	return nil
+}
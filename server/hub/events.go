@@ -0,0 +1,174 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"lukagolubovic/client"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+	"lukagolubovic/webhook"
+)
+
+// EventKind is what happened in an Event.
+type EventKind string
+
+const (
+	// EventMessagePersisted follows a message, of any type, being stored
+	// by this server.
+	EventMessagePersisted EventKind = "message.persisted"
+	// EventClientJoined and EventClientLeft follow a connection being
+	// registered with, or removed from, this server. Connections closed
+	// by a shutdown leave too.
+	EventClientJoined EventKind = "client.joined"
+	EventClientLeft   EventKind = "client.left"
+	// EventRoomCreated follows a room being created. Only the default
+	// room exists so far, so it isn't published yet.
+	EventRoomCreated EventKind = "room.created"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind by;
+// beyond it its events are dropped.
+const subscriberBuffer = 1024
+
+// Event is something that happened on this server. Fields that don't
+// apply to the kind are left zero.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	Room string
+	// Message is the stored message.
+	Message *models.Message
+	// User is the connection that joined or left.
+	User *EventUser
+}
+
+// EventUser is a snapshot of a connection, safe to read after the client
+// is gone.
+type EventUser struct {
+	UserID   int64
+	Username string
+	Guest    bool
+	// Connected is how long the connection lasted, for EventClientLeft.
+	Connected time.Duration
+}
+
+func userSnapshot(c *client.Client) *EventUser {
+	return &EventUser{UserID: c.UserID, Username: c.Username(), Guest: c.Guest, Connected: time.Since(c.ConnectedAt)}
+}
+
+// events hands hub events to in-process subscribers. Each subscriber has
+// its own queue and goroutine, so a slow one neither blocks the hub nor
+// the other subscribers; events it can't keep up with are dropped and
+// counted in metrics.HubEvents.
+type events struct {
+	mu     sync.RWMutex
+	subs   []*subscriber
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type subscriber struct {
+	name  string
+	queue chan Event
+	fn    func(Event)
+}
+
+// Subscribe calls fn with every event published from now on, one at a
+// time, on a goroutine of its own. name labels the subscriber in metrics.
+// Subscribers are never removed; after Stop, Subscribe does nothing.
+func (h *Hub) Subscribe(name string, fn func(Event)) {
+	h.events.subscribe(name, fn)
+}
+
+func (e *events) subscribe(name string, fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	s := &subscriber{name: name, queue: make(chan Event, subscriberBuffer), fn: fn}
+	e.subs = append(e.subs, s)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for ev := range s.queue {
+			s.deliver(ev)
+		}
+	}()
+}
+
+// deliver contains a subscriber's panic to the one event.
+func (s *subscriber) deliver(ev Event) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("event_"+s.name, v)
+		}
+	}()
+	s.fn(ev)
+}
+
+// publish queues ev for every subscriber without waiting.
+func (e *events) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	for _, s := range e.subs {
+		select {
+		case s.queue <- ev:
+			metrics.HubEvents.Add("delivered", 1)
+		default:
+			metrics.HubEvents.Add("dropped", 1)
+			metrics.HubEvents.Add("dropped_"+s.name, 1)
+		}
+	}
+}
+
+// close stops publishing and waits for the subscribers to handle what is
+// already queued.
+func (e *events) close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		for _, s := range e.subs {
+			close(s.queue)
+		}
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+// subscribeBuiltins subscribes the hub's own subsystems, which used to be
+// called from the registration and storage paths.
+func (h *Hub) subscribeBuiltins() {
+	h.Subscribe("webhooks", func(ev Event) {
+		switch ev.Kind {
+		case EventClientJoined:
+			h.webhooks.Emit(webhook.EventUserJoined, h.userEvent(ev.User))
+		case EventClientLeft:
+			h.webhooks.Emit(webhook.EventUserLeft, h.userEvent(ev.User))
+		}
+	})
+	h.Subscribe("analytics", func(ev Event) {
+		switch ev.Kind {
+		case EventClientJoined:
+			h.analytics.SessionStarted(ev.User.UserID, ev.User.Guest)
+		case EventClientLeft:
+			h.analytics.SessionEnded(ev.User.UserID, ev.User.Guest, ev.User.Connected)
+		case EventMessagePersisted:
+			if models.IsChat(ev.Message.Type) {
+				h.analytics.Message(ev.Room, ev.Message.UserID)
+			}
+		}
+	})
+	h.Subscribe("persistence", func(ev Event) {
+		if ev.Kind == EventMessagePersisted {
+			h.persist.Enqueue(*ev.Message)
+		}
+	})
+}
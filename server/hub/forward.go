@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"lukagolubovic/client"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+var (
+	ErrUnknownMessage = errors.New("unknown message")
+	ErrNotForwardable = errors.New("only chat, location, contact and GIF messages can be forwarded")
+	ErrRoomNotAllowed = errors.New("not allowed in that room")
+	ErrGIFsDisabled   = errors.New("GIFs are disabled")
+)
+
+// Forward copies a message of the client's room to room as a new message
+// from the client's user, referencing the original. The user must be
+// allowed to read the source room and to post in the destination, as if
+// connected to it. Every message is in the default room for now, so that
+// is also the only destination.
+func (h *Hub) Forward(ctx context.Context, c *client.Client, messageID int64, room string) error {
+	if room != models.DefaultRoom {
+		return ErrUnknownRoom
+	}
+	source := models.DefaultRoom
+	if err := h.checkRoomAccess(ctx, c, source); err != nil {
+		return err
+	}
+	if !c.CanRead() {
+		return ErrUnknownMessage
+	}
+	if err := h.checkRoomAccess(ctx, c, room); err != nil {
+		return err
+	}
+
+	original, err := database.GetMessage(h.db, messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownMessage
+	}
+	if err != nil {
+		return err
+	}
+	if !models.Forwardable(original.Type) {
+		return ErrNotForwardable
+	}
+	if original.Type == models.MessageTypeGIF && !h.Config().GIFs.Enabled() {
+		return ErrGIFsDisabled
+	}
+
+	ref := original.Forwarded
+	if ref == nil {
+		ref = &models.Forward{ID: original.ID, Room: source, Username: original.Username, Timestamp: original.Timestamp}
+	}
+	msg := models.Message{
+		ID:         h.NextMessageID(),
+		Type:       original.Type,
+		UserID:     c.UserID,
+		Username:   c.Username(),
+		Content:    original.Content,
+		Server:     h.address,
+		Entities:   original.Entities,
+		Location:   original.Location,
+		Contact:    original.Contact,
+		GIF:        original.GIF,
+		Quote:      original.Quote,
+		Attachment: original.Attachment,
+		Forwarded:  ref,
+	}
+	if err := h.SaveMessage(ctx, msg); err != nil {
+		return err
+	}
+	log.Printf("[Server %s] '%s' forwarded message %d to '%s'", h.address, c.Username(), ref.ID, room)
+	return nil
+}
+
+// checkRoomAccess applies the checks made on connecting to room: the
+// client's token must allow it and, when it is invite-only, the user must
+// be a member.
+func (h *Hub) checkRoomAccess(ctx context.Context, c *client.Client, room string) error {
+	if c.Claims != nil && !c.Claims.AllowsRoom(room) {
+		return ErrRoomNotAllowed
+	}
+	member, err := h.IsMember(ctx, room, c.UserID)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrRoomNotAllowed
+	}
+	return nil
+}
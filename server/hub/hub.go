@@ -3,18 +3,41 @@ package hub
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 
+	"lukagolubovic/analytics"
+	"lukagolubovic/archive"
+	"lukagolubovic/attachment"
+	"lukagolubovic/audit"
+	"lukagolubovic/breaker"
+	"lukagolubovic/broker"
 	"lukagolubovic/client"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/identity"
+	"lukagolubovic/idgen"
 	"lukagolubovic/loadbalancer"
+	"lukagolubovic/metrics"
 	"lukagolubovic/models"
+	"lukagolubovic/outbox"
+	"lukagolubovic/persist"
+	"lukagolubovic/scheduler"
+	"lukagolubovic/spill"
+	"lukagolubovic/webhook"
 )
 
 const (
-	redisChannel = "chat-messages"
+	directChannel = "chat-direct"
+	pruneInterval = time.Hour
+	stopTimeout   = 5 * time.Second
 )
 
 type Hub struct {
@@ -23,41 +46,141 @@ type Hub struct {
 	mu          sync.Mutex
 	register    chan *client.Client
 	unregister  chan *client.Client
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	db          *sql.DB
 	ctx         context.Context
 	cancel      context.CancelFunc
+	writer      *database.Writer
 	lbClient    *loadbalancer.Client
+	idGen       *idgen.Generator
+	relay       *outbox.Relay
+	webhooks    *webhook.Dispatcher
+	audit       *audit.Log
+	analytics   *analytics.Emitter
+	events      events
+	persist     *persist.Runner
+	adaptive    adaptive
+	// redisBreaker guards publishing to Redis and dbBreaker storing
+	// messages. spill keeps control commands while Redis is down, and
+	// seen drops repeats once they and the outbox are replayed.
+	redisBreaker *breaker.Breaker
+	dbBreaker    *breaker.Breaker
+	spill        *spill.Queue
+	seen         *seenIDs
+	archiver     *archive.Archiver
+	attachments  *attachment.Store
+	cfg          *config.Store
+	banned       map[int64]bool
+	muted        map[int64]bool
+	maintenance  models.Maintenance
+	tails        map[chan []byte]struct{}
+	tailMu       sync.Mutex
+	replicate    chan []byte
+	wg           sync.WaitGroup
+	stopped      chan struct{}
+	closed       []*client.Client
+	shards       int
 }
 
-func New(address string, redisClient *redis.Client, db *sql.DB, lbClient *loadbalancer.Client) *Hub {
+func New(address string, redisClient redis.UniversalClient, db *sql.DB, writer *database.Writer, lbClient *loadbalancer.Client, cfg *config.Store) *Hub {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Hub{
+	h := &Hub{
 		address:     address,
 		clients:     make(map[*client.Client]bool),
 		register:    make(chan *client.Client),
 		unregister:  make(chan *client.Client),
 		redisClient: redisClient,
 		db:          db,
+		writer:      writer,
 		ctx:         ctx,
 		cancel:      cancel,
 		lbClient:    lbClient,
+		idGen:       idgen.New(address),
+		cfg:         cfg,
+		banned:      make(map[int64]bool),
+		muted:       make(map[int64]bool),
+		tails:       make(map[chan []byte]struct{}),
+		replicate:   make(chan []byte, replicateBuffer),
+		seen:        newSeenIDs(),
+		stopped:     make(chan struct{}),
+		shards:      cfg.Get().Redis.Shards,
 	}
+	h.newBreakers()
+	h.relay = outbox.New(address, db, writer, h.publish)
+	h.webhooks = webhook.New(address, func() []config.Webhook { return cfg.Get().Webhooks })
+	h.audit = audit.New(redisClient, address)
+	h.analytics = analytics.New(cfg.Get().Analytics, address)
+	h.archiver = archive.New(address, redisClient, db, writer, cfg.Get().Archive)
+	h.attachments = attachment.New(redisClient, cfg.Get().Attachments)
+	h.persist = persist.New(address, db, writer, cfg.Get().Persistence)
+	h.subscribeBuiltins()
+	return h
 }
 
+// ClaimNode claims the hub's id generator node in Redis, so no other
+// process issues the same ids; see idgen.Generator.Claim. Call it before
+// Run, which holds the claim.
+func (h *Hub) ClaimNode(ctx context.Context) error {
+	return h.idGen.Claim(ctx, h.redisClient, h.address)
+}
+
+// Run processes registrations until Stop is called.
 func (h *Hub) Run() {
-	go h.listenToRedis()
+	defer close(h.stopped)
+
+	h.migrateUserKeys()
+	h.migrateModeration()
+	h.loadModeration()
+	h.loadRoomOverrides()
+	// Commands get their own subscription so they never queue behind a
+	// burst of chat.
+	h.spawn(func() { h.listenToRedis(controlChannel, directChannel) })
+	// Clients only join the default room so far, so every server carries
+	// that room's shard and no other.
+	h.spawn(func() { h.listenToRedis(broker.Channel(models.DefaultRoom, h.shards)) })
+	h.spawn(func() { h.idGen.Hold(h.ctx) })
+	h.spawn(func() { h.relay.Run(h.ctx) })
+	h.spawn(func() { h.jobs().Run(h.ctx) })
+	h.spawn(h.replicateLoop)
+	h.spawn(h.adaptLimits)
+	if h.spill != nil {
+		h.spawn(h.replaySpill)
+	}
+	h.spawn(func() { h.webhooks.Run(h.ctx) })
+	h.spawn(func() { h.persist.Run(h.ctx) })
+	// Analytics outlive the hub's context so the sessions closeClients ends
+	// are still recorded once the subscribers have caught up.
+	analyticsCtx, stopAnalytics := context.WithCancel(context.Background())
+	h.spawn(func() { h.analytics.Run(analyticsCtx) })
 
 	for {
 		select {
+		case <-h.ctx.Done():
+			h.closeClients()
+			h.events.close()
+			stopAnalytics()
+			return
+
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
 			load := len(h.clients)
 			h.mu.Unlock()
 
-			log.Printf("[Server %s] Client '%s' connected. Total clients: %d\n", h.address, client.Username, load)
-			h.lbClient.UpdateLoad(load)
+			log.Printf("[Server %s] Client '%s' connected. Total clients: %d\n", h.address, client.Username(), load)
+			h.lbClient.UpdateLoad(load, client.Assignment)
+			h.events.publish(Event{Kind: EventClientJoined, Room: models.DefaultRoom, User: userSnapshot(client)})
+			h.warnDegraded(client)
+			if !client.Guest {
+				h.spawn(func() {
+					h.markSeen(client.UserID)
+					h.recordSessions(client)
+				})
+			}
+			if client.ReplayAfter > 0 && client.CanRead() {
+				h.spawn(func() { h.replay(client, client.ReplayAfter) })
+			}
+			h.spawn(func() { h.joined(client) })
 
 		case client := <-h.unregister:
 			h.mu.Lock()
@@ -67,8 +190,18 @@ func (h *Hub) Run() {
 				load := len(h.clients)
 				h.mu.Unlock()
 
-				log.Printf("[Server %s] Client '%s' disconnected. Total clients: %d\n", h.address, client.Username, load)
-				h.lbClient.UpdateLoad(load)
+				log.Printf("[Server %s] Client '%s' disconnected. Total clients: %d\n", h.address, client.Username(), load)
+				h.lbClient.UpdateLoad(load, "")
+				h.events.publish(Event{Kind: EventClientLeft, Room: models.DefaultRoom, User: userSnapshot(client)})
+				if !client.Guest {
+					h.spawn(func() {
+						h.markSeen(client.UserID)
+						h.forgetSession(client)
+					})
+				}
+				if client.Guest {
+					h.spawn(func() { h.ReleaseGuest(client.Username()) })
+				}
 			} else {
 				h.mu.Unlock()
 			}
@@ -76,8 +209,68 @@ func (h *Hub) Run() {
 	}
 }
 
-func (h *Hub) listenToRedis() {
-	pubsub := h.redisClient.Subscribe(h.ctx, redisChannel)
+// userEvent is the webhook payload for a connection joining or leaving.
+type userEvent struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Server   string `json:"server"`
+	Guest    bool   `json:"guest,omitempty"`
+}
+
+func (h *Hub) userEvent(u *EventUser) userEvent {
+	return userEvent{UserID: u.UserID, Username: u.Username, Server: h.address, Guest: u.Guest}
+}
+
+func (h *Hub) spawn(fn func()) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		fn()
+	}()
+}
+
+// Stop shuts the hub down: it stops Run and every background goroutine,
+// closes all client connections and waits up to stopTimeout for their
+// pumps to exit. Run must have been started.
+func (h *Hub) Stop() {
+	h.cancel()
+	<-h.stopped
+	clients := h.closed
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		for _, c := range clients {
+			<-c.Done()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("[Server %s] Hub stopped\n", h.address)
+	case <-time.After(stopTimeout):
+		log.Printf("[Server %s] Hub stop timed out after %s", h.address, stopTimeout)
+	}
+}
+
+// closeClients closes every client's send channel, which makes its
+// WritePump send a close frame and exit. The clients are kept in h.closed so
+// Stop can wait for them. Must only be called from Run.
+func (h *Hub) closeClients() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		c.CloseOnce.Do(func() { close(c.Send) })
+		delete(h.clients, c)
+		h.closed = append(h.closed, c)
+		h.events.publish(Event{Kind: EventClientLeft, Room: models.DefaultRoom, User: userSnapshot(c)})
+	}
+}
+
+func (h *Hub) listenToRedis(channels ...string) {
+	pubsub := h.redisClient.Subscribe(h.ctx, channels...)
 	defer pubsub.Close()
 	ch := pubsub.Channel()
 
@@ -90,53 +283,282 @@ func (h *Hub) listenToRedis() {
 				return
 			}
 
-			h.mu.Lock()
-			var clientsToRemove []*client.Client
-			for client := range h.clients {
-				select {
-				case client.Send <- []byte(rawMsg.Payload):
-				default:
-					clientsToRemove = append(clientsToRemove, client)
-				}
-			}
-			h.mu.Unlock()
+			h.dispatch(rawMsg)
+		}
+	}
+}
 
-			for _, client := range clientsToRemove {
-				h.unregister <- client
-			}
+// dispatch handles one Redis message. A panic is contained to that message
+// so the subscription, and every client on this server, survives it.
+func (h *Hub) dispatch(rawMsg *redis.Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("redis_"+rawMsg.Channel, v)
+		}
+	}()
+
+	switch rawMsg.Channel {
+	case controlChannel:
+		h.handleControl(rawMsg.Payload)
+	case directChannel:
+		h.handleDirect(rawMsg.Payload)
+	default:
+		payload := []byte(rawMsg.Payload)
+		if h.seen.add(messageID(payload)) {
+			h.broadcast(payload)
+			h.publishTail(payload)
 		}
+		h.queueReplication(payload)
 	}
 }
 
-func (h *Hub) RegisterClient(c *client.Client) {
-	h.register <- c
+type directEnvelope struct {
+	To      string          `json:"to"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// PublishDirect routes payload to every connection of one user across the
+// cluster. Each server delivers it only to its own matching clients.
+func (h *Hub) PublishDirect(ctx context.Context, to string, payload []byte) error {
+	b, err := json.Marshal(directEnvelope{To: to, Payload: payload})
+	if err != nil {
+		return err
+	}
+	return h.redisPublish(ctx, directChannel, b)
+}
+
+func (h *Hub) handleDirect(raw string) {
+	var env directEnvelope
+	if err := json.Unmarshal([]byte(raw), &env); err != nil {
+		log.Printf("[Server %s] Invalid direct message: %v", h.address, err)
+		return
+	}
+
+	id := messageID(env.Payload)
+	h.mu.Lock()
+	var clientsToRemove []*client.Client
+	to := config.NormalizeUsername(env.To)
+	for client := range h.clients {
+		if client.Guest || config.NormalizeUsername(client.Username()) != to {
+			continue
+		}
+		select {
+		case lane(client, id) <- env.Payload:
+		default:
+			clientsToRemove = append(clientsToRemove, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range clientsToRemove {
+		h.UnregisterClient(client)
+	}
 }
 
+func (h *Hub) broadcast(payload []byte) {
+	id := messageID(payload)
+
+	h.mu.Lock()
+	var clientsToRemove []*client.Client
+	for client := range h.clients {
+		// Tokens without the read scope only get system messages.
+		if id != 0 && !client.CanRead() {
+			continue
+		}
+		// Tracked before queueing so an ack can't arrive first.
+		client.Track(id, payload)
+		select {
+		case lane(client, id) <- payload:
+		default:
+			clientsToRemove = append(clientsToRemove, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range clientsToRemove {
+		h.UnregisterClient(client)
+	}
+}
+
+// lane is the queue payload goes on: Send for chat messages, and Priority,
+// ahead of them, for system and control frames, which have no id.
+func lane(c *client.Client, id int64) chan []byte {
+	if id == 0 {
+		return c.Priority
+	}
+	return c.Send
+}
+
+// messageID returns the id of a chat message payload, or 0 for system
+// messages, which are never redelivered.
+func messageID(payload []byte) int64 {
+	var msg struct {
+		ID int64 `json:"id,string"`
+	}
+	if json.Unmarshal(payload, &msg) != nil {
+		return 0
+	}
+	return msg.ID
+}
+
+// prune deletes messages older than the room's retention. The retention
+// is re-read on every run so reloads and room overrides apply without a
+// restart.
+func (h *Hub) prune(ctx context.Context) error {
+	days := h.cfg.Room(models.DefaultRoom).RetentionDays
+	if days <= 0 {
+		return nil
+	}
+	var n int64
+	err := h.writer.Tx(func(tx *sql.Tx) error {
+		var err error
+		n, err = database.PruneMessages(tx, models.DefaultRoomID, days)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("retention prune: %w", err)
+	}
+	if n > 0 {
+		log.Printf("[Server %s] Pruned %d messages older than %d days\n", h.address, n, days)
+	}
+	return nil
+}
+
+// jobs returns the hub's periodic jobs. Every server prunes and polls for
+// itself; the archiver takes its own lock for the shared upload.
+func (h *Hub) jobs() *scheduler.Scheduler {
+	jobs := scheduler.New(h.address, h.redisClient)
+	jobs.MustAdd(scheduler.Job{Name: "retention", Every: pruneInterval, Run: h.prune})
+	if h.archiver != nil {
+		jobs.MustAdd(scheduler.Job{Name: "archive", Every: pruneInterval, Jitter: time.Minute, Run: func(ctx context.Context) error {
+			return h.archiver.RunOnce(ctx, time.Now())
+		}})
+	}
+	jobs.MustAdd(scheduler.Job{Name: "presence", Every: identity.PresenceInterval, Run: h.recordPresence})
+	jobs.MustAdd(scheduler.Job{Name: "maintenance", Every: maintenancePoll, RunAtStart: true, Run: h.loadMaintenance})
+	return jobs
+}
+
+// ErrStopped is returned when registering a client after Stop.
+var ErrStopped = errors.New("hub is stopped")
+
+func (h *Hub) RegisterClient(c *client.Client) error {
+	select {
+	case h.register <- c:
+		return nil
+	case <-h.ctx.Done():
+		return ErrStopped
+	}
+}
+
+// UnregisterClient never blocks once the hub is stopped, since Run has then
+// already closed every client.
 func (h *Hub) UnregisterClient(c *client.Client) {
-	h.unregister <- c
+	select {
+	case h.unregister <- c:
+	case <-h.ctx.Done():
+	}
 }
 
 func (h *Hub) GetAddress() string {
 	return h.address
 }
 
+// Config is the configuration of the default room, the one clients chat
+// in.
+func (h *Hub) Config() *config.Runtime {
+	return h.cfg.Room(models.DefaultRoom)
+}
+
+func (h *Hub) NextMessageID() int64 {
+	return h.idGen.Next()
+}
+
+type ConnectedUser struct {
+	UserID      int64     `json:"user_id,string"`
+	Username    string    `json:"username"`
+	Server      string    `json:"server"`
+	SessionID   string    `json:"session_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// BytesIn and BytesOut are the WebSocket message bytes read from and
+	// written to the connection so far.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Latency is the connection's round-trip time, once measured.
+	Latency *models.Latency `json:"latency,omitempty"`
+}
+
+// ConnectedUsers lists this server's connections, sorted by username.
+func (h *Hub) ConnectedUsers() []ConnectedUser {
+	h.mu.Lock()
+	users := make([]ConnectedUser, 0, len(h.clients))
+	for c := range h.clients {
+		in, out := c.Bandwidth()
+		user := ConnectedUser{
+			UserID:      c.UserID,
+			Username:    c.Username(),
+			Server:      h.address,
+			SessionID:   c.SessionID,
+			ConnectedAt: c.ConnectedAt.UTC(),
+			BytesIn:     in,
+			BytesOut:    out,
+		}
+		if latency, ok := c.Latency(); ok {
+			user.Latency = &latency
+		}
+		users = append(users, user)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
 func (h *Hub) GetLoad() int {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	return len(h.clients)
 }
 
-func (h *Hub) SaveMessage(msg models.Message) error {
-	stmt, err := h.db.Prepare("INSERT INTO messages(username, message, server) VALUES(?, ?, ?)")
+// SaveMessage persists the message together with an outbox entry in a single
+// transaction; the relay then publishes it to Redis with retries. It gives up
+// with ctx.Err() once ctx ends, so a stuck database can't block the caller,
+// and with breaker.ErrOpen without trying while the database is failing.
+// While Redis is failing, the message is delivered to this server's clients
+// right away rather than once the relay gets it through.
+func (h *Hub) SaveMessage(ctx context.Context, msg models.Message) error {
+	payload, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(msg.Username, msg.Content, msg.Server)
-	return err
+	err = h.dbBreaker.Do(func() error {
+		return h.writer.TxContext(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.Exec("INSERT INTO messages(id, room_id, user_id, message, server, entities, type, payload) VALUES(?, ?, ?, ?, ?, ?, ?, ?)", msg.ID, models.DefaultRoomID, msg.UserID, msg.Content, msg.Server, models.EncodeEntities(msg.Entities), msg.Type, models.EncodePayload(msg)); err != nil {
+				return err
+			}
+			return outbox.Enqueue(tx, payload)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if h.redisBreaker.State() != breaker.Closed {
+		h.deliverLocally(msg.ID, payload)
+	}
+	h.relay.Notify()
+	h.events.publish(Event{Kind: EventMessagePersisted, Room: models.DefaultRoom, Message: &msg})
+	return nil
 }
 
-func (h *Hub) PublishMessage(msgBytes []byte) error {
-	return h.redisClient.Publish(h.ctx, redisChannel, msgBytes).Err()
-}
\ No newline at end of file
+func (h *Hub) publish(ctx context.Context, msgBytes []byte) error {
+	return h.redisPublish(ctx, broker.Channel(broker.RoomOf(msgBytes), h.shards), msgBytes)
+}
+
+// redisPublish publishes through the Redis circuit breaker.
+func (h *Hub) redisPublish(ctx context.Context, channel string, payload []byte) error {
+	return h.redisBreaker.Do(func() error {
+		return h.redisClient.Publish(ctx, channel, payload).Err()
+	})
+}
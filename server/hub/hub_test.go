@@ -0,0 +1,179 @@
+package hub_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+
+	"lukagolubovic/client"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/hub"
+	"lukagolubovic/loadbalancer"
+	"lukagolubovic/models"
+)
+
+// settleTimeout is how long goroutines get to exit after a shutdown before
+// they count as leaked.
+const settleTimeout = 5 * time.Second
+
+// TestStopLeavesNoGoroutines checks that Stop ends the hub's run loop, its
+// background jobs and the pumps of connected clients.
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	h, closeHub := newHub(t)
+	go h.Run()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveClient(t, h, w, r)
+	}))
+	var conns []*websocket.Conn
+	for range 3 {
+		conns = append(conns, dial(t, srv))
+	}
+	waitFor(t, func() bool { return h.GetLoad() == len(conns) }, "clients to register")
+
+	h.Stop()
+	for _, conn := range conns {
+		// The hub closed the connection, so the close frame arrives
+		// before anything else.
+		conn.SetReadDeadline(time.Now().Add(settleTimeout))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}
+	srv.Close()
+	closeHub()
+
+	checkGoroutines(t, before)
+}
+
+// TestClientDisconnectEndsPumps checks that a client going away ends both
+// of its pumps while the hub keeps running.
+func TestClientDisconnectEndsPumps(t *testing.T) {
+	h, closeHub := newHub(t)
+	go h.Run()
+	defer closeHub()
+	defer h.Stop()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveClient(t, h, w, r)
+	}))
+	defer srv.Close()
+
+	// Warm up one connection first, so goroutines started once per process
+	// (such as the HTTP server's) are already counted.
+	warm := dial(t, srv)
+	waitFor(t, func() bool { return h.GetLoad() == 1 }, "the first client to register")
+	before := runtime.NumGoroutine()
+
+	conn := dial(t, srv)
+	waitFor(t, func() bool { return h.GetLoad() == 2 }, "the second client to register")
+	conn.Close()
+	waitFor(t, func() bool { return h.GetLoad() == 1 }, "the second client to unregister")
+
+	checkGoroutines(t, before)
+	warm.Close()
+}
+
+// newHub returns a hub on a fresh database whose Redis and load balancer
+// are unreachable, which the hub tolerates, and a function releasing the
+// database once the hub has stopped.
+func newHub(t *testing.T) (*hub.Hub, func()) {
+	t.Helper()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	writer := database.NewWriter(db)
+	cfg, err := config.NewStore("")
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	unreachable := closedAddress(t)
+	rdb := redis.NewClient(&redis.Options{Addr: unreachable, MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	lbClient := loadbalancer.New("http://"+unreachable, "", "ws://127.0.0.1:0", "", nil)
+
+	h := hub.New("ws://127.0.0.1:0", rdb, db, writer, lbClient, cfg)
+	return h, func() {
+		writer.Close()
+		rdb.Close()
+		db.Close()
+	}
+}
+
+// serveClient upgrades a connection and runs it as a named client, like
+// handlers.ServeWS without the checks that need Redis.
+func serveClient(t *testing.T, h *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	up := websocket.Upgrader{Subprotocols: []string{models.Subprotocol}}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		t.Errorf("upgrade: %v", err)
+		return
+	}
+	c := client.New(h, conn, 1, "alice")
+	c.SendHello(conn.Subprotocol())
+	if err := h.RegisterClient(c); err != nil {
+		conn.Close()
+		return
+	}
+	go c.WritePump()
+	go c.ReadPump()
+}
+
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{models.Subprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+// closedAddress returns a local address nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func waitFor(t *testing.T, done func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkGoroutines fails the test if more goroutines than before are still
+// running once they had settleTimeout to exit.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
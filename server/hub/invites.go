@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/identity"
+	"lukagolubovic/invite"
+)
+
+// An invite is a hash with its room, use limit, use count and revocation
+// flag, expiring with the token. Redeeming it adds the user id to the
+// room's member set. redeemScript touches both, so they share the {rooms}
+// hash tag.
+const (
+	invitePrefix  = "chat:{rooms}:invite:"
+	membersPrefix = identity.MembersPrefix
+)
+
+var (
+	ErrInvitesDisabled = errors.New("invites are disabled")
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrInviteRevoked   = errors.New("invite has been revoked")
+	ErrInviteUsedUp    = errors.New("invite has no uses left")
+)
+
+// redeemScript returns 1 once the user is a member, -1 for an unknown or
+// expired invite, -2 for a revoked one and -3 when its uses are exhausted.
+// Redeeming an invite again as an existing member doesn't use it up.
+var redeemScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+if redis.call("HGET", KEYS[1], "revoked") == "1" then
+	return -2
+end
+if redis.call("SISMEMBER", KEYS[2], ARGV[1]) == 1 then
+	return 1
+end
+local max = tonumber(redis.call("HGET", KEYS[1], "max_uses"))
+if max > 0 and tonumber(redis.call("HGET", KEYS[1], "uses")) >= max then
+	return -3
+end
+redis.call("HINCRBY", KEYS[1], "uses", 1)
+redis.call("SADD", KEYS[2], ARGV[1])
+return 1
+`)
+
+var revokeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "revoked", 1)
+return 1
+`)
+
+// Invite describes a created invite. Only the token grants access; the id
+// is for revoking it.
+type Invite struct {
+	ID        string     `json:"id"`
+	Token     string     `json:"token"`
+	Room      string     `json:"room"`
+	MaxUses   int        `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateInvite issues a token for room. maxUses of zero allows any number of
+// redemptions and a zero ttl never expires.
+func (h *Hub) CreateInvite(ctx context.Context, room string, maxUses int, ttl time.Duration) (Invite, error) {
+	cfg := h.Config().Invites
+	if !cfg.Enabled() {
+		return Invite{}, ErrInvitesDisabled
+	}
+	id, err := invite.NewID()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	inv := Invite{ID: id, Room: room, MaxUses: maxUses}
+	claims := invite.Claims{ID: id, Room: room}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+		inv.ExpiresAt = &expires
+		claims.Expires = expires.Unix()
+	}
+	if inv.Token, err = invite.Sign([]byte(cfg.Secret), claims); err != nil {
+		return Invite{}, err
+	}
+
+	key := invitePrefix + id
+	_, err = h.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "room", room, "max_uses", maxUses, "uses", 0, "revoked", 0)
+		if ttl > 0 {
+			pipe.ExpireAt(ctx, key, *inv.ExpiresAt)
+		}
+		return nil
+	})
+	if err != nil {
+		return Invite{}, err
+	}
+	return inv, nil
+}
+
+// RevokeInvite stops an invite from being redeemed. Members who already
+// joined through it stay members.
+func (h *Hub) RevokeInvite(ctx context.Context, id string) error {
+	res, err := revokeScript.Run(ctx, h.redisClient, []string{invitePrefix + id}).Int()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RedeemInvite adds userID to the room token invites to and returns the
+// room. Bad signatures and expired tokens come back as invite.ErrInvalid
+// and invite.ErrExpired.
+func (h *Hub) RedeemInvite(ctx context.Context, token string, userID int64) (string, error) {
+	cfg := h.Config().Invites
+	if !cfg.Enabled() {
+		return "", ErrInvitesDisabled
+	}
+	claims, err := invite.Verify([]byte(cfg.Secret), token, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	keys := []string{invitePrefix + claims.ID, membersPrefix + claims.Room}
+	res, err := redeemScript.Run(ctx, h.redisClient, keys, userID).Int()
+	if err != nil {
+		return "", err
+	}
+	switch res {
+	case -1:
+		return "", ErrInviteNotFound
+	case -2:
+		return "", ErrInviteRevoked
+	case -3:
+		return "", ErrInviteUsedUp
+	}
+	return claims.Room, nil
+}
+
+// IsMember reports whether userID may join room. Rooms that aren't private
+// are open to everyone.
+func (h *Hub) IsMember(ctx context.Context, room string, userID int64) (bool, error) {
+	if !h.Config().Invites.Private(room) {
+		return true, nil
+	}
+	return h.redisClient.SIsMember(ctx, membersPrefix+room, strconv.FormatInt(userID, 10)).Result()
+}
@@ -0,0 +1,133 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"lukagolubovic/client"
+	"lukagolubovic/config"
+	"lukagolubovic/identity"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+	"lukagolubovic/roomconfig"
+)
+
+// joinHookTimeout bounds the Redis work of one user's join hooks.
+const joinHookTimeout = 10 * time.Second
+
+// joined records that the client's user has joined the default room,
+// recording a member message if it wasn't a member, and the first time
+// ever runs the room's join hooks. Guests get a new identity on every
+// connection, so they are never recorded and never trigger hooks.
+func (h *Hub) joined(c *client.Client) {
+	if c.Guest {
+		return
+	}
+	room := models.DefaultRoom
+	ctx, cancel := context.WithTimeout(h.ctx, joinHookTimeout)
+	defer cancel()
+
+	added, err := h.redisClient.SAdd(ctx, identity.JoinedPrefix+room, c.UserID).Result()
+	if err != nil {
+		log.Printf("[Server %s] Failed to record that '%s' joined %s: %v", h.address, c.Username(), room, err)
+		return
+	}
+	if isNew, err := h.addMember(ctx, room, c.UserID); err != nil {
+		log.Printf("[Server %s] Failed to add '%s' to the members of %s: %v", h.address, c.Username(), room, err)
+	} else if isNew {
+		if err := h.recordMembership(ctx, c.UserID, c.Username(), models.Membership{Action: models.MemberJoined}); err != nil {
+			log.Printf("[Server %s] Failed to record that '%s' joined %s: %v", h.address, c.Username(), room, err)
+		}
+	}
+	if added == 0 {
+		return
+	}
+
+	cfg := h.cfg.Room(room)
+	hooks := cfg.JoinHooks
+	if !hooks.Enabled() {
+		return
+	}
+	username := c.Username()
+	expand := strings.NewReplacer("{username}", username, "{room}", room).Replace
+	log.Printf("[Server %s] '%s' joined %s for the first time, running join hooks", h.address, username, room)
+
+	if hooks.WelcomeDM != "" {
+		payload, _ := json.Marshal(models.Message{
+			Username: "system",
+			Content:  expand(hooks.WelcomeDM),
+			Server:   h.address,
+			To:       username,
+		})
+		h.Deliver(c, payload)
+		metrics.JoinHooks.Add("welcome_dm", 1)
+	}
+	if hooks.Announcement != "" {
+		cmd := models.ControlCommand{Type: models.ControlAnnounce, Message: expand(hooks.Announcement)}
+		if err := h.PublishControl(ctx, cmd); err != nil {
+			log.Printf("[Server %s] Failed to announce that '%s' joined: %v", h.address, username, err)
+			metrics.JoinHooks.Add("failed", 1)
+		} else {
+			metrics.JoinHooks.Add("announcement", 1)
+		}
+	}
+	if slices.Contains(hooks.Roles, config.RoleModerator) && !cfg.IsModerator(username) {
+		if err := h.grantModerator(ctx, room, username); err != nil {
+			log.Printf("[Server %s] Failed to make '%s' a moderator of %s: %v", h.address, username, room, err)
+			metrics.JoinHooks.Add("failed", 1)
+		} else {
+			metrics.JoinHooks.Add("roles", 1)
+		}
+	}
+	if hooks.NotifyModerators {
+		h.notifyModerators(ctx, cfg, username, room)
+	}
+}
+
+// grantModerator adds username to the room's moderators on every server.
+// Only the moderators of the room's overrides in Redis change, so
+// concurrent grants and changes to other overrides don't overwrite each
+// other, and servers racing to grant the same user publish it once.
+func (h *Hub) grantModerator(ctx context.Context, room, username string) error {
+	added := false
+	_, err := roomconfig.Update(ctx, h.redisClient, room, func(o *config.RoomOverrides) error {
+		added = addModerator(o, username)
+		return nil
+	})
+	if err != nil || !added {
+		return err
+	}
+	return h.PublishControl(ctx, models.ControlCommand{Type: models.ControlGrantModerator, Room: room, Username: username})
+}
+
+// notifyModerators sends each of the room's moderators a direct message,
+// which reaches them on whichever server they are connected to.
+func (h *Hub) notifyModerators(ctx context.Context, cfg *config.Runtime, username, room string) {
+	for _, moderator := range cfg.Moderators {
+		if strings.EqualFold(moderator, username) {
+			continue
+		}
+		if err := h.noticeModerator(ctx, moderator, fmt.Sprintf("%s joined %s for the first time", username, room)); err != nil {
+			log.Printf("[Server %s] Failed to notify moderator '%s' of '%s' joining: %v", h.address, moderator, username, err)
+			metrics.JoinHooks.Add("failed", 1)
+			continue
+		}
+		metrics.JoinHooks.Add("moderator_notices", 1)
+	}
+}
+
+// noticeModerator sends a moderator a direct message from the system.
+func (h *Hub) noticeModerator(ctx context.Context, moderator, content string) error {
+	payload, _ := json.Marshal(models.Message{
+		Username: "system",
+		Content:  content,
+		Server:   h.address,
+		To:       moderator,
+	})
+	return h.PublishDirect(ctx, moderator, payload)
+}
@@ -0,0 +1,139 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+
+	"lukagolubovic/models"
+)
+
+const (
+	// maintenanceKey holds the maintenance state as JSON while maintenance
+	// is on. It may also be set or deleted with redis-cli; servers poll it
+	// every maintenancePoll.
+	maintenanceKey  = "chat:maintenance"
+	maintenancePoll = 15 * time.Second
+)
+
+// maxMaintenanceMessage keeps the message short enough for a banner.
+const maxMaintenanceMessage = 500
+
+var ErrInvalidMaintenance = errors.New("invalid maintenance message")
+
+// Maintenance returns the maintenance state this server enforces.
+func (h *Hub) Maintenance() models.Maintenance {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.maintenance
+}
+
+func (h *Hub) InMaintenance() bool {
+	return h.Maintenance().Enabled
+}
+
+// SetMaintenance turns maintenance on with message, or off when enabled is
+// false, on every server.
+func (h *Hub) SetMaintenance(ctx context.Context, enabled bool, message string) (models.Maintenance, error) {
+	if len(message) > maxMaintenanceMessage {
+		return models.Maintenance{}, ErrInvalidMaintenance
+	}
+	m := models.Maintenance{}
+	if enabled {
+		if message == "" {
+			message = models.DefaultMaintenanceMessage
+		}
+		now := time.Now().UTC()
+		m = models.Maintenance{Enabled: true, Message: message, Since: &now}
+		raw, err := json.Marshal(m)
+		if err != nil {
+			return m, err
+		}
+		if err := h.redisClient.Set(ctx, maintenanceKey, raw, 0).Err(); err != nil {
+			return m, err
+		}
+	} else if err := h.redisClient.Del(ctx, maintenanceKey).Err(); err != nil {
+		return m, err
+	}
+	return m, h.PublishControl(ctx, models.ControlCommand{Type: models.ControlMaintenance})
+}
+
+// loadMaintenance reads the maintenance flag from Redis and applies it if
+// it changed. It runs at startup, on control commands and every
+// maintenancePoll, to catch changes made directly in Redis. A value that
+// isn't the JSON state, as left by a plain "SET chat:maintenance <text>",
+// is taken as the message.
+func (h *Hub) loadMaintenance(ctx context.Context) error {
+	raw, err := h.redisClient.Get(ctx, maintenanceKey).Result()
+	var m models.Maintenance
+	switch {
+	case errors.Is(err, redis.Nil):
+	case err != nil:
+		return fmt.Errorf("load maintenance flag: %w", err)
+	case json.Unmarshal([]byte(raw), &m) != nil:
+		m = models.Maintenance{Enabled: true, Message: raw}
+	}
+	if m.Enabled && m.Message == "" {
+		m.Message = models.DefaultMaintenanceMessage
+	}
+
+	h.mu.Lock()
+	current := h.maintenance
+	if m.Enabled && m.Since == nil {
+		m.Since = current.Since
+		if !current.Enabled {
+			now := time.Now().UTC()
+			m.Since = &now
+		}
+	}
+	changed := m.Enabled != current.Enabled || m.Message != current.Message
+	h.maintenance = m
+	h.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if m.Enabled {
+		log.Printf("[Server %s] Maintenance started: %s\n", h.address, m.Message)
+	} else {
+		log.Printf("[Server %s] Maintenance ended\n", h.address)
+	}
+	h.broadcast(h.maintenanceMessage(m))
+	return nil
+}
+
+// maintenanceMessage is the banner sent to connected clients when
+// maintenance starts or ends.
+func (h *Hub) maintenanceMessage(m models.Maintenance) []byte {
+	content := m.Message
+	if !m.Enabled {
+		content = "Maintenance is over."
+	}
+	payload, _ := json.Marshal(models.Message{
+		Type:        models.MessageTypeMaintenance,
+		Username:    "system",
+		Content:     content,
+		Server:      h.address,
+		Maintenance: &m,
+	})
+	return payload
+}
+
+// RefuseForMaintenance sends a freshly upgraded connection the maintenance
+// banner and closes it without registering a client.
+func (h *Hub) RefuseForMaintenance(conn *websocket.Conn) {
+	defer conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	conn.SetWriteDeadline(deadline)
+	if err := conn.WriteMessage(websocket.TextMessage, h.maintenanceMessage(h.Maintenance())); err != nil {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, models.MaintenanceCloseReason), deadline)
+}
@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+
+	"lukagolubovic/client"
+	"lukagolubovic/identity"
+	"lukagolubovic/models"
+)
+
+// memberOffline is how long after their last presence refresh members
+// are shown offline.
+const memberOffline = 3 * identity.PresenceInterval
+
+var (
+	ErrNotMember     = errors.New("not a member of the room")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// addMember makes userID a current member of room, reporting whether it
+// wasn't one already.
+func (h *Hub) addMember(ctx context.Context, room string, userID int64) (bool, error) {
+	n, err := h.redisClient.ZAddNX(ctx, identity.JoinedAtPrefix+room, &redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: userID,
+	}).Result()
+	return n > 0, err
+}
+
+// removeMember drops userID from room's members and records the change,
+// reporting false if the user wasn't a member.
+func (h *Hub) removeMember(ctx context.Context, room string, userID int64, username string, change models.Membership) (bool, error) {
+	n, err := h.redisClient.ZRem(ctx, identity.JoinedAtPrefix+room, userID).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, h.recordMembership(ctx, userID, username, change)
+}
+
+// recordMembership saves a member message for the change. It goes through
+// the outbox like a chat message, so it reaches every server's history.
+func (h *Hub) recordMembership(ctx context.Context, userID int64, username string, change models.Membership) error {
+	return h.SaveMessage(ctx, models.Message{
+		ID:       h.NextMessageID(),
+		Type:     models.MessageTypeMember,
+		UserID:   userID,
+		Username: username,
+		Content:  change.Fallback(username, models.DefaultRoom),
+		Server:   h.address,
+		Member:   &change,
+	})
+}
+
+// Leave takes the client's user out of the room and closes all of the
+// user's connections, since each of them is in it.
+func (h *Hub) Leave(ctx context.Context, c *client.Client) error {
+	left, err := h.removeMember(ctx, models.DefaultRoom, c.UserID, c.Username(), models.Membership{Action: models.MemberLeft})
+	if err != nil {
+		return err
+	}
+	if !left {
+		return ErrNotMember
+	}
+	return h.PublishControl(ctx, models.ControlCommand{Type: models.ControlLeave, UserID: c.UserID})
+}
+
+// kicked records that cmd's user was kicked, if still a member.
+func (h *Hub) kicked(ctx context.Context, cmd models.ControlCommand) error {
+	username := cmd.Username
+	if username == "" {
+		var err error
+		username, err = h.redisClient.HGet(ctx, usernamesKey, strconv.FormatInt(cmd.UserID, 10)).Result()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := h.removeMember(ctx, models.DefaultRoom, cmd.UserID, username, models.Membership{Action: models.MemberKicked})
+	return err
+}
+
+func (h *Hub) applyLeave(cmd models.ControlCommand) {
+	h.mu.Lock()
+	var matched []*client.Client
+	for c := range h.clients {
+		if c.UserID == cmd.UserID {
+			c.SetCloseReason(websocket.CloseNormalClosure, "left the room")
+			matched = append(matched, c)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, c := range matched {
+		h.UnregisterClient(c)
+	}
+}
+
+// Members returns up to limit of room's current members, longest-standing
+// first, starting after the cursor next returned by the previous page;
+// next is empty on the last page. Members whose name can't be found are
+// left out.
+func (h *Hub) Members(ctx context.Context, room, after string, limit int) (members []models.Member, next string, err error) {
+	entries, err := h.memberPage(ctx, room, after, limit+1)
+	if err != nil || len(entries) == 0 {
+		return nil, "", err
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = fmt.Sprintf("%d-%s", int64(last.Score), last.Member)
+	}
+
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i], _ = e.Member.(string)
+	}
+	pipe := h.redisClient.Pipeline()
+	names := pipe.HMGet(ctx, usernamesKey, ids...)
+	seen := pipe.HMGet(ctx, identity.LastSeenKey, ids...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, "", err
+	}
+
+	onlineSince := time.Now().Add(-memberOffline).Unix()
+	members = make([]models.Member, 0, len(entries))
+	for i, e := range entries {
+		userID, err := strconv.ParseInt(ids[i], 10, 64)
+		name, ok := names.Val()[i].(string)
+		if err != nil || !ok {
+			continue
+		}
+		lastSeen, _ := seen.Val()[i].(string)
+		seenAt, _ := strconv.ParseInt(lastSeen, 10, 64)
+		members = append(members, models.Member{
+			UserID:   userID,
+			Username: name,
+			JoinedAt: time.UnixMilli(int64(e.Score)).UTC(),
+			Online:   seenAt >= onlineSince,
+		})
+	}
+	return members, next, nil
+}
+
+// memberPage reads up to count members after the cursor, a joined time in
+// Unix milliseconds and a user id. Members who joined in the same
+// millisecond are ordered by id as text, as Redis orders them.
+func (h *Hub) memberPage(ctx context.Context, room, after string, count int) ([]redis.Z, error) {
+	key := identity.JoinedAtPrefix + room
+	if after == "" {
+		return h.redisClient.ZRangeWithScores(ctx, key, 0, int64(count-1)).Result()
+	}
+	rawScore, afterID, ok := strings.Cut(after, "-")
+	score, err := strconv.ParseInt(rawScore, 10, 64)
+	if !ok || err != nil || afterID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	var page []redis.Z
+	for offset := int64(0); len(page) < count; {
+		batch, err := h.redisClient.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min:    strconv.FormatInt(score, 10),
+			Max:    "+inf",
+			Offset: offset,
+			Count:  int64(count),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range batch {
+			id, _ := e.Member.(string)
+			if int64(e.Score) == score && id <= afterID {
+				continue
+			}
+			page = append(page, e)
+		}
+		if len(batch) < count {
+			break
+		}
+		offset += int64(len(batch))
+	}
+	if len(page) > count {
+		page = page[:count]
+	}
+	return page, nil
+}
@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"context"
+	"errors"
+
+	"lukagolubovic/notify"
+)
+
+var ErrNotificationsDisabled = errors.New("notifications are disabled")
+
+func (h *Hub) NotificationPrefs(ctx context.Context, userID int64) (notify.Prefs, error) {
+	return notify.Load(ctx, h.redisClient, userID)
+}
+
+func (h *Hub) SetNotificationPrefs(ctx context.Context, userID int64, p notify.Prefs) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return notify.Save(ctx, h.redisClient, userID, p)
+}
+
+// Unsubscribe turns off the digests of the user an unsubscribe token was
+// issued for.
+func (h *Hub) Unsubscribe(ctx context.Context, token string) error {
+	cfg := h.cfg.Get().Notifications
+	if !cfg.Enabled() {
+		return ErrNotificationsDisabled
+	}
+	userID, err := notify.VerifyUnsubscribe([]byte(cfg.Secret), token)
+	if err != nil {
+		return err
+	}
+	return notify.Unsubscribe(ctx, h.redisClient, userID)
+}
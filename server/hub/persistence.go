@@ -0,0 +1,30 @@
+package hub
+
+import (
+	"context"
+
+	"lukagolubovic/database"
+	"lukagolubovic/persist"
+)
+
+// RegisterPersistHook adds a hook that every message this server stores
+// is written through to, next to the configured ones. Call it before Run.
+func (h *Hub) RegisterPersistHook(hook persist.Hook) error {
+	return h.persist.Register(hook)
+}
+
+// DeadLetters lists the messages persistence hooks gave up on, after the
+// dead letter with id after, optionally only those of one hook.
+func (h *Hub) DeadLetters(ctx context.Context, hook string, after int64, limit int) ([]database.DeadLetter, error) {
+	return h.persist.DeadLetters(ctx, hook, after, limit)
+}
+
+// RetryDeadLetter hands a dead letter to its hook again.
+func (h *Hub) RetryDeadLetter(id int64) error {
+	return h.persist.Retry(id)
+}
+
+// DiscardDeadLetter deletes a dead letter without retrying it.
+func (h *Hub) DiscardDeadLetter(id int64) error {
+	return h.persist.Discard(id)
+}
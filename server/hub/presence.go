@@ -0,0 +1,47 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"lukagolubovic/client"
+	"lukagolubovic/identity"
+)
+
+// recordPresence records every connected user but guests as seen, so
+// processes that act on offline users, such as cmd/digest, can tell who is
+// connected anywhere in the cluster, and refreshes their sessions. It runs
+// every identity.PresenceInterval.
+func (h *Hub) recordPresence(ctx context.Context) error {
+	h.mu.Lock()
+	ids := make([]int64, 0, len(h.clients))
+	clients := make([]*client.Client, 0, len(h.clients))
+	for c := range h.clients {
+		if !c.Guest {
+			ids = append(ids, c.UserID)
+			clients = append(clients, c)
+		}
+	}
+	h.mu.Unlock()
+	h.markSeen(ids...)
+	h.recordSessions(clients...)
+	return nil
+}
+
+// markSeen sets the last-seen time of users to now.
+func (h *Hub) markSeen(userIDs ...int64) {
+	if len(userIDs) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	values := make([]interface{}, 0, 2*len(userIDs))
+	for _, id := range userIDs {
+		values = append(values, id, now)
+	}
+	ctx, cancel := context.WithTimeout(h.ctx, identity.PresenceInterval/2)
+	defer cancel()
+	if err := h.redisClient.HSet(ctx, identity.LastSeenKey, values...).Err(); err != nil {
+		log.Printf("[Server %s] Failed to record presence: %v", h.address, err)
+	}
+}
@@ -0,0 +1,28 @@
+package hub
+
+import (
+	"database/sql"
+	"errors"
+
+	"lukagolubovic/client"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+// Quote returns the snapshot of a message the client replies to. It is
+// looked up in this server's database, which holds every server's messages
+// once replicated. Clients without read access can't quote what they can't
+// see.
+func (h *Hub) Quote(c *client.Client, messageID int64) (*models.Quote, error) {
+	if !c.CanRead() {
+		return nil, ErrUnknownMessage
+	}
+	msg, err := database.GetMessage(h.db, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !models.IsChat(msg.Type)) {
+		return nil, ErrUnknownMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+	return models.NewQuote(msg), nil
+}
@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"lukagolubovic/client"
+	"lukagolubovic/models"
+)
+
+const (
+	// Clients are told to wait a random delay in [reconnectDelay,
+	// 2*reconnectDelay) so an evicted server's users don't all land on the
+	// alternative at the same instant.
+	reconnectDelay = 2 * time.Second
+	evictTimeout   = 5 * time.Second
+)
+
+func (h *Hub) reconnectHint(reason, server string) []byte {
+	retryAfter := reconnectDelay + time.Duration(rand.Int63n(int64(reconnectDelay)))
+	payload, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeReconnect,
+		Username: "system",
+		Server:   h.address,
+		Reconnect: &models.Reconnect{
+			Reason:       reason,
+			RetryAfterMs: retryAfter.Milliseconds(),
+			Server:       server,
+		},
+	})
+	return payload
+}
+
+// Evict closes every local connection with a reconnect hint pointing at
+// another server, and waits up to evictTimeout for the close frames to be
+// written. Clients are spread over the other servers by load, so they don't
+// all land on one. The server should already be deregistered so the load
+// balancer doesn't list it again.
+func (h *Hub) Evict(reason string) int {
+	alternatives := h.lbClient.Alternatives(h.GetLoad())
+
+	h.mu.Lock()
+	clients := make([]*client.Client, 0, len(h.clients))
+	for c := range h.clients {
+		// Clients that connected since the count share the servers picked.
+		alternative := ""
+		if len(alternatives) > 0 {
+			alternative = alternatives[len(clients)%len(alternatives)]
+		}
+		select {
+		case c.Priority <- h.reconnectHint(reason, alternative):
+		default:
+		}
+		c.SetCloseReason(websocket.CloseServiceRestart, reason)
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		h.UnregisterClient(c)
+	}
+
+	deadline := time.After(evictTimeout)
+	for _, c := range clients {
+		select {
+		case <-c.Done():
+		case <-deadline:
+			log.Printf("[Server %s] Timed out waiting for evicted clients to close", h.address)
+			return len(clients)
+		}
+	}
+	log.Printf("[Server %s] Evicted %d clients (%s) \n", h.address, len(clients), reason)
+	return len(clients)
+}
+
+// Overloaded reports whether the server is at its configured connection cap.
+func (h *Hub) Overloaded() bool {
+	max := h.cfg.Get().MaxConnections
+	return max > 0 && h.GetLoad() >= max
+}
+
+// TurnAway sends a freshly upgraded connection a reconnect hint and closes
+// it without registering a client.
+func (h *Hub) TurnAway(conn *websocket.Conn) {
+	defer conn.Close()
+
+	hint := h.reconnectHint(models.ReconnectOverload, h.lbClient.Alternative())
+	deadline := time.Now().Add(time.Second)
+	conn.SetWriteDeadline(deadline)
+	if err := conn.WriteMessage(websocket.TextMessage, hint); err != nil {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, models.ReconnectOverload), deadline)
+}
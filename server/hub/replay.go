@@ -0,0 +1,50 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"lukagolubovic/client"
+	"lukagolubovic/database"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+)
+
+// replay queues the room's messages after the client's last seen id, so a
+// client that lost its server misses nothing by reconnecting to another
+// one. It replays at most models.MaxResync, well under the send buffer.
+// Every server stores every message, so any of them can replay. It runs
+// once the client is registered; messages broadcast meanwhile may arrive
+// twice, and clients drop ids they have already shown.
+func (h *Hub) replay(c *client.Client, after int64) {
+	messages, err := database.ArchivedMessages(context.Background(), h.db, models.DefaultRoomID, database.ArchiveQuery{After: after, Limit: models.MaxResync + 1})
+	if err != nil {
+		log.Printf("[Server %s] Failed to load messages to replay to '%s': %v", h.address, c.Username(), err)
+		return
+	}
+	if len(messages) > models.MaxResync {
+		log.Printf("[Server %s] Client '%s' missed more than %d messages, replaying the oldest %d\n", h.address, c.Username(), models.MaxResync, models.MaxResync)
+		messages = messages[:models.MaxResync]
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	for _, msg := range messages {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		c.Track(msg.ID, payload)
+		select {
+		case c.Send <- payload:
+			metrics.MessagesReplayed.Add(1)
+		default:
+			// Live traffic filled the buffer; the rest is in /history.
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+)
+
+const replicateBuffer = 1024
+
+// queueReplication hands a broadcast to replicateLoop without blocking the
+// Redis listener. If the queue is full the message is dropped here and
+// picked up later by anti-entropy.
+func (h *Hub) queueReplication(payload []byte) {
+	select {
+	case h.replicate <- payload:
+	default:
+		log.Printf("[Server %s] Replication queue full, leaving message to anti-entropy", h.address)
+	}
+}
+
+// replicateLoop stores chat and member messages written by other servers,
+// so every server's history holds the whole conversation.
+func (h *Hub) replicateLoop() {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case payload := <-h.replicate:
+			var msg models.Message
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				continue
+			}
+			if !models.IsStored(msg.Type) || msg.ID == 0 || msg.Server == h.address {
+				continue
+			}
+
+			row := database.RowFromMessage(msg)
+			err := h.writer.Tx(func(tx *sql.Tx) error {
+				_, err := database.InsertReplicated(tx, row)
+				return err
+			})
+			if err != nil {
+				log.Printf("[Server %s] Failed to store message %d from %s: %v", h.address, msg.ID, msg.Server, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/roomconfig"
+)
+
+var (
+	ErrUnknownRoom      = errors.New("unknown room")
+	ErrInvalidOverrides = errors.New("invalid room overrides")
+)
+
+// loadRoomOverrides applies the room overrides kept in Redis and caches
+// them in this server's database. Overrides cached from before Redis kept
+// them are moved there first. While Redis is unreachable the cached
+// overrides apply instead.
+func (h *Hub) loadRoomOverrides() {
+	cached, err := database.RoomOverrides(h.db)
+	if err != nil {
+		log.Printf("[Server %s] Failed to load cached room overrides: %v", h.address, err)
+	}
+	stale := make(map[string]config.RoomOverrides, len(cached))
+	for room, raw := range cached {
+		var o config.RoomOverrides
+		if err := json.Unmarshal(raw, &o); err != nil {
+			log.Printf("[Server %s] Invalid overrides cached for room '%s': %v", h.address, room, err)
+			continue
+		}
+		stale[room] = o
+	}
+	for room, o := range stale {
+		if _, err := roomconfig.Seed(h.ctx, h.redisClient, room, o); err != nil {
+			// Sync reports Redis being unreachable.
+			break
+		}
+	}
+	all, err := roomconfig.Sync(h.ctx, h.redisClient, h.cfg)
+	if err != nil {
+		log.Printf("[Server %s] Failed to load room overrides from Redis, using the cached ones: %v", h.address, err)
+		for room, o := range stale {
+			if err := h.cfg.SetRoomOverrides(room, o); err != nil {
+				log.Printf("[Server %s] Ignoring overrides of room '%s': %v", h.address, room, err)
+			}
+		}
+		return
+	}
+	for room := range stale {
+		if _, ok := all[room]; !ok {
+			all[room] = config.RoomOverrides{}
+		}
+	}
+	for room, o := range all {
+		h.cacheRoomOverrides(room, o)
+	}
+}
+
+// ReloadRoomOverrides applies the room overrides kept in Redis again, for
+// after a config reload.
+func (h *Hub) ReloadRoomOverrides() {
+	h.loadRoomOverrides()
+}
+
+func (h *Hub) RoomOverrides(room string) (config.RoomOverrides, error) {
+	if _, err := database.GetRoom(h.db, room); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return config.RoomOverrides{}, ErrUnknownRoom
+		}
+		return config.RoomOverrides{}, err
+	}
+	return h.cfg.RoomOverrides(room), nil
+}
+
+// SetRoomOverrides replaces a room's overrides on every server. They are
+// checked against this server's configuration first, so a change that
+// can't apply is refused rather than ignored by every server.
+func (h *Hub) SetRoomOverrides(ctx context.Context, room string, o config.RoomOverrides) error {
+	return h.publishRoomOverrides(ctx, room, o, "")
+}
+
+// publishRoomOverrides stores a room's new overrides in Redis and tells
+// every server; by is the moderator who changed them, or empty for an
+// administrator.
+func (h *Hub) publishRoomOverrides(ctx context.Context, room string, o config.RoomOverrides, by string) error {
+	if _, err := h.RoomOverrides(room); err != nil {
+		return err
+	}
+	if err := h.checkRoomOverrides(o); err != nil {
+		return err
+	}
+	_, err := roomconfig.Update(ctx, h.redisClient, room, func(stored *config.RoomOverrides) error {
+		*stored = o
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return h.PublishControl(ctx, models.ControlCommand{Type: models.ControlRoomConfig, Username: by, Room: room, Overrides: raw})
+}
+
+// checkRoomOverrides refuses overrides that don't fit this server's
+// configuration.
+func (h *Hub) checkRoomOverrides(o config.RoomOverrides) error {
+	if err := o.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOverrides, err)
+	}
+	if _, err := h.cfg.Get().ForRoom(o); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOverrides, err)
+	}
+	return nil
+}
+
+// applyRoomOverrides runs on every server: each one applies the room's
+// overrides and tells its clients if slow mode changed.
+func (h *Hub) applyRoomOverrides(cmd models.ControlCommand) {
+	var o config.RoomOverrides
+	if err := json.Unmarshal(cmd.Overrides, &o); err != nil {
+		log.Printf("[Server %s] Invalid overrides for room '%s': %v", h.address, cmd.Room, err)
+		return
+	}
+	before := h.cfg.Room(cmd.Room)
+	if !h.applyRoomChange(cmd.Room, func(current *config.RoomOverrides) { *current = o }) {
+		return
+	}
+	h.announceSlowMode(cmd.Room, cmd.Username, before, h.cfg.Room(cmd.Room))
+}
+
+// applyGrantModerator runs on every server: each one brings the room's
+// moderators up to date.
+func (h *Hub) applyGrantModerator(cmd models.ControlCommand) {
+	h.applyRoomChange(cmd.Room, func(o *config.RoomOverrides) { addModerator(o, cmd.Username) })
+}
+
+// addModerator adds username to the room's moderators, reporting whether
+// they weren't one already.
+func addModerator(o *config.RoomOverrides, username string) bool {
+	if slices.ContainsFunc(o.Moderators, func(m string) bool { return strings.EqualFold(m, username) }) {
+		return false
+	}
+	o.Moderators = append(slices.Clone(o.Moderators), username)
+	return true
+}
+
+// applyRoomChange applies a room's overrides after a command changed them,
+// reporting whether it could. They are read from Redis, so every server
+// ends up with the same overrides whatever order commands arrive in. If
+// Redis can't be read, the command's change is applied to the current
+// overrides instead.
+func (h *Hub) applyRoomChange(room string, change func(*config.RoomOverrides)) bool {
+	o, err := roomconfig.Refresh(h.ctx, h.redisClient, h.cfg, room)
+	if err != nil {
+		log.Printf("[Server %s] Failed to load overrides of room '%s', applying the change alone: %v", h.address, room, err)
+		if o, err = h.cfg.UpdateRoomOverrides(room, change); err != nil {
+			log.Printf("[Server %s] Failed to apply overrides of room '%s': %v", h.address, room, err)
+			return false
+		}
+	}
+	h.cacheRoomOverrides(room, o)
+	return true
+}
+
+// cacheRoomOverrides saves a room's overrides to this server's database,
+// for starting while Redis is unreachable.
+func (h *Hub) cacheRoomOverrides(room string, o config.RoomOverrides) {
+	var raw []byte
+	if !o.IsZero() {
+		var err error
+		if raw, err = json.Marshal(o); err != nil {
+			log.Printf("[Server %s] Failed to encode overrides of room '%s': %v", h.address, room, err)
+			return
+		}
+	}
+	if err := h.writer.Tx(func(tx *sql.Tx) error { return database.SaveRoomOverrides(tx, room, raw) }); err != nil {
+		log.Printf("[Server %s] Failed to save overrides of room '%s': %v", h.address, room, err)
+	}
+}
@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"lukagolubovic/client"
+	"lukagolubovic/identity"
+	"lukagolubovic/models"
+)
+
+// sessionStale is how long a session goes without a refresh before it is
+// taken for one left behind by a server that died.
+const sessionStale = 3 * identity.PresenceInterval
+
+var ErrSessionNotFound = errors.New("session not found")
+
+func sessionsKey(userID int64) string {
+	return identity.SessionsPrefix + strconv.FormatInt(userID, 10)
+}
+
+// recordSessions writes or refreshes the sessions of clients. Guests get a
+// new identity on every connection, so they have no session list.
+func (h *Hub) recordSessions(clients ...*client.Client) {
+	ctx, cancel := context.WithTimeout(h.ctx, identity.PresenceInterval/2)
+	defer cancel()
+	now := time.Now().UTC()
+	pipe := h.redisClient.Pipeline()
+	for _, c := range clients {
+		if c.Guest {
+			continue
+		}
+		raw, _ := json.Marshal(models.Session{
+			ID:          c.SessionID,
+			Server:      h.address,
+			UserAgent:   c.UserAgent,
+			RemoteAddr:  c.RemoteAddr,
+			ConnectedAt: c.ConnectedAt.UTC(),
+			LastSeen:    now,
+		})
+		pipe.HSet(ctx, sessionsKey(c.UserID), c.SessionID, raw)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[Server %s] Failed to record sessions: %v", h.address, err)
+	}
+}
+
+func (h *Hub) forgetSession(c *client.Client) {
+	ctx, cancel := context.WithTimeout(h.ctx, identity.PresenceInterval/2)
+	defer cancel()
+	if err := h.redisClient.HDel(ctx, sessionsKey(c.UserID), c.SessionID).Err(); err != nil {
+		log.Printf("[Server %s] Failed to remove session: %v", h.address, err)
+	}
+}
+
+// Sessions lists a user's connections across the cluster, oldest first.
+// Sessions that went stale are dropped on the way.
+func (h *Hub) Sessions(ctx context.Context, userID int64) ([]models.Session, error) {
+	key := sessionsKey(userID)
+	raw, err := h.redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]models.Session, 0, len(raw))
+	var stale []string
+	for id, value := range raw {
+		var s models.Session
+		if err := json.Unmarshal([]byte(value), &s); err != nil || time.Since(s.LastSeen) > sessionStale {
+			stale = append(stale, id)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	if len(stale) > 0 {
+		h.redisClient.HDel(ctx, key, stale...)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt) })
+	return sessions, nil
+}
+
+// RevokeSession closes one of a user's connections on whichever server
+// holds it, or every connection of the user when sessionID is empty. The
+// client is told not to reconnect on its own.
+func (h *Hub) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	if sessionID != "" {
+		exists, err := h.redisClient.HExists(ctx, sessionsKey(userID), sessionID).Result()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrSessionNotFound
+		}
+	}
+	return h.PublishControl(ctx, models.ControlCommand{Type: models.ControlRevokeSession, UserID: userID, Session: sessionID})
+}
+
+func (h *Hub) applyRevokeSession(cmd models.ControlCommand) {
+	h.mu.Lock()
+	var matched []*client.Client
+	for c := range h.clients {
+		if c.UserID == cmd.UserID && (cmd.Session == "" || c.SessionID == cmd.Session) {
+			c.SetCloseReason(websocket.ClosePolicyViolation, "session revoked")
+			matched = append(matched, c)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, c := range matched {
+		h.UnregisterClient(c)
+	}
+}
@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+	"lukagolubovic/roomconfig"
+)
+
+// slowModeKey marks a user who sent a message within the room's slow mode
+// interval. It expires when the user may send again, so every server in
+// the cluster enforces the same cooldown.
+func slowModeKey(room string, userID int64) string {
+	return fmt.Sprintf("chat:slowmode:%s:%d", room, userID)
+}
+
+// SlowModeWait starts the user's slow mode cooldown in the default room,
+// returning zero when they may send now, or how long they must still wait.
+func (h *Hub) SlowModeWait(ctx context.Context, userID int64) (time.Duration, error) {
+	interval := h.Config().SlowMode()
+	if interval <= 0 {
+		return 0, nil
+	}
+	key := slowModeKey(models.DefaultRoom, userID)
+	ok, err := h.redisClient.SetNX(ctx, key, 1, interval).Result()
+	if err != nil || ok {
+		return 0, err
+	}
+	wait, err := h.redisClient.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// The key may have expired in between; the next message starts a new
+	// cooldown.
+	return max(wait, 0), nil
+}
+
+// SetSlowMode changes the default room's slow mode on every server; zero
+// seconds turns it off. by is the moderator who changed it. Only the slow
+// mode of the room's overrides in Redis changes, so it never undoes a
+// concurrent change to other overrides.
+func (h *Hub) SetSlowMode(ctx context.Context, by string, seconds int) error {
+	room := models.DefaultRoom
+	_, err := roomconfig.Update(ctx, h.redisClient, room, func(o *config.RoomOverrides) error {
+		setSlowMode(o, seconds)
+		return h.checkRoomOverrides(*o)
+	})
+	if err != nil {
+		return err
+	}
+	return h.PublishControl(ctx, models.ControlCommand{Type: models.ControlSlowMode, Username: by, Room: room, Seconds: seconds})
+}
+
+// applySlowMode runs on every server: each one applies the room's
+// overrides and tells the room's clients.
+func (h *Hub) applySlowMode(cmd models.ControlCommand) {
+	before := h.cfg.Room(cmd.Room)
+	if !h.applyRoomChange(cmd.Room, func(o *config.RoomOverrides) { setSlowMode(o, cmd.Seconds) }) {
+		return
+	}
+	h.announceSlowMode(cmd.Room, cmd.Username, before, h.cfg.Room(cmd.Room))
+}
+
+func setSlowMode(o *config.RoomOverrides, seconds int) {
+	o.SlowModeSeconds = nil
+	if seconds > 0 {
+		o.SlowModeSeconds = &seconds
+	}
+}
+
+// announceSlowMode tells the room's clients that its slow mode changed.
+func (h *Hub) announceSlowMode(room, by string, before, after *config.Runtime) {
+	if room != models.DefaultRoom || before.SlowMode() == after.SlowMode() {
+		return
+	}
+	if by == "" {
+		by = "An administrator"
+	}
+	seconds := int(after.SlowMode() / time.Second)
+	content := fmt.Sprintf("%s turned slow mode off", by)
+	if seconds > 0 {
+		content = fmt.Sprintf("%s turned slow mode on: one message every %s", by, plural(seconds, "second"))
+	}
+	msg, err := json.Marshal(models.Message{
+		Type:     models.MessageTypeSlowMode,
+		Username: "system",
+		Content:  content,
+		Server:   h.address,
+		SlowMode: &models.SlowMode{Seconds: seconds},
+	})
+	if err != nil {
+		log.Printf("[Server %s] Failed to encode slow mode change: %v", h.address, err)
+		return
+	}
+	h.broadcast(msg)
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
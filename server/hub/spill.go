@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"lukagolubovic/metrics"
+	"lukagolubovic/spill"
+)
+
+const (
+	// spillReplayInterval is how often waiting spilled publishes are
+	// retried.
+	spillReplayInterval = time.Second
+	// seenCapacity is how many recent message and command ids dispatch
+	// remembers to drop repeats.
+	seenCapacity = 10000
+)
+
+// OpenSpill keeps control commands that can't be published to Redis in
+// the append-only file at path, replaying them once Redis is back. Without
+// it they fail. Call it before Run.
+func (h *Hub) OpenSpill(path string) error {
+	q, err := spill.Open(path)
+	if err != nil {
+		return err
+	}
+	h.spill = q
+	if n := q.Pending(); n > 0 {
+		log.Printf("[Server %s] %d spilled publishes left from the last run", h.address, n)
+	}
+	return nil
+}
+
+// publishOrSpill publishes payload to channel, or spills it while Redis is
+// unreachable. spilled reports that it was kept for later.
+func (h *Hub) publishOrSpill(ctx context.Context, channel string, payload []byte) (spilled bool, err error) {
+	if h.spill == nil {
+		return false, h.redisPublish(ctx, channel, payload)
+	}
+	spilled, err = h.spill.Publish(ctx, spill.Entry{Channel: channel, Payload: payload}, h.publishEntry)
+	if spilled && err == nil {
+		metrics.Spillover.Add("spilled", 1)
+	}
+	return spilled, err
+}
+
+func (h *Hub) publishEntry(ctx context.Context, e spill.Entry) error {
+	return h.redisPublish(ctx, e.Channel, e.Payload)
+}
+
+// replaySpill retries the spilled publishes until the hub stops. Failures
+// aren't logged; the Redis circuit breaker logs the outage once.
+func (h *Hub) replaySpill() {
+	ticker := time.NewTicker(spillReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			if err := h.spill.Close(); err != nil {
+				log.Printf("[Server %s] Failed to close the spill file: %v", h.address, err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if h.spill.Pending() == 0 {
+			continue
+		}
+		n, _ := h.spill.Replay(h.ctx, h.publishEntry)
+		if n > 0 {
+			metrics.Spillover.Add("replayed", int64(n))
+			log.Printf("[Server %s] Replayed %d spilled publishes, %d left", h.address, n, h.spill.Pending())
+		}
+	}
+}
+
+// seenIDs remembers the most recent message and control command ids this
+// server handled, so copies published again by the outbox relay or a spill
+// replay after an outage, or delivered here early while Redis was down,
+// are handled once.
+type seenIDs struct {
+	mu    sync.Mutex
+	ids   map[int64]struct{}
+	order []int64
+	next  int
+}
+
+func newSeenIDs() *seenIDs {
+	return &seenIDs{ids: make(map[int64]struct{}), order: make([]int64, seenCapacity)}
+}
+
+// add records id and reports whether it is new. Zero ids are always new.
+func (s *seenIDs) add(id int64) bool {
+	if id == 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	delete(s.ids, s.order[s.next])
+	s.order[s.next] = id
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[id] = struct{}{}
+	return true
+}
@@ -0,0 +1,36 @@
+package hub
+
+import "log"
+
+const tailBuffer = 256
+
+// Tail subscribes to every message this server receives from the broadcast
+// channel, without registering as a chat client. Slow subscribers miss
+// messages rather than holding up delivery. The returned function must be
+// called to unsubscribe.
+func (h *Hub) Tail() (<-chan []byte, func()) {
+	ch := make(chan []byte, tailBuffer)
+
+	h.tailMu.Lock()
+	h.tails[ch] = struct{}{}
+	h.tailMu.Unlock()
+
+	return ch, func() {
+		h.tailMu.Lock()
+		delete(h.tails, ch)
+		h.tailMu.Unlock()
+	}
+}
+
+func (h *Hub) publishTail(payload []byte) {
+	h.tailMu.Lock()
+	defer h.tailMu.Unlock()
+
+	for ch := range h.tails {
+		select {
+		case ch <- payload:
+		default:
+			log.Printf("[Server %s] Tail subscriber is behind, dropping message", h.address)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/markup"
+	"lukagolubovic/models"
+)
+
+// templatesKey is a hash of message templates by name, shared by every
+// server.
+const templatesKey = "chat:templates"
+
+// maxTemplateContent is the protocol's limit on message content; the
+// rendered message must fit it too.
+const maxTemplateContent = 512
+
+var (
+	templateName     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	templateVariable = regexp.MustCompile(`\{([a-z][a-z0-9_]*)\}`)
+)
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrInvalidTemplate  = errors.New("invalid template")
+	ErrTemplateValues   = errors.New("invalid template variables")
+	ErrInvalidSender    = errors.New("invalid sender")
+	ErrSenderBlocked    = errors.New("sender is banned or muted")
+)
+
+// Template is a reusable message for bots and support integrations. Its
+// content names variables in braces, e.g. "Ticket {ticket} is {status}",
+// which are filled in when it is sent.
+type Template struct {
+	Name        string    `json:"name"`
+	Content     string    `json:"content"`
+	Description string    `json:"description,omitempty"`
+	Variables   []string  `json:"variables"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// variables lists the distinct variables content uses, in order of first
+// use.
+func variables(content string) []string {
+	vars := []string{}
+	seen := make(map[string]bool)
+	for _, m := range templateVariable.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			vars = append(vars, m[1])
+		}
+	}
+	return vars
+}
+
+func (t Template) render(values map[string]string) (string, error) {
+	for name := range values {
+		if !slices.Contains(t.Variables, name) {
+			return "", fmt.Errorf("%w: template %s has no variable %q", ErrTemplateValues, t.Name, name)
+		}
+	}
+	var missing []string
+	for _, name := range t.Variables {
+		if _, ok := values[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: missing %s", ErrTemplateValues, strings.Join(missing, ", "))
+	}
+	content := templateVariable.ReplaceAllStringFunc(t.Content, func(v string) string {
+		return values[v[1:len(v)-1]]
+	})
+	if strings.TrimSpace(content) == "" {
+		return "", fmt.Errorf("%w: the message is empty", ErrTemplateValues)
+	}
+	return content, nil
+}
+
+func (h *Hub) Templates(ctx context.Context) ([]Template, error) {
+	raw, err := h.redisClient.HGetAll(ctx, templatesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]Template, 0, len(raw))
+	for _, value := range raw {
+		var t Template
+		if err := json.Unmarshal([]byte(value), &t); err != nil {
+			continue
+		}
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (h *Hub) Template(ctx context.Context, name string) (Template, error) {
+	var t Template
+	raw, err := h.redisClient.HGet(ctx, templatesKey, name).Bytes()
+	if err == redis.Nil {
+		return t, ErrTemplateNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(raw, &t)
+	return t, err
+}
+
+// SetTemplate creates or replaces a template.
+func (h *Hub) SetTemplate(ctx context.Context, name, content, description string) (Template, error) {
+	switch {
+	case !templateName.MatchString(name):
+		return Template{}, fmt.Errorf("%w: names are 1 to 64 lowercase letters, digits, - and _", ErrInvalidTemplate)
+	case strings.TrimSpace(content) == "":
+		return Template{}, fmt.Errorf("%w: content is required", ErrInvalidTemplate)
+	case len(content) > maxTemplateContent:
+		return Template{}, fmt.Errorf("%w: content must be at most %d bytes", ErrInvalidTemplate, maxTemplateContent)
+	case len(description) > maxTemplateContent:
+		return Template{}, fmt.Errorf("%w: description must be at most %d bytes", ErrInvalidTemplate, maxTemplateContent)
+	}
+	t := Template{
+		Name:        name,
+		Content:     content,
+		Description: description,
+		Variables:   variables(content),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	raw, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+	return t, h.redisClient.HSet(ctx, templatesKey, name, raw).Err()
+}
+
+func (h *Hub) DeleteTemplate(ctx context.Context, name string) error {
+	n, err := h.redisClient.HDel(ctx, templatesKey, name).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// SendTemplate posts a template to the default room as username, filling
+// in values.
+func (h *Hub) SendTemplate(ctx context.Context, name, username string, values map[string]string) (models.Message, error) {
+	t, err := h.Template(ctx, name)
+	if err != nil {
+		return models.Message{}, err
+	}
+	content, err := t.render(values)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if limit := h.Config().ContentLimit(maxTemplateContent); len(content) > limit {
+		return models.Message{}, fmt.Errorf("%w: the message is %d bytes, the room allows at most %d", ErrTemplateValues, len(content), limit)
+	}
+	return h.postAs(ctx, username, models.Message{Content: content})
+}
+
+// postAs posts msg to the default room as username, for bots and
+// integrations using the admin API. The sender goes through the checks a
+// chat client gets: its name must be allowed, and it must be neither
+// banned nor muted. The content is censored and formatted.
+func (h *Hub) postAs(ctx context.Context, username string, msg models.Message) (models.Message, error) {
+	cfg := h.Config()
+	if err := cfg.Usernames.Check(username); err != nil {
+		return models.Message{}, fmt.Errorf("%w: %v", ErrInvalidSender, err)
+	}
+	userID, username, err := h.ResolveUser(username)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if h.IsBanned(userID) || h.IsMuted(userID) {
+		return models.Message{}, ErrSenderBlocked
+	}
+
+	msg.ID = h.NextMessageID()
+	msg.UserID = userID
+	msg.Username = username
+	msg.Server = h.address
+	msg.Content, msg.Entities = markup.Parse(cfg.Censor(msg.Content))
+	return msg, h.SaveMessage(ctx, msg)
+}
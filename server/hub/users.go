@@ -0,0 +1,261 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/client"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/identity"
+	"lukagolubovic/models"
+)
+
+// Identities live in Redis (see package identity). Each server mirrors the
+// names it sees into its local users table so history can show a user's
+// current name.
+const (
+	userIDsKey    = identity.UserIDsKey
+	usernamesKey  = identity.UsernamesKey
+	collisionsKey = identity.CollisionsKey
+)
+
+// legacyUserKeys maps the names the identity hashes had before they were
+// hash-tagged to their current names.
+var legacyUserKeys = map[string]string{
+	"chat:user-ids":  userIDsKey,
+	"chat:usernames": usernamesKey,
+}
+
+// guestAttempts bounds how many random guest names NewGuest tries before
+// giving up on a crowded namespace.
+const guestAttempts = 8
+
+var ErrUsernameTaken = errors.New("username already taken")
+
+// renameScript moves a user's name only if the new name is free and the old
+// name still belongs to that user. ARGV[1] and ARGV[2] are the normalized
+// old and new names, ARGV[4] the new name as typed; a change of case only
+// updates the latter.
+var renameScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[3] then
+	return -1
+end
+if ARGV[1] ~= ARGV[2] then
+	if redis.call("HEXISTS", KEYS[1], ARGV[2]) == 1 then
+		return 0
+	end
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("HSET", KEYS[1], ARGV[2], ARGV[3])
+end
+redis.call("HSET", KEYS[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+// ResolveUser returns the stable id for username, allocating one the first
+// time the name is seen anywhere in the cluster, along with the name as the
+// user first registered it.
+func (h *Hub) ResolveUser(username string) (int64, string, error) {
+	userID, username, err := identity.Resolve(h.ctx, h.redisClient, h.idGen.Next(), username)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := h.writer.Tx(func(tx *sql.Tx) error { return database.SaveUser(tx, userID, username) }); err != nil {
+		log.Printf("[Server %s] Failed to save user '%s': %v", h.address, username, err)
+	}
+	return userID, username, nil
+}
+
+// NewGuest allocates an unused guest name and a fresh id for it. The name is
+// freed again by ReleaseGuest once the guest disconnects.
+func (h *Hub) NewGuest() (int64, string, error) {
+	for i := 0; i < guestAttempts; i++ {
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, "", err
+		}
+		username := config.GuestPrefix + hex.EncodeToString(b[:])
+		userID := h.idGen.Next()
+		created, err := h.redisClient.HSetNX(h.ctx, userIDsKey, username, userID).Result()
+		if err != nil {
+			return 0, "", err
+		}
+		if !created {
+			continue
+		}
+		if err := h.redisClient.HSet(h.ctx, usernamesKey, userID, username).Err(); err != nil {
+			return 0, "", err
+		}
+		if err := h.writer.Tx(func(tx *sql.Tx) error { return database.SaveUser(tx, userID, username) }); err != nil {
+			log.Printf("[Server %s] Failed to save guest '%s': %v", h.address, username, err)
+		}
+		return userID, username, nil
+	}
+	return 0, "", errors.New("no free guest name")
+}
+
+// ReleaseGuest frees a guest name for reuse. The id keeps the name in
+// usernamesKey so history still shows who wrote what.
+func (h *Hub) ReleaseGuest(username string) {
+	if err := h.redisClient.HDel(h.ctx, userIDsKey, config.NormalizeUsername(username)).Err(); err != nil {
+		log.Printf("[Server %s] Failed to release guest '%s': %v", h.address, username, err)
+	}
+}
+
+func (h *Hub) RenameUser(ctx context.Context, userID int64, oldName, newName string) error {
+	keys := []string{userIDsKey, usernamesKey}
+	res, err := renameScript.Run(ctx, h.redisClient, keys, config.NormalizeUsername(oldName), config.NormalizeUsername(newName), userID, newName).Int()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case 0:
+		return ErrUsernameTaken
+	case -1:
+		return fmt.Errorf("user %d is no longer named '%s'", userID, oldName)
+	}
+
+	return h.PublishControl(ctx, models.ControlCommand{
+		Type:        models.ControlRename,
+		UserID:      userID,
+		Username:    oldName,
+		NewUsername: newName,
+	})
+}
+
+func (h *Hub) applyRename(cmd models.ControlCommand) {
+	if err := h.writer.Tx(func(tx *sql.Tx) error { return database.SaveUser(tx, cmd.UserID, cmd.NewUsername) }); err != nil {
+		log.Printf("[Server %s] Failed to save rename of user %d: %v", h.address, cmd.UserID, err)
+	}
+
+	h.mu.Lock()
+	for c := range h.clients {
+		if c.UserID == cmd.UserID {
+			c.SetUsername(cmd.NewUsername)
+		}
+	}
+	h.mu.Unlock()
+
+	msg, _ := json.Marshal(models.Message{
+		Type:     models.MessageTypeRename,
+		UserID:   cmd.UserID,
+		Username: cmd.NewUsername,
+		Content:  fmt.Sprintf("%s is now known as %s", cmd.Username, cmd.NewUsername),
+		Server:   h.address,
+	})
+	h.broadcast(msg)
+}
+
+// Deliver sends payload to a single local client, if it is still connected.
+func (h *Hub) Deliver(c *client.Client, payload []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	select {
+	case lane(c, messageID(payload)) <- payload:
+	default:
+	}
+}
+
+// migrateUserKeys renames identity hashes written under their legacy names,
+// then normalizes the names they are keyed by.
+func (h *Hub) migrateUserKeys() {
+	// Clusters never had the legacy keys, and the rename would cross slots
+	// there anyway.
+	if _, ok := h.redisClient.(*redis.ClusterClient); ok {
+		h.normalizeUserKeys()
+		return
+	}
+	for legacy, key := range legacyUserKeys {
+		renamed, err := h.redisClient.RenameNX(h.ctx, legacy, key).Result()
+		if err != nil {
+			if err.Error() != "ERR no such key" {
+				log.Printf("[Server %s] Failed to migrate %s to %s: %v", h.address, legacy, key, err)
+			}
+			continue
+		}
+		if renamed {
+			log.Printf("[Server %s] Migrated %s to %s\n", h.address, legacy, key)
+		}
+	}
+	h.normalizeUserKeys()
+}
+
+// normalizeUserKeys rekeys ids stored before names were normalized. When
+// users differ only in case, a user already under the normalized name keeps
+// it, and otherwise the one registered first. Every server picks the same
+// owner, whatever order it reads the hash in. The other users' names are
+// moved to collisionsKey and reported for an operator to resolve.
+func (h *Hub) normalizeUserKeys() {
+	ids, err := h.redisClient.HGetAll(h.ctx, userIDsKey).Result()
+	if err != nil {
+		log.Printf("[Server %s] Failed to read %s: %v", h.address, userIDsKey, err)
+		return
+	}
+	legacy := make(map[string][]string)
+	for name := range ids {
+		if key := config.NormalizeUsername(name); key != name {
+			legacy[key] = append(legacy[key], name)
+		}
+	}
+	for key, names := range legacy {
+		// Ids grow over time, so the lowest was registered first.
+		sort.Slice(names, func(i, j int) bool { return idOrder(ids[names[i]]) < idOrder(ids[names[j]]) })
+		for _, name := range names {
+			h.normalizeUserKey(name, key, ids[name])
+		}
+	}
+}
+
+// normalizeUserKey moves name's id to key, unless another user holds key.
+func (h *Hub) normalizeUserKey(name, key, id string) {
+	if err := h.redisClient.HSetNX(h.ctx, userIDsKey, key, id).Err(); err != nil {
+		log.Printf("[Server %s] Failed to normalize user '%s': %v", h.address, name, err)
+		return
+	}
+	owner, err := h.redisClient.HGet(h.ctx, userIDsKey, key).Result()
+	if err != nil {
+		log.Printf("[Server %s] Failed to normalize user '%s': %v", h.address, name, err)
+		return
+	}
+	if owner != id {
+		_, err := h.redisClient.TxPipelined(h.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(h.ctx, collisionsKey, name, id)
+			pipe.HDel(h.ctx, userIDsKey, name)
+			return nil
+		})
+		if err != nil {
+			log.Printf("[Server %s] Failed to record the collision of user '%s': %v", h.address, name, err)
+			return
+		}
+		log.Printf("[Server %s] User '%s' (%s) collides with user %s under '%s'; moved to %s", h.address, name, id, owner, key, collisionsKey)
+		return
+	}
+	if err := h.redisClient.HDel(h.ctx, userIDsKey, name).Err(); err != nil {
+		log.Printf("[Server %s] Failed to normalize user '%s': %v", h.address, name, err)
+	}
+}
+
+// idOrder sorts an id read from Redis; ids that don't parse sort last.
+func idOrder(id string) int64 {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return n
+}
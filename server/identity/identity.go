@@ -0,0 +1,91 @@
+// Package identity maps usernames to the stable user ids shared by the whole
+// cluster. Redis is the source of truth for them, since every chat server
+// keeps its own SQLite database.
+package identity
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+)
+
+// UserIDsKey is keyed by the normalized name, so names differing only in
+// case resolve to the same user; UsernamesKey keeps the name as first typed.
+// Scripts touch both hashes, so they share the {users} hash tag to land in
+// the same Redis Cluster slot.
+const (
+	UserIDsKey   = "chat:{users}:user-ids"
+	UsernamesKey = "chat:{users}:usernames"
+)
+
+// CollisionsKey maps legacy names that could not be lowercased, because
+// another user already holds the name in another case, to the ids they
+// belonged to, for an operator to resolve.
+const CollisionsKey = "chat:{users}:collisions"
+
+// BannedKey and MutedKey are sets of the ids of banned and muted users.
+const (
+	BannedKey = "chat:banned-ids"
+	MutedKey  = "chat:muted-ids"
+)
+
+// LastSeenKey is a hash of user ids to the Unix time they were last
+// connected. Servers refresh it every PresenceInterval while a user is
+// connected, so a user seen longer ago than that is offline.
+const (
+	LastSeenKey      = "chat:{users}:last-seen"
+	PresenceInterval = time.Minute
+)
+
+// SessionsPrefix starts the keys of the hashes of a user's connections by
+// session id, followed by the user id. Servers refresh their sessions every
+// PresenceInterval, so entries left behind by a crashed server go stale.
+const SessionsPrefix = "chat:{users}:sessions:"
+
+// MembersPrefix starts the keys of the sets of user ids allowed into
+// invite-only rooms, followed by the room name.
+const MembersPrefix = "chat:{rooms}:members:"
+
+// JoinedPrefix starts the keys of the sets of user ids that have joined a
+// room at least once, followed by the room name.
+const JoinedPrefix = "chat:{rooms}:joined:"
+
+// JoinedAtPrefix starts the keys of the sorted sets of a room's current
+// members, user ids scored by when they joined in Unix milliseconds,
+// followed by the room name. Unlike JoinedPrefix, members leave it when
+// they leave the room or are kicked.
+const JoinedAtPrefix = "chat:{rooms}:joined-at:"
+
+// Resolve returns the stable id for username, claiming newID for it the
+// first time the name is seen anywhere in the cluster, along with the name
+// as the user first registered it.
+func Resolve(ctx context.Context, rdb redis.UniversalClient, newID int64, username string) (int64, string, error) {
+	key := config.NormalizeUsername(username)
+	created, err := rdb.HSetNX(ctx, UserIDsKey, key, newID).Result()
+	if err != nil {
+		return 0, "", err
+	}
+	if created {
+		if err := rdb.HSet(ctx, UsernamesKey, newID, username).Err(); err != nil {
+			return 0, "", err
+		}
+		return newID, username, nil
+	}
+
+	userID, err := rdb.HGet(ctx, UserIDsKey, key).Int64()
+	if err != nil {
+		return 0, "", err
+	}
+	stored, err := rdb.HGet(ctx, UsernamesKey, strconv.FormatInt(userID, 10)).Result()
+	if err != nil && err != redis.Nil {
+		return 0, "", err
+	}
+	if stored != "" {
+		username = stored
+	}
+	return userID, username, nil
+}
@@ -0,0 +1,134 @@
+package idgen
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// NodeKeyPrefix starts the keys claiming node ids, followed by the node id.
+// Each holds the token of the process using the node.
+const NodeKeyPrefix = "chat:idgen:node:"
+
+// nodeTTL is how long a claim outlives its holder; holders refresh it
+// every nodeTTL/3.
+const nodeTTL = 30 * time.Second
+
+var ErrNoFreeNode = errors.New("every node id is claimed")
+
+// refreshScript extends the caller's claim, or takes the node again if the
+// claim expired meanwhile. It returns 0 if another process holds the node.
+var refreshScript = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if holder == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Claim makes the node id unique among live processes sharing rdb: it
+// takes the node New picked if no other process holds it, and otherwise
+// the next free one. Processes hashing to the same node would otherwise
+// issue the same ids, and duplicates are dropped as already seen. Call it
+// before issuing ids, and Hold to keep the claim.
+func (g *Generator) Claim(ctx context.Context, rdb redis.UniversalClient, owner string) error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rdb = rdb
+	g.owner = owner
+	g.token = owner + "/" + hex.EncodeToString(b[:])
+	return g.claimFrom(ctx, g.node)
+}
+
+// claimFrom claims the first free node from start on. The caller holds mu.
+func (g *Generator) claimFrom(ctx context.Context, start int64) error {
+	for i := int64(0); i <= maxNode; i++ {
+		node := (start + i) & maxNode
+		ok, err := g.rdb.SetNX(ctx, nodeKey(node), g.token, nodeTTL).Result()
+		if err != nil {
+			return fmt.Errorf("claim node id %d: %w", node, err)
+		}
+		if ok {
+			if node != g.node {
+				log.Printf("[IDGen] %s uses node id %d; %d is taken", g.owner, node, g.node)
+			}
+			g.node = node
+			return nil
+		}
+	}
+	return ErrNoFreeNode
+}
+
+// Hold refreshes the claim until ctx ends, then releases it. If another
+// process took the node meanwhile, after an outage longer than the claim,
+// it claims a free node instead. Without a claim it returns at once.
+func (g *Generator) Hold(ctx context.Context) {
+	if g.rdb == nil {
+		return
+	}
+	ticker := time.NewTicker(nodeTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			g.release()
+			return
+		case <-ticker.C:
+			g.refresh(ctx)
+		}
+	}
+}
+
+func (g *Generator) refresh(ctx context.Context) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	held, err := refreshScript.Run(ctx, g.rdb, []string{nodeKey(g.node)}, g.token, nodeTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("[IDGen] failed to refresh the claim on node id %d: %v", g.node, err)
+		return
+	}
+	if held == 1 {
+		return
+	}
+	log.Printf("[IDGen] node id %d was claimed by another process; claiming another", g.node)
+	if err := g.claimFrom(ctx, g.node+1); err != nil {
+		log.Printf("[IDGen] failed to claim a node id: %v", err)
+	}
+}
+
+func (g *Generator) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := releaseScript.Run(ctx, g.rdb, []string{nodeKey(g.node)}, g.token).Err(); err != nil {
+		log.Printf("[IDGen] failed to release node id %d: %v", g.node, err)
+	}
+}
+
+func nodeKey(node int64) string {
+	return NodeKeyPrefix + strconv.FormatInt(node, 10)
+}
@@ -0,0 +1,93 @@
+package idgen
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Snowflake-style layout: 41 bits of milliseconds since epoch, 10 bits of
+// node id and 12 bits of per-millisecond sequence.
+const (
+	epoch        int64 = 1735689600000 // 2025-01-01T00:00:00Z
+	nodeBits           = 10
+	sequenceBits       = 12
+	maxNode            = -1 ^ (-1 << nodeBits)
+	maxSequence        = -1 ^ (-1 << sequenceBits)
+	nodeShift          = sequenceBits
+)
+
+// TimeShift is how far an id's milliseconds are shifted left; the bits
+// below hold the node id and sequence.
+const TimeShift = sequenceBits + nodeBits
+
+type Generator struct {
+	mu       sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+	// rdb, owner and token are set once the node is claimed; see Claim.
+	rdb   redis.UniversalClient
+	owner string
+	token string
+}
+
+// New returns a generator whose node id is a hash of address. Hashes of
+// different addresses can collide, so processes sharing a cluster should
+// Claim their node.
+func New(address string) *Generator {
+	h := fnv.New32a()
+	h.Write([]byte(address))
+	return &Generator{
+		node: int64(h.Sum32()) & maxNode,
+	}
+}
+
+func (g *Generator) Node() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.node
+}
+
+func (g *Generator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	if now < g.lastMs {
+		// Clock moved backwards; keep issuing ids from the last seen
+		// millisecond so ordering is preserved.
+		now = g.lastMs
+	}
+
+	if now == g.lastMs {
+		g.sequence = (g.sequence + 1) & maxSequence
+		if g.sequence == 0 {
+			for now <= g.lastMs {
+				time.Sleep(time.Millisecond)
+				now = time.Now().UnixMilli()
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = now
+
+	return (now-epoch)<<TimeShift | g.node<<nodeShift | g.sequence
+}
+
+func Time(id int64) time.Time {
+	return time.UnixMilli((id >> TimeShift) + epoch)
+}
+
+// MinID is the smallest id that could have been issued at t, for range
+// queries over the time-ordered primary key.
+func MinID(t time.Time) int64 {
+	ms := t.UnixMilli() - epoch
+	if ms < 0 {
+		return 0
+	}
+	return ms << TimeShift
+}
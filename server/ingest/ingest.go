@@ -0,0 +1,139 @@
+// Package ingest publishes messages that come from outside the chat
+// servers, through bridges and gateways, to the default room. It applies
+// the rules a chat server applies to its own clients: bans and mutes,
+// banned words and formatting. The message is published to the room's
+// Redis channel under the publisher's source as its server, so every chat
+// server broadcasts it and stores it as replicated.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/authtoken"
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/identity"
+	"lukagolubovic/idgen"
+	"lukagolubovic/markup"
+	"lukagolubovic/models"
+	"lukagolubovic/roomconfig"
+)
+
+var (
+	ErrBanned = errors.New("user is banned")
+	ErrMuted  = errors.New("user is muted")
+	// ErrToken is returned by Authenticate when tokens are required and
+	// the one given doesn't admit the user.
+	ErrToken = errors.New("token required")
+)
+
+type Publisher struct {
+	rdb    redis.UniversalClient
+	cfg    *config.Store
+	source string
+	idGen  *idgen.Generator
+}
+
+// New returns a publisher whose messages carry source as their server,
+// e.g. "bridge:slack". Consumers use it to skip their own messages.
+func New(rdb redis.UniversalClient, cfg *config.Store, source string) *Publisher {
+	return &Publisher{rdb: rdb, cfg: cfg, source: source, idGen: idgen.New(source)}
+}
+
+func (p *Publisher) Source() string {
+	return p.source
+}
+
+// ClaimNode claims the publisher's id generator node in Redis, so no other
+// process issues the same ids, and HoldNode keeps it until ctx ends. See
+// idgen.Generator.Claim.
+func (p *Publisher) ClaimNode(ctx context.Context) error {
+	return p.idGen.Claim(ctx, p.rdb, p.source)
+}
+
+func (p *Publisher) HoldNode(ctx context.Context) {
+	p.idGen.Hold(ctx)
+}
+
+// FollowRooms keeps the room overrides the publisher applies, such as a
+// room's banned words, up to date with those in Redis until ctx ends.
+func (p *Publisher) FollowRooms(ctx context.Context) {
+	roomconfig.Follow(ctx, p.rdb, p.cfg)
+}
+
+// NextID returns a new message id, for callers that need to know a
+// message's id before it is published.
+func (p *Publisher) NextID() int64 {
+	return p.idGen.Next()
+}
+
+// Login resolves username to its cluster identity, returning the name as
+// first registered. Banned users get ErrBanned.
+func (p *Publisher) Login(ctx context.Context, username string) (int64, string, error) {
+	userID, name, err := identity.Resolve(ctx, p.rdb, p.idGen.Next(), username)
+	if err != nil {
+		return 0, "", err
+	}
+	banned, err := p.rdb.SIsMember(ctx, identity.BannedKey, userID).Result()
+	if err != nil {
+		return 0, "", err
+	}
+	if banned {
+		return 0, "", ErrBanned
+	}
+	return userID, name, nil
+}
+
+// Authenticate is Login for gateways whose users sign in themselves. With
+// tokens.required, token must be a valid access token for username that
+// allows sending to the room, as on /ws; otherwise it is ignored.
+func (p *Publisher) Authenticate(ctx context.Context, username, token string) (int64, string, error) {
+	if tokens := p.cfg.Get().Tokens; tokens.Required {
+		claims, err := authtoken.Verify([]byte(tokens.Secret), token, time.Now())
+		if err != nil {
+			return 0, "", fmt.Errorf("%w: %v", ErrToken, err)
+		}
+		if config.NormalizeUsername(claims.Subject) != config.NormalizeUsername(username) {
+			return 0, "", fmt.Errorf("%w: token is for another user", ErrToken)
+		}
+		if !claims.AllowsRoom(models.DefaultRoom) || !claims.Allows(authtoken.ScopeSend) {
+			return 0, "", fmt.Errorf("%w: token does not allow sending to this room", ErrToken)
+		}
+	}
+	return p.Login(ctx, username)
+}
+
+// Publish posts text to the room as id from the user. Muted users get
+// ErrMuted; a user banned since Login is refused too.
+func (p *Publisher) Publish(ctx context.Context, id, userID int64, username, text string) error {
+	for key, blockedErr := range map[string]error{identity.BannedKey: ErrBanned, identity.MutedKey: ErrMuted} {
+		blocked, err := p.rdb.SIsMember(ctx, key, userID).Result()
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return blockedErr
+		}
+	}
+
+	cfg := p.cfg.Room(models.DefaultRoom)
+	content, entities := markup.Parse(cfg.Censor(text))
+	payload, err := json.Marshal(models.Message{
+		ID:       id,
+		UserID:   userID,
+		Username: username,
+		Content:  content,
+		Server:   p.source,
+		Entities: entities,
+	})
+	if err != nil {
+		return err
+	}
+	return p.rdb.Publish(ctx, broker.Channel(models.DefaultRoom, cfg.Redis.Shards), payload).Err()
+}
@@ -0,0 +1,79 @@
+// Package invite signs and verifies room invitation tokens. A token carries
+// the invite id, the room and an optional expiry, followed by an HMAC over
+// them, so any server holding the shared secret can check it without a
+// lookup. Usage counts and revocation live with the invite in Redis.
+package invite
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("invalid invite token")
+	ErrExpired = errors.New("invite has expired")
+)
+
+// Claims is the signed part of a token.
+type Claims struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// Expires is a Unix timestamp; zero never expires.
+	Expires int64 `json:"exp,omitempty"`
+}
+
+// NewID returns a random invite id.
+func NewID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Sign encodes c as "<payload>.<signature>", both base64url.
+func Sign(secret []byte, c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac(secret, encoded)), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+func Verify(secret []byte, token string, now time.Time) (Claims, error) {
+	var c Claims
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, ErrInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(secret, encoded)) {
+		return c, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return c, ErrInvalid
+	}
+	if err := json.Unmarshal(payload, &c); err != nil || c.ID == "" || c.Room == "" {
+		return c, ErrInvalid
+	}
+	if c.Expires != 0 && now.Unix() >= c.Expires {
+		return c, ErrExpired
+	}
+	return c, nil
+}
+
+func mac(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -3,46 +3,194 @@ package loadbalancer
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-)
+	"sync/atomic"
+	"time"
 
-const lbURL = "http://127.0.0.1:9000"
+	"lukagolubovic/balancer"
+)
 
 type Client struct {
-	address string
+	lbURL        string
+	secret       string
+	address      string
+	adminAddress string
+	transport    http.RoundTripper
+	registered   atomic.Bool
+	// drained is set by Deregister; a drained server never registers
+	// again.
+	drained   atomic.Bool
+	rejoining atomic.Bool
+	// load is the load last reported, sent again when re-registering.
+	load atomic.Int64
+	// alternatives is the server list Alternative picks from.
+	alternatives alternatives
 }
 
-func New(address string) *Client {
+// maxRejoinWait caps the wait between attempts to register again.
+const maxRejoinWait = 30 * time.Second
+
+// New creates a client registering address with the load balancer at lbURL.
+// secret is the load balancer's -auth-secret, or empty. adminAddress is the
+// server's separate control-plane URL, or empty. transport carries the
+// client certificate under mutual TLS and may be nil.
+func New(lbURL, secret, address, adminAddress string, transport http.RoundTripper) *Client {
 	return &Client{
-		address: address,
+		lbURL:        lbURL,
+		secret:       secret,
+		address:      address,
+		adminAddress: adminAddress,
+		transport:    transport,
 	}
 }
 
+func (c *Client) Registered() bool {
+	return c.registered.Load()
+}
+
 func (c *Client) Register() {
-	payload := map[string]interface{}{
-		"address": c.address,
-		"load":    0,
+	if err := c.register(); err != nil {
+		log.Fatalf("[Server %s] Failed to register with LB: %v", c.address, err)
 	}
-	b, _ := json.Marshal(payload)
-	resp, err := http.Post(lbURL+"/register", "application/json", bytes.NewReader(b))
+	log.Printf("[Server %s] Successfully registered with Load Balancer\n", c.address)
+}
+
+func (c *Client) register() error {
+	resp, err := c.post("/register", int(c.load.Load()), "")
 	if err != nil {
-		log.Fatalf("[Server %s] Failed to register with LB: %v", c.address, err)
+		return err
 	}
 	resp.Body.Close()
-	log.Printf("[Server %s] Successfully registered with Load Balancer\n", c.address)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("load balancer rejected registration: %s", resp.Status)
+	}
+	c.registered.Store(true)
+	return nil
 }
 
-func (c *Client) UpdateLoad(load int) {
-	payload := map[string]interface{}{
-		"address": c.address,
-		"load":    load,
+// Rejoin is for a load balancer that announced it is going away: the
+// server no longer counts as registered, and registers again with its last
+// load in the background, retrying with backoff until a load balancer at
+// the same URL accepts it. A drained server stays out.
+func (c *Client) Rejoin() {
+	if c.drained.Load() || !c.rejoining.CompareAndSwap(false, true) {
+		return
 	}
-	b, _ := json.Marshal(payload)
-	resp, err := http.Post(lbURL+"/update", "application/json", bytes.NewReader(b))
+	c.registered.Store(false)
+	log.Printf("[Server %s] Load balancer is shutting down, registering again once it is back\n", c.address)
+	go func() {
+		defer c.rejoining.Store(false)
+		wait := time.Second
+		for !c.drained.Load() {
+			time.Sleep(wait)
+			if err := c.register(); err != nil {
+				wait = min(2*wait, maxRejoinWait)
+				continue
+			}
+			if c.drained.Load() {
+				// Drained while registering.
+				c.Deregister()
+				return
+			}
+			log.Printf("[Server %s] Registered with Load Balancer again\n", c.address)
+			return
+		}
+	}()
+}
+
+func (c *Client) post(path string, load int, assignment string) (*http.Response, error) {
+	b, _ := json.Marshal(balancer.Registration{
+		Version:      balancer.SchemaVersion,
+		Address:      c.address,
+		Load:         load,
+		AdminAddress: c.adminAddress,
+		Assignment:   assignment,
+	})
+	req, err := c.request(http.MethodPost, path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Transport: c.transport}
+	return client.Do(req)
+}
+
+// request is a request to one of the load balancer's internal routes,
+// carrying the secret.
+func (c *Client) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.lbURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.secret)
+	}
+	return req, nil
+}
+
+// UpdateLoad reports the server's load. assignment is the load balancer's
+// assignment id of a client that just connected, or empty.
+func (c *Client) UpdateLoad(load int, assignment string) {
+	c.load.Store(int64(load))
+	if c.drained.Load() {
+		// Clients leaving a drained server must not put it back into
+		// rotation.
+		return
+	}
+	resp, err := c.post("/update", load, assignment)
 	if err != nil {
 		log.Printf("[Server %s] Failed to update load: %v\n", c.address, err)
 		return
 	}
 	resp.Body.Close()
-}
\ No newline at end of file
+}
+
+func (c *Client) Deregister() {
+	c.drained.Store(true)
+	c.registered.Store(false)
+	resp, err := c.post("/deregister", 0, "")
+	if err != nil {
+		log.Printf("[Server %s] Failed to deregister from LB: %v\n", c.address, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("[Server %s] Deregistered from Load Balancer\n", c.address)
+}
+
+// Stats fetches the cluster-wide connection figures from the load balancer.
+func (c *Client) Stats() (balancer.ClusterStats, error) {
+	var stats balancer.ClusterStats
+	client := &http.Client{Timeout: 5 * time.Second, Transport: c.transport}
+	resp, err := client.Get(c.lbURL + "/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("load balancer stats: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
+
+// Alternative picks the server a client turned away or evicted from this
+// one should try: the least loaded other server, counting the clients
+// already pointed at each. It returns "" when there is none or the load
+// balancer is unreachable. See alternatives.
+func (c *Client) Alternative() string {
+	if picked := c.alternatives.pick(c, 1); len(picked) > 0 {
+		return picked[0]
+	}
+	return ""
+}
+
+// Alternatives picks the servers for n clients leaving this one, spreading
+// them over the other servers by load as Alternative would one by one. It
+// returns nil when there is no other server or the load balancer is
+// unreachable.
+func (c *Client) Alternatives(n int) []string {
+	return c.alternatives.pick(c, n)
+}
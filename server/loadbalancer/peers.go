@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"lukagolubovic/balancer"
+)
+
+// Peers returns every other registered server.
+func (c *Client) Peers() ([]balancer.ChatServerInfo, error) {
+	req, err := c.request(http.MethodGet, "/servers", nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: c.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("load balancer servers: %s", resp.Status)
+	}
+
+	var servers []balancer.ChatServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+		return nil, err
+	}
+	peers := make([]balancer.ChatServerInfo, 0, len(servers))
+	for _, s := range servers {
+		if s.Address != c.address {
+			peers = append(peers, s)
+		}
+	}
+	return peers, nil
+}
+
+// alternativesTTL is how long Alternative reuses the server list it read.
+const alternativesTTL = 5 * time.Second
+
+// alternatives caches the other servers for Alternative. They are read from
+// /servers, which unlike /get assigns no client and isn't rate limited per
+// IP, and read again once the list is alternativesTTL old, so turning away
+// a burst of clients costs one request to the load balancer.
+type alternatives struct {
+	mu      sync.Mutex
+	fetched time.Time
+	peers   []balancer.ChatServerInfo
+	// hinted counts the clients pointed at each server since the list was
+	// read, which its load doesn't show yet.
+	hinted map[string]int
+}
+
+// pick returns the servers for n clients, each the least loaded one
+// counting the clients already pointed at it.
+func (a *alternatives) pick(c *Client, n int) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.fetched) > alternativesTTL {
+		peers, err := c.Peers()
+		if err != nil {
+			// Wait out the TTL before asking again; meanwhile clients
+			// get no suggestion.
+			peers = nil
+		}
+		a.fetched = time.Now()
+		a.peers = peers
+		a.hinted = make(map[string]int)
+	}
+	if len(a.peers) == 0 {
+		return nil
+	}
+	picked := make([]string, 0, n)
+	for range n {
+		best := ""
+		bestLoad := 0
+		for _, s := range a.peers {
+			load := s.Load + s.Pending + a.hinted[s.Address]
+			if best == "" || load < bestLoad || load == bestLoad && s.Address < best {
+				best, bestLoad = s.Address, load
+			}
+		}
+		a.hinted[best]++
+		picked = append(picked, best)
+	}
+	return picked
+}
@@ -0,0 +1,129 @@
+// Package lockout counts failed credential checks in Redis, so every server
+// sees the same counts, and locks out the client IPs and accounts that keep
+// failing. Lockouts grow exponentially with further failures, as set by the
+// config's lockout section.
+//
+// Redis being unreachable fails open: a check that can't be counted is let
+// through rather than locking everyone out. Every lockout is recorded in the
+// audit log.
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/audit"
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+)
+
+// The keys of a subject share a hash tag, so they can be deleted together
+// on a cluster.
+func failuresKey(subject string) string {
+	return "chat:lockout:{" + subject + "}:failures"
+}
+
+func untilKey(subject string) string {
+	return "chat:lockout:{" + subject + "}:until"
+}
+
+// IP is the subject of a client address.
+func IP(addr string) string {
+	return "ip:" + addr
+}
+
+// Account is the subject of a username on the given service, such as
+// "mqtt".
+func Account(service, username string) string {
+	return service + ":" + config.NormalizeUsername(username)
+}
+
+type Guard struct {
+	rdb   redis.UniversalClient
+	cfg   *config.Store
+	audit *audit.Log
+}
+
+func New(rdb redis.UniversalClient, cfg *config.Store, auditLog *audit.Log) *Guard {
+	return &Guard{rdb: rdb, cfg: cfg, audit: auditLog}
+}
+
+// Locked returns how long the longest lockout among subjects lasts, or zero
+// when none of them is locked out.
+func (g *Guard) Locked(ctx context.Context, subjects ...string) time.Duration {
+	if !g.cfg.Get().Lockout.Enabled() {
+		return 0
+	}
+	var longest time.Duration
+	for _, subject := range subjects {
+		ttl, err := g.rdb.PTTL(ctx, untilKey(subject)).Result()
+		if err != nil {
+			log.Printf("[Lockout] failed to check '%s': %v", subject, err)
+			continue
+		}
+		longest = max(longest, ttl)
+	}
+	if longest > 0 {
+		metrics.AuthFailures.Add("refused", 1)
+	}
+	return longest
+}
+
+// Fail records a failed check of kind, such as "admin_token", against each
+// subject and locks out those over the limit. It returns the longest
+// lockout started.
+func (g *Guard) Fail(ctx context.Context, kind string, subjects ...string) time.Duration {
+	c := g.cfg.Get().Lockout
+	metrics.AuthFailures.Add(kind, 1)
+	if !c.Enabled() {
+		return 0
+	}
+	window := time.Duration(c.WindowSeconds) * time.Second
+	var longest time.Duration
+	for _, subject := range subjects {
+		failures, err := g.rdb.Incr(ctx, failuresKey(subject)).Result()
+		if err != nil {
+			log.Printf("[Lockout] failed to count a failure of '%s': %v", subject, err)
+			continue
+		}
+		d := c.Duration(failures)
+		// The count outlives the lockout, so failing again right after it
+		// ends locks the subject out for longer.
+		_, err = g.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Expire(ctx, failuresKey(subject), window+d)
+			if d > 0 {
+				pipe.Set(ctx, untilKey(subject), failures, d)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[Lockout] failed to lock out '%s': %v", subject, err)
+			continue
+		}
+		if d > 0 {
+			metrics.AuthFailures.Add("locked_out", 1)
+			log.Printf("[Lockout] '%s' locked out for %s after %d failed %s checks", subject, d, failures, kind)
+			g.audit.Record(ctx, audit.Entry{
+				Type:    audit.TypeLockout,
+				Action:  "locked_out",
+				Subject: subject,
+				Detail:  fmt.Sprintf("locked out for %s after %d failed %s checks", d, failures, kind),
+			})
+		}
+		longest = max(longest, d)
+	}
+	return longest
+}
+
+// Reset forgets the failures of subjects after a successful check.
+func (g *Guard) Reset(ctx context.Context, subjects ...string) {
+	for _, subject := range subjects {
+		if err := g.rdb.Del(ctx, failuresKey(subject), untilKey(subject)).Err(); err != nil {
+			log.Printf("[Lockout] failed to reset '%s': %v", subject, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package markup
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"lukagolubovic/models"
+)
+
+// Parse strips the sanctioned markdown subset from content and returns the
+// plain text together with the formatting entities found in it:
+//
+//	**bold**  *italic*  _italic_  `code`  [text](https://example.com)
+//
+// A backslash escapes the next markup character. Spans do not nest. Entity
+// offsets and lengths are in UTF-16 code units so browser clients can slice
+// the returned text directly.
+func Parse(content string) (string, []models.Entity) {
+	p := &parser{src: []rune(content)}
+	p.run()
+	return p.out.String(), p.entities
+}
+
+type parser struct {
+	src      []rune
+	out      strings.Builder
+	offset   int
+	entities []models.Entity
+}
+
+func (p *parser) run() {
+	for i := 0; i < len(p.src); {
+		r := p.src[i]
+		switch {
+		case r == '\\' && i+1 < len(p.src) && strings.ContainsRune("\\*_`[]", p.src[i+1]):
+			p.write(p.src[i+1 : i+2])
+			i += 2
+			continue
+		case r == '`':
+			if end := p.find(i+1, "`"); end > i+1 {
+				p.span(models.EntityCode, p.src[i+1:end], "")
+				i = end + 1
+				continue
+			}
+		case r == '*' && p.at(i, "**"):
+			if end := p.find(i+2, "**"); end > i+2 && !unicode.IsSpace(p.src[i+2]) {
+				p.span(models.EntityBold, p.src[i+2:end], "")
+				i = end + 2
+				continue
+			}
+		case r == '*' || r == '_':
+			if end := p.find(i+1, string(r)); end > i+1 && !unicode.IsSpace(p.src[i+1]) && p.italicBoundary(r, i, end) {
+				p.span(models.EntityItalic, p.src[i+1:end], "")
+				i = end + 1
+				continue
+			}
+		case r == '[':
+			if mid := p.find(i+1, "]("); mid > i+1 {
+				if end := p.find(mid+2, ")"); end > mid+2 {
+					if link := string(p.src[mid+2 : end]); safeURL(link) {
+						p.span(models.EntityLink, p.src[i+1:mid], link)
+						i = end + 1
+						continue
+					}
+				}
+			}
+		}
+
+		p.write(p.src[i : i+1])
+		i++
+	}
+}
+
+// italicBoundary keeps snake_case identifiers from turning into italics.
+func (p *parser) italicBoundary(r rune, start, end int) bool {
+	if r != '_' {
+		return true
+	}
+	if start > 0 && isWord(p.src[start-1]) {
+		return false
+	}
+	return end+1 >= len(p.src) || !isWord(p.src[end+1])
+}
+
+func (p *parser) at(i int, token string) bool {
+	t := []rune(token)
+	if i+len(t) > len(p.src) {
+		return false
+	}
+	for j := range t {
+		if p.src[i+j] != t[j] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) find(from int, token string) int {
+	for i := from; i < len(p.src); i++ {
+		if p.at(i, token) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *parser) span(kind string, text []rune, link string) {
+	start := p.offset
+	p.write(text)
+	p.entities = append(p.entities, models.Entity{
+		Type:   kind,
+		Offset: start,
+		Length: p.offset - start,
+		URL:    link,
+	})
+}
+
+func (p *parser) write(text []rune) {
+	p.out.WriteString(string(text))
+	p.offset += len(utf16.Encode(text))
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
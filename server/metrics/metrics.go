@@ -0,0 +1,130 @@
+// Package metrics holds process-wide counters, published through expvar so
+// they can be scraped from /debug/vars.
+package metrics
+
+import (
+	"expvar"
+	"log"
+	"runtime/debug"
+)
+
+// PanicsRecovered counts panics caught instead of crashing the process,
+// keyed by where they happened ("http", "read_pump", "write_pump", ...).
+var PanicsRecovered = expvar.NewMap("panics_recovered")
+
+// MessageTimeouts counts inbound frames whose database or Redis work ran
+// past the per-message budget, keyed by operation ("save", "signal", ...).
+var MessageTimeouts = expvar.NewMap("message_timeouts")
+
+// MessagesRedelivered counts chat messages written again because the client
+// didn't ack them in time; MessagesUnacked counts those given up on.
+var (
+	MessagesRedelivered = expvar.NewInt("messages_redelivered")
+	MessagesUnacked     = expvar.NewInt("messages_unacked")
+)
+
+// MessagesReplayed counts messages sent again to clients reconnecting with
+// the id of the last message they saw.
+var MessagesReplayed = expvar.NewInt("messages_replayed")
+
+// JoinHooks counts the join hooks run for users joining a room for the
+// first time: "welcome_dm", "announcement", "roles", "moderator_notices",
+// and "failed".
+var JoinHooks = expvar.NewMap("join_hooks")
+
+// GIFSearches counts GIF searches by outcome: "cached", "fetched" from
+// the provider, "failed" and "rate_limited".
+var GIFSearches = expvar.NewMap("gif_searches")
+
+// Translations counts message translations by outcome: "cached",
+// "fetched" from the provider, "failed" and "rate_limited".
+var Translations = expvar.NewMap("translations")
+
+// Queries counts the database reads of requests that were "rejected"
+// because too many ran, or "timed_out".
+var Queries = expvar.NewMap("queries")
+
+// Attachments counts uploads by outcome: "stored" as a new file,
+// "deduplicated" against a stored one, "quarantined" by the scanner or
+// "over_quota"; "scan_failed" scans; "thumbnails" stored; and "purged" files, deleted
+// with their last attachment.
+var Attachments = expvar.NewMap("attachments")
+
+// AuthFailures counts failed credential checks by kind ("admin_token",
+// "mqtt_password"), lockouts started ("locked_out") and attempts refused
+// while locked out ("refused").
+var AuthFailures = expvar.NewMap("auth_failures")
+
+// WebhookDeliveries counts webhook deliveries by outcome: "delivered",
+// "retried", "failed" after the last retry, and "dropped" on a full queue.
+var WebhookDeliveries = expvar.NewMap("webhook_deliveries")
+
+// AnalyticsEvents counts analytics events by outcome: "sent", "failed"
+// when the sink refused a batch, and "dropped" on a full queue.
+var AnalyticsEvents = expvar.NewMap("analytics_events")
+
+// HubEvents counts hub events handed to in-process subscribers:
+// "delivered", and "dropped" on a full queue, also per subscriber as
+// "dropped_<name>".
+var HubEvents = expvar.NewMap("hub_events")
+
+// Persistence counts the messages handed to persistence hooks by outcome:
+// "persisted", "retried", "dead_lettered" after the last attempt or on a
+// full queue, and dead letters "redriven" by an admin.
+var Persistence = expvar.NewMap("persistence")
+
+// AdaptiveLimits counts the load samples that "tightened" or "relaxed"
+// the message limits.
+var AdaptiveLimits = expvar.NewMap("adaptive_limits")
+
+// Bandwidth counts the WebSocket message bytes read ("bytes_in") and
+// written ("bytes_out") across connections, and the messages a connection's
+// cap delayed ("throttled_in", "throttled_out").
+var Bandwidth = expvar.NewMap("bandwidth")
+
+// CircuitBreakers counts, per breaker as "<name>_<event>", the times it
+// turned "open" and "closed" again, and the calls it "rejected" while
+// open. The breakers are "redis" and "database".
+var CircuitBreakers = expvar.NewMap("circuit_breakers")
+
+// Spillover counts control commands "spilled" to the local file while
+// Redis was down, and "replayed" from it once Redis was back.
+var Spillover = expvar.NewMap("spillover")
+
+// ConnectionRTT counts ping round trips measured on WebSocket connections,
+// by duration: "under_50ms", "under_200ms", "under_1s" and "over_1s".
+var ConnectionRTT = expvar.NewMap("connection_rtt")
+
+// LBRejections counts /get requests the load balancer refused, keyed by
+// reason: "rate_limited", "blocked" and "user_agent".
+var LBRejections = expvar.NewMap("lb_rejections")
+
+// LBAssignments counts clients the load balancer sent to a server:
+// "issued" by /get, "connected" when a server reported the client by its
+// assignment id, "unattributed" when a load report covered it without one,
+// and "abandoned" when the client never showed up. "failed_over" counts the
+// connected clients that were reported by another of their candidates than
+// the first. LBTimeToConnect buckets the connected ones by the time from
+// /get to the server's report:
+// "under_250ms", "under_1s", "under_5s" and "under_10s".
+var (
+	LBAssignments   = expvar.NewMap("lb_assignments")
+	LBTimeToConnect = expvar.NewMap("lb_time_to_connect")
+)
+
+// LBHealthChecks counts the load balancer's health checks of servers that
+// "failed", and the servers "removed" from the pool for failing them.
+var LBHealthChecks = expvar.NewMap("lb_health_checks")
+
+// SchedulerJobs holds a map per scheduled job with its "runs", "failures",
+// runs "skipped" because another instance led them, "last_duration_ms"
+// and "last_run_unix".
+var SchedulerJobs = expvar.NewMap("scheduler_jobs")
+
+// RecordPanic logs a recovered panic value with its stack trace and counts
+// it under source. Call it from a deferred function with the result of
+// recover().
+func RecordPanic(source string, v interface{}) {
+	PanicsRecovered.Add(source, 1)
+	log.Printf("[Panic] recovered in %s: %v\n%s", source, v, debug.Stack())
+}
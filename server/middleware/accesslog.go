@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// AccessLogOptions controls which requests are logged. Failed requests
+// (status >= 400) are always logged; successful ones are logged with
+// probability SampleRate, and never for paths in Skip, such as probes.
+type AccessLogOptions struct {
+	SampleRate float64
+	Skip       []string
+}
+
+// RequestID returns the id AccessLog assigned to the request, or "".
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// AccessLog logs one line per request with its method, path, status,
+// latency, response size, remote address and request id. The id is taken
+// from an incoming X-Request-ID header or generated, and echoed back.
+func AccessLog(opts AccessLogOptions, next http.Handler) http.Handler {
+	skip := make(map[string]bool, len(opts.Skip))
+	for _, p := range opts.Skip {
+		skip[p] = true
+	}
+	rate := math.Max(0, math.Min(1, opts.SampleRate))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < 400 && (skip[r.URL.Path] || mrand.Float64() >= rate) {
+			return
+		}
+
+		// Behind a trusted proxy, the proxy is logged too.
+		remote, peer := ClientIP(r), peerIP(r)
+		via := ""
+		if peer != remote {
+			via = " via=" + peer
+		}
+		log.Printf("[HTTP] %s %s %d %s %dB remote=%s%s id=%s", r.Method, r.URL.Path, status,
+			time.Since(start).Round(time.Microsecond), rec.bytes, remote, via, id)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder captures the status and size of a response. It passes
+// Flush and Hijack through so streaming and WebSocket upgrades still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
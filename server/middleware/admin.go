@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"lukagolubovic/apierror"
+)
+
+// AdminAuth requires "Authorization: Bearer <token>". An empty token disables
+// the wrapped endpoints entirely rather than leaving them open.
+func AdminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeNotFound, "admin API disabled")
+			return
+		}
+
+		expected := "Bearer " + token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSecret rejects requests without the bearer token secret, for
+// routes shared between internal parties rather than admins. An empty secret
+// lets every request through.
+func RequireSecret(secret string, next http.Handler) http.Handler {
+	if secret == "" {
+		return next
+	}
+	expected := []byte("Bearer " + secret)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireClientCert rejects requests that did not present a client
+// certificate verified during the TLS handshake. It guards internal routes
+// on listeners that use tls.VerifyClientCertIfGiven because browsers share
+// them.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "client certificate required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,12 +1,25 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
 
-func CORS(next http.Handler) http.Handler {
+	"lukagolubovic/config"
+)
+
+// CORS applies the allowed origins from cfg on every request, so a config
+// reload takes effect immediately. A nil store allows any origin.
+func CORS(cfg *config.Store, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		runtime := cfg.Get()
+		origin := r.Header.Get("Origin")
+		if runtime.AllowsAnyOrigin() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" && runtime.OriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/lockout"
+)
+
+// Lockout counts requests with an Authorization header that were answered
+// 401 against the client IP, and refuses further ones with 429 once the IP
+// is locked out. Only admin clients send the header, so chat users sharing
+// the IP are not affected. A nil guard disables it.
+func Lockout(guard *lockout.Guard, next http.Handler) http.Handler {
+	if guard == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subject := lockout.IP(ClientIP(r))
+		if wait := guard.Locked(r.Context(), subject); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "too many failed attempts")
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusUnauthorized {
+			guard.Fail(r.Context(), "admin_token", subject)
+		}
+	})
+}
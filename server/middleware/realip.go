@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"lukagolubovic/config"
+)
+
+type clientIPKey struct{}
+
+// RealIP works out each request's client IP for ClientIP. Requests from a
+// proxy in cfg's trusted_proxies are taken to come from the address it
+// forwarded: the last X-Forwarded-For entry that isn't itself a trusted
+// proxy, or failing that X-Real-IP. The headers of anyone else are ignored,
+// so clients can't pick the IP they are rate limited or banned by. A nil
+// store trusts no proxy.
+func RealIP(cfg *config.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := peerIP(r)
+		if peer, err := netip.ParseAddr(ip); err == nil {
+			if trusted := cfg.Get().TrustedProxies; trusted.Trusts(peer) {
+				ip = forwardedIP(r, trusted, peer)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// ClientIP is the IP RealIP resolved for the request, or its peer address
+// outside RealIP.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedIP walks X-Forwarded-For from the nearest hop back, stopping at
+// the first address that isn't a trusted proxy. An entry that isn't an IP
+// ends the walk at the hop that added it.
+func forwardedIP(r *http.Request, trusted config.TrustedProxies, peer netip.Addr) string {
+	client := peer
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	if len(hops) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap().String()
+		}
+		return peer.Unmap().String()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr
+		if !trusted.Trusts(addr) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
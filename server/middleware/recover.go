@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"lukagolubovic/apierror"
+	"lukagolubovic/metrics"
+)
+
+// Recover turns a panicking handler into a 500 response instead of a dropped
+// connection, and counts it. http.ErrAbortHandler is re-raised, since it is
+// the documented way for a handler to abort a response.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			metrics.RecordPanic("http", v)
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+
+	"lukagolubovic/apierror"
+)
+
+// Request body limits for MaxBytes.
+const (
+	SmallBody   = 4 * 1024
+	ControlBody = 16 * 1024
+)
+
+// MaxBytes rejects request bodies larger than limit. Handlers see the
+// overflow as a read error, which they report as a bad request.
+func MaxBytes(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.CodeBadRequest, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Routes serves mux, replacing the plain-text 404 and 405 responses that
+// http.ServeMux writes for unmatched paths and methods with JSON errors.
+// The Allow header set by the mux is kept. Requests are always dispatched
+// through mux.ServeHTTP, which fills in the path wildcards handlers read
+// with r.PathValue; mux.Handler is only asked whether a pattern matches.
+func Routes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&routeErrorWriter{ResponseWriter: w}, r)
+	})
+}
+
+// routeErrorWriter swallows the mux's own error body and writes the JSON
+// envelope instead.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *routeErrorWriter) WriteHeader(status int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	w.Header().Del("Content-Type")
+	switch status {
+	case http.StatusMethodNotAllowed:
+		apierror.Write(w.ResponseWriter, status, apierror.CodeMethodNotAllowed, "method not allowed")
+	case http.StatusNotFound:
+		apierror.Write(w.ResponseWriter, status, apierror.CodeNotFound, "not found")
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *routeErrorWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(b), nil
+}
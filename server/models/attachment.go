@@ -0,0 +1,42 @@
+package models
+
+// MaxAttachmentName is the longest file name an attachment keeps.
+const MaxAttachmentName = 255
+
+// Attachment is a file uploaded to be shared in messages. Attachments
+// with the same content share one stored copy, whose SHA-256 digest is
+// SHA256.
+type Attachment struct {
+	ID          int64  `json:"id,string"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	UploadedAt  string `json:"uploaded_at"`
+	// Width and Height are an image's dimensions, in pixels, for clients
+	// to reserve its space before it loads.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Thumbnails lists the sizes an image was scaled down to, by its
+	// longer side; sizes it isn't larger than are left out.
+	Thumbnails []int `json:"thumbnails,omitempty"`
+}
+
+// HasThumbnail reports whether the attachment has a thumbnail of size.
+func (a Attachment) HasThumbnail(size int) bool {
+	for _, s := range a.Thumbnails {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// AttachmentUsage is how much of their quota a user's attachments take.
+type AttachmentUsage struct {
+	UsedBytes int64 `json:"used_bytes"`
+	// QuotaBytes is zero when the user has no quota.
+	QuotaBytes int64 `json:"quota_bytes"`
+	// Override is set when an admin gave the user their own quota.
+	Override bool `json:"override"`
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Limits on a card, so one message can't flood every client.
+const (
+	MaxCardTitle      = 256
+	MaxCardText       = 2000
+	MaxCardFields     = 10
+	MaxCardFieldName  = 256
+	MaxCardFieldValue = 512
+	MaxCardButtons    = 5
+	MaxCardButtonText = 80
+	MaxCallbackID     = 100
+)
+
+const (
+	ButtonDefault = ""
+	ButtonPrimary = "primary"
+	ButtonDanger  = "danger"
+)
+
+// Card is a structured message posted by a bot. Clicking one of its buttons
+// sends an interaction frame naming the button's callback id, which is
+// delivered to the bot's webhooks.
+type Card struct {
+	Title   string       `json:"title"`
+	Text    string       `json:"text,omitempty"`
+	Fields  []CardField  `json:"fields,omitempty"`
+	Buttons []CardButton `json:"buttons,omitempty"`
+}
+
+type CardField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Inline lets clients lay the field out next to its neighbours.
+	Inline bool `json:"inline,omitempty"`
+}
+
+type CardButton struct {
+	Label      string `json:"label"`
+	CallbackID string `json:"callback_id"`
+	Style      string `json:"style,omitempty"`
+}
+
+// Interaction is a click on a card's button, sent by clients in
+// interaction frames along with the card message's id.
+type Interaction struct {
+	CallbackID string `json:"callback_id"`
+}
+
+func (c *Card) Validate() error {
+	switch {
+	case strings.TrimSpace(c.Title) == "":
+		return errors.New("title is required")
+	case len(c.Title) > MaxCardTitle:
+		return fmt.Errorf("title must be at most %d bytes", MaxCardTitle)
+	case len(c.Text) > MaxCardText:
+		return fmt.Errorf("text must be at most %d bytes", MaxCardText)
+	case len(c.Fields) > MaxCardFields:
+		return fmt.Errorf("a card has at most %d fields", MaxCardFields)
+	case len(c.Buttons) > MaxCardButtons:
+		return fmt.Errorf("a card has at most %d buttons", MaxCardButtons)
+	}
+	for i, f := range c.Fields {
+		switch {
+		case f.Name == "" || len(f.Name) > MaxCardFieldName:
+			return fmt.Errorf("fields[%d].name must be 1 to %d bytes", i, MaxCardFieldName)
+		case len(f.Value) > MaxCardFieldValue:
+			return fmt.Errorf("fields[%d].value must be at most %d bytes", i, MaxCardFieldValue)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, b := range c.Buttons {
+		switch {
+		case b.Label == "" || len(b.Label) > MaxCardButtonText:
+			return fmt.Errorf("buttons[%d].label must be 1 to %d bytes", i, MaxCardButtonText)
+		case b.CallbackID == "" || len(b.CallbackID) > MaxCallbackID:
+			return fmt.Errorf("buttons[%d].callback_id must be 1 to %d bytes", i, MaxCallbackID)
+		case seen[b.CallbackID]:
+			return fmt.Errorf("buttons[%d].callback_id %q is used twice", i, b.CallbackID)
+		case b.Style != ButtonDefault && b.Style != ButtonPrimary && b.Style != ButtonDanger:
+			return fmt.Errorf("buttons[%d].style must be primary, danger or empty", i)
+		}
+		seen[b.CallbackID] = true
+	}
+	return nil
+}
+
+// HasCallback reports whether one of the card's buttons has id.
+func (c *Card) HasCallback(id string) bool {
+	for _, b := range c.Buttons {
+		if b.CallbackID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Fallback is the card as plain text, sent as the message content for
+// clients, bridges and gateways that don't render cards.
+func (c *Card) Fallback() string {
+	var b strings.Builder
+	b.WriteString(c.Title)
+	if c.Text != "" {
+		b.WriteString("\n" + c.Text)
+	}
+	for _, f := range c.Fields {
+		b.WriteString("\n" + f.Name + ": " + f.Value)
+	}
+	return b.String()
+}
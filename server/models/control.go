@@ -0,0 +1,73 @@
+package models
+
+import "encoding/json"
+
+const (
+	ControlBan      = "ban"
+	ControlUnban    = "unban"
+	ControlMute     = "mute"
+	ControlUnmute   = "unmute"
+	ControlKick     = "kick"
+	ControlReload   = "reload"
+	ControlAnnounce = "announce"
+	ControlTopic    = "topic"
+	ControlRename   = "rename"
+	// ControlRoomConfig replaces a room's configuration overrides.
+	ControlRoomConfig = "room_config"
+	// ControlGrantModerator adds Username to the moderators of Room.
+	ControlGrantModerator = "grant_moderator"
+	// ControlSlowMode sets Room's slow mode to Seconds, zero turning it
+	// off; Username is the moderator who changed it.
+	ControlSlowMode = "slow_mode"
+	// ControlMaintenance tells servers the maintenance flag in Redis changed.
+	ControlMaintenance = "maintenance"
+	// ControlRevokeSession closes one of a user's connections, or all of
+	// them when Session is empty.
+	ControlRevokeSession = "revoke_session"
+	// ControlLeave closes every connection of a user who left the room.
+	ControlLeave = "leave"
+)
+
+type ControlCommand struct {
+	// ID is set when the command is published, so a copy published again
+	// after a Redis outage is applied once.
+	ID          int64  `json:"id,string,omitempty"`
+	Type        string `json:"type"`
+	UserID      int64  `json:"user_id,string,omitempty"`
+	Username    string `json:"username,omitempty"`
+	NewUsername string `json:"new_username,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	Room        string `json:"room,omitempty"`
+	// Overrides are the room's new overrides, as JSON.
+	Overrides json.RawMessage `json:"overrides,omitempty"`
+	Origin    string          `json:"origin,omitempty"`
+	// Session is the session a revoke_session command closes.
+	Session string `json:"session,omitempty"`
+	// Seconds is the slow mode interval of a slow_mode command.
+	Seconds int `json:"seconds,omitempty"`
+}
+
+func (c ControlCommand) NeedsUser() bool {
+	switch c.Type {
+	case ControlBan, ControlUnban, ControlMute, ControlUnmute, ControlKick:
+		return true
+	}
+	return false
+}
+
+// Valid reports whether the command can be issued through the admin API.
+// Renames are only issued by the user themselves over the WebSocket, and
+// room overrides and maintenance through their own endpoints.
+func (c ControlCommand) Valid() bool {
+	switch c.Type {
+	case ControlBan, ControlUnban, ControlMute, ControlUnmute, ControlKick:
+		return c.Username != "" || c.UserID != 0
+	case ControlReload, ControlTopic:
+		return true
+	case ControlAnnounce:
+		return c.Message != ""
+	}
+	return false
+}
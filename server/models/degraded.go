@@ -0,0 +1,17 @@
+package models
+
+// Dependencies a server may run degraded without.
+const (
+	DependencyRedis    = "redis"
+	DependencyDatabase = "database"
+)
+
+// Degraded is whether a server is running without one of its
+// dependencies. Without Redis, messages sent on the server reach only its
+// own clients until Redis is back; without the database, messages can't
+// be sent.
+type Degraded struct {
+	Dependency string `json:"dependency"`
+	Degraded   bool   `json:"degraded"`
+	Message    string `json:"message"`
+}
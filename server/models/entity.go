@@ -0,0 +1,38 @@
+package models
+
+import "encoding/json"
+
+const (
+	EntityBold   = "bold"
+	EntityItalic = "italic"
+	EntityCode   = "code"
+	EntityLink   = "link"
+)
+
+type Entity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+}
+
+// EncodeEntities and DecodeEntities convert entities to and from the JSON
+// text stored alongside each message. Empty lists are stored as "".
+func EncodeEntities(entities []Entity) string {
+	if len(entities) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(entities)
+	return string(b)
+}
+
+func DecodeEntities(raw string) []Entity {
+	if raw == "" {
+		return nil
+	}
+	var entities []Entity
+	if err := json.Unmarshal([]byte(raw), &entities); err != nil {
+		return nil
+	}
+	return entities
+}
@@ -0,0 +1,20 @@
+package models
+
+// Forward references the message a forwarded message copies. Forwarding a
+// forward references the first message, not the intermediate copy.
+type Forward struct {
+	ID        int64  `json:"id,string"`
+	Room      string `json:"room"`
+	Username  string `json:"username"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// Forwardable reports whether messages of type t may be forwarded. Cards
+// are not: their buttons belong to the bot that posted them.
+func Forwardable(t string) bool {
+	switch t {
+	case MessageTypeChat, MessageTypeLocation, MessageTypeContact, MessageTypeGIF:
+		return true
+	}
+	return false
+}
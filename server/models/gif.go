@@ -0,0 +1,76 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	MaxGIFID    = 64
+	MaxGIFTitle = 256
+	MaxGIFSize  = 4096
+)
+
+// gifHosts is the domain each provider serves its media from. GIF messages
+// may only link there, so clients can't use them to embed arbitrary URLs.
+var gifHosts = map[string]string{
+	"giphy": "giphy.com",
+	"tenor": "tenor.com",
+}
+
+// GIF is a GIF found through the server's search proxy and sent in a gif
+// message.
+type GIF struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+	Title    string `json:"title,omitempty"`
+	// URL is the full-size GIF and PreviewURL a smaller rendition for
+	// pickers and previews.
+	URL        string `json:"url"`
+	PreviewURL string `json:"preview_url,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+}
+
+func (g *GIF) Validate() error {
+	host, ok := gifHosts[g.Provider]
+	switch {
+	case !ok:
+		return fmt.Errorf("provider %q must be giphy or tenor", g.Provider)
+	case g.ID == "":
+		return errors.New("id is required")
+	case len(g.ID) > MaxGIFID:
+		return fmt.Errorf("id must be at most %d bytes", MaxGIFID)
+	case len(g.Title) > MaxGIFTitle:
+		return fmt.Errorf("title must be at most %d bytes", MaxGIFTitle)
+	case g.Width < 0 || g.Width > MaxGIFSize || g.Height < 0 || g.Height > MaxGIFSize:
+		return fmt.Errorf("width and height must be between 0 and %d", MaxGIFSize)
+	case !servedBy(g.URL, host):
+		return fmt.Errorf("url must be an https:// URL on %s", host)
+	case g.PreviewURL != "" && !servedBy(g.PreviewURL, host):
+		return fmt.Errorf("preview_url must be an https:// URL on %s", host)
+	}
+	return nil
+}
+
+// Fallback is the GIF as plain text, for clients that don't show GIFs.
+func (g *GIF) Fallback() string {
+	if g.Title == "" {
+		return g.URL
+	}
+	return g.Title + " " + g.URL
+}
+
+func servedBy(raw, domain string) bool {
+	if len(raw) > 2048 {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
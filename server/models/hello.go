@@ -0,0 +1,44 @@
+package models
+
+// ProtocolVersion is bumped whenever the WebSocket message envelope changes
+// incompatibly. Subprotocol is the Sec-WebSocket-Protocol name for it.
+const (
+	ProtocolVersion = 1
+	Subprotocol     = "chat.v1"
+)
+
+// Hello is sent as the first frame of every connection so clients can adapt
+// to the server they landed on instead of assuming its limits.
+type Hello struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Subprotocol     string   `json:"subprotocol,omitempty"`
+	Server          string   `json:"server"`
+	Encodings       []string `json:"encodings"`
+	Compression     bool     `json:"compression"`
+	MaxFrameSize    int      `json:"max_frame_size"`
+	// FrameLimits are the frame types allowed to exceed MaxFrameSize, with
+	// their own limits.
+	FrameLimits       map[string]int  `json:"frame_limits,omitempty"`
+	MaxContentSize    int             `json:"max_content_size"`
+	MaxUsernameSize   int             `json:"max_username_size"`
+	MessagesPerSecond float64         `json:"messages_per_second"`
+	MessageBurst      int             `json:"message_burst"`
+	EventTypes        []string        `json:"event_types"`
+	Features          map[string]bool `json:"features,omitempty"`
+	// Acks is true when the connection opted into at-least-once delivery
+	// and must ack every chat message it receives.
+	Acks bool `json:"acks"`
+	// Username is the name the connection was signed in under: the one
+	// first registered for a name differing only in case, or the name
+	// assigned to a guest.
+	Username string `json:"username"`
+	Guest    bool   `json:"guest,omitempty"`
+	// SlowModeSeconds is the room's slow mode interval, zero when it is off.
+	SlowModeSeconds int `json:"slow_mode_seconds,omitempty"`
+	// LatencyReportSeconds is how often latency frames are sent, zero when
+	// they are off.
+	LatencyReportSeconds int `json:"latency_report_seconds,omitempty"`
+	// Scopes are what the connection's token allows, "read" and "send";
+	// omitted for connections without a token, which may do both.
+	Scopes []string `json:"scopes,omitempty"`
+}
@@ -0,0 +1,58 @@
+package models
+
+// Inbound is a frame sent by a client. It only has the fields clients may
+// set, so decoding it strictly rejects server-only fields such as "server"
+// or "hello".
+type Inbound struct {
+	Type string `json:"type"`
+	// ID is the chat message being acknowledged by an ack frame or copied
+	// by a forward frame, or the card whose button an interaction frame
+	// clicks.
+	ID int64 `json:"id,string"`
+	// Username is accepted for older clients but ignored; messages always
+	// carry the connection's name.
+	Username string       `json:"username"`
+	Content  string       `json:"content"`
+	To       string       `json:"to"`
+	Room     *InboundRoom `json:"room"`
+	Signal   *Signal      `json:"signal"`
+	SlowMode *SlowMode    `json:"slow_mode"`
+	// Interaction is the button clicked, in interaction frames.
+	Interaction *Interaction `json:"interaction"`
+	// Location, Contact and GIF are shared by location, contact and gif
+	// frames.
+	Location *Location `json:"location"`
+	Contact  *Contact  `json:"contact"`
+	GIF      *GIF      `json:"gif"`
+	// QuoteID is the message a chat, location, contact or gif frame replies
+	// to, quoting it.
+	QuoteID int64 `json:"quote_id,string"`
+	// AttachmentID is an uploaded file a chat frame shares.
+	AttachmentID int64 `json:"attachment_id,string"`
+	// ToRoom is the room a forward frame copies the message to.
+	ToRoom string `json:"to_room"`
+	// Session is the session a revoke_session frame closes.
+	Session string `json:"session"`
+}
+
+// InboundRoom is the part of a room a topic frame may change besides the
+// topic itself.
+type InboundRoom struct {
+	Description string `json:"description"`
+}
+
+// FrameError describes why an inbound frame was rejected. It is sent back
+// in the error frame's "error" field.
+type FrameError struct {
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+	// Limit is the size limit, in bytes, of a frame rejected as too large.
+	Limit int `json:"limit,omitempty"`
+}
+
+func (e *FrameError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return e.Field + ": " + e.Reason
+}
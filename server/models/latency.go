@@ -0,0 +1,12 @@
+package models
+
+// Latency is a connection's round-trip time to its server, measured with
+// WebSocket pings, on latency messages. Times are in milliseconds.
+type Latency struct {
+	// RTTMs is the last measurement.
+	RTTMs float64 `json:"rtt_ms"`
+	// SmoothedMs and JitterMs are the moving average of the measurements
+	// and their mean deviation from it, as TCP keeps them.
+	SmoothedMs float64 `json:"smoothed_ms"`
+	JitterMs   float64 `json:"jitter_ms"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// DefaultMaintenanceMessage is shown when maintenance is started without a
+// message of its own.
+const DefaultMaintenanceMessage = "Maintenance in progress, please try again later."
+
+// MaintenanceCloseReason is the close frame reason of connections refused
+// during maintenance.
+const MaintenanceCloseReason = "maintenance in progress"
+
+// Maintenance is the cluster-wide maintenance flag. While it is set,
+// servers refuse new connections; connected clients stay on.
+type Maintenance struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// Membership actions, in member messages.
+const (
+	MemberJoined = "joined"
+	MemberLeft   = "left"
+	MemberKicked = "kicked"
+)
+
+// Membership is the change a member message records: its user joined the
+// room for the first time, left it or was kicked from it.
+type Membership struct {
+	Action string `json:"action"`
+	// By is who kicked the user; empty for an administrator.
+	By string `json:"by,omitempty"`
+}
+
+// Fallback describes the change as the message's content.
+func (m Membership) Fallback(username, room string) string {
+	switch m.Action {
+	case MemberJoined:
+		return username + " joined " + room
+	case MemberLeft:
+		return username + " left " + room
+	}
+	if m.By != "" {
+		return username + " was kicked from " + room + " by " + m.By
+	}
+	return username + " was kicked from " + room
+}
+
+// Member is a member of a room, as listed by /rooms/{room}/members.
+type Member struct {
+	UserID   int64     `json:"user_id,string"`
+	Username string    `json:"username"`
+	JoinedAt time.Time `json:"joined_at"`
+	// Online is whether the user was connected to any server within the
+	// last few presence refreshes.
+	Online bool `json:"online"`
+}
@@ -1,9 +1,120 @@
 package models
 
+const (
+	MessageTypeChat      = ""
+	MessageTypeTopic     = "topic"
+	MessageTypeRoom      = "room"
+	MessageTypeSignal    = "signal"
+	MessageTypeRename    = "rename"
+	MessageTypeError     = "error"
+	MessageTypeHello     = "hello"
+	MessageTypeReconnect = "reconnect"
+	// MessageTypeMaintenance announces that maintenance started or ended,
+	// and greets connections refused because of it.
+	MessageTypeMaintenance = "maintenance"
+	// MessageTypeDegraded warns that the server lost, or got back, Redis
+	// or the database.
+	MessageTypeDegraded = "degraded"
+	// MessageTypeLatency reports a connection's round-trip time to it.
+	MessageTypeLatency = "latency"
+	// MessageTypeSlowMode is sent by moderators to change the room's slow
+	// mode, and to clients when it changed.
+	MessageTypeSlowMode = "slow_mode"
+	// MessageTypeCard is a chat message with a card, posted by a bot.
+	MessageTypeCard = "card"
+	// MessageTypeLocation and MessageTypeContact are chat messages sharing
+	// a location or a contact card.
+	MessageTypeLocation = "location"
+	MessageTypeContact  = "contact"
+	// MessageTypeGIF is a chat message with a GIF found through the
+	// server's GIF search.
+	MessageTypeGIF = "gif"
+	// MessageTypeSessions asks for the user's sessions, and answers with
+	// them. MessageTypeRevokeSession is sent by clients only, closing one
+	// of their other sessions.
+	MessageTypeSessions      = "sessions"
+	MessageTypeRevokeSession = "revoke_session"
+	// MessageTypeMember records a user joining, leaving or being kicked
+	// from the room; it is kept in history. MessageTypeLeave is sent by
+	// clients only, leaving the room.
+	MessageTypeMember = "member"
+	MessageTypeLeave  = "leave"
+	// MessageTypeForward is sent by clients only, copying the message with
+	// the same id to another room.
+	MessageTypeForward = "forward"
+	// MessageTypeInteraction is sent by clients only, clicking a button of
+	// the card message with the same id.
+	MessageTypeInteraction = "interaction"
+	// MessageTypeAck is sent by clients only, acknowledging the chat
+	// message with the same id.
+	MessageTypeAck = "ack"
+)
+
+// MaxContentSize is the longest message content, in bytes, clients of any
+// server, gateway or bridge may send. Rooms may lower it with
+// max_message_length.
+const MaxContentSize = 512
+
+// EventTypes lists every message type a client may receive.
+var EventTypes = []string{"chat", MessageTypeTopic, MessageTypeRoom, MessageTypeSignal, MessageTypeRename, MessageTypeError, MessageTypeHello, MessageTypeReconnect, MessageTypeMaintenance, MessageTypeDegraded, MessageTypeLatency, MessageTypeSlowMode, MessageTypeCard, MessageTypeLocation, MessageTypeContact, MessageTypeGIF, MessageTypeSessions, MessageTypeMember}
+
 type Message struct {
-	ID        int64  `json:"id,omitempty"`
-	Username  string `json:"username"`
-	Content   string `json:"content"`
-	Server    string `json:"server,omitempty"`
-	Timestamp string `json:"timestamp,omitempty"`
-}
\ No newline at end of file
+	ID        int64      `json:"id,string,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	UserID    int64      `json:"user_id,string,omitempty"`
+	Username  string     `json:"username"`
+	Content   string     `json:"content"`
+	Server    string     `json:"server,omitempty"`
+	Timestamp string     `json:"timestamp,omitempty"`
+	Room      *Room      `json:"room,omitempty"`
+	Entities  []Entity   `json:"entities,omitempty"`
+	To        string     `json:"to,omitempty"`
+	Signal    *Signal    `json:"signal,omitempty"`
+	Hello     *Hello     `json:"hello,omitempty"`
+	Reconnect *Reconnect `json:"reconnect,omitempty"`
+	// Maintenance is the new state, on maintenance messages.
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	// Degraded is the dependency's state, on degraded messages.
+	Degraded *Degraded `json:"degraded,omitempty"`
+	// Latency is the connection's round-trip time, on latency messages.
+	Latency *Latency `json:"latency,omitempty"`
+	// SlowMode is the room's slow mode, on slow_mode messages and on error
+	// frames rejecting a message sent too soon.
+	SlowMode *SlowMode `json:"slow_mode,omitempty"`
+	// Card is the card of card messages.
+	Card     *Card     `json:"card,omitempty"`
+	Location *Location `json:"location,omitempty"`
+	Contact  *Contact  `json:"contact,omitempty"`
+	GIF      *GIF      `json:"gif,omitempty"`
+	// Attachment is the file a chat message shares.
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Quote is the snapshot of the message a reply quotes.
+	Quote *Quote `json:"quote,omitempty"`
+	// Forwarded references the original of a forwarded message.
+	Forwarded *Forward `json:"forwarded,omitempty"`
+	// Member is the change recorded by member messages.
+	Member *Membership `json:"member,omitempty"`
+	// Sessions answers a sessions frame.
+	Sessions []Session `json:"sessions,omitempty"`
+	// Error details why an inbound frame was rejected, on error frames.
+	Error *FrameError `json:"error,omitempty"`
+}
+
+// IsChat reports whether messages of type t are part of the conversation:
+// stored, replicated, replayed and acknowledged like plain chat messages.
+// Typed ones carry a plain-text version in their content for clients,
+// bridges and gateways that don't render them.
+func IsChat(t string) bool {
+	switch t {
+	case MessageTypeChat, MessageTypeCard, MessageTypeLocation, MessageTypeContact, MessageTypeGIF:
+		return true
+	}
+	return false
+}
+
+// IsStored reports whether messages of type t are kept in history:
+// conversation messages and membership changes. Membership changes are
+// not relayed by bridges and gateways.
+func IsStored(t string) bool {
+	return IsChat(t) || t == MessageTypeMember
+}
@@ -0,0 +1,45 @@
+package models
+
+import "encoding/json"
+
+// payload is the typed part of a message, stored as JSON alongside its
+// content.
+type payload struct {
+	Card       *Card       `json:"card,omitempty"`
+	Location   *Location   `json:"location,omitempty"`
+	Contact    *Contact    `json:"contact,omitempty"`
+	GIF        *GIF        `json:"gif,omitempty"`
+	Member     *Membership `json:"member,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+	Quote      *Quote      `json:"quote,omitempty"`
+	Forwarded  *Forward    `json:"forwarded,omitempty"`
+}
+
+// EncodePayload and DecodePayload convert a message's typed fields to and
+// from the JSON text stored with it. Messages without any are stored as "".
+func EncodePayload(m Message) string {
+	p := payload{Card: m.Card, Location: m.Location, Contact: m.Contact, GIF: m.GIF, Member: m.Member, Attachment: m.Attachment, Quote: m.Quote, Forwarded: m.Forwarded}
+	if p == (payload{}) {
+		return ""
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func DecodePayload(m *Message, raw string) {
+	if raw == "" {
+		return
+	}
+	var p payload
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return
+	}
+	m.Card = p.Card
+	m.Location = p.Location
+	m.Contact = p.Contact
+	m.GIF = p.GIF
+	m.Member = p.Member
+	m.Attachment = p.Attachment
+	m.Quote = p.Quote
+	m.Forwarded = p.Forwarded
+}
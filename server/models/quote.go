@@ -0,0 +1,25 @@
+package models
+
+// MaxQuoteExcerpt is how many characters of the quoted message's content a
+// quote keeps.
+const MaxQuoteExcerpt = 140
+
+// Quote is the snapshot of a quoted message that a reply carries. The
+// server takes it when the reply is sent, so every client renders the same
+// quote, even once the original is pruned or archived.
+type Quote struct {
+	ID        int64  `json:"id,string"`
+	Username  string `json:"username"`
+	Excerpt   string `json:"excerpt"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// NewQuote takes the snapshot of m, shortening its content to
+// MaxQuoteExcerpt characters with an ellipsis.
+func NewQuote(m Message) *Quote {
+	excerpt := m.Content
+	if r := []rune(excerpt); len(r) > MaxQuoteExcerpt {
+		excerpt = string(r[:MaxQuoteExcerpt-1]) + "…"
+	}
+	return &Quote{ID: m.ID, Username: m.Username, Excerpt: excerpt, Timestamp: m.Timestamp}
+}
@@ -0,0 +1,18 @@
+package models
+
+// Reasons a server asks clients to reconnect elsewhere.
+const (
+	ReconnectDrain    = "drain"
+	ReconnectShutdown = "shutdown"
+	ReconnectOverload = "overload"
+)
+
+// Reconnect is sent just before the server closes a connection it wants the
+// client to re-establish. Server is a suggested alternative from the load
+// balancer and may be empty, in which case the client should ask the load
+// balancer itself after RetryAfterMs.
+type Reconnect struct {
+	Reason       string `json:"reason"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+	Server       string `json:"server,omitempty"`
+}
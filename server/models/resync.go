@@ -0,0 +1,20 @@
+package models
+
+// MaxResync is the most messages a reconnecting client is caught up with,
+// by /sync or a replay. A longer gap is left to /history.
+const MaxResync = 200
+
+// Reasons a gap is too large to catch up with.
+const (
+	ResyncTooManyMessages = "too_many_messages"
+	ResyncHistoryPruned   = "history_pruned"
+)
+
+// Resync answers a client catching up after an id it saw. Either Messages
+// holds everything after it, oldest first, or ResyncRequired is set, with
+// Reason, and the client should drop what it has and reload /history.
+type Resync struct {
+	Messages       []Message `json:"messages"`
+	ResyncRequired bool      `json:"resync_required"`
+	Reason         string    `json:"reason,omitempty"`
+}
@@ -0,0 +1,15 @@
+package models
+
+const (
+	DefaultRoom   = "general"
+	DefaultRoomID = 1
+)
+
+type Room struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	UpdatedBy   string `json:"updated_by,omitempty"`
+	UpdatedAt   string `json:"updated_at,omitempty"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Session is one of a user's connections, anywhere in the cluster.
+type Session struct {
+	ID          string    `json:"id"`
+	Server      string    `json:"server"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Current marks the connection that asked for the list.
+	Current bool `json:"current,omitempty"`
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+const (
+	MaxShareName    = 256
+	MaxContactEmail = 254
+	// maxContactUsername matches the longest username the server allows
+	// by default; the contact's username is only shown, never resolved.
+	maxContactUsername = 64
+)
+
+var contactPhone = regexp.MustCompile(`^\+?[0-9 ()./-]{3,32}$`)
+
+// Location is a point shared by a client, such as its current position.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// AccuracyMeters is the radius of uncertainty, when the client knows
+	// it.
+	AccuracyMeters float64 `json:"accuracy_meters,omitempty"`
+	// Name labels the place, e.g. "Office".
+	Name string `json:"name,omitempty"`
+}
+
+func (l *Location) Validate() error {
+	switch {
+	case math.IsNaN(l.Latitude) || l.Latitude < -90 || l.Latitude > 90:
+		return errors.New("latitude must be between -90 and 90")
+	case math.IsNaN(l.Longitude) || l.Longitude < -180 || l.Longitude > 180:
+		return errors.New("longitude must be between -180 and 180")
+	case math.IsNaN(l.AccuracyMeters) || l.AccuracyMeters < 0:
+		return errors.New("accuracy_meters must not be negative")
+	case len(l.Name) > MaxShareName:
+		return fmt.Errorf("name must be at most %d bytes", MaxShareName)
+	}
+	return nil
+}
+
+func (l *Location) Fallback() string {
+	text := fmt.Sprintf("Location: %.6f, %.6f", l.Latitude, l.Longitude)
+	if l.Name != "" {
+		text += " (" + l.Name + ")"
+	}
+	return text
+}
+
+// Contact is a contact card shared by a client. It needs a name and at
+// least one way to reach the contact.
+type Contact struct {
+	Name     string `json:"name"`
+	Phone    string `json:"phone,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func (c *Contact) Validate() error {
+	switch {
+	case strings.TrimSpace(c.Name) == "":
+		return errors.New("name is required")
+	case len(c.Name) > MaxShareName:
+		return fmt.Errorf("name must be at most %d bytes", MaxShareName)
+	case c.Phone == "" && c.Email == "" && c.Username == "":
+		return errors.New("phone, email or username is required")
+	case c.Phone != "" && !contactPhone.MatchString(c.Phone):
+		return errors.New("phone must be 3 to 32 digits, spaces and ()./- with an optional leading +")
+	case len(c.Email) > MaxContactEmail:
+		return fmt.Errorf("email must be at most %d bytes", MaxContactEmail)
+	case len(c.Username) > maxContactUsername:
+		return fmt.Errorf("username must be at most %d bytes", maxContactUsername)
+	}
+	if c.Email != "" {
+		if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+			return errors.New("email must be a plain address such as name@example.com")
+		}
+	}
+	return nil
+}
+
+func (c *Contact) Fallback() string {
+	parts := []string{c.Name}
+	for _, p := range []string{c.Phone, c.Email} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if c.Username != "" {
+		parts = append(parts, "@"+c.Username)
+	}
+	return "Contact: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,31 @@
+package models
+
+import "encoding/json"
+
+const (
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "candidate"
+	SignalHangup    = "hangup"
+)
+
+// Signal carries WebRTC negotiation data between two users. Data is opaque to
+// the server (an SDP description or ICE candidate) and relayed untouched.
+type Signal struct {
+	Kind   string          `json:"kind"`
+	CallID string          `json:"call_id"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func (s *Signal) Valid() bool {
+	if s.CallID == "" {
+		return false
+	}
+	switch s.Kind {
+	case SignalOffer, SignalAnswer, SignalCandidate:
+		return len(s.Data) > 0
+	case SignalHangup:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package models
+
+// MaxSlowModeSeconds is the longest interval slow mode may impose.
+const MaxSlowModeSeconds = 6 * 60 * 60
+
+// SlowMode is a room's minimum interval between two messages of one user.
+// Moderators are exempt.
+type SlowMode struct {
+	// Seconds is the interval; zero turns slow mode off.
+	Seconds int `json:"seconds"`
+	// RetryAfterMs is how long until the user may send again, on error
+	// frames rejecting a message sent too soon.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// StatsBucket is the number of messages in one hour or day, keyed by the
+// bucket's start in UTC.
+type StatsBucket struct {
+	Start string `json:"start"`
+	Count int64  `json:"count"`
+}
+
+type RoomStats struct {
+	ID             int64         `json:"id"`
+	Name           string        `json:"name"`
+	TotalMessages  int64         `json:"total_messages"`
+	Messages24h    int64         `json:"messages_24h"`
+	ActiveUsers24h int64         `json:"active_users_24h"`
+	Hourly         []StatsBucket `json:"hourly"`
+	Daily          []StatsBucket `json:"daily"`
+}
+
+type GlobalStats struct {
+	TotalMessages   int64         `json:"total_messages"`
+	Messages24h     int64         `json:"messages_24h"`
+	ActiveUsers24h  int64         `json:"active_users_24h"`
+	ActiveUsers7d   int64         `json:"active_users_7d"`
+	Connections     int           `json:"connections"`
+	PeakConnections int           `json:"peak_connections"`
+	PeakAt          time.Time     `json:"peak_at"`
+	Hourly          []StatsBucket `json:"hourly"`
+	Daily           []StatsBucket `json:"daily"`
+	TopRooms        []RoomStats   `json:"top_rooms"`
+	GeneratedAt     time.Time     `json:"generated_at"`
+}
+
+// LimitsStats is a server's adaptive rate limiting: the latest load
+// measurements and the factor they scaled the message limits by.
+type LimitsStats struct {
+	Server  string `json:"server"`
+	Enabled bool   `json:"enabled"`
+	// Factor multiplies the configured message limits; 1 leaves them
+	// as configured.
+	Factor float64 `json:"factor"`
+	// Overloaded lists the measurements over their thresholds at the
+	// last sample: "send_backlog", "redis_latency" or "db_write_latency".
+	Overloaded       []string     `json:"overloaded"`
+	SendBacklog      float64      `json:"send_backlog"`
+	RedisLatencyMS   float64      `json:"redis_latency_ms"`
+	DBWriteLatencyMS float64      `json:"db_write_latency_ms"`
+	Thresholds       LimitsBounds `json:"thresholds"`
+	SampledAt        *time.Time   `json:"sampled_at,omitempty"`
+}
+
+// LimitsBounds are the thresholds of adaptive rate limiting; zero isn't
+// checked.
+type LimitsBounds struct {
+	SendBacklog      float64 `json:"send_backlog"`
+	RedisLatencyMS   int     `json:"redis_latency_ms"`
+	DBWriteLatencyMS int     `json:"db_write_latency_ms"`
+}
@@ -0,0 +1,228 @@
+// Package mqtt lets devices take part in the chat over MQTT 3.1.1. It is a
+// small MQTT server, not a general broker: devices publish to topics that
+// the config's inbound rules map to a room, and those messages are posted
+// to the room as from the device's username, going through the same bans,
+// mutes and filters as chat clients. Devices subscribing to an outbound
+// rule's topic receive the room's messages on it as JSON, read from the
+// room's Redis channel like a chat server does.
+//
+// QoS 0 and 1 are supported; nothing is retained and sessions are not
+// persisted, so clean sessions are assumed.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/audit"
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/ingest"
+	"lukagolubovic/lockout"
+	"lukagolubovic/models"
+)
+
+const (
+	// maxPacketSize bounds a packet's body; chat messages are far smaller.
+	maxPacketSize  = 16 << 10
+	publishTimeout = 5 * time.Second
+)
+
+type Gateway struct {
+	rdb redis.UniversalClient
+	cfg *config.Store
+	pub *ingest.Publisher
+	// guard locks out devices guessing the password.
+	guard *lockout.Guard
+
+	mu       sync.Mutex
+	sessions map[*session]bool
+}
+
+// New returns a gateway whose messages carry "mqtt:"+name as their server.
+func New(name string, rdb redis.UniversalClient, cfg *config.Store) *Gateway {
+	return &Gateway{
+		rdb:      rdb,
+		cfg:      cfg,
+		pub:      ingest.New(rdb, cfg, "mqtt:"+name),
+		guard:    lockout.New(rdb, cfg, audit.New(rdb, "mqtt:"+name)),
+		sessions: make(map[*session]bool),
+	}
+}
+
+// Serve accepts device connections on ln until ctx is done.
+func (g *Gateway) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				g.closeSessions()
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go newSession(g, conn).serve()
+	}
+}
+
+// ClaimNode claims the gateway's message id node; call it before Run.
+func (g *Gateway) ClaimNode(ctx context.Context) error {
+	return g.pub.ClaimNode(ctx)
+}
+
+// Run relays room messages to subscribed devices and disconnects kicked and
+// banned users until ctx is done.
+func (g *Gateway) Run(ctx context.Context) {
+	go g.pub.HoldNode(ctx)
+	go g.pub.FollowRooms(ctx)
+	channels := []string{broker.ControlChannel, broker.Channel(models.DefaultRoom, g.cfg.Get().Redis.Shards)}
+	pubsub := g.rdb.Subscribe(ctx, channels...)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case raw, ok := <-ch:
+			if !ok {
+				return
+			}
+			if raw.Channel == broker.ControlChannel {
+				g.handleControl(raw.Payload)
+				continue
+			}
+			var msg models.Message
+			if err := json.Unmarshal([]byte(raw.Payload), &msg); err != nil {
+				continue
+			}
+			if models.IsChat(msg.Type) && msg.ID != 0 {
+				g.relay(broker.RoomOf([]byte(raw.Payload)), []byte(raw.Payload))
+			}
+		}
+	}
+}
+
+// relay publishes a room message on every outbound topic mapped to the
+// room, to the devices subscribed to it.
+func (g *Gateway) relay(room string, payload []byte) {
+	var topics []string
+	for _, rule := range g.cfg.Get().MQTT.Rules {
+		if rule.Outbound() && rule.Room == room {
+			topics = append(topics, rule.Topic)
+		}
+	}
+	if len(topics) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for s := range g.sessions {
+		for _, topic := range topics {
+			if s.subscribed(topic) {
+				s.send(encodePublish(topic, payload))
+			}
+		}
+	}
+}
+
+func (g *Gateway) handleControl(raw string) {
+	var cmd models.ControlCommand
+	if err := json.Unmarshal([]byte(raw), &cmd); err != nil {
+		return
+	}
+	switch cmd.Type {
+	case models.ControlKick, models.ControlBan:
+		g.disconnectUser(cmd.UserID)
+	case models.ControlRename:
+		g.mu.Lock()
+		for s := range g.sessions {
+			if s.userID == cmd.UserID {
+				s.setUsername(cmd.NewUsername)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// disconnectUser closes every connection of a kicked or banned user. MQTT
+// has no way to tell a device why.
+func (g *Gateway) disconnectUser(userID int64) {
+	g.mu.Lock()
+	var matched []*session
+	for s := range g.sessions {
+		if s.userID == userID {
+			matched = append(matched, s)
+		}
+	}
+	g.mu.Unlock()
+	for _, s := range matched {
+		s.close()
+	}
+}
+
+// inboundRoom returns the room a device's publish on topic goes to, or ""
+// when no inbound rule matches. The first matching rule wins.
+func (g *Gateway) inboundRoom(topic string) string {
+	for _, rule := range g.cfg.Get().MQTT.Rules {
+		if rule.Inbound() && matches(rule.Topic, topic) {
+			return rule.Room
+		}
+	}
+	return ""
+}
+
+// outboundTopic reports whether a subscription filter can receive any
+// outbound rule's topic.
+func (g *Gateway) outboundTopic(filter string) bool {
+	for _, rule := range g.cfg.Get().MQTT.Rules {
+		if rule.Outbound() && matches(filter, rule.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) addSession(s *session) {
+	g.mu.Lock()
+	g.sessions[s] = true
+	g.mu.Unlock()
+}
+
+func (g *Gateway) removeSession(s *session) {
+	g.mu.Lock()
+	delete(g.sessions, s)
+	g.mu.Unlock()
+}
+
+func (g *Gateway) closeSessions() {
+	g.mu.Lock()
+	sessions := make([]*session, 0, len(g.sessions))
+	for s := range g.sessions {
+		sessions = append(sessions, s)
+	}
+	g.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+// encodePublish builds a QoS 0 PUBLISH packet.
+func encodePublish(topic string, payload []byte) []byte {
+	return encode(typePublish, 0, append(appendString(nil, topic), payload...))
+}
@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Control packet types of MQTT 3.1.1 (the high nibble of the first byte).
+const (
+	typeConnect     = 1
+	typeConnack     = 2
+	typePublish     = 3
+	typePuback      = 4
+	typeSubscribe   = 8
+	typeSuback      = 9
+	typeUnsubscribe = 10
+	typeUnsuback    = 11
+	typePingreq     = 12
+	typePingresp    = 13
+	typeDisconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	connAccepted          = 0
+	connBadProtocol       = 1
+	connServerUnavailable = 3
+	connBadCredentials    = 4
+	connNotAuthorized     = 5
+)
+
+const (
+	protocolLevel311 = 4
+	// subackFailure refuses a filter in SUBACK.
+	subackFailure = 0x80
+	// maxRemainingLenSize is the most bytes the remaining length takes.
+	maxRemainingLenSize = 4
+)
+
+var errMalformed = errors.New("malformed packet")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads one control packet, refusing bodies over maxSize.
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == maxRemainingLenSize {
+			return packet{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > maxSize {
+		return packet{}, fmt.Errorf("packet of %d bytes exceeds the %d byte limit", length, maxSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// encode builds a packet with its fixed header.
+func encode(kind, flags byte, body []byte) []byte {
+	out := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// reader decodes the fields of a packet body.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+type connect struct {
+	protocol  string
+	level     byte
+	keepAlive uint16
+	clientID  string
+	username  string
+	hasUser   bool
+	password  string
+}
+
+func parseConnect(body []byte) (connect, error) {
+	r := reader{b: body}
+	c := connect{protocol: r.string(), level: r.byte()}
+	flags := r.byte()
+	c.keepAlive = r.uint16()
+	c.clientID = r.string()
+	if flags&0x04 != 0 {
+		// The will is parsed past and ignored.
+		r.string()
+		r.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.hasUser = true
+		c.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = string(r.bytes())
+	}
+	if r.err != nil {
+		return connect{}, r.err
+	}
+	return c, nil
+}
+
+type publish struct {
+	topic    string
+	qos      byte
+	packetID uint16
+	payload  []byte
+}
+
+func parsePublish(p packet) (publish, error) {
+	r := reader{b: p.body}
+	pub := publish{topic: r.string(), qos: (p.flags >> 1) & 0x03}
+	if pub.qos > 0 {
+		pub.packetID = r.uint16()
+	}
+	if r.err != nil || pub.qos > 2 || pub.topic == "" || strings.ContainsAny(pub.topic, "+#") {
+		return publish{}, errMalformed
+	}
+	pub.payload = r.b
+	return pub, nil
+}
+
+// parseSubscribe returns the packet id and topic filters of a SUBSCRIBE or
+// UNSUBSCRIBE packet; SUBSCRIBE filters are followed by a QoS byte.
+func parseSubscribe(body []byte, withQoS bool) (uint16, []string, error) {
+	r := reader{b: body}
+	id := r.uint16()
+	var filters []string
+	for r.err == nil && len(r.b) > 0 {
+		filters = append(filters, r.string())
+		if withQoS {
+			r.byte()
+		}
+	}
+	if r.err != nil || len(filters) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, filters, nil
+}
+
+// matches reports whether topic matches filter, with + matching one level
+// and # the rest. Wildcards at the first level don't match topics starting
+// with "$", which are reserved for brokers.
+func matches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
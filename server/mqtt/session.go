@@ -0,0 +1,364 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"lukagolubovic/ingest"
+	"lukagolubovic/lockout"
+	"lukagolubovic/models"
+	"lukagolubovic/ratelimit"
+)
+
+const (
+	// connectTimeout is how long a device has to send CONNECT.
+	connectTimeout = 10 * time.Second
+	// idleTimeout applies to devices that turn keep-alive off.
+	idleTimeout  = 5 * time.Minute
+	writeTimeout = 10 * time.Second
+	sendBuffer   = 256
+)
+
+type session struct {
+	gw   *Gateway
+	conn net.Conn
+	r    *bufio.Reader
+
+	out       chan []byte
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// Set once the device has connected.
+	userID    int64
+	clientID  string
+	keepAlive time.Duration
+
+	mu            sync.Mutex
+	username      string
+	subscriptions map[string]bool
+
+	chatLimit ratelimit.Bucket
+}
+
+func newSession(gw *Gateway, conn net.Conn) *session {
+	return &session{
+		gw:            gw,
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		out:           make(chan []byte, sendBuffer),
+		quit:          make(chan struct{}),
+		subscriptions: make(map[string]bool),
+	}
+}
+
+func (s *session) name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.username
+}
+
+func (s *session) setUsername(name string) {
+	s.mu.Lock()
+	s.username = name
+	s.mu.Unlock()
+}
+
+// subscribed reports whether one of the device's filters matches topic.
+func (s *session) subscribed(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for filter := range s.subscriptions {
+		if matches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues a packet for the writer. A device too slow to keep up is
+// disconnected rather than holding up the room.
+func (s *session) send(packet []byte) {
+	select {
+	case <-s.quit:
+	case s.out <- packet:
+	default:
+		log.Printf("[MQTT] '%s' is too slow, disconnecting it", s.clientID)
+		s.close()
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() { close(s.quit) })
+}
+
+// writePump writes queued packets until the session closes, then closes
+// the connection, which also ends the read loop.
+func (s *session) writePump() {
+	defer s.conn.Close()
+	for {
+		select {
+		case packet := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := s.conn.Write(packet); err != nil {
+				s.close()
+				return
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *session) serve() {
+	if err := s.connect(); err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("[MQTT] connection from %s refused: %v", s.conn.RemoteAddr(), err)
+		}
+		s.conn.Close()
+		return
+	}
+	s.gw.addSession(s)
+	go s.writePump()
+	log.Printf("[MQTT] '%s' connected as '%s'", s.clientID, s.name())
+	defer func() {
+		s.gw.removeSession(s)
+		s.close()
+		log.Printf("[MQTT] '%s' disconnected", s.clientID)
+	}()
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(s.keepAlive))
+		p, err := readPacket(s.r, maxPacketSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[MQTT] connection of '%s' failed: %v", s.clientID, err)
+			}
+			return
+		}
+		if err := s.handle(p); err != nil {
+			log.Printf("[MQTT] connection of '%s' failed: %v", s.clientID, err)
+			return
+		}
+	}
+}
+
+// connect reads CONNECT and answers it, signing the device in as its
+// username. With tokens.required, the password is the user's access token
+// instead of the gateway's password.
+func (s *session) connect() error {
+	s.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(s.r, maxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.kind != typeConnect {
+		return fmt.Errorf("expected CONNECT, got packet type %d", p.kind)
+	}
+	c, err := parseConnect(p.body)
+	if err != nil {
+		return err
+	}
+	if c.protocol != "MQTT" || c.level != protocolLevel311 {
+		s.connack(connBadProtocol)
+		return fmt.Errorf("unsupported protocol %q level %d", c.protocol, c.level)
+	}
+	if c.clientID == "" {
+		// Clean sessions may leave the client id to the server.
+		c.clientID = fmt.Sprintf("%s-%d", s.conn.RemoteAddr(), time.Now().UnixNano())
+	}
+	s.clientID = c.clientID
+
+	cfg := s.gw.cfg.Get()
+	if !c.hasUser {
+		s.connack(connBadCredentials)
+		return errors.New("no username")
+	}
+	if password := cfg.MQTT.Password; password != "" && !cfg.Tokens.Required {
+		if err := s.checkPassword(c, password); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Usernames.Check(c.username); err != nil {
+		s.connack(connNotAuthorized)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	userID, name, err := s.gw.pub.Authenticate(ctx, c.username, c.password)
+	if errors.Is(err, ingest.ErrToken) {
+		s.connack(connBadCredentials)
+		return fmt.Errorf("'%s' was refused: %w", c.username, err)
+	}
+	if errors.Is(err, ingest.ErrBanned) {
+		s.connack(connNotAuthorized)
+		return fmt.Errorf("'%s' is banned", c.username)
+	}
+	if err != nil {
+		s.connack(connServerUnavailable)
+		return fmt.Errorf("failed to resolve '%s': %w", c.username, err)
+	}
+	s.userID = userID
+	s.setUsername(name)
+
+	// Devices must send something within one and a half keep-alive
+	// periods.
+	s.keepAlive = idleTimeout
+	if c.keepAlive > 0 {
+		s.keepAlive = time.Duration(c.keepAlive) * time.Second * 3 / 2
+	}
+	return s.connack(connAccepted)
+}
+
+// checkPassword refuses devices whose address or username is locked out
+// after too many wrong passwords, then checks c's password.
+func (s *session) checkPassword(c connect, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		host = s.conn.RemoteAddr().String()
+	}
+	subjects := []string{lockout.IP(host), lockout.Account("mqtt", c.username)}
+	if wait := s.gw.guard.Locked(ctx, subjects...); wait > 0 {
+		s.connack(connNotAuthorized)
+		return fmt.Errorf("'%s' is locked out for another %s", c.username, wait.Round(time.Second))
+	}
+	if subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) != 1 {
+		s.gw.guard.Fail(ctx, "mqtt_password", subjects...)
+		s.connack(connBadCredentials)
+		return errors.New("wrong password")
+	}
+	s.gw.guard.Reset(ctx, subjects[1])
+	return nil
+}
+
+// connack is written directly, before writePump runs.
+func (s *session) connack(code byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := s.conn.Write(encode(typeConnack, 0, []byte{0, code}))
+	return err
+}
+
+func (s *session) handle(p packet) error {
+	switch p.kind {
+	case typePublish:
+		return s.handlePublish(p)
+	case typeSubscribe:
+		id, filters, err := parseSubscribe(p.body, true)
+		if err != nil {
+			return err
+		}
+		granted := make([]byte, len(filters))
+		for i, filter := range filters {
+			// Room messages are sent at QoS 0 whatever was asked for.
+			if validFilter(filter) && s.gw.outboundTopic(filter) {
+				s.mu.Lock()
+				s.subscriptions[filter] = true
+				s.mu.Unlock()
+			} else {
+				granted[i] = subackFailure
+			}
+		}
+		s.send(encode(typeSuback, 0, append(binary.BigEndian.AppendUint16(nil, id), granted...)))
+	case typeUnsubscribe:
+		id, filters, err := parseSubscribe(p.body, false)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		for _, filter := range filters {
+			delete(s.subscriptions, filter)
+		}
+		s.mu.Unlock()
+		s.send(encode(typeUnsuback, 0, binary.BigEndian.AppendUint16(nil, id)))
+	case typePingreq:
+		s.send(encode(typePingresp, 0, nil))
+	case typeDisconnect:
+		return io.EOF
+	default:
+		return fmt.Errorf("unexpected packet type %d", p.kind)
+	}
+	return nil
+}
+
+// handlePublish posts a device's message to the room its topic maps to.
+// Messages that can't be posted are dropped, since MQTT 3.1.1 can't tell
+// the device why, but QoS 1 messages are still acknowledged so the device
+// doesn't resend them.
+func (s *session) handlePublish(p packet) error {
+	pub, err := parsePublish(p)
+	if err != nil {
+		return err
+	}
+	if pub.qos == 2 {
+		return errors.New("QoS 2 is not supported")
+	}
+	if pub.qos == 1 {
+		defer s.send(encode(typePuback, 0, binary.BigEndian.AppendUint16(nil, pub.packetID)))
+	}
+
+	room := s.gw.inboundRoom(pub.topic)
+	switch {
+	case room == "":
+		log.Printf("[MQTT] '%s' published on '%s', which no rule maps to a room", s.clientID, pub.topic)
+		return nil
+	case room != models.DefaultRoom:
+		log.Printf("[MQTT] '%s' published on '%s' for room '%s', but only %s is bridged", s.clientID, pub.topic, room, models.DefaultRoom)
+		return nil
+	}
+
+	text := strings.TrimSpace(string(pub.payload))
+	switch {
+	case text == "":
+		return nil
+	case !utf8.ValidString(text):
+		log.Printf("[MQTT] dropped a message from '%s' that is not UTF-8 text", s.clientID)
+		return nil
+	case len(text) > s.gw.cfg.Room(models.DefaultRoom).ContentLimit(models.MaxContentSize):
+		log.Printf("[MQTT] dropped a message from '%s' over the room's length limit", s.clientID)
+		return nil
+	case !s.chatLimit.Allow(s.gw.cfg.Get().MessageRate(false)):
+		log.Printf("[MQTT] dropped a message from '%s', sending too fast", s.clientID)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	err = s.gw.pub.Publish(ctx, s.gw.pub.NextID(), s.userID, s.name(), text)
+	switch {
+	case errors.Is(err, ingest.ErrMuted):
+		log.Printf("[MQTT] dropped a message from '%s', '%s' is muted", s.clientID, s.name())
+	case errors.Is(err, ingest.ErrBanned):
+		return fmt.Errorf("'%s' is banned", s.name())
+	case err != nil:
+		log.Printf("[MQTT] failed to publish message from '%s': %v", s.clientID, err)
+	}
+	return nil
+}
+
+// validFilter reports whether a subscription filter is well formed: + and
+// # fill a whole level and # comes last.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && !(level == "#" && i == len(levels)-1) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/identity"
+	"lukagolubovic/models"
+)
+
+const (
+	// offlineAfter is how long since a user was last seen before they count
+	// as offline; servers refresh presence every identity.PresenceInterval.
+	offlineAfter = 3 * identity.PresenceInterval
+	// maxListed caps the mentions quoted in one digest; the rest are
+	// counted.
+	maxListed = 20
+	// maxScanned bounds the candidate messages read per user and run.
+	maxScanned  = 500
+	sendTimeout = 30 * time.Second
+)
+
+// Digester sends each opted-in user who is offline the mentions they
+// missed, at most once per their digest period.
+type Digester struct {
+	rdb    redis.UniversalClient
+	db     *sql.DB
+	cfg    *config.Store
+	sender Sender
+}
+
+// NewDigester reads messages from db, a read-only copy of a chat server's
+// or the history service's database.
+func NewDigester(rdb redis.UniversalClient, db *sql.DB, cfg *config.Store, sender Sender) *Digester {
+	return &Digester{rdb: rdb, db: db, cfg: cfg, sender: sender}
+}
+
+// RunOnce sends the digests that are due at now, returning how it failed
+// when the preferences couldn't be read. Failures for single users are
+// logged and retried on the next run.
+func (d *Digester) RunOnce(ctx context.Context, now time.Time) error {
+	cfg := d.cfg.Get().Notifications
+	if !cfg.Enabled() {
+		return errors.New("notifications have no secret in the config")
+	}
+	prefs, err := All(ctx, d.rdb)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for userID, p := range prefs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, err := d.digest(ctx, cfg, userID, p, now)
+		if err != nil {
+			log.Printf("[Digest] user %d: %v", userID, err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("[Digest] sent %d digest(s)\n", sent)
+	}
+	return nil
+}
+
+// digest emails one user their missed mentions if a digest is due,
+// reporting whether one was sent.
+func (d *Digester) digest(ctx context.Context, cfg config.Notifications, userID int64, p Prefs, now time.Time) (bool, error) {
+	period := p.Period()
+	if period == 0 {
+		return false, nil
+	}
+	id := strconv.FormatInt(userID, 10)
+	lastSent, err := d.unixTime(ctx, SentKey, id)
+	if err != nil {
+		return false, err
+	}
+	if now.Sub(lastSent) < period {
+		return false, nil
+	}
+	lastSeen, err := d.unixTime(ctx, identity.LastSeenKey, id)
+	if err != nil {
+		return false, err
+	}
+	if now.Sub(lastSeen) < offlineAfter {
+		return false, nil
+	}
+	banned, err := d.rdb.SIsMember(ctx, identity.BannedKey, userID).Result()
+	if err != nil || banned {
+		return false, err
+	}
+	username, err := d.rdb.HGet(ctx, identity.UsernamesKey, id).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Only what arrived since the user left, and since the last digest,
+	// counts as missed. Users who were never seen get one period's worth.
+	since := lastSeen
+	if lastSent.After(since) {
+		since = lastSent
+	}
+	if since.IsZero() {
+		since = now.Add(-period)
+	}
+	mentions, err := database.Mentions(d.db, models.DefaultRoomID, userID, username, since, maxScanned)
+	if err != nil {
+		return false, err
+	}
+	if len(mentions) == 0 {
+		return false, nil
+	}
+
+	link := cfg.UnsubscribeURL + "?token=" + url.QueryEscape(UnsubscribeToken([]byte(cfg.Secret), userID))
+	email := Email{
+		To:      p.Email,
+		Subject: subject(len(mentions)),
+		Body:    body(username, mentions, link),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + link + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if err := d.sender.Send(sendCtx, email); err != nil {
+		return false, fmt.Errorf("send to %s: %w", p.Email, err)
+	}
+	return true, d.rdb.HSet(ctx, SentKey, id, now.Unix()).Err()
+}
+
+// unixTime reads a Unix time from a hash, the zero time when it is unset.
+func (d *Digester) unixTime(ctx context.Context, key, field string) (time.Time, error) {
+	v, err := d.rdb.HGet(ctx, key, field).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(v, 0), nil
+}
+
+func subject(n int) string {
+	if n == 1 {
+		return "You were mentioned in #" + models.DefaultRoom
+	}
+	return fmt.Sprintf("You were mentioned %d times in #%s", n, models.DefaultRoom)
+}
+
+func body(username string, mentions []models.Message, unsubscribe string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nyou were mentioned while you were away:\n\n", username)
+	for i, msg := range mentions {
+		if i == maxListed {
+			fmt.Fprintf(&b, "...and %d more.\n\n", len(mentions)-maxListed)
+			break
+		}
+		fmt.Fprintf(&b, "[%s] %s: %s\n\n", sentAt(msg.Timestamp), msg.Username, msg.Content)
+	}
+	fmt.Fprintf(&b, "-- \nTo stop these emails, open %s\n", unsubscribe)
+	return b.String()
+}
+
+// sentAt formats a stored timestamp, which the driver returns as RFC 3339
+// or as stored, to the minute.
+func sentAt(timestamp string) string {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return t.UTC().Format("2006-01-02 15:04 UTC")
+		}
+	}
+	return timestamp
+}
@@ -0,0 +1,166 @@
+// Package notify emails users a digest of the messages that mentioned them
+// while they were offline. Users opt in through their notification
+// preferences, kept in Redis, and every digest carries a signed link that
+// turns digests off again.
+//
+// The digest job runs in cmd/digest and reads messages from a copy of the
+// message store; chat servers serve the unsubscribe link and record when
+// users were last connected (see identity.LastSeenKey).
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// PrefsKey is a hash of user ids to their JSON preferences; SentKey is a
+// hash of user ids to the Unix time of their last digest.
+const (
+	PrefsKey = "chat:{users}:notify"
+	SentKey  = "chat:{users}:digest-sent"
+)
+
+// Digest frequencies.
+const (
+	Off    = "off"
+	Hourly = "hourly"
+	Daily  = "daily"
+)
+
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+// Prefs are a user's notification preferences. The zero value sends
+// nothing.
+type Prefs struct {
+	Email string `json:"email"`
+	// Digest is how often missed mentions are emailed: "off", "hourly"
+	// or "daily".
+	Digest string `json:"digest"`
+}
+
+func (p Prefs) Validate() error {
+	switch p.Digest {
+	case "", Off, Hourly, Daily:
+	default:
+		return fmt.Errorf("digest %q must be off, hourly or daily", p.Digest)
+	}
+	if p.Email == "" {
+		if p.Digest != "" && p.Digest != Off {
+			return errors.New("email is required to receive digests")
+		}
+		return nil
+	}
+	addr, err := mail.ParseAddress(p.Email)
+	if err != nil || addr.Address != p.Email {
+		return fmt.Errorf("email %q is not a plain email address", p.Email)
+	}
+	return nil
+}
+
+// Period is the time between two digests, zero when they are off.
+func (p Prefs) Period() time.Duration {
+	if p.Email == "" {
+		return 0
+	}
+	switch p.Digest {
+	case Hourly:
+		return time.Hour
+	case Daily:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// Load returns a user's preferences, the zero Prefs when none are set.
+func Load(ctx context.Context, rdb redis.UniversalClient, userID int64) (Prefs, error) {
+	var p Prefs
+	raw, err := rdb.HGet(ctx, PrefsKey, strconv.FormatInt(userID, 10)).Result()
+	if err == redis.Nil {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	return p, json.Unmarshal([]byte(raw), &p)
+}
+
+func Save(ctx context.Context, rdb redis.UniversalClient, userID int64, p Prefs) error {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, PrefsKey, userID, raw).Err()
+}
+
+// All returns the preferences of every user who has set any.
+func All(ctx context.Context, rdb redis.UniversalClient) (map[int64]Prefs, error) {
+	raw, err := rdb.HGetAll(ctx, PrefsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	prefs := make(map[int64]Prefs, len(raw))
+	for id, value := range raw {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		var p Prefs
+		if err := json.Unmarshal([]byte(value), &p); err != nil {
+			continue
+		}
+		prefs[userID] = p
+	}
+	return prefs, nil
+}
+
+// Unsubscribe turns a user's digests off, keeping their email address.
+func Unsubscribe(ctx context.Context, rdb redis.UniversalClient, userID int64) error {
+	p, err := Load(ctx, rdb, userID)
+	if err != nil {
+		return err
+	}
+	p.Digest = Off
+	return Save(ctx, rdb, userID, p)
+}
+
+// UnsubscribeToken signs a user id as "<user id>.<signature>". Tokens don't
+// expire, since digests sit in inboxes indefinitely.
+func UnsubscribeToken(secret []byte, userID int64) string {
+	id := strconv.FormatInt(userID, 10)
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac(secret, id))
+}
+
+// VerifyUnsubscribe returns the user id an unsubscribe token was issued
+// for.
+func VerifyUnsubscribe(secret []byte, token string) (int64, error) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, ErrInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(secret, id)) {
+		return 0, ErrInvalidToken
+	}
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+func mac(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("unsubscribe:" + payload))
+	return h.Sum(nil)
+}
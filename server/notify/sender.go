@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Email is a plain-text message. Headers are added to the standard ones.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// Sender delivers digests. SMTP is the production provider; other
+// providers, such as an HTTP email API, implement the same interface.
+type Sender interface {
+	Send(ctx context.Context, e Email) error
+}
+
+// SMTP sends through an SMTP relay, upgrading to TLS when the relay offers
+// STARTTLS. Username and Password, when set, authenticate with PLAIN,
+// which net/smtp only allows over TLS or to localhost.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTP) Send(ctx context.Context, e Email) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg, err := compose(s.From, e)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp has no context support, so a cancelled send is abandoned
+	// rather than interrupted.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.Addr, auth, s.From, []string{e.To}, msg) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Log writes emails to the log instead of sending them, for development
+// and dry runs.
+type Log struct{}
+
+func (Log) Send(_ context.Context, e Email) error {
+	log.Printf("[Digest] would email %s: %s\n%s", e.To, e.Subject, e.Body)
+	return nil
+}
+
+// compose renders e as an RFC 5322 message from from.
+func compose(from string, e Email) ([]byte, error) {
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndexByte(from, '@'); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	headers := map[string]string{
+		"From":                      from,
+		"To":                        e.To,
+		"Subject":                   mime.QEncoding.Encode("utf-8", e.Subject),
+		"Date":                      time.Now().Format(time.RFC1123Z),
+		"Message-ID":                fmt.Sprintf("<%s@%s>", hex.EncodeToString(id[:]), domain),
+		"MIME-Version":              "1.0",
+		"Content-Type":              `text/plain; charset="utf-8"`,
+		"Content-Transfer-Encoding": "8bit",
+		"Auto-Submitted":            "auto-generated",
+	}
+	for k, v := range e.Headers {
+		headers[k] = v
+	}
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %s has a line break", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+	}
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(e.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
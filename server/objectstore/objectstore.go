@@ -0,0 +1,148 @@
+// Package objectstore reads and writes objects in S3-compatible storage,
+// such as AWS S3 or MinIO, or in a local directory for development. It is
+// shared by the archive, attachments, backups and the analytics sink.
+// Small objects are written and read whole; large ones, such as backups,
+// are streamed in with Upload, which S3 takes in parts.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lukagolubovic/config"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type Store interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+	// Upload writes an object read from r, without holding it in memory
+	// whole.
+	Upload(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Get returns ErrNotFound for a missing key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete succeeds for a missing key.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// New returns the store cfg describes.
+func New(cfg config.ObjectStorage) Store {
+	if cfg.Store == config.ObjectStoreS3 {
+		s := NewS3(cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.AccessKey, cfg.SecretKey)
+		if cfg.PartSize > 0 {
+			s.PartSize = cfg.PartSize
+		}
+		return s
+	}
+	return Dir(cfg.Dir)
+}
+
+// Dir keeps objects as files below a directory, keys mapping to relative
+// paths.
+type Dir string
+
+func (d Dir) Put(_ context.Context, key string, body []byte, _ string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write then rename, so readers never see half an object.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d Dir) Upload(_ context.Context, key string, r io.Reader, _ string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d Dir) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return body, err
+}
+
+func (d Dir) Delete(_ context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d Dir) List(_ context.Context, prefix string) ([]string, error) {
+	// Only the directory holding the prefix's last segment is walked.
+	root := filepath.Join(string(d), filepath.FromSlash(prefix[:strings.LastIndexByte(prefix, '/')+1]))
+	var keys []string
+	err := filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (d Dir) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if key == "" || strings.HasSuffix(key, "/") || clean != "/"+key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(string(d), filepath.FromSlash(clean)), nil
+}
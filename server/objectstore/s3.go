@@ -0,0 +1,398 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeout = time.Minute
+
+	// DefaultPartSize is the size of the parts Upload sends; S3 takes up to
+	// 10,000 parts, so objects up to about 80 GB.
+	DefaultPartSize = 8 << 20
+)
+
+// S3 talks to an S3-compatible service with path-style URLs
+// ("<endpoint>/<bucket>/<key>"), which AWS and MinIO both accept, signing
+// requests with AWS Signature Version 4.
+type S3 struct {
+	// Endpoint is the service URL, e.g. "https://s3.eu-west-1.amazonaws.com"
+	// or "http://minio:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PartSize is the size of the parts Upload sends objects larger than
+	// it in.
+	PartSize int64
+
+	client *http.Client
+}
+
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) *S3 {
+	return &S3{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PartSize:  DefaultPartSize,
+		client:    &http.Client{Timeout: requestTimeout},
+	}
+}
+
+func (s *S3) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	req, err := s.request(ctx, http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Upload sends an object that fits in one part with a single request, and
+// a larger one as a multipart upload, holding one part in memory at a
+// time. A failed multipart upload is aborted, so its parts aren't kept.
+func (s *S3) Upload(ctx context.Context, key string, r io.Reader, contentType string) error {
+	part := make([]byte, s.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.Put(ctx, key, part[:n], contentType)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipart(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	for number := 1; n > 0; number++ {
+		etag, err := s.uploadPart(ctx, key, uploadID, number, part[:n])
+		if err != nil {
+			s.abortMultipart(key, uploadID)
+			return err
+		}
+		parts = append(parts, completedPart{Number: number, ETag: etag})
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(key, uploadID)
+			return err
+		}
+	}
+	if err := s.completeMultipart(ctx, key, uploadID, parts); err != nil {
+		s.abortMultipart(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+type completedPart struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (s *S3) createMultipart(ctx context.Context, key, contentType string) (string, error) {
+	req, err := s.request(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.doXML(req, nil, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("POST %s: no upload id", req.URL.Path)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3) uploadPart(ctx context.Context, key, uploadID string, number int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := s.request(ctx, http.MethodPut, key, query, body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.do(req, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3) completeMultipart(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	req, err := s.request(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	// S3 can answer 200 and still fail, with an Error document.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := s.doXML(req, body, &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("POST %s: %s: %s", req.URL.Path, result.Code, result.Message)
+	}
+	return nil
+}
+
+// abortMultipart discards the parts of a failed upload. The caller's
+// context may be what failed, so it has its own.
+func (s *S3) abortMultipart(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := s.request(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := s.do(req, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// List pages through ListObjectsV2.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := s.doXML(req, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// request builds a request for key, or for the bucket when key is empty.
+func (s *S3) request(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := s.Endpoint + "/" + s.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = encodeQuery(query)
+	return http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+}
+
+// doXML sends req and decodes its XML answer into v.
+func (s *S3) doXML(req *http.Request, body []byte, v interface{}) error {
+	resp, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// do signs and sends req, turning error answers into errors.
+func (s *S3) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		signed = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+		values["content-type"] = ct
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + strings.TrimSpace(values[name]) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		encodeQuery(req.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	for _, part := range []string{s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// encodePath escapes a path the way Signature Version 4 expects: every
+// byte but unreserved characters and "/" is percent-encoded.
+func encodePath(path string) string {
+	return uriEncode(path, "/")
+}
+
+// encodeQuery sorts and escapes a query the way Signature Version 4
+// expects: keys and values are encoded as RFC 3986 says, so "~" stays as
+// it is and spaces become %20, and pairs are sorted by key, then value.
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, "")+"="+uriEncode(v, ""))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters
+// of RFC 3986 and those in keep.
+func uriEncode(s, keep string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || strings.IndexByte(keep, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,137 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"lukagolubovic/database"
+)
+
+const (
+	batchSize    = 100
+	pollInterval = time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+type PublishFunc func(ctx context.Context, payload []byte) error
+
+type Relay struct {
+	address string
+	db      *sql.DB
+	writer  *database.Writer
+	publish PublishFunc
+	notify  chan struct{}
+}
+
+func New(address string, db *sql.DB, writer *database.Writer, publish PublishFunc) *Relay {
+	return &Relay{
+		address: address,
+		db:      db,
+		writer:  writer,
+		publish: publish,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func Enqueue(tx *sql.Tx, payload []byte) error {
+	_, err := tx.Exec("INSERT INTO outbox(payload) VALUES(?)", payload)
+	return err
+}
+
+func (r *Relay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.notify:
+		}
+
+		if err := r.drain(ctx); err != nil {
+			backoff = nextBackoff(backoff)
+			log.Printf("[Server %s] Outbox relay error, retrying in %s: %v", r.address, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			r.Notify()
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// drain publishes pending entries in insertion order and stops at the first
+// failure so that later messages are never broadcast ahead of earlier ones.
+func (r *Relay) drain(ctx context.Context) error {
+	for {
+		rows, err := r.db.QueryContext(ctx, "SELECT id, payload FROM outbox ORDER BY id LIMIT ?", batchSize)
+		if err != nil {
+			return err
+		}
+
+		type entry struct {
+			id      int64
+			payload []byte
+		}
+		var entries []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.id, &e.payload); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := r.publish(ctx, e.payload); err != nil {
+				r.writer.Tx(func(tx *sql.Tx) error {
+					_, err := tx.Exec("UPDATE outbox SET attempts = attempts + 1 WHERE id = ?", e.id)
+					return err
+				})
+				return err
+			}
+			err := r.writer.Tx(func(tx *sql.Tx) error {
+				_, err := tx.Exec("DELETE FROM outbox WHERE id = ?", e.id)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < batchSize {
+			return nil
+		}
+	}
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	if current == 0 {
+		return 100 * time.Millisecond
+	}
+	current *= 2
+	if current > maxBackoff {
+		return maxBackoff
+	}
+	return current
+}
@@ -0,0 +1,65 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+	"lukagolubovic/webhook"
+)
+
+// EventMessagePersisted is the event type of the requests of http hooks.
+const EventMessagePersisted = "message.persisted"
+
+// httpHook posts each message as a webhook.Event, signed and with the
+// same headers as webhook deliveries so receivers can share their checks.
+// The event id is the message id, for receivers to drop repeats.
+type httpHook struct {
+	cfg    config.PersistHook
+	source string
+	client *http.Client
+}
+
+func newHTTPHook(source string, cfg config.PersistHook) *httpHook {
+	return &httpHook{cfg: cfg, source: source, client: &http.Client{}}
+}
+
+func (h *httpHook) Name() string {
+	return h.cfg.Name
+}
+
+func (h *httpHook) Persist(ctx context.Context, msg models.Message) error {
+	id := strconv.FormatInt(msg.ID, 10)
+	body, err := json.Marshal(webhook.Event{ID: id, Type: EventMessagePersisted, Time: time.Now().UTC(), Source: h.source, Data: msg})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", EventMessagePersisted)
+	req.Header.Set("X-Webhook-Id", id)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhook.Sign(h.cfg.Secret, timestamp, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
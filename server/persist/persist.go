@@ -0,0 +1,302 @@
+// Package persist writes stored messages through to external systems, such
+// as a search index or a data warehouse. Hooks run on a worker queue after
+// the message is committed, so a slow or failing system never holds up
+// chat. Failed writes are retried with exponential backoff; messages still
+// failing after the last attempt, or that don't fit in the queue, are kept
+// in the dead_letters table until an admin retries or discards them.
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/metrics"
+	"lukagolubovic/models"
+)
+
+const (
+	queueSize      = 1024
+	persistTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnknownHook = errors.New("no persistence hook by that name")
+	ErrNotFound    = errors.New("dead letter not found")
+)
+
+// Hook writes one stored message to an external system. Persist may be
+// called again with the same message after a failure or a retried dead
+// letter, so it should be idempotent, e.g. keyed by the message id.
+type Hook interface {
+	Name() string
+	Persist(ctx context.Context, msg models.Message) error
+}
+
+type job struct {
+	hook    Hook
+	msg     models.Message
+	attempt int
+}
+
+// Runner hands stored messages to every hook. A Runner without hooks drops
+// messages.
+type Runner struct {
+	address string
+	db      *sql.DB
+	writer  *database.Writer
+	cfg     config.Persistence
+	queue   chan job
+
+	mu       sync.Mutex
+	hooks    []Hook
+	retries  map[*time.Timer]job
+	stopping bool
+}
+
+// New returns a runner with the hooks configured in cfg. address
+// identifies this server in what the hooks send.
+func New(address string, db *sql.DB, writer *database.Writer, cfg config.Persistence) *Runner {
+	r := &Runner{
+		address: address,
+		db:      db,
+		writer:  writer,
+		cfg:     cfg,
+		queue:   make(chan job, queueSize),
+		retries: make(map[*time.Timer]job),
+	}
+	for _, hook := range cfg.Hooks {
+		switch hook.Type {
+		case config.PersistHTTP:
+			r.hooks = append(r.hooks, newHTTPHook(address, hook))
+		}
+	}
+	return r
+}
+
+// Register adds a hook built in code rather than configured. Its name must
+// not be used by another hook.
+func (r *Runner) Register(hook Hook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hook(hook.Name()) != nil {
+		return fmt.Errorf("persistence hook %q is already registered", hook.Name())
+	}
+	r.hooks = append(r.hooks, hook)
+	return nil
+}
+
+// hook must be called with r.mu held.
+func (r *Runner) hook(name string) Hook {
+	for _, h := range r.hooks {
+		if h.Name() == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Enqueue queues msg for every hook without waiting. What doesn't fit in
+// the queue, or arrives once the runner is stopping, is dead-lettered.
+func (r *Runner) Enqueue(msg models.Message) {
+	r.mu.Lock()
+	hooks := r.hooks
+	r.mu.Unlock()
+	for _, hook := range hooks {
+		r.enqueue(job{hook: hook, msg: msg})
+	}
+}
+
+func (r *Runner) enqueue(j job) {
+	r.mu.Lock()
+	var cause error
+	if r.stopping {
+		cause = errors.New("server stopped")
+	} else {
+		select {
+		case r.queue <- j:
+		default:
+			cause = errors.New("queue full")
+		}
+	}
+	r.mu.Unlock()
+	if cause != nil {
+		r.deadLetter(j, cause)
+	}
+}
+
+// Run persists queued messages until ctx is done. It then dead-letters
+// the messages still queued or waiting for a retry, so the next start can
+// retry them.
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	r.mu.Lock()
+	r.stopping = true
+	var left []job
+	for timer, j := range r.retries {
+		if timer.Stop() {
+			left = append(left, j)
+		}
+	}
+	r.retries = nil
+	r.mu.Unlock()
+drain:
+	for {
+		select {
+		case j := <-r.queue:
+			left = append(left, j)
+		default:
+			break drain
+		}
+	}
+	for _, j := range left {
+		r.deadLetter(j, errors.New("server stopped"))
+	}
+}
+
+func (r *Runner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-r.queue:
+			r.persist(ctx, j)
+		}
+	}
+}
+
+func (r *Runner) persist(ctx context.Context, j job) {
+	j.attempt++
+	err := r.call(ctx, j)
+	if err == nil {
+		metrics.Persistence.Add("persisted", 1)
+		return
+	}
+	if ctx.Err() != nil || j.attempt >= r.cfg.MaxAttempts {
+		r.deadLetter(j, err)
+		return
+	}
+
+	// Retries wait off the workers so one failing hook can't hold up the
+	// others.
+	metrics.Persistence.Add("retried", 1)
+	wait := time.Duration(r.cfg.RetrySeconds) * time.Second << (j.attempt - 1)
+	log.Printf("[Server %s] Persistence hook %s failed for message %d, retrying in %s: %v", r.address, j.hook.Name(), j.msg.ID, wait, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		r.mu.Lock()
+		_, ok := r.retries[timer]
+		delete(r.retries, timer)
+		r.mu.Unlock()
+		if ok {
+			r.enqueue(j)
+		}
+	})
+	r.retries[timer] = j
+}
+
+// call contains a hook's panic to the one message.
+func (r *Runner) call(ctx context.Context, j job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("persist_"+j.hook.Name(), v)
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, persistTimeout)
+	defer cancel()
+	return j.hook.Persist(ctx, j.msg)
+}
+
+func (r *Runner) deadLetter(j job, cause error) {
+	metrics.Persistence.Add("dead_lettered", 1)
+	log.Printf("[Server %s] Persistence hook %s gave up on message %d after %d attempts: %v", r.address, j.hook.Name(), j.msg.ID, j.attempt, cause)
+	payload, err := json.Marshal(j.msg)
+	if err != nil {
+		log.Printf("[Server %s] Failed to encode dead letter: %v", r.address, err)
+		return
+	}
+	d := database.DeadLetter{Hook: j.hook.Name(), MessageID: j.msg.ID, Payload: payload, Error: cause.Error(), Attempts: j.attempt}
+	if err := r.writer.Tx(func(tx *sql.Tx) error { return database.InsertDeadLetter(tx, d) }); err != nil {
+		log.Printf("[Server %s] Failed to store dead letter for message %d: %v", r.address, j.msg.ID, err)
+	}
+}
+
+// DeadLetters lists dead letters after the id after, oldest first,
+// optionally only those of one hook.
+func (r *Runner) DeadLetters(ctx context.Context, hook string, after int64, limit int) ([]database.DeadLetter, error) {
+	return database.DeadLetters(ctx, r.db, hook, after, limit)
+}
+
+// Retry queues a dead letter for its hook again, starting over with its
+// attempts, and removes it. It is dead-lettered anew if it fails again.
+func (r *Runner) Retry(id int64) error {
+	d, err := database.GetDeadLetter(r.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	hook := r.hook(d.Hook)
+	r.mu.Unlock()
+	if hook == nil {
+		return ErrUnknownHook
+	}
+	var msg models.Message
+	if err := json.Unmarshal(d.Payload, &msg); err != nil {
+		return fmt.Errorf("dead letter %d: %w", id, err)
+	}
+
+	var found bool
+	if err := r.writer.Tx(func(tx *sql.Tx) error {
+		var err error
+		found, err = database.DeleteDeadLetter(tx, id)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !found {
+		// Retried or discarded concurrently.
+		return ErrNotFound
+	}
+	metrics.Persistence.Add("redriven", 1)
+	r.enqueue(job{hook: hook, msg: msg})
+	return nil
+}
+
+// Discard deletes a dead letter without retrying it.
+func (r *Runner) Discard(id int64) error {
+	var found bool
+	if err := r.writer.Tx(func(tx *sql.Tx) error {
+		var err error
+		found, err = database.DeleteDeadLetter(tx, id)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// offenseWindow is how long rejections are counted towards a block.
+	offenseWindow = time.Minute
+	// idleAfter is how long an unused key is kept.
+	idleAfter     = 10 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// KeyedLimits configures a Keyed limiter.
+type KeyedLimits struct {
+	Rate  float64
+	Burst int
+	// BlockAfter rejections within a minute block the key for BlockFor;
+	// zero never blocks.
+	BlockAfter int
+	BlockFor   time.Duration
+}
+
+type keyState struct {
+	bucket       Bucket
+	rejected     int
+	windowStart  time.Time
+	blockedUntil time.Time
+	lastSeen     time.Time
+}
+
+// Keyed keeps one bucket per key, such as a client IP, and blocks keys
+// that keep going past their limit. It is safe for concurrent use.
+type Keyed struct {
+	mu        sync.Mutex
+	keys      map[string]*keyState
+	lastSweep time.Time
+}
+
+func NewKeyed() *Keyed {
+	return &Keyed{keys: make(map[string]*keyState)}
+}
+
+// Allow takes a token for key. When it can't, it returns how long the
+// caller should wait, and whether this rejection started a block.
+func (k *Keyed) Allow(key string, limits KeyedLimits) (ok bool, retryAfter time.Duration, blocked bool) {
+	if limits.Rate <= 0 {
+		return true, 0, false
+	}
+	now := time.Now()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.sweep(now)
+
+	s := k.keys[key]
+	if s == nil {
+		s = &keyState{}
+		k.keys[key] = s
+	}
+	s.lastSeen = now
+	if now.Before(s.blockedUntil) {
+		return false, s.blockedUntil.Sub(now), false
+	}
+	if s.bucket.Allow(limits.Rate, limits.Burst) {
+		return true, 0, false
+	}
+
+	if now.Sub(s.windowStart) > offenseWindow {
+		s.windowStart, s.rejected = now, 0
+	}
+	s.rejected++
+	if limits.BlockAfter > 0 && s.rejected >= limits.BlockAfter {
+		s.blockedUntil = now.Add(limits.BlockFor)
+		s.rejected = 0
+		return false, limits.BlockFor, true
+	}
+	return false, time.Duration(float64(time.Second) / limits.Rate), false
+}
+
+// sweep drops idle keys that aren't blocked; k.mu must be held.
+func (k *Keyed) sweep(now time.Time) {
+	if now.Sub(k.lastSweep) < sweepInterval {
+		return
+	}
+	k.lastSweep = now
+	for key, s := range k.keys {
+		if now.Sub(s.lastSeen) > idleAfter && now.After(s.blockedUntil) {
+			delete(k.keys, key)
+		}
+	}
+}
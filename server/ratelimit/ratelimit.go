@@ -0,0 +1,61 @@
+// Package ratelimit has the token buckets that limit how fast connections
+// may send, and how many bytes they may move.
+package ratelimit
+
+import "time"
+
+// Bucket is refilled at rate tokens per second up to burst. It is not safe
+// for concurrent use; each connection touches its buckets from the
+// goroutine reading it, or from the one writing it for its outbound bytes.
+type Bucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Allow takes a token if one is available.
+func (b *Bucket) Allow(rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	b.refill(rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes n tokens, going into debt when there aren't enough, and
+// returns how long the caller should wait for the debt to be paid off. It
+// suits budgets such as bytes, where one take may exceed the burst.
+func (b *Bucket) Reserve(rate float64, burst int, n int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+
+	b.refill(rate, burst)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (b *Bucket) refill(rate float64, burst int) {
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	now := time.Now()
+	if b.lastRefill.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.lastRefill).Seconds() * rate
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+	}
+	b.lastRefill = now
+}
@@ -0,0 +1,118 @@
+// Package redisconn builds the Redis client described by the config file:
+// a single server, a Sentinel-managed master or a Redis Cluster, with its
+// credentials, database, TLS and pool settings.
+package redisconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+)
+
+// Dialer opens connections to Redis nodes, e.g. over mutual TLS. Nil uses
+// plain TCP, or TLS when the config asks for it.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// New returns a client for cfg. defaultAddr, normally the -redis flag, is
+// used when cfg lists no addresses.
+func New(cfg config.Redis, defaultAddr string, dial Dialer) (redis.UniversalClient, error) {
+	addrs := cfg.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{defaultAddr}
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS && dial == nil {
+		var err error
+		if tlsConfig, err = loadTLS(cfg.TLSCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Mode {
+	case config.RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    addrs,
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: cfg.SentinelPassword,
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+			PoolSize:         cfg.PoolSize,
+			TLSConfig:        tlsConfig,
+			Dialer:           dial,
+		}), nil
+	case config.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			PoolSize:  cfg.PoolSize,
+			TLSConfig: tlsConfig,
+			Dialer:    dial,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      addrs[0],
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			DB:        cfg.DB,
+			PoolSize:  cfg.PoolSize,
+			TLSConfig: tlsConfig,
+			Dialer:    dial,
+		}), nil
+	}
+}
+
+// loadTLS verifies servers against caFile, or the system roots when it is
+// empty. The server name is taken from each node's address on dial.
+func loadTLS(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read redis CA file: %w", err)
+	}
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return cfg, nil
+}
+
+// Describe names the Redis deployment for logs. It never includes
+// credentials.
+func Describe(cfg config.Redis, defaultAddr string) string {
+	addrs := cfg.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{defaultAddr}
+	}
+
+	var desc string
+	switch cfg.Mode {
+	case config.RedisSentinel:
+		desc = fmt.Sprintf("master %q via sentinels %s", cfg.MasterName, strings.Join(addrs, ","))
+	case config.RedisCluster:
+		desc = "cluster " + strings.Join(addrs, ",")
+	default:
+		desc = addrs[0]
+	}
+	if cfg.DB != 0 {
+		desc += fmt.Sprintf(" db %d", cfg.DB)
+	}
+	if cfg.Username != "" {
+		desc += " as " + cfg.Username
+	}
+	return desc
+}
@@ -0,0 +1,194 @@
+// Package roomconfig keeps the room overrides in Redis, where every chat
+// server, gateway and the bridge reads them, so a process that starts after
+// a change still sees it. Servers also cache the overrides in their
+// databases, for starting while Redis is unreachable.
+package roomconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+)
+
+// Key is the hash of every room's overrides as JSON, by room name. Rooms
+// whose overrides were removed keep an empty object rather than losing
+// their field, so Seed never brings back overrides from a stale cache.
+const Key = "chat:{rooms}:overrides"
+
+const (
+	// updateAttempts bounds how often Update retries after concurrent
+	// changes to the hash.
+	updateAttempts = 10
+	// followResync is how often Follow reloads every room, to catch changes
+	// whose commands it missed while disconnected.
+	followResync = time.Minute
+)
+
+var ErrContention = errors.New("room overrides changed too often to update")
+
+// Load returns the overrides of every room that has some.
+func Load(ctx context.Context, rdb redis.UniversalClient) (map[string]config.RoomOverrides, error) {
+	stored, err := rdb.HGetAll(ctx, Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]config.RoomOverrides, len(stored))
+	for room, raw := range stored {
+		o, err := decode(raw)
+		if err != nil {
+			log.Printf("[RoomConfig] Invalid overrides stored for room '%s': %v", room, err)
+			continue
+		}
+		if !o.IsZero() {
+			all[room] = o
+		}
+	}
+	return all, nil
+}
+
+// Get returns a room's overrides, which are zero if it has none.
+func Get(ctx context.Context, rdb redis.UniversalClient, room string) (config.RoomOverrides, error) {
+	raw, err := rdb.HGet(ctx, Key, room).Result()
+	if err != nil && err != redis.Nil {
+		return config.RoomOverrides{}, err
+	}
+	return decode(raw)
+}
+
+// Seed stores a room's overrides unless Redis already has them, reporting
+// whether it did. It moves overrides kept only in a server's database,
+// from before Redis held them.
+func Seed(ctx context.Context, rdb redis.UniversalClient, room string, o config.RoomOverrides) (bool, error) {
+	raw, err := json.Marshal(o)
+	if err != nil {
+		return false, err
+	}
+	return rdb.HSetNX(ctx, Key, room, raw).Result()
+}
+
+// Update changes a room's overrides with update and returns the result.
+// update gets the current overrides and may refuse the change by returning
+// an error, which Update returns. The change is written only if the hash
+// didn't change meanwhile, and retried otherwise, so concurrent updates
+// from any process never undo each other.
+func Update(ctx context.Context, rdb redis.UniversalClient, room string, update func(*config.RoomOverrides) error) (config.RoomOverrides, error) {
+	for range updateAttempts {
+		var o config.RoomOverrides
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			raw, err := tx.HGet(ctx, Key, room).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if o, err = decode(raw); err != nil {
+				return fmt.Errorf("stored overrides: %w", err)
+			}
+			if err := update(&o); err != nil {
+				return err
+			}
+			b, err := json.Marshal(o)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, Key, room, b)
+				return nil
+			})
+			return err
+		}, Key)
+		if err != redis.TxFailedErr {
+			return o, err
+		}
+	}
+	return config.RoomOverrides{}, ErrContention
+}
+
+// Sync replaces the room overrides applied by cfg with those in Redis and
+// returns them. Rooms whose overrides don't fit cfg's configuration are
+// logged and left without overrides, as loading them from a file would.
+func Sync(ctx context.Context, rdb redis.UniversalClient, cfg *config.Store) (map[string]config.RoomOverrides, error) {
+	all, err := Load(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+	for _, room := range cfg.OverriddenRooms() {
+		if _, ok := all[room]; !ok {
+			all[room] = config.RoomOverrides{}
+		}
+	}
+	for room, o := range all {
+		if err := cfg.SetRoomOverrides(room, o); err != nil {
+			log.Printf("[RoomConfig] Ignoring overrides of room '%s': %v", room, err)
+		}
+	}
+	return all, nil
+}
+
+// Refresh applies a room's overrides from Redis to cfg and returns them.
+func Refresh(ctx context.Context, rdb redis.UniversalClient, cfg *config.Store, room string) (config.RoomOverrides, error) {
+	o, err := Get(ctx, rdb, room)
+	if err != nil {
+		return config.RoomOverrides{}, err
+	}
+	return o, cfg.SetRoomOverrides(room, o)
+}
+
+// Follow keeps the room overrides applied by cfg up to date until ctx is
+// done, for processes that don't apply control commands to rooms
+// themselves: it loads every room once subscribed, then reloads a room
+// whenever a command changes it, and every room on a config reload.
+func Follow(ctx context.Context, rdb redis.UniversalClient, cfg *config.Store) {
+	pubsub := rdb.Subscribe(ctx, broker.ControlChannel)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+	sync := func() {
+		if _, err := Sync(ctx, rdb, cfg); err != nil && ctx.Err() == nil {
+			log.Printf("[RoomConfig] Failed to load room overrides: %v", err)
+		}
+	}
+	sync()
+	ticker := time.NewTicker(followResync)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sync()
+		case raw, ok := <-ch:
+			if !ok {
+				return
+			}
+			var cmd models.ControlCommand
+			if err := json.Unmarshal([]byte(raw.Payload), &cmd); err != nil {
+				continue
+			}
+			switch cmd.Type {
+			case models.ControlRoomConfig, models.ControlGrantModerator, models.ControlSlowMode:
+				if _, err := Refresh(ctx, rdb, cfg, cmd.Room); err != nil {
+					log.Printf("[RoomConfig] Failed to reload overrides of room '%s': %v", cmd.Room, err)
+				}
+			case models.ControlReload:
+				sync()
+			}
+		}
+	}
+}
+
+func decode(raw string) (config.RoomOverrides, error) {
+	var o config.RoomOverrides
+	if raw == "" {
+		return o, nil
+	}
+	err := json.Unmarshal([]byte(raw), &o)
+	return o, err
+}
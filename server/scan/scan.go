@@ -0,0 +1,226 @@
+// Package scan checks uploaded files for malware before they are stored.
+// Scanners are reached over the network: a clamd daemon, an ICAP service
+// such as c-icap or a commercial gateway, or an HTTP webhook wrapping any
+// other engine.
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"lukagolubovic/config"
+)
+
+const (
+	// clamdChunk stays well under clamd's default StreamMaxLength.
+	clamdChunk  = 64 << 10
+	icapPort    = "1344"
+	maxResponse = 64 << 10
+)
+
+// Verdict is a scanner's finding on a file.
+type Verdict struct {
+	Infected bool
+	// Threat names what was found, when the scanner says.
+	Threat string
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, name, contentType string, body []byte) (Verdict, error)
+}
+
+// New returns nil when scanning is disabled.
+func New(cfg config.AttachmentScan) Scanner {
+	switch cfg.Scanner {
+	case config.ScannerClamAV:
+		return ClamAV{Address: cfg.Address}
+	case config.ScannerICAP:
+		u, _ := url.Parse(cfg.Address)
+		return ICAP{URL: u}
+	case config.ScannerWebhook:
+		return Webhook{URL: cfg.Address, Secret: cfg.Secret, Client: http.DefaultClient}
+	}
+	return nil
+}
+
+// ClamAV scans through clamd's INSTREAM command.
+type ClamAV struct {
+	Address string
+}
+
+func (c ClamAV) Scan(ctx context.Context, _, _ string, body []byte) (Verdict, error) {
+	conn, err := dial(ctx, c.Address)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	for len(body) > 0 {
+		n := min(len(body), clamdChunk)
+		binary.Write(w, binary.BigEndian, uint32(n))
+		w.Write(body[:n])
+		body = body[n:]
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	// clamd answers "stream: OK" or "stream: <threat> FOUND" and closes
+	// the connection.
+	reply, err := io.ReadAll(io.LimitReader(conn, maxResponse))
+	if err != nil {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+	result := strings.TrimPrefix(strings.TrimRight(string(reply), "\x00\n"), "stream: ")
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Threat: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return Verdict{}, fmt.Errorf("clamd: %s", result)
+}
+
+// ICAP scans through an ICAP service's RESPMOD method, sending the file
+// as the body of an HTTP response. The service answers 204 for a clean
+// file, as allowed, and otherwise returns a modified response, usually
+// naming the threat in a header.
+type ICAP struct {
+	URL *url.URL
+}
+
+func (c ICAP) Scan(ctx context.Context, _, contentType string, body []byte) (Verdict, error) {
+	host := c.URL.Host
+	if c.URL.Port() == "" {
+		host = net.JoinHostPort(c.URL.Hostname(), icapPort)
+	}
+	conn, err := dial(ctx, host)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resHeader := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", contentType, len(body))
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n",
+		c.URL.String(), c.URL.Host, len(resHeader))
+	w.WriteString(resHeader)
+	fmt.Fprintf(w, "%x\r\n", len(body))
+	w.Write(body)
+	w.WriteString("\r\n0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return Verdict{}, fmt.Errorf("icap: %w", err)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(io.LimitReader(conn, maxResponse)))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("icap: %w", err)
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return Verdict{}, fmt.Errorf("icap: invalid status line %q", status)
+	}
+	code, _ := strconv.Atoi(fields[1])
+	switch code {
+	case http.StatusNoContent:
+		return Verdict{}, nil
+	case http.StatusOK:
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return Verdict{}, fmt.Errorf("icap: %w", err)
+		}
+		return Verdict{Infected: true, Threat: icapThreat(header)}, nil
+	}
+	return Verdict{}, fmt.Errorf("icap: service returned %s", strings.Join(fields[1:], " "))
+}
+
+// icapThreat reads the threat from the headers services commonly set,
+// such as "X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test;".
+func icapThreat(header textproto.MIMEHeader) string {
+	if found := header.Get("X-Infection-Found"); found != "" {
+		for _, part := range strings.Split(found, ";") {
+			if threat, ok := strings.CutPrefix(strings.TrimSpace(part), "Threat="); ok {
+				return threat
+			}
+		}
+	}
+	for _, name := range []string{"X-Virus-Id", "X-Violations-Found"} {
+		if v := header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Webhook posts the file to an HTTP service, which answers with a JSON
+// object such as {"infected": true, "threat": "Eicar-Test-Signature"}.
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (c Webhook) Scan(ctx context.Context, name, contentType string, body []byte) (Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Attachment-Name", name)
+	if c.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Secret)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("scan webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponse))
+		return Verdict{}, fmt.Errorf("scan webhook returned %s", resp.Status)
+	}
+	var v struct {
+		Infected *bool  `json:"infected"`
+		Threat   string `json:"threat"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(&v); err != nil {
+		return Verdict{}, fmt.Errorf("invalid scan webhook response: %w", err)
+	}
+	if v.Infected == nil {
+		return Verdict{}, errors.New("scan webhook response has no verdict")
+	}
+	return Verdict{Infected: *v.Infected, Threat: v.Threat}, nil
+}
+
+// dial connects to address, with the context's deadline applying to the
+// whole exchange.
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
@@ -0,0 +1,219 @@
+// Package scheduler runs the periodic jobs of a process: retention,
+// backups, digests, reconciliation and the like. Jobs run at a fixed
+// interval or on a cron expression, with optional jitter, and leader jobs
+// run on one instance of the cluster at a time. Every job's runs are
+// counted in the scheduler_jobs expvar map.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/metrics"
+)
+
+// leaderKeyPrefix prefixes the Redis key a leader job is locked under.
+const leaderKeyPrefix = "chat:{scheduler}:"
+
+// Job is one periodic task. Exactly one of Every and Cron must be set.
+type Job struct {
+	Name string
+	// Every runs the job at a fixed interval, the first time one interval
+	// after the scheduler starts unless RunAtStart is set.
+	Every time.Duration
+	// Cron runs the job at the minutes a cron expression matches, in local
+	// time; see ParseCron.
+	Cron string
+	// Jitter delays every run by a random duration below it, so instances
+	// started together don't all hit a shared resource at once.
+	Jitter time.Duration
+	// RunAtStart runs the job once as soon as the scheduler starts.
+	RunAtStart bool
+	// Leader runs the job on one instance only: each run first takes a
+	// lock in Redis named after the job, held for most of the period, and
+	// instances that don't get it skip the run.
+	Leader bool
+	Run    func(ctx context.Context) error
+}
+
+// Scheduler runs jobs until its context is done. Add every job before
+// calling Run.
+type Scheduler struct {
+	name string
+	rdb  redis.UniversalClient
+	jobs []*job
+	wg   sync.WaitGroup
+}
+
+type job struct {
+	Job
+	cron  *Cron
+	stats *expvar.Map
+}
+
+// New returns a scheduler for the instance called name, the holder
+// recorded on leader locks. rdb may be nil when no job is a leader job.
+func New(name string, rdb redis.UniversalClient) *Scheduler {
+	return &Scheduler{name: name, rdb: rdb}
+}
+
+// Add registers a job, checking its schedule.
+func (s *Scheduler) Add(j Job) error {
+	if j.Name == "" || j.Run == nil {
+		return errors.New("scheduler: a job needs a name and a Run function")
+	}
+	if (j.Every > 0) == (j.Cron != "") {
+		return fmt.Errorf("scheduler: job %s needs exactly one of Every and Cron", j.Name)
+	}
+	if j.Leader && s.rdb == nil {
+		return fmt.Errorf("scheduler: leader job %s needs Redis", j.Name)
+	}
+	added := &job{Job: j, stats: jobStats(j.Name)}
+	if j.Cron != "" {
+		c, err := ParseCron(j.Cron)
+		if err != nil {
+			return fmt.Errorf("scheduler: job %s: %w", j.Name, err)
+		}
+		added.cron = c
+	}
+	s.jobs = append(s.jobs, added)
+	return nil
+}
+
+// MustAdd is Add for jobs whose schedule is fixed in code.
+func (s *Scheduler) MustAdd(j Job) {
+	if err := s.Add(j); err != nil {
+		panic(err)
+	}
+}
+
+// Run runs the jobs until ctx is done, then waits for running jobs to
+// return.
+func (s *Scheduler) Run(ctx context.Context) {
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.loop(ctx, j)
+		}()
+	}
+	<-ctx.Done()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	if j.RunAtStart {
+		s.run(ctx, j, time.Now())
+	}
+	next := time.Now()
+	for {
+		next = j.next(next)
+		if next.IsZero() {
+			log.Printf("[Scheduler] Job %s never runs again", j.Name)
+			return
+		}
+		delay := time.Until(next)
+		if j.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(j.Jitter)))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.run(ctx, j, next)
+		// Intervals count from the scheduled time, so jitter and run time
+		// don't add up, unless the run overran the next one; cron times
+		// the run overlapped are skipped.
+		if j.cron != nil || time.Since(next) > j.Every {
+			next = time.Now()
+		}
+	}
+}
+
+func (j *job) next(after time.Time) time.Time {
+	if j.cron != nil {
+		return j.cron.Next(after)
+	}
+	return after.Add(j.Every)
+}
+
+// run runs one occurrence of the job scheduled at at.
+func (s *Scheduler) run(ctx context.Context, j *job, at time.Time) {
+	if j.Leader {
+		leader, err := s.lead(ctx, j, at)
+		if err != nil {
+			j.stats.Add("failures", 1)
+			log.Printf("[Scheduler] Job %s: leader lock failed: %v", j.Name, err)
+			return
+		}
+		if !leader {
+			j.stats.Add("skipped", 1)
+			return
+		}
+	}
+
+	start := time.Now()
+	err := safeRun(ctx, j)
+	elapsed := time.Since(start)
+
+	j.stats.Add("runs", 1)
+	j.stats.Set("last_duration_ms", intVar(elapsed.Milliseconds()))
+	j.stats.Set("last_run_unix", intVar(start.Unix()))
+	if err != nil && ctx.Err() == nil {
+		j.stats.Add("failures", 1)
+		log.Printf("[Scheduler] Job %s failed after %s: %v", j.Name, elapsed.Round(time.Millisecond), err)
+	}
+}
+
+// lead takes the job's lock for the run at at. The lock is never released
+// but expires shortly before the next run, so the instances that lost
+// skip this run and everyone competes again for the next one.
+func (s *Scheduler) lead(ctx context.Context, j *job, at time.Time) (bool, error) {
+	ttl := j.next(at).Sub(at) * 9 / 10
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return s.rdb.SetNX(ctx, leaderKeyPrefix+j.Name, s.name, ttl).Result()
+}
+
+func safeRun(ctx context.Context, j *job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.RecordPanic("scheduler", v)
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return j.Run(ctx)
+}
+
+var statsMu sync.Mutex
+
+// jobStats returns the expvar map of a job, shared by every scheduler of
+// the process that runs a job by that name.
+func jobStats(name string) *expvar.Map {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if m, ok := metrics.SchedulerJobs.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	metrics.SchedulerJobs.Set(name, m)
+	return m
+}
+
+func intVar(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
@@ -0,0 +1,159 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+)
+
+// elasticsearch keeps one document per message, with the message id as
+// the document id.
+type elasticsearch struct {
+	client
+	cfg   *config.Store
+	index string
+}
+
+func newElasticsearch(cfg *config.Store, c config.Search) *elasticsearch {
+	return &elasticsearch{
+		client: client{
+			name: "elasticsearch",
+			base: strings.TrimRight(c.URL, "/"),
+			auth: func(req *http.Request) {
+				switch {
+				case c.APIKey != "":
+					req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+				case c.Username != "":
+					req.SetBasicAuth(c.Username, c.Password)
+				}
+			},
+			http: &http.Client{Timeout: requestTimeout},
+		},
+		cfg:   cfg,
+		index: c.Index,
+	}
+}
+
+// esMappings leaves the stored message out of the index; only content is
+// analyzed for full-text search.
+var esMappings = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"id":       map[string]string{"type": "keyword"},
+			"room":     map[string]string{"type": "keyword"},
+			"user_id":  map[string]string{"type": "keyword"},
+			"username": map[string]string{"type": "keyword"},
+			"content":  map[string]string{"type": "text"},
+			"type":     map[string]string{"type": "keyword"},
+			"sent_ms":  map[string]string{"type": "long"},
+			"message":  map[string]interface{}{"type": "object", "enabled": false},
+		},
+	},
+}
+
+func (e *elasticsearch) Setup(ctx context.Context) error {
+	err := e.do(ctx, http.MethodPut, "/"+url.PathEscape(e.index), "application/json", esMappings, nil)
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusBadRequest && strings.Contains(status.body, "resource_already_exists_exception") {
+		return nil
+	}
+	return err
+}
+
+// Index writes messages with one bulk request.
+func (e *elasticsearch) Index(ctx context.Context, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, msg := range messages {
+		action := map[string]map[string]string{"index": {"_index": e.index, "_id": formatID(msg.ID)}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		if err := enc.Encode(newDocument(models.DefaultRoom, msg)); err != nil {
+			return err
+		}
+	}
+
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := e.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Errors {
+		for _, item := range resp.Items {
+			for _, result := range item {
+				if len(result.Error) > 0 {
+					return fmt.Errorf("%w: elasticsearch refused a document: %s", ErrEngine, result.Error)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Search matches the words of the query in any order, allowing a typo or
+// two per word depending on its length.
+func (e *elasticsearch) Search(ctx context.Context, q Query) ([]models.Message, error) {
+	ctx, cancel := timeout(ctx, e.cfg)
+	defer cancel()
+
+	filter := []interface{}{map[string]interface{}{"term": map[string]string{"room": q.Room}}}
+	from, hasFrom, to, hasTo := q.window()
+	if hasFrom || hasTo {
+		bounds := map[string]int64{}
+		if hasFrom {
+			bounds["gte"] = from
+		}
+		if hasTo {
+			bounds["lt"] = to
+		}
+		filter = append(filter, map[string]interface{}{"range": map[string]interface{}{"sent_ms": bounds}})
+	}
+	body := map[string]interface{}{
+		"size":    q.Limit,
+		"_source": []string{"message"},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"match": map[string]interface{}{
+						"content": map[string]string{"query": q.Text, "operator": "and", "fuzziness": "AUTO"},
+					},
+				},
+				"filter": filter,
+			},
+		},
+	}
+
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					Message models.Message `json:"message"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := e.do(ctx, http.MethodPost, "/"+url.PathEscape(e.index)+"/_search", "application/json", body, &resp); err != nil {
+		return nil, err
+	}
+	messages := make([]models.Message, 0, len(resp.Hits.Hits))
+	for _, hit := range resp.Hits.Hits {
+		messages = append(messages, hit.Source.Message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,77 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// client is what the external engines share: their base URL, how they
+// authenticate and the HTTP round trip.
+type client struct {
+	name string
+	base string
+	auth func(*http.Request)
+	http *http.Client
+}
+
+// do sends body, JSON-encoded unless it already is bytes, and decodes a
+// 2xx answer into out when out isn't nil. Other answers and network
+// failures wrap ErrEngine.
+func (c *client) do(ctx context.Context, method, path, contentType string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, ok := body.([]byte)
+		if !ok {
+			var err error
+			if b, err = json.Marshal(body); err != nil {
+				return err
+			}
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.auth(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrEngine, c.name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{engine: c.name, status: resp.Status, code: resp.StatusCode, body: string(detail)}
+	}
+	if out == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrEngine, c.name, err)
+	}
+	return nil
+}
+
+type statusError struct {
+	engine string
+	status string
+	code   int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.engine, e.status, e.body)
+}
+
+func (e *statusError) Unwrap() error {
+	return ErrEngine
+}
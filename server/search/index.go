@@ -0,0 +1,133 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/persist"
+)
+
+// reindexBatch is how many messages each reindex request carries.
+const reindexBatch = 500
+
+// Hook is the persistence hook keeping ix up to date with the chat
+// messages a server stores. Its failures are retried and dead-lettered
+// like any hook's.
+func Hook(ix Indexer) persist.Hook {
+	return &hook{ix: ix}
+}
+
+type hook struct {
+	ix Indexer
+}
+
+func (h *hook) Name() string {
+	return "search"
+}
+
+func (h *hook) Persist(ctx context.Context, msg models.Message) error {
+	if !models.IsChat(msg.Type) {
+		return nil
+	}
+	return h.ix.Index(ctx, []models.Message{msg})
+}
+
+// ReindexStatus is the progress of the last reindex on a server.
+type ReindexStatus struct {
+	Running bool `json:"running"`
+	// LastID is the id of the last message indexed; a failed reindex can
+	// be resumed after it.
+	LastID     int64      `json:"last_id,string"`
+	Indexed    int64      `json:"indexed"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Reindexer indexes the messages a server already holds, for a new index
+// or one that missed messages. One runs at a time per server.
+type Reindexer struct {
+	ctx     context.Context
+	address string
+	ix      Indexer
+	db      *sql.DB
+
+	mu     sync.Mutex
+	status ReindexStatus
+}
+
+// NewReindexer returns a reindexer whose runs stop when ctx ends.
+func NewReindexer(ctx context.Context, address string, ix Indexer, db *sql.DB) *Reindexer {
+	return &Reindexer{ctx: ctx, address: address, ix: ix, db: db}
+}
+
+func (r *Reindexer) Status() ReindexStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Start indexes the chat messages after the id after in the background,
+// oldest first. It reports false, and the running one's status, when a
+// reindex is already running.
+func (r *Reindexer) Start(after int64) (ReindexStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.Running {
+		return r.status, false
+	}
+	now := time.Now().UTC()
+	r.status = ReindexStatus{Running: true, LastID: after, StartedAt: &now}
+	go r.run(after)
+	return r.status, true
+}
+
+func (r *Reindexer) run(after int64) {
+	log.Printf("[Server %s] Reindexing search from message %d\n", r.address, after)
+	err := r.reindex(after)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	r.status.Running, r.status.FinishedAt = false, &now
+	if err != nil {
+		r.status.Error = err.Error()
+		log.Printf("[Server %s] Search reindex stopped after message %d: %v", r.address, r.status.LastID, err)
+		return
+	}
+	log.Printf("[Server %s] Search reindex indexed %d messages\n", r.address, r.status.Indexed)
+}
+
+// reindex pages through the messages rather than holding one cursor, so
+// no read transaction stays open while the engine is slow.
+func (r *Reindexer) reindex(after int64) error {
+	for {
+		page, err := database.ArchivedMessages(r.ctx, r.db, models.DefaultRoomID, database.ArchiveQuery{After: after, Limit: reindexBatch})
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		batch := make([]models.Message, 0, len(page))
+		for _, msg := range page {
+			if models.IsChat(msg.Type) {
+				batch = append(batch, msg)
+			}
+		}
+		if err := r.ix.Index(r.ctx, batch); err != nil {
+			return err
+		}
+		after = page[len(page)-1].ID
+
+		r.mu.Lock()
+		r.status.LastID = after
+		r.status.Indexed += int64(len(batch))
+		r.mu.Unlock()
+	}
+}
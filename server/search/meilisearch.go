@@ -0,0 +1,107 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"lukagolubovic/config"
+	"lukagolubovic/models"
+)
+
+// meilisearch keeps one document per message, keyed by the message id.
+// Meilisearch applies writes asynchronously, so a document it refuses is
+// only reported in its task list, not here.
+type meilisearch struct {
+	client
+	cfg   *config.Store
+	index string
+}
+
+func newMeilisearch(cfg *config.Store, c config.Search) *meilisearch {
+	return &meilisearch{
+		client: client{
+			name: "meilisearch",
+			base: strings.TrimRight(c.URL, "/"),
+			auth: func(req *http.Request) {
+				if c.APIKey != "" {
+					req.Header.Set("Authorization", "Bearer "+c.APIKey)
+				}
+			},
+			http: &http.Client{Timeout: requestTimeout},
+		},
+		cfg:   cfg,
+		index: c.Index,
+	}
+}
+
+func (m *meilisearch) path(suffix string) string {
+	return "/indexes/" + url.PathEscape(m.index) + suffix
+}
+
+// meiliSettings searches content, like the database does, and only
+// returns the stored message.
+var meiliSettings = map[string]interface{}{
+	"searchableAttributes": []string{"content"},
+	"filterableAttributes": []string{"room", "sent_ms"},
+	"displayedAttributes":  []string{"message"},
+}
+
+// Setup creates the index, which fails harmlessly in the background when
+// it exists, and applies the settings.
+func (m *meilisearch) Setup(ctx context.Context) error {
+	index := map[string]string{"uid": m.index, "primaryKey": "id"}
+	if err := m.do(ctx, http.MethodPost, "/indexes", "application/json", index, nil); err != nil {
+		return err
+	}
+	return m.do(ctx, http.MethodPatch, m.path("/settings"), "application/json", meiliSettings, nil)
+}
+
+func (m *meilisearch) Index(ctx context.Context, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	docs := make([]document, 0, len(messages))
+	for _, msg := range messages {
+		docs = append(docs, newDocument(models.DefaultRoom, msg))
+	}
+	return m.do(ctx, http.MethodPost, m.path("/documents?primaryKey=id"), "application/json", docs, nil)
+}
+
+// Search uses Meilisearch's default ranking, which tolerates typos and
+// prefers messages containing all the words of the query.
+func (m *meilisearch) Search(ctx context.Context, q Query) ([]models.Message, error) {
+	ctx, cancel := timeout(ctx, m.cfg)
+	defer cancel()
+
+	filter := []string{"room = " + strconv.Quote(q.Room)}
+	from, hasFrom, to, hasTo := q.window()
+	if hasFrom {
+		filter = append(filter, fmt.Sprintf("sent_ms >= %d", from))
+	}
+	if hasTo {
+		filter = append(filter, fmt.Sprintf("sent_ms < %d", to))
+	}
+	body := map[string]interface{}{
+		"q":      q.Text,
+		"limit":  q.Limit,
+		"filter": strings.Join(filter, " AND "),
+	}
+
+	var resp struct {
+		Hits []struct {
+			Message models.Message `json:"message"`
+		} `json:"hits"`
+	}
+	if err := m.do(ctx, http.MethodPost, m.path("/search"), "application/json", body, &resp); err != nil {
+		return nil, err
+	}
+	messages := make([]models.Message, 0, len(resp.Hits))
+	for _, hit := range resp.Hits {
+		messages = append(messages, hit.Message)
+	}
+	return messages, nil
+}
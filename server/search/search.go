@@ -0,0 +1,139 @@
+// Package search finds messages by their text, either in the database or
+// in an external search engine. The database does a plain substring match
+// and stays correct without any setup; Elasticsearch and Meilisearch rank
+// by relevance and tolerate typos, but only know the messages indexed into
+// them, which happens in the background as messages are stored.
+package search
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/idgen"
+	"lukagolubovic/models"
+)
+
+// ErrEngine wraps failures of an external engine, as opposed to an invalid
+// search.
+var ErrEngine = errors.New("search engine failed")
+
+// Query is one search of a room's messages. After and Before are message
+// ids bounding the search, exclusive; zero leaves that side open.
+type Query struct {
+	Room   string
+	Text   string
+	After  int64
+	Before int64
+	Limit  int
+}
+
+// Engine answers searches. Results are the best matches first, which for
+// the database is the newest.
+type Engine interface {
+	Search(ctx context.Context, q Query) ([]models.Message, error)
+}
+
+// Indexer is an engine with its own index of messages.
+type Indexer interface {
+	Engine
+	// Setup creates the index and its settings if they don't exist yet.
+	Setup(ctx context.Context) error
+	// Index adds messages to the index, replacing those already in it
+	// with the same ids.
+	Index(ctx context.Context, messages []models.Message) error
+}
+
+// New returns the engine cfg's search section selects: an external one,
+// also returned as the Indexer to keep up to date, or the database read
+// through reads when none is configured.
+func New(cfg *config.Store, reads *database.ReadPool) (Engine, Indexer) {
+	c := cfg.Get().Search
+	var ix Indexer
+	switch c.Engine {
+	case config.SearchElasticsearch:
+		ix = newElasticsearch(cfg, c)
+	case config.SearchMeilisearch:
+		ix = newMeilisearch(cfg, c)
+	default:
+		return &Database{reads: reads, cfg: cfg}, nil
+	}
+	return ix, ix
+}
+
+// Database searches the messages table.
+type Database struct {
+	reads *database.ReadPool
+	cfg   *config.Store
+}
+
+// Search is bounded by the config's queries section.
+func (d *Database) Search(ctx context.Context, q Query) ([]models.Message, error) {
+	queries := d.cfg.Get().Queries
+	ctx, done, err := d.reads.Begin(ctx, queries.MaxConcurrent, queries.Timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return database.SearchMessages(ctx, d.reads.DB(), models.DefaultRoomID, q.Text, q.After, q.Before, q.Limit)
+}
+
+// document is a message as stored in an external index. The engines only
+// search content and filter on room and sent_ms; message is returned
+// whole as the result.
+type document struct {
+	ID       string         `json:"id"`
+	Room     string         `json:"room"`
+	UserID   int64          `json:"user_id,string"`
+	Username string         `json:"username"`
+	Content  string         `json:"content"`
+	Type     string         `json:"type"`
+	SentMS   int64          `json:"sent_ms"`
+	Message  models.Message `json:"message"`
+}
+
+func newDocument(room string, msg models.Message) document {
+	return document{
+		ID:       formatID(msg.ID),
+		Room:     room,
+		UserID:   msg.UserID,
+		Username: msg.Username,
+		Content:  msg.Content,
+		Type:     msg.Type,
+		SentMS:   idgen.Time(msg.ID).UnixMilli(),
+		Message:  msg,
+	}
+}
+
+func formatID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// window turns the query's id bounds into the milliseconds documents are
+// filtered on, with has false for a side left open. Ids above a millisecond's
+// first one fall into that millisecond, so the bounds are as fine as the
+// from and to times they were made from.
+func (q Query) window() (from int64, hasFrom bool, to int64, hasTo bool) {
+	if q.After > 0 {
+		from, hasFrom = idgen.Time(q.After+1).UnixMilli(), true
+	}
+	if q.Before > 0 && q.Before < math.MaxInt64 {
+		to, hasTo = idgen.Time(q.Before).UnixMilli(), true
+	}
+	return from, hasFrom, to, hasTo
+}
+
+// timeout bounds an external search like a database one.
+func timeout(ctx context.Context, cfg *config.Store) (context.Context, context.CancelFunc) {
+	if d := cfg.Get().Queries.Timeout(); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// requestTimeout bounds every request to an engine.
+const requestTimeout = 30 * time.Second
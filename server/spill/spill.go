@@ -0,0 +1,189 @@
+// Package spill keeps publishes the broker couldn't take in a local
+// append-only file and replays them, in order, once it is back. Replays
+// may repeat entries published just before a crash or a failed rewrite, so
+// receivers drop payloads whose id they have already seen.
+package spill
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// maxEntry bounds one line of the file.
+const maxEntry = 1 << 20
+
+// Entry is one publish: the payload and the channel it goes to.
+type Entry struct {
+	Channel string          `json:"channel"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type PublishFunc func(ctx context.Context, e Entry) error
+
+// Queue is the spill file. Entries are appended only while publishing
+// fails or earlier entries are still waiting, so they reach the broker in
+// the order they were published.
+type Queue struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	pending int
+}
+
+// Open opens the spill file at path, creating it if needed. Entries left
+// by a previous run are replayed like new ones; the file is rewritten
+// first, so a line a crash cut short can't swallow the next one appended.
+func Open(path string) (*Queue, error) {
+	entries, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{path: path}
+	if err := q.rewrite(entries); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Pending is how many entries wait to be replayed.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Publish publishes e unless earlier entries are waiting, and appends it
+// to the file if it isn't published. spilled reports that it was appended;
+// err is only set when that failed too.
+func (q *Queue) Publish(ctx context.Context, e Entry, publish PublishFunc) (spilled bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == 0 && publish(ctx, e) == nil {
+		return false, nil
+	}
+	return true, q.append(e)
+}
+
+// append must be called with q.mu held. The entry is synced before it
+// counts as kept.
+func (q *Queue) append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.pending++
+	return nil
+}
+
+// Replay publishes the waiting entries oldest first, stopping at the first
+// failure, and removes those published from the file. It reports how many
+// were published.
+func (q *Queue) Replay(ctx context.Context, publish PublishFunc) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == 0 {
+		return 0, nil
+	}
+	entries, err := read(q.path)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if err = publish(ctx, e); err != nil {
+			break
+		}
+		n++
+	}
+	if rerr := q.rewrite(entries[n:]); rerr != nil {
+		return n, rerr
+	}
+	return n, err
+}
+
+// rewrite replaces the file with entries, must be called with q.mu held.
+// The new file is renamed into place, so a crash leaves either the old
+// entries or the new ones.
+func (q *Queue) rewrite(entries []Entry) error {
+	tmp := q.path + ".tmp"
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = file
+	q.pending = len(entries)
+	return nil
+}
+
+// Close closes the file; waiting entries stay in it for the next Open.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+// read returns the entries in the file at path, none if it doesn't exist.
+// A line that doesn't decode, as a write cut short by a crash leaves, is
+// skipped.
+func read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxEntry)
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Channel != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
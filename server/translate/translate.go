@@ -0,0 +1,198 @@
+// Package translate translates message content through DeepL or a
+// LibreTranslate instance on behalf of clients. Like GIF search, the API
+// key stays on the servers, and translations are cached in Redis so every
+// server shares them and a message translated once doesn't use up the
+// provider's quota again.
+package translate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+)
+
+const (
+	deeplURL     = "https://api.deepl.com/v2/translate"
+	deeplFreeURL = "https://api-free.deepl.com/v2/translate"
+
+	cachePrefix    = "chat:translations:"
+	requestTimeout = 10 * time.Second
+	maxResponse    = 1 << 20
+)
+
+var (
+	ErrDisabled = errors.New("translation is disabled")
+	// ErrUnsupportedLanguage is returned for a malformed language code, and
+	// for one the provider refuses.
+	ErrUnsupportedLanguage = errors.New("unsupported language")
+)
+
+// language matches codes such as "de", "pt-br" or "zh-hans", once
+// lowercased.
+var language = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2,4})?$`)
+
+// Result is a translation of a text.
+type Result struct {
+	Text string `json:"text"`
+	// SourceLang is the language the provider detected, lowercased, or
+	// empty when it didn't report one.
+	SourceLang string `json:"source_lang,omitempty"`
+}
+
+type Translator struct {
+	rdb    redis.UniversalClient
+	cfg    *config.Store
+	client *http.Client
+}
+
+func NewTranslator(rdb redis.UniversalClient, cfg *config.Store) *Translator {
+	return &Translator{rdb: rdb, cfg: cfg, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// NormalizeLang lowercases a language code, or returns
+// ErrUnsupportedLanguage when it isn't one.
+func NormalizeLang(lang string) (string, error) {
+	lang = strings.ToLower(lang)
+	if !language.MatchString(lang) {
+		return "", ErrUnsupportedLanguage
+	}
+	return lang, nil
+}
+
+// Translate translates text into lang, from the cache when the same text
+// was translated into it recently. A cache that can't be read or written
+// only costs a request to the provider.
+func (t *Translator) Translate(ctx context.Context, text, lang string) (Result, error) {
+	c := t.cfg.Get().Translation
+	if !c.Enabled() {
+		return Result{}, ErrDisabled
+	}
+	lang, err := NormalizeLang(lang)
+	if err != nil {
+		return Result{}, err
+	}
+	sum := sha256.Sum256([]byte(text))
+	key := fmt.Sprintf("%s%s:%s:%s", cachePrefix, c.Provider, lang, hex.EncodeToString(sum[:16]))
+
+	if c.CacheSeconds > 0 {
+		raw, err := t.rdb.Get(ctx, key).Bytes()
+		if err == nil {
+			var r Result
+			if err := json.Unmarshal(raw, &r); err == nil {
+				metrics.Translations.Add("cached", 1)
+				return r, nil
+			}
+		} else if err != redis.Nil {
+			log.Printf("[Translate] Failed to read cached translation: %v", err)
+		}
+	}
+
+	var r Result
+	switch c.Provider {
+	case config.TranslationProviderDeepL:
+		r, err = t.deepl(ctx, c, text, lang)
+	case config.TranslationProviderLibreTranslate:
+		r, err = t.libreTranslate(ctx, c, text, lang)
+	}
+	if err != nil {
+		metrics.Translations.Add("failed", 1)
+		return Result{}, err
+	}
+	metrics.Translations.Add("fetched", 1)
+
+	if c.CacheSeconds > 0 {
+		raw, _ := json.Marshal(r)
+		if err := t.rdb.Set(ctx, key, raw, time.Duration(c.CacheSeconds)*time.Second).Err(); err != nil {
+			log.Printf("[Translate] Failed to cache translation: %v", err)
+		}
+	}
+	return r, nil
+}
+
+func (t *Translator) deepl(ctx context.Context, c config.Translation, text, lang string) (Result, error) {
+	endpoint := deeplURL
+	// Keys of DeepL's free plan end in ":fx" and only work on its free API.
+	if strings.HasSuffix(c.APIKey, ":fx") {
+		endpoint = deeplFreeURL
+	}
+	req := map[string]interface{}{"text": []string{text}, "target_lang": strings.ToUpper(lang)}
+	var body struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := t.post(ctx, endpoint, "DeepL-Auth-Key "+c.APIKey, req, &body); err != nil {
+		return Result{}, err
+	}
+	if len(body.Translations) == 0 {
+		return Result{}, errors.New("provider returned no translation")
+	}
+	tr := body.Translations[0]
+	return Result{Text: tr.Text, SourceLang: strings.ToLower(tr.DetectedSourceLanguage)}, nil
+}
+
+func (t *Translator) libreTranslate(ctx context.Context, c config.Translation, text, lang string) (Result, error) {
+	req := map[string]string{"q": text, "source": "auto", "target": lang, "format": "text"}
+	if c.APIKey != "" {
+		req["api_key"] = c.APIKey
+	}
+	var body struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	if err := t.post(ctx, strings.TrimSuffix(c.URL, "/")+"/translate", "", req, &body); err != nil {
+		return Result{}, err
+	}
+	return Result{Text: body.TranslatedText, SourceLang: strings.ToLower(body.DetectedLanguage.Language)}, nil
+}
+
+func (t *Translator) post(ctx context.Context, endpoint, auth string, payload, v interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("provider request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponse))
+		// Both providers answer 400 for a target language they don't
+		// support.
+		if resp.StatusCode == http.StatusBadRequest {
+			return ErrUnsupportedLanguage
+		}
+		return fmt.Errorf("provider returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(v); err != nil {
+		return fmt.Errorf("invalid provider response: %w", err)
+	}
+	return nil
+}
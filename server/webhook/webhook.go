@@ -0,0 +1,231 @@
+// Package webhook delivers lifecycle events to the HTTP endpoints listed in
+// the runtime config. Deliveries are queued and sent in the background, so
+// emitting an event never blocks the caller; failed deliveries are retried
+// with exponential backoff before being given up on.
+//
+// Every request carries the headers below. Receivers should recompute the
+// signature over "<timestamp>.<body>" and reject stale timestamps:
+//
+//	X-Webhook-Event:     user.joined
+//	X-Webhook-Id:        9f2c4e1a0b3d5f67
+//	X-Webhook-Timestamp: 1760000000
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 keyed with the hook's secret>
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lukagolubovic/config"
+	"lukagolubovic/metrics"
+)
+
+// Rooms can't be created and messages can't be reported yet, so there are
+// no room.created and message.reported events.
+const (
+	EventUserJoined         = "user.joined"
+	EventUserLeft           = "user.left"
+	EventServerRegistered   = "server.registered"
+	EventServerDeregistered = "server.deregistered"
+	EventScaleAdvice        = "scale.advice"
+	// EventCardInteraction is only sent to the hooks of the bot that
+	// posted the card (see EmitTo).
+	EventCardInteraction = "card.interaction"
+	// EventAttachmentQuarantined reports an upload the virus scanner
+	// flagged.
+	EventAttachmentQuarantined = "attachment.quarantined"
+)
+
+const (
+	queueSize   = 1024
+	workers     = 4
+	sendTimeout = 10 * time.Second
+	// maxAttempts includes the first try; retries wait retryBase, then
+	// twice as long each time.
+	maxAttempts = 5
+	retryBase   = time.Second
+)
+
+// Event is the JSON body of a delivery.
+type Event struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Source string      `json:"source"`
+	Data   interface{} `json:"data"`
+}
+
+type delivery struct {
+	hook    config.Webhook
+	event   string
+	id      string
+	body    []byte
+	attempt int
+}
+
+// Dispatcher queues events for every configured hook that wants them. A nil
+// *Dispatcher drops events, for processes without webhooks.
+type Dispatcher struct {
+	source string
+	hooks  func() []config.Webhook
+	client *http.Client
+	queue  chan delivery
+}
+
+// New returns a dispatcher that reads the current hooks from hooks on every
+// event, so config reloads apply to the next event. source identifies the
+// emitting process in each event.
+func New(source string, hooks func() []config.Webhook) *Dispatcher {
+	return &Dispatcher{
+		source: source,
+		hooks:  hooks,
+		client: &http.Client{Timeout: sendTimeout},
+		queue:  make(chan delivery, queueSize),
+	}
+}
+
+// Run sends queued deliveries until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for i := 0; i < workers; i++ {
+		go d.work(ctx)
+	}
+	<-ctx.Done()
+}
+
+// Emit queues eventType with data for every interested hook. Deliveries
+// that don't fit in the queue are dropped and counted.
+func (d *Dispatcher) Emit(eventType string, data interface{}) {
+	d.emit(eventType, data, func(config.Webhook) bool { return true })
+}
+
+// EmitTo is like Emit but only queues the event for the hooks belonging to
+// bot.
+func (d *Dispatcher) EmitTo(bot, eventType string, data interface{}) {
+	d.emit(eventType, data, func(hook config.Webhook) bool { return hook.BelongsTo(bot) })
+}
+
+func (d *Dispatcher) emit(eventType string, data interface{}, match func(config.Webhook) bool) {
+	if d == nil {
+		return
+	}
+	var targets []config.Webhook
+	for _, hook := range d.hooks() {
+		if hook.Wants(eventType) && match(hook) {
+			targets = append(targets, hook)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		log.Printf("[Webhook] %s: %v", eventType, err)
+		return
+	}
+	body, err := json.Marshal(Event{ID: id, Type: eventType, Time: time.Now().UTC(), Source: d.source, Data: data})
+	if err != nil {
+		log.Printf("[Webhook] %s: %v", eventType, err)
+		return
+	}
+	for _, hook := range targets {
+		d.enqueue(delivery{hook: hook, event: eventType, id: id, body: body})
+	}
+}
+
+func (d *Dispatcher) enqueue(job delivery) {
+	select {
+	case d.queue <- job:
+	default:
+		metrics.WebhookDeliveries.Add("dropped", 1)
+		log.Printf("[Webhook] queue full, dropping %s %s for %s", job.event, job.id, job.hook.URL)
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-d.queue:
+			d.deliver(ctx, job)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, job delivery) {
+	job.attempt++
+	err := d.send(ctx, job)
+	if err == nil {
+		metrics.WebhookDeliveries.Add("delivered", 1)
+		return
+	}
+	if job.attempt >= maxAttempts {
+		metrics.WebhookDeliveries.Add("failed", 1)
+		log.Printf("[Webhook] giving up on %s %s for %s after %d attempts: %v", job.event, job.id, job.hook.URL, job.attempt, err)
+		return
+	}
+
+	// Retries wait off the workers so one slow endpoint can't hold up the
+	// others.
+	metrics.WebhookDeliveries.Add("retried", 1)
+	wait := retryBase << (job.attempt - 1)
+	log.Printf("[Webhook] %s %s for %s failed, retrying in %s: %v", job.event, job.id, job.hook.URL, wait, err)
+	time.AfterFunc(wait, func() {
+		if ctx.Err() == nil {
+			d.enqueue(job)
+		}
+	})
+}
+
+func (d *Dispatcher) send(ctx context.Context, job delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", job.event)
+	req.Header.Set("X-Webhook-Id", job.id)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(job.hook.Secret, timestamp, job.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign is the hex HMAC-SHA256 of "<timestamp>.<body>" under secret.
+func Sign(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
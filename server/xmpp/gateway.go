@@ -0,0 +1,440 @@
+// Package xmpp lets XMPP clients join the chat. It serves client-to-server
+// streams and maps the default room onto a multi-user chat (MUC) room,
+// "general@rooms.<domain>", working at the Redis level like the chat
+// servers: room messages are read from the room's channel and relayed to
+// the occupants, and occupants' messages are published to the room, so
+// every server broadcasts and stores them. Message archive queries (MAM)
+// and join history are read from a copy of the message store.
+//
+// Only the room is mapped; there are no rosters or one-to-one chats.
+// Presence is only known for users connected to this gateway, since the
+// cluster doesn't track who is online.
+package xmpp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"lukagolubovic/broker"
+	"lukagolubovic/config"
+	"lukagolubovic/database"
+	"lukagolubovic/identity"
+	"lukagolubovic/ingest"
+	"lukagolubovic/models"
+)
+
+const (
+	// joinHistory is how many recent messages a joining occupant gets when
+	// it doesn't ask for a number.
+	joinHistory = 20
+	// maxArchivePage caps one MAM result page.
+	maxArchivePage = 100
+	publishTimeout = 5 * time.Second
+)
+
+type Gateway struct {
+	// Domain is the XMPP domain users sign in to; the room lives on
+	// MUCDomain.
+	Domain    string
+	MUCDomain string
+
+	rdb redis.UniversalClient
+	db  *sql.DB
+	cfg *config.Store
+	tls *tls.Config
+	pub *ingest.Publisher
+
+	mu sync.Mutex
+	// occupants maps the user ids of the room's occupants to their joined
+	// sessions; a user may join from several clients at once.
+	occupants map[int64]map[*session]bool
+	sessions  map[*session]bool
+}
+
+// New returns a gateway for domain. db is a read-only copy of a chat
+// server's or the history service's database, or nil to serve no history.
+// Without tlsConfig streams are never encrypted, which most clients refuse.
+func New(domain, mucDomain string, rdb redis.UniversalClient, db *sql.DB, cfg *config.Store, tlsConfig *tls.Config) *Gateway {
+	return &Gateway{
+		Domain:    domain,
+		MUCDomain: mucDomain,
+		rdb:       rdb,
+		db:        db,
+		cfg:       cfg,
+		tls:       tlsConfig,
+		pub:       ingest.New(rdb, cfg, "xmpp:"+domain),
+		occupants: make(map[int64]map[*session]bool),
+		sessions:  make(map[*session]bool),
+	}
+}
+
+// roomJID is the MUC room the default room appears as.
+func (g *Gateway) roomJID() string {
+	return models.DefaultRoom + "@" + g.MUCDomain
+}
+
+func (g *Gateway) occupantJID(nick string) string {
+	return g.roomJID() + "/" + nick
+}
+
+// Serve accepts client streams on ln until ctx is done.
+func (g *Gateway) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				g.closeSessions()
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go newSession(g, conn).serve()
+	}
+}
+
+// ClaimNode claims the gateway's message id node; call it before Run.
+func (g *Gateway) ClaimNode(ctx context.Context) error {
+	return g.pub.ClaimNode(ctx)
+}
+
+// Run relays room traffic and moderation commands to the occupants until
+// ctx is done.
+func (g *Gateway) Run(ctx context.Context) {
+	go g.pub.HoldNode(ctx)
+	go g.pub.FollowRooms(ctx)
+	channels := []string{broker.ControlChannel, broker.Channel(models.DefaultRoom, g.cfg.Get().Redis.Shards)}
+	pubsub := g.rdb.Subscribe(ctx, channels...)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case raw, ok := <-ch:
+			if !ok {
+				return
+			}
+			if raw.Channel == broker.ControlChannel {
+				g.handleControl(raw.Payload)
+				continue
+			}
+			var msg models.Message
+			if err := json.Unmarshal([]byte(raw.Payload), &msg); err != nil {
+				continue
+			}
+			if models.IsChat(msg.Type) && msg.ID != 0 {
+				g.relay(msg)
+			}
+		}
+	}
+}
+
+// relay sends a room message to every occupant. The sender's own copy
+// carries the id its client gave the message, so the client can match it.
+func (g *Gateway) relay(msg models.Message) {
+	from := g.occupantJID(msg.Username)
+	stanzaID := fmt.Sprint(msg.ID)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, sessions := range g.occupants {
+		for s := range sessions {
+			s.send([]byte(groupchat(s.jid, from, s.originID(msg.ID), msg.Content, stanzaID, g.roomJID(), "")))
+		}
+	}
+}
+
+func (g *Gateway) handleControl(raw string) {
+	var cmd models.ControlCommand
+	if err := json.Unmarshal([]byte(raw), &cmd); err != nil {
+		return
+	}
+	switch cmd.Type {
+	case models.ControlKick:
+		g.removeUser(cmd.UserID, statusKicked)
+	case models.ControlBan:
+		g.removeUser(cmd.UserID, statusBanned)
+	case models.ControlAnnounce:
+		g.broadcastRoom(func(s *session) []byte {
+			return []byte(groupchat(s.jid, g.roomJID(), "", cmd.Message, "", g.roomJID(), ""))
+		})
+	case models.ControlTopic:
+		g.broadcastRoom(func(s *session) []byte { return subject(s.jid, g.roomJID(), cmd.Topic) })
+	case models.ControlRename:
+		g.rename(cmd.UserID, cmd.NewUsername)
+	}
+}
+
+func (g *Gateway) broadcastRoom(stanza func(*session) []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, sessions := range g.occupants {
+		for s := range sessions {
+			s.send(stanza(s))
+		}
+	}
+}
+
+// removeUser ends every session of a kicked or banned user, telling the
+// room why.
+func (g *Gateway) removeUser(userID int64, status int) {
+	g.mu.Lock()
+	var matched []*session
+	for s := range g.sessions {
+		if s.userID == userID {
+			matched = append(matched, s)
+		}
+	}
+	if sessions, ok := g.occupants[userID]; ok && len(matched) > 0 {
+		from := g.occupantJID(matched[0].nick())
+		for _, others := range g.occupants {
+			for o := range others {
+				o.send(occupantPresence(o.jid, from, "unavailable", false, g.selfCodes(o, sessions, status)...))
+			}
+		}
+		delete(g.occupants, userID)
+	}
+	g.mu.Unlock()
+
+	for _, s := range matched {
+		s.close()
+	}
+}
+
+// selfCodes adds the self-presence status code when o is one of the
+// sessions the presence is about.
+func (g *Gateway) selfCodes(o *session, about map[*session]bool, codes ...int) []int {
+	if about[o] {
+		return append([]int{statusSelf}, codes...)
+	}
+	return codes
+}
+
+// rename moves a renamed user's occupants to their new nick, as a MUC nick
+// change: unavailable under the old nick with status 303, then available
+// under the new one.
+func (g *Gateway) rename(userID int64, newName string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sessions, joined := g.occupants[userID]
+	var oldName string
+	for s := range g.sessions {
+		if s.userID == userID {
+			oldName = s.nick()
+			s.setNick(newName)
+		}
+	}
+	if !joined || oldName == "" {
+		return
+	}
+	moderator := g.cfg.Get().IsModerator(newName)
+	for _, others := range g.occupants {
+		for o := range others {
+			codes := g.selfCodes(o, sessions)
+			o.send(nickChange(o.jid, g.occupantJID(oldName), newName, moderator, codes))
+			o.send(occupantPresence(o.jid, g.occupantJID(newName), "", moderator, codes...))
+		}
+	}
+}
+
+// join makes s an occupant: it gets the current occupants, its own
+// presence, recent history and the subject, and the others learn it
+// joined. Occupants always use their chat username as nick.
+func (g *Gateway) join(ctx context.Context, s *session, requestedNick string, history int) stanzaError {
+	if ok, err := g.allowed(ctx, s.userID); err != nil {
+		log.Printf("[XMPP] membership check for '%s' failed: %v", s.nick(), err)
+		return errUnavailable
+	} else if !ok {
+		return stanzaError{"auth", "registration-required", "room is invite-only"}
+	}
+
+	nick := s.nick()
+	moderator := g.cfg.Get().IsModerator(nick)
+	self := g.occupantJID(nick)
+
+	g.mu.Lock()
+	sessions, present := g.occupants[s.userID]
+	if !present {
+		sessions = make(map[*session]bool)
+		g.occupants[s.userID] = sessions
+	}
+	for userID, others := range g.occupants {
+		if userID == s.userID || len(others) == 0 {
+			continue
+		}
+		for o := range others {
+			s.send(occupantPresence(s.jid, g.occupantJID(o.nick()), "", g.cfg.Get().IsModerator(o.nick())))
+			break
+		}
+	}
+	sessions[s] = true
+	codes := []int{statusSelf}
+	if requestedNick != nick {
+		codes = append(codes, statusNickChanged)
+	}
+	s.send(occupantPresence(s.jid, self, "", moderator, codes...))
+	if !present {
+		for userID, others := range g.occupants {
+			if userID == s.userID {
+				continue
+			}
+			for o := range others {
+				o.send(occupantPresence(o.jid, self, "", moderator))
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	if history > 0 && g.db != nil {
+		messages, err := database.RecentMessages(context.Background(), g.db, models.DefaultRoomID, history)
+		if err != nil {
+			log.Printf("[XMPP] failed to load join history: %v", err)
+		}
+		for _, msg := range messages {
+			s.send([]byte(groupchat(s.jid, g.occupantJID(msg.Username), "", msg.Content, fmt.Sprint(msg.ID), g.roomJID(), stamp(msg.Timestamp))))
+		}
+	}
+
+	// Clients treat the subject as the end of the join.
+	topic := ""
+	if g.db != nil {
+		if room, err := database.GetRoom(g.db, models.DefaultRoom); err == nil {
+			topic = room.Topic
+		}
+	}
+	s.send(subject(s.jid, g.roomJID(), topic))
+	return stanzaError{}
+}
+
+// leave removes s from the room. When it was the user's last session the
+// other occupants see them leave; the session itself is told unless it is
+// disconnecting.
+func (g *Gateway) leave(s *session, notify bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sessions, ok := g.occupants[s.userID]
+	if !ok || !sessions[s] {
+		return
+	}
+	delete(sessions, s)
+	self := g.occupantJID(s.nick())
+	if notify {
+		s.send(occupantPresence(s.jid, self, "unavailable", false, statusSelf))
+	}
+	if len(sessions) > 0 {
+		return
+	}
+	delete(g.occupants, s.userID)
+	for _, others := range g.occupants {
+		for o := range others {
+			o.send(occupantPresence(o.jid, self, "unavailable", false))
+		}
+	}
+}
+
+func (g *Gateway) joined(s *session) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.occupants[s.userID][s]
+}
+
+// allowed reports whether a user may enter the room, which is everyone
+// unless the room is invite-only.
+func (g *Gateway) allowed(ctx context.Context, userID int64) (bool, error) {
+	if !g.cfg.Get().Invites.Private(models.DefaultRoom) {
+		return true, nil
+	}
+	return g.rdb.SIsMember(ctx, identity.MembersPrefix+models.DefaultRoom, userID).Result()
+}
+
+func (g *Gateway) addSession(s *session) {
+	g.mu.Lock()
+	g.sessions[s] = true
+	g.mu.Unlock()
+}
+
+func (g *Gateway) removeSession(s *session) {
+	g.leave(s, false)
+	g.mu.Lock()
+	delete(g.sessions, s)
+	g.mu.Unlock()
+}
+
+func (g *Gateway) closeSessions() {
+	g.mu.Lock()
+	sessions := make([]*session, 0, len(g.sessions))
+	for s := range g.sessions {
+		sessions = append(sessions, s)
+	}
+	g.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+// login resolves a user signing in, refusing names the username policy
+// rejects, banned users and, with tokens.required, passwords that aren't
+// an access token for the user.
+func (g *Gateway) login(ctx context.Context, username, password string) (int64, string, error) {
+	if err := g.cfg.Get().Usernames.Check(username); err != nil {
+		return 0, "", err
+	}
+	return g.pub.Authenticate(ctx, username, password)
+}
+
+// publish posts an occupant's message to the room as a chat server would
+// for one of its clients.
+func (g *Gateway) publish(s *session, id int64, text string) stanzaError {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	err := g.pub.Publish(ctx, id, s.userID, s.nick(), text)
+	switch {
+	case err == nil:
+		return stanzaError{}
+	case errors.Is(err, ingest.ErrMuted):
+		return stanzaError{"auth", "forbidden", "you are muted"}
+	case errors.Is(err, ingest.ErrBanned):
+		return stanzaError{"auth", "forbidden", "you are banned"}
+	default:
+		log.Printf("[XMPP] failed to publish message from '%s': %v", s.nick(), err)
+		return stanzaError{"wait", "remote-server-timeout", "message not sent"}
+	}
+}
+
+// stamp converts a stored "YYYY-MM-DD HH:MM:SS" UTC timestamp to the
+// XMPP date-time format.
+func stamp(timestamp string) string {
+	t, err := time.Parse("2006-01-02 15:04:05", timestamp)
+	if err != nil {
+		return time.Now().UTC().Format(time.RFC3339)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func newStreamID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
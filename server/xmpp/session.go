@@ -0,0 +1,657 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukagolubovic/database"
+	"lukagolubovic/models"
+	"lukagolubovic/ratelimit"
+)
+
+const (
+	// idleTimeout closes streams that send nothing, not even the
+	// whitespace keepalives clients send, for this long.
+	idleTimeout  = 5 * time.Minute
+	writeTimeout = 10 * time.Second
+	// maxStanzaSize bounds how much a client may send in one stanza.
+	maxStanzaSize = 64 * 1024
+	sendBuffer    = 256
+	// maxPendingIDs bounds the ids remembered for reflecting a sender's
+	// own messages back with the id its client chose.
+	maxPendingIDs = 64
+)
+
+var errStanzaTooLarge = errors.New("stanza too large")
+
+// stanzaLimit fails reads once a stanza has taken more than maxStanzaSize
+// bytes; reset is called between stanzas.
+type stanzaLimit struct {
+	r         io.Reader
+	remaining int
+}
+
+func (l *stanzaLimit) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, errStanzaTooLarge
+	}
+	if len(p) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= n
+	return n, err
+}
+
+func (l *stanzaLimit) reset() { l.remaining = maxStanzaSize }
+
+type session struct {
+	gw   *Gateway
+	conn net.Conn
+
+	limit *stanzaLimit
+	dec   *xml.Decoder
+
+	out       chan []byte
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// Set once the client has authenticated and bound a resource.
+	userID int64
+	jid    string
+	bare   string
+
+	mu       sync.Mutex
+	username string
+	pending  map[int64]string
+
+	chatLimit ratelimit.Bucket
+}
+
+func newSession(gw *Gateway, conn net.Conn) *session {
+	return &session{
+		gw:      gw,
+		conn:    conn,
+		out:     make(chan []byte, sendBuffer),
+		quit:    make(chan struct{}),
+		pending: make(map[int64]string),
+	}
+}
+
+// nick is the user's chat username, which is also their occupant nick.
+func (s *session) nick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.username
+}
+
+func (s *session) setNick(name string) {
+	s.mu.Lock()
+	s.username = name
+	s.mu.Unlock()
+}
+
+// remember records the id the client gave a message it sent.
+func (s *session) remember(msgID int64, clientID string) {
+	if clientID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxPendingIDs {
+		for id := range s.pending {
+			delete(s.pending, id)
+			break
+		}
+	}
+	s.pending[msgID] = clientID
+}
+
+// originID returns, and forgets, the client's id for one of its own
+// messages coming back from the room.
+func (s *session) originID(msgID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.pending[msgID]
+	if ok {
+		delete(s.pending, msgID)
+	}
+	return id
+}
+
+// send queues a stanza for the writer. A session too slow to keep up is
+// closed rather than holding up the room.
+func (s *session) send(stanza []byte) {
+	select {
+	case <-s.quit:
+	case s.out <- stanza:
+	default:
+		log.Printf("[XMPP] '%s' is too slow, closing its stream", s.jid)
+		s.close()
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() { close(s.quit) })
+}
+
+// writePump writes queued stanzas until the session closes, then ends the
+// stream.
+func (s *session) writePump() {
+	defer s.conn.Close()
+	for {
+		select {
+		case stanza := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := s.conn.Write(stanza); err != nil {
+				s.close()
+				return
+			}
+		case <-s.quit:
+			s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			io.WriteString(s.conn, "</stream:stream>")
+			return
+		}
+	}
+}
+
+// writeNow writes directly to the connection, during negotiation before
+// writePump runs.
+func (s *session) writeNow(data string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(s.conn, data)
+	return err
+}
+
+func (s *session) serve() {
+	defer func() {
+		if s.bare != "" {
+			s.gw.removeSession(s)
+			log.Printf("[XMPP] '%s' disconnected", s.jid)
+		}
+		s.close()
+	}()
+
+	if err := s.negotiate(); err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("[XMPP] stream from %s failed: %v", s.conn.RemoteAddr(), err)
+		}
+		s.conn.Close()
+		return
+	}
+	go s.writePump()
+
+	for {
+		start, err := s.next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[XMPP] stream of '%s' failed: %v", s.jid, err)
+			}
+			return
+		}
+		if err := s.handle(start); err != nil {
+			log.Printf("[XMPP] stream of '%s' failed: %v", s.jid, err)
+			return
+		}
+	}
+}
+
+// restart begins a new stream on the connection, as required after TLS
+// and after authentication.
+func (s *session) restart() error {
+	s.limit = &stanzaLimit{r: s.conn}
+	s.limit.reset()
+	s.dec = xml.NewDecoder(bufio.NewReader(s.limit))
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		tok, err := s.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space != nsStream || t.Name.Local != "stream" {
+				return fmt.Errorf("expected stream header, got <%s>", t.Name.Local)
+			}
+			return s.writeNow(fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='%s' id='%s' from='%s' version='1.0' xml:lang='en'>",
+				nsStream, newStreamID(), esc(s.gw.Domain)))
+		case xml.Directive:
+			return errors.New("DTDs are not allowed")
+		}
+	}
+}
+
+// next returns the start of the next top-level element, skipping
+// whitespace keepalives. The closing stream tag is io.EOF.
+func (s *session) next() (xml.StartElement, error) {
+	s.limit.reset()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		tok, err := s.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		case xml.Directive:
+			return xml.StartElement{}, errors.New("DTDs are not allowed")
+		}
+	}
+}
+
+// negotiate runs STARTTLS (when the gateway has a certificate) and SASL
+// PLAIN, leaving a restarted stream that offers resource binding.
+func (s *session) negotiate() error {
+	if err := s.restart(); err != nil {
+		return err
+	}
+
+	if s.gw.tls != nil {
+		if err := s.writeNow(fmt.Sprintf("<stream:features><starttls xmlns='%s'><required/></starttls></stream:features>", nsTLS)); err != nil {
+			return err
+		}
+		start, err := s.next()
+		if err != nil {
+			return err
+		}
+		if start.Name.Space != nsTLS || start.Name.Local != "starttls" {
+			s.writeNow(fmt.Sprintf("<failure xmlns='%s'/></stream:stream>", nsTLS))
+			return errors.New("client did not start TLS")
+		}
+		if err := s.dec.Skip(); err != nil {
+			return err
+		}
+		if err := s.writeNow(fmt.Sprintf("<proceed xmlns='%s'/>", nsTLS)); err != nil {
+			return err
+		}
+		tlsConn := tls.Server(s.conn, s.gw.tls)
+		s.conn.SetDeadline(time.Now().Add(writeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		s.conn = tlsConn
+		if err := s.restart(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeNow(fmt.Sprintf("<stream:features><mechanisms xmlns='%s'><mechanism>PLAIN</mechanism></mechanisms></stream:features>", nsSASL)); err != nil {
+		return err
+	}
+	for {
+		start, err := s.next()
+		if err != nil {
+			return err
+		}
+		if start.Name.Space != nsSASL || start.Name.Local != "auth" {
+			s.writeNow(fmt.Sprintf("<failure xmlns='%s'><not-authorized/></failure>", nsSASL))
+			return fmt.Errorf("expected SASL auth, got <%s>", start.Name.Local)
+		}
+		var auth saslAuth
+		if err := s.dec.DecodeElement(&auth, &start); err != nil {
+			return err
+		}
+		condition, text := s.authenticate(auth)
+		if condition == "" {
+			break
+		}
+		// Clients may retry, e.g. after the user corrects their name.
+		if err := s.writeNow(fmt.Sprintf("<failure xmlns='%s'><%s/><text>%s</text></failure>", nsSASL, condition, esc(text))); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeNow(fmt.Sprintf("<success xmlns='%s'/>", nsSASL)); err != nil {
+		return err
+	}
+	if err := s.restart(); err != nil {
+		return err
+	}
+	return s.writeNow(fmt.Sprintf("<stream:features><bind xmlns='%s'/><session xmlns='%s'><optional/></session></stream:features>", nsBind, nsSession))
+}
+
+// authenticate checks a SASL PLAIN exchange and returns the failure
+// condition, or "" on success. Like the WebSocket endpoint, the gateway
+// trusts the name the user gives unless tokens are required, in which case
+// the password must be an access token for it.
+func (s *session) authenticate(auth saslAuth) (string, string) {
+	if auth.Mechanism != "PLAIN" {
+		return "invalid-mechanism", "only PLAIN is supported"
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth.Value))
+	if err != nil {
+		return "incorrect-encoding", "invalid base64"
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return "malformed-request", "expected authzid, authcid and password"
+	}
+	username := parts[1]
+	if parts[0] != "" && !strings.EqualFold(parts[0], username+"@"+s.gw.Domain) {
+		return "invalid-authzid", "can't act as another user"
+	}
+	if !validLocalpart(username) {
+		return "not-authorized", "this name can't be used in an XMPP address"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	userID, name, err := s.gw.login(ctx, username, parts[2])
+	if err != nil {
+		return "not-authorized", err.Error()
+	}
+	s.userID = userID
+	s.username = name
+	s.bare = username + "@" + s.gw.Domain
+	return "", ""
+}
+
+// handle processes one stanza.
+func (s *session) handle(start xml.StartElement) error {
+	switch start.Name.Local {
+	case "iq":
+		var iq iqStanza
+		if err := s.dec.DecodeElement(&iq, &start); err != nil {
+			return err
+		}
+		s.handleIQ(iq)
+	case "presence":
+		var p presenceStanza
+		if err := s.dec.DecodeElement(&p, &start); err != nil {
+			return err
+		}
+		if s.jid != "" {
+			s.handlePresence(p)
+		}
+	case "message":
+		var m messageStanza
+		if err := s.dec.DecodeElement(&m, &start); err != nil {
+			return err
+		}
+		if s.jid != "" {
+			s.handleMessage(m)
+		}
+	default:
+		return s.dec.Skip()
+	}
+	return nil
+}
+
+func (s *session) handleIQ(iq iqStanza) {
+	if iq.Type != "get" && iq.Type != "set" {
+		return
+	}
+	reply := func(payload string) { s.send(iqResult(s.replyTo(), iq.To, iq.ID, payload)) }
+	fail := func(e stanzaError) { s.send(iqError(s.replyTo(), iq.To, iq.ID, e)) }
+
+	if s.jid == "" {
+		if iq.Type == "set" && iq.Bind != nil {
+			s.bind(iq)
+			return
+		}
+		fail(errNotAuthorized)
+		return
+	}
+
+	to := bareJID(iq.To)
+	switch {
+	case iq.Bind != nil:
+		fail(stanzaError{"cancel", "not-allowed", "resource already bound"})
+	case iq.Session != nil, iq.Ping != nil:
+		reply("")
+	case iq.Roster != nil:
+		if iq.Type == "set" {
+			fail(errNotImplemented)
+			return
+		}
+		reply(fmt.Sprintf("<query xmlns='%s'/>", nsRoster))
+	case iq.DiscoInfo != nil:
+		info, ok := s.discoInfo(to)
+		if !ok {
+			fail(errNotFound)
+			return
+		}
+		reply(info)
+	case iq.DiscoItems != nil:
+		reply(s.discoItems(to))
+	case iq.MAM != nil && iq.Type == "set":
+		s.queryArchive(iq)
+	default:
+		fail(errUnavailable)
+	}
+}
+
+// replyTo is where replies go: the full JID once bound.
+func (s *session) replyTo() string {
+	if s.jid == "" {
+		return s.bare
+	}
+	return s.jid
+}
+
+func (s *session) bind(iq iqStanza) {
+	resource := strings.TrimSpace(iq.Bind.Resource)
+	if resource == "" || strings.ContainsAny(resource, "<>&'\"") {
+		resource = newStreamID()[:8]
+	}
+	s.jid = s.bare + "/" + resource
+	s.gw.addSession(s)
+	s.send(iqResult(s.jid, "", iq.ID, fmt.Sprintf("<bind xmlns='%s'><jid>%s</jid></bind>", nsBind, esc(s.jid))))
+	log.Printf("[XMPP] '%s' connected as %s", s.nick(), s.jid)
+}
+
+func (s *session) discoInfo(to string) (string, bool) {
+	var identity string
+	var features []string
+	switch {
+	case to == "" || strings.EqualFold(to, s.gw.Domain):
+		identity = "<identity category='server' type='im'/>"
+		features = []string{nsDiscoInfo, nsDiscoItems, nsPing}
+	case strings.EqualFold(to, s.bare):
+		identity = "<identity category='account' type='registered'/>"
+		features = []string{nsDiscoInfo}
+	case strings.EqualFold(to, s.gw.MUCDomain):
+		identity = "<identity category='conference' type='text' name='Chat rooms'/>"
+		features = []string{nsDiscoInfo, nsDiscoItems, nsMUC}
+	case strings.EqualFold(to, s.gw.roomJID()):
+		identity = fmt.Sprintf("<identity category='conference' type='text' name='%s'/>", esc(models.DefaultRoom))
+		access := "muc_open"
+		if s.gw.cfg.Get().Invites.Private(models.DefaultRoom) {
+			access = "muc_membersonly"
+		}
+		features = []string{nsDiscoInfo, nsMUC, nsStanzaID, "muc_persistent", "muc_public", "muc_semianonymous", access}
+		if s.gw.db != nil {
+			features = append(features, nsMAM)
+		}
+	default:
+		return "", false
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<query xmlns='%s'>%s", nsDiscoInfo, identity)
+	for _, f := range features {
+		fmt.Fprintf(&b, "<feature var='%s'/>", f)
+	}
+	b.WriteString("</query>")
+	return b.String(), true
+}
+
+func (s *session) discoItems(to string) string {
+	item := ""
+	switch {
+	case to == "" || strings.EqualFold(to, s.gw.Domain):
+		item = fmt.Sprintf("<item jid='%s' name='Chat rooms'/>", esc(s.gw.MUCDomain))
+	case strings.EqualFold(to, s.gw.MUCDomain):
+		item = fmt.Sprintf("<item jid='%s' name='%s'/>", esc(s.gw.roomJID()), esc(models.DefaultRoom))
+	}
+	return fmt.Sprintf("<query xmlns='%s'>%s</query>", nsDiscoItems, item)
+}
+
+// queryArchive answers a MAM query on the room with one page of stored
+// messages, paged by message id with RSM.
+func (s *session) queryArchive(iq iqStanza) {
+	fail := func(e stanzaError) { s.send(iqError(s.jid, iq.To, iq.ID, e)) }
+	if !strings.EqualFold(bareJID(iq.To), s.gw.roomJID()) {
+		fail(errUnavailable)
+		return
+	}
+	if s.gw.db == nil {
+		fail(errNotImplemented)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	allowed, err := s.gw.allowed(ctx, s.userID)
+	cancel()
+	if err != nil || !allowed {
+		fail(stanzaError{"auth", "forbidden", "room is invite-only"})
+		return
+	}
+
+	q := database.ArchiveQuery{Limit: maxArchivePage}
+	for name, dst := range map[string]*time.Time{"start": &q.Start, "end": &q.End} {
+		if raw := iq.MAM.field(name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				fail(stanzaError{"modify", "bad-request", "invalid " + name})
+				return
+			}
+			*dst = t
+		}
+	}
+	if set := iq.MAM.Set; set != nil {
+		if set.Max != nil && *set.Max >= 0 && *set.Max < maxArchivePage {
+			q.Limit = *set.Max
+		}
+		var err error
+		if set.After != nil && *set.After != "" {
+			q.After, err = strconv.ParseInt(*set.After, 10, 64)
+		}
+		if set.Before != nil {
+			q.Last = true
+			if *set.Before != "" {
+				q.Before, err = strconv.ParseInt(*set.Before, 10, 64)
+			}
+		}
+		if err != nil {
+			fail(errNotFound)
+			return
+		}
+	}
+
+	var messages []models.Message
+	if q.Limit > 0 {
+		messages, err = database.ArchivedMessages(context.Background(), s.gw.db, models.DefaultRoomID, q)
+		if err != nil {
+			log.Printf("[XMPP] archive query failed: %v", err)
+			fail(stanzaError{"wait", "internal-server-error", ""})
+			return
+		}
+	}
+
+	room := s.gw.roomJID()
+	for _, msg := range messages {
+		id := strconv.FormatInt(msg.ID, 10)
+		inner := forwardedMessage(s.gw.occupantJID(msg.Username), msg.Content)
+		s.send([]byte(fmt.Sprintf("<message to='%s' from='%s'><result xmlns='%s' queryid='%s' id='%s'><forwarded xmlns='%s'><delay xmlns='%s' stamp='%s'/>%s</forwarded></result></message>",
+			esc(s.jid), esc(room), nsMAM, esc(iq.MAM.QueryID), id, nsForward, nsDelay, stamp(msg.Timestamp), inner)))
+	}
+
+	complete := len(messages) < q.Limit || q.Limit == 0
+	set := fmt.Sprintf("<set xmlns='%s'/>", nsRSM)
+	if len(messages) > 0 {
+		set = fmt.Sprintf("<set xmlns='%s'><first>%d</first><last>%d</last></set>", nsRSM, messages[0].ID, messages[len(messages)-1].ID)
+	}
+	s.send(iqResult(s.jid, iq.To, iq.ID, fmt.Sprintf("<fin xmlns='%s' complete='%t'>%s</fin>", nsMAM, complete, set)))
+}
+
+func (s *session) handlePresence(p presenceStanza) {
+	to := bareJID(p.To)
+	if to == "" {
+		// Broadcast presence; there is no roster to send it to, except
+		// that going unavailable leaves the room.
+		if p.Type == "unavailable" {
+			s.gw.leave(s, true)
+		}
+		return
+	}
+	if !strings.EqualFold(to, s.gw.roomJID()) {
+		if strings.EqualFold(to, s.gw.MUCDomain) || strings.HasSuffix(strings.ToLower(to), "@"+strings.ToLower(s.gw.MUCDomain)) {
+			s.send(presenceError(s.jid, p.To, p.ID, errNotFound))
+		}
+		return
+	}
+
+	switch p.Type {
+	case "":
+		if s.gw.joined(s) {
+			return
+		}
+		history := joinHistory
+		if p.MUC != nil && p.MUC.History != nil && p.MUC.History.MaxStanzas != nil {
+			history = min(max(*p.MUC.History.MaxStanzas, 0), maxArchivePage)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		if e := s.gw.join(ctx, s, resourceOf(p.To), history); e.Condition != "" {
+			s.send(presenceError(s.jid, p.To, p.ID, e))
+		}
+	case "unavailable":
+		s.gw.leave(s, true)
+	}
+}
+
+func (s *session) handleMessage(m messageStanza) {
+	if m.Type == "error" {
+		return
+	}
+	room := s.gw.roomJID()
+	if m.Type != "groupchat" || !strings.EqualFold(bareJID(m.To), room) {
+		s.send(messageError(s.jid, m.To, m.ID, stanzaError{"cancel", "service-unavailable", "only the room is available"}))
+		return
+	}
+	if !s.gw.joined(s) {
+		s.send(messageError(s.jid, room, m.ID, stanzaError{"modify", "not-acceptable", "join the room first"}))
+		return
+	}
+	if m.Subject != nil {
+		s.send(messageError(s.jid, room, m.ID, stanzaError{"auth", "forbidden", "the subject is set from the chat"}))
+		return
+	}
+	text := strings.TrimSpace(m.Body)
+	if text == "" {
+		// Chat states and receipts come without a body.
+		return
+	}
+	if limit := s.gw.cfg.Room(models.DefaultRoom).ContentLimit(models.MaxContentSize); len(text) > limit {
+		s.send(messageError(s.jid, room, m.ID, stanzaError{"modify", "not-acceptable", fmt.Sprintf("messages are limited to %d bytes", limit)}))
+		return
+	}
+	if !s.chatLimit.Allow(s.gw.cfg.Get().MessageRate(false)) {
+		s.send(messageError(s.jid, room, m.ID, stanzaError{"wait", "resource-constraint", "you are sending messages too fast"}))
+		return
+	}
+
+	// The id is remembered before publishing, since the message may come
+	// back from the room before publish returns.
+	id := s.gw.pub.NextID()
+	s.remember(id, m.ID)
+	if e := s.gw.publish(s, id, text); e.Condition != "" {
+		s.originID(id)
+		s.send(messageError(s.jid, room, m.ID, e))
+	}
+}
@@ -0,0 +1,259 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const (
+	nsStream     = "http://etherx.jabber.org/streams"
+	nsTLS        = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL       = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind       = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSession    = "urn:ietf:params:xml:ns:xmpp-session"
+	nsStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsMUC        = "http://jabber.org/protocol/muc"
+	nsMUCUser    = "http://jabber.org/protocol/muc#user"
+	nsMAM        = "urn:xmpp:mam:2"
+	nsRSM        = "http://jabber.org/protocol/rsm"
+	nsForward    = "urn:xmpp:forward:0"
+	nsDelay      = "urn:xmpp:delay"
+	nsPing       = "urn:xmpp:ping"
+	nsRoster     = "jabber:iq:roster"
+	nsStanzaID   = "urn:xmpp:sid:0"
+)
+
+// MUC status codes sent in occupant presence.
+const (
+	statusSelf        = 110
+	statusNickChanged = 210
+	statusBanned      = 301
+	statusNewNick     = 303
+	statusKicked      = 307
+)
+
+// Inbound stanzas. Only the children the gateway acts on are decoded.
+
+type iqStanza struct {
+	ID   string `xml:"id,attr"`
+	Type string `xml:"type,attr"`
+	To   string `xml:"to,attr"`
+
+	Bind *struct {
+		Resource string `xml:"resource"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Session    *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Ping       *struct{} `xml:"urn:xmpp:ping ping"`
+	Roster     *struct{} `xml:"jabber:iq:roster query"`
+	DiscoInfo  *struct{} `xml:"http://jabber.org/protocol/disco#info query"`
+	DiscoItems *struct{} `xml:"http://jabber.org/protocol/disco#items query"`
+	MAM        *mamQuery `xml:"urn:xmpp:mam:2 query"`
+}
+
+type mamQuery struct {
+	QueryID string `xml:"queryid,attr"`
+	Form    *struct {
+		Fields []struct {
+			Var   string `xml:"var,attr"`
+			Value string `xml:"value"`
+		} `xml:"field"`
+	} `xml:"jabber:x:data x"`
+	Set *struct {
+		Max    *int    `xml:"max"`
+		Before *string `xml:"before"`
+		After  *string `xml:"after"`
+	} `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// field returns the value of a search form field.
+func (q *mamQuery) field(name string) string {
+	if q.Form == nil {
+		return ""
+	}
+	for _, f := range q.Form.Fields {
+		if f.Var == name {
+			return strings.TrimSpace(f.Value)
+		}
+	}
+	return ""
+}
+
+type presenceStanza struct {
+	ID   string `xml:"id,attr"`
+	Type string `xml:"type,attr"`
+	To   string `xml:"to,attr"`
+	MUC  *struct {
+		History *struct {
+			MaxStanzas *int `xml:"maxstanzas,attr"`
+		} `xml:"history"`
+	} `xml:"http://jabber.org/protocol/muc x"`
+}
+
+type messageStanza struct {
+	ID      string  `xml:"id,attr"`
+	Type    string  `xml:"type,attr"`
+	To      string  `xml:"to,attr"`
+	Body    string  `xml:"body"`
+	Subject *string `xml:"subject"`
+}
+
+type saslAuth struct {
+	Mechanism string `xml:"mechanism,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// Outbound stanzas are written as text; esc escapes attribute values and
+// character data alike.
+
+func esc(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// stanzaError is an XMPP error condition, e.g. {"cancel",
+// "item-not-found", ""}.
+type stanzaError struct {
+	Type      string
+	Condition string
+	Text      string
+}
+
+func (e stanzaError) xml() string {
+	text := ""
+	if e.Text != "" {
+		text = fmt.Sprintf("<text xmlns='%s'>%s</text>", nsStanzas, esc(e.Text))
+	}
+	return fmt.Sprintf("<error type='%s'><%s xmlns='%s'/>%s</error>", e.Type, e.Condition, nsStanzas, text)
+}
+
+var (
+	errNotFound       = stanzaError{"cancel", "item-not-found", ""}
+	errUnavailable    = stanzaError{"cancel", "service-unavailable", ""}
+	errNotImplemented = stanzaError{"cancel", "feature-not-implemented", ""}
+	errBadRequest     = stanzaError{"modify", "bad-request", ""}
+	errNotAuthorized  = stanzaError{"auth", "not-authorized", ""}
+)
+
+// addressed opens a stanza, leaving out empty addressing attributes.
+func addressed(name, typ, to, from, id string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s type='%s'", name, typ)
+	for _, a := range [][2]string{{"to", to}, {"from", from}, {"id", id}} {
+		if a[1] != "" {
+			fmt.Fprintf(&b, " %s='%s'", a[0], esc(a[1]))
+		}
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+func iqResult(to, from, id, payload string) []byte {
+	return []byte(addressed("iq", "result", to, from, id) + payload + "</iq>")
+}
+
+func iqError(to, from, id string, e stanzaError) []byte {
+	return []byte(addressed("iq", "error", to, from, id) + e.xml() + "</iq>")
+}
+
+func messageError(to, from, id string, e stanzaError) []byte {
+	return []byte(addressed("message", "error", to, from, id) + e.xml() + "</message>")
+}
+
+func presenceError(to, from, id string, e stanzaError) []byte {
+	return []byte(addressed("presence", "error", to, from, id) + e.xml() + "</presence>")
+}
+
+// occupantPresence announces an occupant of the room; typ is "" for an
+// available occupant and "unavailable" for one leaving.
+func occupantPresence(to, from, typ string, moderator bool, codes ...int) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<presence to='%s' from='%s'", esc(to), esc(from))
+	if typ != "" {
+		fmt.Fprintf(&b, " type='%s'", typ)
+	}
+	affiliation, role := "member", "participant"
+	if moderator {
+		affiliation, role = "admin", "moderator"
+	}
+	if typ == "unavailable" {
+		role = "none"
+	}
+	fmt.Fprintf(&b, "><x xmlns='%s'><item affiliation='%s' role='%s'/>", nsMUCUser, affiliation, role)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "<status code='%d'/>", code)
+	}
+	b.WriteString("</x></presence>")
+	return []byte(b.String())
+}
+
+// nickChange tells an occupant that another one, from, is now known as
+// newNick.
+func nickChange(to, from, newNick string, moderator bool, codes []int) []byte {
+	affiliation := "member"
+	if moderator {
+		affiliation = "admin"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<presence to='%s' from='%s' type='unavailable'><x xmlns='%s'>", esc(to), esc(from), nsMUCUser)
+	fmt.Fprintf(&b, "<item affiliation='%s' role='none' nick='%s'/>", affiliation, esc(newNick))
+	for _, code := range append(codes, statusNewNick) {
+		fmt.Fprintf(&b, "<status code='%d'/>", code)
+	}
+	b.WriteString("</x></presence>")
+	return []byte(b.String())
+}
+
+// groupchat is a room message from an occupant's JID. A non-empty stamp
+// marks it as history with the time it was sent.
+func groupchat(to, from, id, body, stanzaID, room, stamp string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<message type='groupchat' to='%s' from='%s'", esc(to), esc(from))
+	if id != "" {
+		fmt.Fprintf(&b, " id='%s'", esc(id))
+	}
+	fmt.Fprintf(&b, "><body>%s</body>", esc(body))
+	if stanzaID != "" {
+		fmt.Fprintf(&b, "<stanza-id xmlns='%s' id='%s' by='%s'/>", nsStanzaID, esc(stanzaID), esc(room))
+	}
+	if stamp != "" {
+		fmt.Fprintf(&b, "<delay xmlns='%s' from='%s' stamp='%s'/>", nsDelay, esc(room), stamp)
+	}
+	b.WriteString("</message>")
+	return b.String()
+}
+
+// forwardedMessage is an archived room message, wrapped in a MAM result.
+func forwardedMessage(from, body string) string {
+	return fmt.Sprintf("<message xmlns='jabber:client' type='groupchat' from='%s'><body>%s</body></message>", esc(from), esc(body))
+}
+
+func subject(to, from, topic string) []byte {
+	return []byte(fmt.Sprintf("<message type='groupchat' to='%s' from='%s'><subject>%s</subject></message>", esc(to), esc(from), esc(topic)))
+}
+
+// bareJID strips the resource from a JID.
+func bareJID(jid string) string {
+	if i := strings.IndexByte(jid, '/'); i >= 0 {
+		return jid[:i]
+	}
+	return jid
+}
+
+// resourceOf returns the resource of a JID, the occupant nick for room
+// JIDs.
+func resourceOf(jid string) string {
+	if i := strings.IndexByte(jid, '/'); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
+
+// validLocalpart reports whether name can stand before the @ of a JID.
+func validLocalpart(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\"&'/:<>@")
+}